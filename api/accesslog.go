@@ -0,0 +1,100 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat is a format of access log lines
+type AccessLogFormat string
+
+const (
+	// LogfmtFormat writes lines of key=value pairs, e.g.
+	//
+	//   ts=2015-10-01T12:00:00Z request_id=5c0d... method=POST route=/v1/hello path=/v1/hello status=200 duration=0.0003 bytes=57 client=127.0.0.1:52112
+	//
+	LogfmtFormat AccessLogFormat = "logfmt"
+	// JSONFormat writes lines of JSON objects with the same keys as LogfmtFormat
+	JSONFormat AccessLogFormat = "json"
+)
+
+// ParseAccessLogFormat returns the access log format by name
+func ParseAccessLogFormat(v string) (AccessLogFormat, error) {
+	switch f := AccessLogFormat(v); f {
+	case LogfmtFormat, JSONFormat:
+		return f, nil
+	}
+	return "", fmt.Errorf("unsupported access log format '%v', expected 'logfmt' or 'json'", v)
+}
+
+// AccessLog turns on the access log, the server writes a line in the format
+// to w for every request when it's served
+func AccessLog(w io.Writer, format AccessLogFormat) ServerOption {
+	return func(s *APIServer) {
+		s.accessLog = &accessLog{w: w, format: format}
+	}
+}
+
+// accessEntry is a line of the access log
+type accessEntry struct {
+	Time      time.Time `json:"ts"`
+	RequestID string    `json:"request_id"`
+	Method    string    `json:"method"`
+	Route     string    `json:"route"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	// Duration is the latency in seconds
+	Duration float64 `json:"duration"`
+	Bytes    int64   `json:"bytes"`
+	Client   string  `json:"client"`
+}
+
+type accessLog struct {
+	w      io.Writer
+	format AccessLogFormat
+	// mtx makes sure lines of concurrent requests are not interleaved
+	mtx sync.Mutex
+}
+
+func (l *accessLog) write(e accessEntry) {
+	buf := &bytes.Buffer{}
+	if l.format == JSONFormat {
+		json.NewEncoder(buf).Encode(e)
+	} else {
+		pairs := [][2]string{
+			{"ts", e.Time.Format(time.RFC3339Nano)},
+			{"request_id", e.RequestID},
+			{"method", e.Method},
+			{"route", e.Route},
+			{"path", e.Path},
+			{"status", strconv.Itoa(e.Status)},
+			{"duration", strconv.FormatFloat(e.Duration, 'f', -1, 64)},
+			{"bytes", strconv.FormatInt(e.Bytes, 10)},
+			{"client", e.Client},
+		}
+		for i, p := range pairs {
+			if i != 0 {
+				buf.WriteByte(' ')
+			}
+			buf.WriteString(p[0] + "=" + logfmtValue(p[1]))
+		}
+		buf.WriteByte('\n')
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.w.Write(buf.Bytes())
+}
+
+// logfmtValue quotes values with spaces, quotes or equal signs
+func logfmtValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " \"=\t\n") {
+		return strconv.Quote(v)
+	}
+	return v
+}
@@ -0,0 +1,183 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravitational/hello"
+	"github.com/gravitational/hello/backend/membk"
+	"github.com/gravitational/hello/requestid"
+
+	. "github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+type AccessLogSuite struct {
+	bk  *membk.MemBackend
+	log *syncBuffer
+}
+
+var _ = Suite(&AccessLogSuite{})
+
+func (s *AccessLogSuite) SetUpTest(c *C) {
+	var err error
+	s.bk, err = membk.New()
+	c.Assert(err, IsNil)
+	c.Assert(s.bk.UpsertGreeting("hello.us", "Hello"), IsNil)
+	s.log = &syncBuffer{}
+}
+
+func (s *AccessLogSuite) TearDownTest(c *C) {
+	c.Assert(s.bk.Close(), IsNil)
+}
+
+func (s *AccessLogSuite) start(h hello.Helloer, format AccessLogFormat) *httptest.Server {
+	return httptest.NewServer(NewAPIServer(h, s.bk, AccessLog(s.log, format)))
+}
+
+func (s *AccessLogSuite) get(c *C, url, id string) *http.Response {
+	req, err := http.NewRequest("GET", url, nil)
+	c.Assert(err, IsNil)
+	if id != "" {
+		req.Header.Set(requestid.Header, id)
+	}
+	re, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	re.Body.Close()
+	return re
+}
+
+func (s *AccessLogSuite) TestRequestID(c *C) {
+	srv := s.start(hello.New(s.bk), LogfmtFormat)
+	defer srv.Close()
+
+	// ids passed by clients are propagated
+	re := s.get(c, srv.URL+"/v1/greetings/hello.us", "client-id-1")
+	c.Assert(re.Header.Get(requestid.Header), Equals, "client-id-1")
+
+	// new ids are assigned to requests without ids or with invalid ones
+	re = s.get(c, srv.URL+"/v1/greetings/hello.us", "")
+	id := re.Header.Get(requestid.Header)
+	c.Assert(requestid.Valid(id), Equals, true)
+	re = s.get(c, srv.URL+"/v1/greetings/hello.us", "bad id\"")
+	c.Assert(re.Header.Get(requestid.Header), Not(Equals), "bad id\"")
+	c.Assert(requestid.Valid(re.Header.Get(requestid.Header)), Equals, true)
+
+	re = s.get(c, srv.URL+"/unknown", "client-id-2")
+	c.Assert(re.StatusCode, Equals, http.StatusNotFound)
+	c.Assert(re.Header.Get(requestid.Header), Equals, "client-id-2")
+}
+
+func (s *AccessLogSuite) TestLogfmt(c *C) {
+	srv := s.start(hello.New(s.bk), LogfmtFormat)
+	defer srv.Close()
+	s.get(c, srv.URL+"/v1/greetings/hello.us", "client-id-1")
+	s.log.waitLines(c, 1)
+	s.get(c, srv.URL+"/unknown", "client-id-2")
+
+	lines := s.log.waitLines(c, 2)
+	c.Assert(len(lines), Equals, 2)
+	c.Assert(lines[0], Matches, `ts=\S+ request_id=client-id-1 method=GET route=/v1/greetings/:prompt `+
+		`path=/v1/greetings/hello.us status=200 duration=\S+ bytes=\d+ client=127.0.0.1:\d+`)
+	c.Assert(lines[1], Matches, `ts=\S+ request_id=client-id-2 method=GET route=unmatched path=/unknown status=404 .*`)
+
+	c.Assert(logfmtValue("a b"), Equals, `"a b"`)
+	c.Assert(logfmtValue(`a"b`), Equals, `"a\"b"`)
+	c.Assert(logfmtValue(""), Equals, `""`)
+}
+
+func (s *AccessLogSuite) TestJSON(c *C) {
+	srv := s.start(hello.New(s.bk), JSONFormat)
+	defer srv.Close()
+	re := s.get(c, srv.URL+"/v1/greetings/hello.us", "")
+
+	lines := s.log.waitLines(c, 1)
+	c.Assert(len(lines), Equals, 1)
+	var e accessEntry
+	c.Assert(json.Unmarshal([]byte(lines[0]), &e), IsNil)
+	c.Assert(e.RequestID, Equals, re.Header.Get(requestid.Header))
+	c.Assert(e.Method, Equals, "GET")
+	c.Assert(e.Route, Equals, "/v1/greetings/:prompt")
+	c.Assert(e.Path, Equals, "/v1/greetings/hello.us")
+	c.Assert(e.Status, Equals, http.StatusOK)
+	c.Assert(e.Bytes > 0, Equals, true)
+	c.Assert(e.Client, Matches, "127.0.0.1:.*")
+	c.Assert(e.Time.IsZero(), Equals, false)
+
+	_, err := ParseAccessLogFormat("xml")
+	c.Assert(err, NotNil)
+	f, err := ParseAccessLogFormat("json")
+	c.Assert(err, IsNil)
+	c.Assert(f, Equals, JSONFormat)
+}
+
+// TestPropagation checks that the request id reaches the Helloer and
+// is passed on by the client to the next server
+func (s *AccessLogSuite) TestPropagation(c *C) {
+	h := &contextHelloer{Helloer: hello.New(s.bk)}
+	srv := s.start(h, LogfmtFormat)
+	defer srv.Close()
+	clt, err := NewClient(srv.URL)
+	c.Assert(err, IsNil)
+
+	ctx := requestid.NewContext(context.Background(), "upstream-id")
+	_, err = clt.Greet(ctx, hello.Request{Prompt: "hello.us", Name: "Dog"})
+	c.Assert(err, IsNil)
+	c.Assert(h.requestID, Equals, "upstream-id")
+
+	// client assigns ids to the requests without them
+	_, err = clt.Hello("hello.us", "Dog")
+	c.Assert(err, IsNil)
+	c.Assert(requestid.Valid(h.requestID), Equals, true)
+	c.Assert(h.requestID, Not(Equals), "upstream-id")
+}
+
+// contextHelloer remembers the request id of the last greeting
+type contextHelloer struct {
+	hello.Helloer
+	requestID string
+}
+
+func (h *contextHelloer) Greet(ctx context.Context, r hello.Request) (*hello.Response, error) {
+	h.requestID = requestid.FromContext(ctx)
+	return h.Helloer.Greet(ctx, r)
+}
+
+// syncBuffer is a buffer safe for concurrent use
+type syncBuffer struct {
+	mtx sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(data []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.Write(data)
+}
+
+func (b *syncBuffer) lines() []string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.buf.Len() == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSpace(b.buf.String()), "\n")
+}
+
+// waitLines waits for n lines, access log lines are written
+// after the replies are sent, so they may be late
+func (b *syncBuffer) waitLines(c *C, n int) []string {
+	for i := 0; i < 100; i++ {
+		if lines := b.lines(); len(lines) >= n {
+			return lines
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatalf("timeout waiting for %v lines, got %v", n, b.lines())
+	return nil
+}
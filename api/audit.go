@@ -0,0 +1,94 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/gravitational/form"
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/julienschmidt/httprouter"
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/gravitational/hello/audit"
+	"github.com/gravitational/hello/auth"
+	"github.com/gravitational/hello/backend"
+	"github.com/gravitational/hello/requestid"
+)
+
+// Audit sets the sink receiving audit events of greeting upserts and deletes,
+// by default the changes are not audited. If the sink is an audit.Searcher,
+// admins can search the events with GET /v1/audit.
+func Audit(sink audit.Sink) ServerOption {
+	return func(s *APIServer) {
+		s.audit = sink
+	}
+}
+
+// currentValue returns the current value of the greeting to audit it's change,
+// the value is read before the change, so it may miss concurrent changes
+func (s *APIServer) currentValue(prompt string) string {
+	if s.audit == nil {
+		return ""
+	}
+	g, err := s.b.GetGreeting(prompt)
+	if err != nil {
+		if _, ok := err.(*backend.NotFoundError); !ok {
+			log.Warningf("failed to get the value of '%v' for audit: %v", prompt, err)
+		}
+		return ""
+	}
+	return g.Value
+}
+
+// emit records the change made by the request, failures to record are logged,
+// as the change has been made already
+func (s *APIServer) emit(r *http.Request, action, prompt, oldValue, newValue string) {
+	if s.audit == nil {
+		return
+	}
+	e := audit.Event{
+		Time:       time.Now().UTC(),
+		Action:     action,
+		RemoteAddr: r.RemoteAddr,
+		RequestID:  requestid.FromContext(r.Context()),
+		Prompt:     prompt,
+		OldValue:   oldValue,
+		NewValue:   newValue,
+	}
+	if id := auth.GetIdentity(r.Context()); id != nil {
+		e.User = id.Name
+	}
+	if err := s.audit.Emit(e); err != nil {
+		log.Errorf("failed to emit audit event %#v: %v", e, err)
+	}
+}
+
+type auditResponse struct {
+	Events []audit.Event `json:"events"`
+}
+
+// getAuditEvents returns audit events, the optional 'prompt' parameter
+// selects events of the greeting and 'limit' the number of the most recent events
+func (s *APIServer) getAuditEvents(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	q := audit.Query{Prompt: r.URL.Query().Get("prompt")}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			replyErr(w, &form.BadParameterError{Param: "limit", Message: "expected non-negative integer"})
+			return
+		}
+		q.Limit = limit
+	}
+	if s.audit == nil {
+		replyErr(w, &audit.NotSupportedError{Message: "audit log is off"})
+		return
+	}
+	events, err := audit.Search(s.audit, q)
+	if err != nil {
+		replyErr(w, err)
+		return
+	}
+	if events == nil {
+		events = []audit.Event{}
+	}
+	reply(w, http.StatusOK, auditResponse{Events: events})
+}
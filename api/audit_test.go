@@ -0,0 +1,98 @@
+package api
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+
+	"github.com/gravitational/hello"
+	"github.com/gravitational/hello/audit"
+	"github.com/gravitational/hello/auth"
+	"github.com/gravitational/hello/backend"
+	"github.com/gravitational/hello/backend/membk"
+
+	. "github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+type AuditSuite struct {
+	srv  *httptest.Server
+	bk   *membk.MemBackend
+	sink *audit.FileSink
+}
+
+var _ = Suite(&AuditSuite{})
+
+func (s *AuditSuite) SetUpTest(c *C) {
+	var err error
+	s.bk, err = membk.New()
+	c.Assert(err, IsNil)
+	s.sink, err = audit.NewFileSink(filepath.Join(c.MkDir(), "audit.log"))
+	c.Assert(err, IsNil)
+	keys, err := auth.FromString(`{
+      "tokens": [{"name": "bob", "token": "editor-token", "role": "editor"},
+                 {"name": "ops", "token": "admin-token", "role": "admin"}]}`)
+	c.Assert(err, IsNil)
+	s.srv = httptest.NewServer(NewAPIServer(hello.New(s.bk), s.bk, Auth(keys), Audit(s.sink)))
+}
+
+func (s *AuditSuite) TearDownTest(c *C) {
+	s.srv.Close()
+	c.Assert(s.sink.Close(), IsNil)
+	c.Assert(s.bk.Close(), IsNil)
+}
+
+func (s *AuditSuite) client(c *C, token string) *Client {
+	clt, err := NewClient(s.srv.URL, BearerToken(token))
+	c.Assert(err, IsNil)
+	return clt
+}
+
+func (s *AuditSuite) TestAudit(c *C) {
+	editor := s.client(c, "editor-token")
+	admin := s.client(c, "admin-token")
+
+	c.Assert(editor.UpsertGreeting("hello.us", "Hello"), IsNil)
+	c.Assert(editor.UpsertGreeting("hello.us", "Howdy"), IsNil)
+	c.Assert(editor.UpsertGreeting("hello.uk", "Hiya"), IsNil)
+	c.Assert(admin.DeleteGreeting("hello.us"), IsNil)
+
+	// failed changes are not audited
+	err := editor.UpsertGreeting("hello.uk", "Hello", backend.Create())
+	c.Assert(err, FitsTypeOf, &backend.ConflictError{})
+	err = admin.DeleteGreeting("hello.fr")
+	c.Assert(err, FitsTypeOf, &backend.NotFoundError{})
+
+	events, err := admin.GetAuditEvents("hello.us", 0)
+	c.Assert(err, IsNil)
+	c.Assert(len(events), Equals, 3)
+	type change struct{ action, user, old, new string }
+	changes := make([]change, len(events))
+	for i, e := range events {
+		changes[i] = change{e.Action, e.User, e.OldValue, e.NewValue}
+		c.Assert(e.Prompt, Equals, "hello.us")
+		c.Assert(e.RemoteAddr, Matches, "127.0.0.1:.*")
+		c.Assert(e.Time.IsZero(), Equals, false)
+	}
+	c.Assert(changes, DeepEquals, []change{
+		{audit.ActionUpsert, "bob", "", "Hello"},
+		{audit.ActionUpsert, "bob", "Hello", "Howdy"},
+		{audit.ActionDelete, "ops", "Howdy", ""},
+	})
+
+	events, err = admin.GetAuditEvents("", 1)
+	c.Assert(err, IsNil)
+	c.Assert(len(events), Equals, 1)
+	c.Assert(events[0].Action, Equals, audit.ActionDelete)
+
+	// only admins can read the audit log
+	_, err = editor.GetAuditEvents("", 0)
+	c.Assert(err, FitsTypeOf, &auth.AccessDeniedError{})
+}
+
+func (s *AuditSuite) TestNotSupported(c *C) {
+	srv := httptest.NewServer(NewAPIServer(hello.New(s.bk), s.bk))
+	defer srv.Close()
+	clt, err := NewClient(srv.URL)
+	c.Assert(err, IsNil)
+	_, err = clt.GetAuditEvents("", 0)
+	c.Assert(err, FitsTypeOf, &audit.NotSupportedError{})
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gravitational/hello/auth"
+)
+
+// public is a role of routes that don't require authentication
+const public auth.Role = ""
+
+// authorize checks that the client that sent the request has the role
+// and returns the request with the client identity in the context, see auth.GetIdentity.
+// It always succeeds if the server does not authenticate clients.
+func (s *APIServer) authorize(r *http.Request, role auth.Role) (*http.Request, error) {
+	a := s.authenticator()
+	if a == nil || role == public {
+		return r, nil
+	}
+	id, err := a.Authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+	if !id.Role.Includes(role) {
+		return nil, &auth.AccessDeniedError{Name: id.Name, Role: id.Role, Required: role}
+	}
+	return r.WithContext(auth.WithIdentity(r.Context(), id)), nil
+}
+
+// BearerToken sets the token sent in 'Authorization: Bearer <token>' header
+// to servers that authenticate clients, see auth.Keys
+func BearerToken(token string) ClientOption {
+	return func(c *clientOptions) {
+		c.token = token
+	}
+}
+
+// APIKey sets the API key sent in 'X-API-Key' header to servers
+// that authenticate clients, see auth.Keys
+func APIKey(key string) ClientOption {
+	return func(c *clientOptions) {
+		c.apiKey = key
+	}
+}
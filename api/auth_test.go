@@ -0,0 +1,106 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/gravitational/hello"
+	"github.com/gravitational/hello/auth"
+	"github.com/gravitational/hello/backend"
+	"github.com/gravitational/hello/backend/membk"
+
+	. "github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+type AuthSuite struct {
+	srv *httptest.Server
+	bk  *membk.MemBackend
+}
+
+var _ = Suite(&AuthSuite{})
+
+func (s *AuthSuite) SetUpTest(c *C) {
+	var err error
+	s.bk, err = membk.New()
+	c.Assert(err, IsNil)
+	c.Assert(s.bk.UpsertGreeting("hello.us", "Hello"), IsNil)
+	keys, err := auth.FromString(`{
+      "tokens": [{"name": "alice", "token": "reader-token", "role": "reader"},
+                 {"name": "bob", "token": "editor-token", "role": "editor"}],
+      "apiKeys": [{"name": "ops", "key": "admin-key", "role": "admin"}]}`)
+	c.Assert(err, IsNil)
+	s.srv = httptest.NewServer(NewAPIServer(hello.New(s.bk), s.bk, Auth(keys)))
+}
+
+func (s *AuthSuite) TearDownTest(c *C) {
+	s.srv.Close()
+	c.Assert(s.bk.Close(), IsNil)
+}
+
+func (s *AuthSuite) client(c *C, opts ...ClientOption) *Client {
+	clt, err := NewClient(s.srv.URL, opts...)
+	c.Assert(err, IsNil)
+	return clt
+}
+
+func (s *AuthSuite) TestUnauthenticated(c *C) {
+	for _, clt := range []*Client{
+		s.client(c),
+		s.client(c, BearerToken("bad-token")),
+		s.client(c, APIKey("reader-token")),
+	} {
+		_, err := clt.Hello("hello.us", "Dog")
+		c.Assert(err, FitsTypeOf, &auth.UnauthenticatedError{})
+		_, err = clt.GetGreeting("hello.us")
+		c.Assert(err, FitsTypeOf, &auth.UnauthenticatedError{})
+		_, err = clt.WatchGreetings(make(chan bool))
+		c.Assert(err, FitsTypeOf, &auth.UnauthenticatedError{})
+
+		// probes don't need credentials
+		c.Assert(clt.Ping(), IsNil)
+		_, err = clt.Version()
+		c.Assert(err, IsNil)
+	}
+
+	re, err := http.Get(s.srv.URL + "/v1/greetings")
+	c.Assert(err, IsNil)
+	re.Body.Close()
+	c.Assert(re.StatusCode, Equals, http.StatusUnauthorized)
+	c.Assert(re.Header.Get("WWW-Authenticate"), Equals, `Bearer realm="hello"`)
+}
+
+func (s *AuthSuite) TestRoles(c *C) {
+	reader := s.client(c, BearerToken("reader-token"))
+	out, err := reader.Hello("hello.us", "Dog")
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, "Hello, Dog!")
+	_, _, err = reader.GetGreetings("", "", 0)
+	c.Assert(err, IsNil)
+	stopC := make(chan bool)
+	_, err = reader.WatchGreetings(stopC)
+	c.Assert(err, IsNil)
+	close(stopC)
+
+	err = reader.UpsertGreeting("hello.uk", "Hiya")
+	c.Assert(err, FitsTypeOf, &auth.AccessDeniedError{})
+	c.Assert(*(err.(*auth.AccessDeniedError)), Equals,
+		auth.AccessDeniedError{Name: "alice", Role: auth.Reader, Required: auth.Editor})
+
+	editor := s.client(c, BearerToken("editor-token"))
+	c.Assert(editor.UpsertGreeting("hello.uk", "Hiya"), IsNil)
+	err = editor.DeleteGreeting("hello.uk")
+	c.Assert(err, FitsTypeOf, &auth.AccessDeniedError{})
+
+	admin := s.client(c, APIKey("admin-key"))
+	c.Assert(admin.DeleteGreeting("hello.uk"), IsNil)
+	_, err = admin.GetGreeting("hello.uk")
+	c.Assert(err, FitsTypeOf, &backend.NotFoundError{})
+}
+
+func (s *AuthSuite) TestFromString(c *C) {
+	b, err := FromString(`{"addr": "` + s.srv.URL + `", "token": "reader-token"}`)
+	c.Assert(err, IsNil)
+	g, err := b.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(g.Value, Equals, "Hello")
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/gravitational/hello/backend"
+)
+
+func init() {
+	backend.Register(backend.Registration{
+		Name:        "hello",
+		Description: "another hello server, e.g. a central one shared by edge servers",
+		Params: []backend.Param{
+			{Name: "addr", Type: backend.StringParam, Required: true, Description: "server address, e.g. http://localhost:8080"},
+			{Name: "token", Type: backend.StringParam, Description: "bearer token, if the server authenticates clients"},
+			{Name: "apiKey", Type: backend.StringParam, Description: "API key, if the server authenticates clients"},
+		},
+		New: FromString,
+	})
+}
+
+// cfg represents JSON config for using remote hello server as a backend
+type cfg struct {
+	Addr   string `json:"addr"`
+	Token  string `json:"token"`
+	APIKey string `json:"apiKey"`
+}
+
+// FromString initializes the client to the hello server from configuration string,
+// so it can be used as a backend of another hello server
+//
+//   api.FromString(`{"addr": "http://localhost:8080"}`)
+//   api.FromString(`{"addr": "http://localhost:8080", "token": "s3cr3t"}`)
+//
+func FromString(v string) (backend.GreetingBackend, error) {
+	if len(v) == 0 {
+		return nil, fmt.Errorf(`please supply a valid dictionary, e.g. {"addr": "http://localhost:8080"}`)
+	}
+	var c *cfg
+	if err := json.Unmarshal([]byte(v), &c); err != nil {
+		return nil, fmt.Errorf("invalid backend configuration format, err: %v", err)
+	}
+	if c.Addr == "" {
+		return nil, fmt.Errorf("supply a valid hello server address")
+	}
+	return NewClient(c.Addr, BearerToken(c.Token), APIKey(c.APIKey))
+}
@@ -1,68 +1,292 @@
 package api
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
-
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 
-	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/gravitational/roundtrip" // Client is an HTTP RPC client to the running Hello server
+	"github.com/gravitational/hello"
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/gravitational/roundtrip"
+	"github.com/gravitational/hello/audit"
+	"github.com/gravitational/hello/auth"
 	"github.com/gravitational/hello/backend"
+	"github.com/gravitational/hello/requestid"
+	"github.com/gravitational/hello/version"
 )
 
+// Client is an HTTP RPC client to the running Hello server. It implements
+// hello.Helloer, backend.GreetingBackend and backend.HistoryBackend, so the remote
+// server can be used in place of the local one, or as a backend of another hello server.
 type Client struct {
 	roundtrip.Client
+	// addr is the server address, used for unversioned endpoints
+	addr string
+	// client is used for streaming requests that roundtrip can't do
+	client *http.Client
+}
+
+var _ hello.Helloer = (*Client)(nil)
+var _ backend.GreetingBackend = (*Client)(nil)
+var _ backend.HistoryBackend = (*Client)(nil)
+
+// ClientOption is a functional option for the client
+type ClientOption func(c *clientOptions)
+
+type clientOptions struct {
+	tlsConfig *tls.Config
+	token     string
+	apiKey    string
+	retry     retryOptions
+}
+
+// TLS sets TLS config used to connect to the Hello server over HTTPS,
+// see ClientTLSConfig
+//
+//     cfg, err := api.ClientTLSConfig("ca.pem", "client.pem", "client-key.pem", false)
+//     c, err := api.NewClient("https://localhost:8080", api.TLS(cfg))
+//
+func TLS(cfg *tls.Config) ClientOption {
+	return func(c *clientOptions) {
+		c.tlsConfig = cfg
+	}
 }
 
 // NewClient returns a new instance of the client connected to the Hello server
 // that is reachable by address addr
-func NewClient(addr string) (*Client, error) {
-	c, err := roundtrip.NewClient(addr, CurrentVersion)
+func NewClient(addr string, opts ...ClientOption) (*Client, error) {
+	o := clientOptions{retry: retryOptions{retries: DefaultRetries, maxWait: DefaultMaxRetryWait}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	next := http.DefaultTransport
+	if o.tlsConfig != nil {
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.TLSClientConfig = o.tlsConfig
+		next = tr
+	}
+	hc := &http.Client{Transport: &headerTransport{next: next, token: o.token, apiKey: o.apiKey, retry: o.retry}}
+	c, err := roundtrip.NewClient(addr, CurrentVersion, roundtrip.HTTPClient(hc))
 	if err != nil {
 		return nil, err
 	}
-	return &Client{*c}, nil
+	return &Client{Client: *c, addr: strings.TrimRight(addr, "/"), client: hc}, nil
 }
 
-// UpsertGreeting updates or inserts the greeting into the database backend
+// UpsertGreeting updates or inserts the greeting into the database backend,
+// write options make the upsert conditional or expiring and set the metadata.
+// Servers that authenticate clients record the client as the author, Author option
+// is recorded by the others. NoHistory option skips recording the change in the history,
+// ReturnRevision option receives the revision of the written greeting.
 //
 //     c.UpsertGreeting("hello.us", "Hello")
+//     c.UpsertGreeting("hello.us", "Hello", backend.Create())
+//     c.UpsertGreeting("hello.us", "Howdy", backend.IfRevision(g.Revision))
+//     c.UpsertGreeting("hello.xmas", "Merry Christmas", backend.TTL(24*time.Hour))
+//     c.UpsertGreeting("hello.us", "Hello", backend.Locale("en-US"), backend.Tags("web"))
+//     c.UpsertGreeting("hello.jp", "{{.Name}}さん、こんにちは", backend.Template())
 //
-func (c *Client) UpsertGreeting(prompt, value string) error {
-	_, err := convert(
-		c.PostForm(
-			c.Endpoint("greetings"),
-			url.Values{"prompt": []string{prompt}, "value": []string{value}}))
-	return err
+func (c *Client) UpsertGreeting(prompt, value string, opts ...backend.WriteOption) error {
+	vals := url.Values{"prompt": []string{prompt}, "value": []string{value}}
+	o := backend.GetWriteOptions(opts)
+	if o.TTL != 0 {
+		vals.Set("ttl", o.TTL.String())
+	}
+	if o.Template {
+		vals.Set("template", "true")
+	}
+	if o.Locale != "" {
+		vals.Set("locale", o.Locale)
+	}
+	if o.Description != "" {
+		vals.Set("description", o.Description)
+	}
+	if len(o.Tags) != 0 {
+		vals["tags"] = o.Tags
+	}
+	for k, v := range writeParams(o) {
+		vals[k] = v
+	}
+	rev, err := writtenRevision(convert(
+		c.postForm(c.Endpoint("greetings"), vals, writeHeaders(opts))))
+	if err != nil {
+		return err
+	}
+	o.SetWritten(rev)
+	return nil
 }
 
-// GetGreeting returns the value of the greeting by it's prompt id
+// GetGreeting returns the greeting by it's prompt id
 //
-//     val, err := c.GetGreeting("hello.us", "Hello")
+//     g, err := c.GetGreeting("hello.us")
 //
-func (c *Client) GetGreeting(prompt string) (string, error) {
+func (c *Client) GetGreeting(prompt string) (*backend.Greeting, error) {
 	body, err := convert(
 		c.Get(c.Endpoint("greetings", prompt), url.Values{}))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	var g *greetingResponse
 	if err := json.Unmarshal(body, &g); err != nil {
-		return "", err
+		return nil, err
+	}
+	return fromGreeting(g.Greeting)
+}
+
+// GetGreetings returns a page of greetings with ids starting with prefix,
+// and a cursor to fetch the next page, that is empty for the last page
+//
+//     gs, next, err := c.GetGreetings("hello.", "", 10)
+//
+func (c *Client) GetGreetings(prefix, cursor string, limit int) ([]backend.Greeting, string, error) {
+	body, err := convert(
+		c.Get(c.Endpoint("greetings"), url.Values{
+			"prefix": []string{prefix},
+			"cursor": []string{cursor},
+			"limit":  []string{strconv.Itoa(limit)},
+		}))
+	if err != nil {
+		return nil, "", err
+	}
+	var re *greetingsResponse
+	if err := json.Unmarshal(body, &re); err != nil {
+		return nil, "", err
 	}
-	return g.Greeting.Value, nil
+	gs := make([]backend.Greeting, len(re.Greetings))
+	for i, g := range re.Greetings {
+		out, err := fromGreeting(g)
+		if err != nil {
+			return nil, "", err
+		}
+		gs[i] = *out
+	}
+	return gs, re.NextCursor, nil
+}
+
+// WatchGreetings streams greeting changes until stopC is closed
+//
+//     stopC := make(chan bool)
+//     defer close(stopC)
+//     events, err := c.WatchGreetings(stopC)
+//     for e := range events {
+//         fmt.Println(e.Type, e.ID, e.Value)
+//     }
+//
+func (c *Client) WatchGreetings(stopC <-chan bool) (<-chan backend.GreetingEvent, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequest("GET", c.Endpoint("greetings")+"?watch=true", nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	re, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if re.StatusCode != http.StatusOK {
+		defer cancel()
+		defer re.Body.Close()
+		body, err := ioutil.ReadAll(re.Body)
+		if err != nil {
+			return nil, err
+		}
+		_, err = convertBody(re.StatusCode, re.Header, body)
+		return nil, err
+	}
+	out := make(chan backend.GreetingEvent)
+	go func() {
+		select {
+		case <-stopC:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	go func() {
+		defer close(out)
+		defer cancel()
+		defer re.Body.Close()
+		dec := json.NewDecoder(re.Body)
+		for {
+			var e greetingEvent
+			if err := dec.Decode(&e); err != nil {
+				return
+			}
+			select {
+			case out <- backend.GreetingEvent{
+				Type: backend.EventType(e.Type), ID: e.Prompt, Value: e.Value, Revision: e.Revision}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
 }
 
 // DeleteGreeting deletes the greeting from DB by it's ID
 //
 //     err := c.DeleteGreeting("hello.us")
+//     err := c.DeleteGreeting("hello.us", backend.IfRevision(g.Revision))
 //
-func (c *Client) DeleteGreeting(prompt string) error {
-	_, err := convert(c.Delete(c.Endpoint("greetings", prompt)))
+func (c *Client) DeleteGreeting(prompt string, opts ...backend.WriteOption) error {
+	endpoint := c.Endpoint("greetings", prompt)
+	if vals := writeParams(backend.GetWriteOptions(opts)); len(vals) != 0 {
+		endpoint += "?" + vals.Encode()
+	}
+	_, err := convert(c.delete(endpoint, writeHeaders(opts)))
 	return err
 }
 
+// GetHistory returns the recorded changes of the greeting, most recent first
+//
+//     history, err := c.GetHistory("hello.us")
+//
+func (c *Client) GetHistory(prompt string) ([]backend.Version, error) {
+	body, err := convert(c.Get(c.Endpoint("greetings", prompt, "history"), url.Values{}))
+	if err != nil {
+		return nil, err
+	}
+	var re *historyResponse
+	if err := json.Unmarshal(body, &re); err != nil {
+		return nil, err
+	}
+	out := make([]backend.Version, len(re.History))
+	for i, v := range re.History {
+		out[i] = backend.Version{
+			Revision: v.Revision, Value: v.Value, Template: v.Template, Deleted: v.Deleted, Author: v.Author, Time: v.Time}
+	}
+	return out, nil
+}
+
+// RollbackGreeting writes the value the greeting had at the revision
+// from it's history back, see GetHistory, and returns the new revision
+//
+//     rev, err := c.RollbackGreeting("hello.us", history[1].Revision)
+//
+func (c *Client) RollbackGreeting(prompt string, rev uint64) (uint64, error) {
+	return writtenRevision(convert(
+		c.PostForm(
+			c.Endpoint("greetings", prompt, "rollback"),
+			url.Values{"revision": []string{strconv.FormatUint(rev, 10)}})))
+}
+
+// writtenRevision returns the revision of the greeting in the write reply
+func writtenRevision(body []byte, err error) (uint64, error) {
+	if err != nil {
+		return 0, err
+	}
+	var re *greetingResponse
+	if err := json.Unmarshal(body, &re); err != nil {
+		return 0, err
+	}
+	return re.Greeting.Revision, nil
+}
+
 // Hello generates the Hello sentence by prompt id and a name
 //
 //     h, err := c.Hello("hello.us", "Dog") // Hello, Dog!
@@ -83,22 +307,192 @@ func (c *Client) Hello(prompt, name string) (string, error) {
 	return h.Value, nil
 }
 
+// Greet is like Hello, but resolves the greeting for the locales listed
+// in the order of preference and reports the greeting used. The request
+// is canceled with the context, the request id from the context is passed
+// on to the server, see requestid package.
+//
+//     re, err := c.Greet(ctx, hello.Request{Prompt: "hello", Name: "Dog", Locales: []string{"es-MX"}})
+//     // re.Value: Hola, Dog!, re.GreetingID: hello.es, re.Locale: es
+//     re, err := c.Greet(ctx, hello.Request{Prompt: "hello.formal", Name: "Dog", Fields: map[string]string{"title": "Sir"}})
+//
+func (c *Client) Greet(ctx context.Context, r hello.Request) (*hello.Response, error) {
+	h := http.Header{}
+	if len(r.Locales) != 0 {
+		h.Set("Accept-Language", acceptLanguage(r.Locales))
+	}
+	// propagate the id of the request served by the caller,
+	// e.g. by the hello server using this client as it's Helloer
+	if id := requestid.FromContext(ctx); id != "" {
+		h.Set(requestid.Header, id)
+	}
+	vals := url.Values{"prompt": []string{r.Prompt}, "name": []string{r.Name}}
+	for k, v := range r.Fields {
+		vals.Set(fieldPrefix+k, v)
+	}
+	body, err := convert(c.postFormContext(ctx, c.Endpoint("hello"), vals, h))
+	if err != nil {
+		return nil, err
+	}
+	var re *helloResponse
+	if err := json.Unmarshal(body, &re); err != nil {
+		return nil, err
+	}
+	return &hello.Response{Value: re.Value, GreetingID: re.Greeting, Locale: re.Locale}, nil
+}
+
+// acceptLanguage formats locales as Accept-Language header value
+// with decreasing quality to preserve their order
+func acceptLanguage(locales []string) string {
+	parts := make([]string, len(locales))
+	for i, l := range locales {
+		q := 1 - float64(i)*0.001
+		if q < 0.001 {
+			q = 0.001
+		}
+		parts[i] = fmt.Sprintf("%v;q=%.3f", l, q)
+	}
+	return strings.Join(parts, ",")
+}
+
+// Ping checks that the server is ready to serve requests,
+// i.e. that it's backend is reachable
+func (c *Client) Ping() error {
+	_, err := convert(c.Get(c.addr+"/readyz", url.Values{}))
+	return err
+}
+
+// Version returns the version of the server
+func (c *Client) Version() (*version.Info, error) {
+	body, err := convert(c.Get(c.addr+"/version", url.Values{}))
+	if err != nil {
+		return nil, err
+	}
+	var v *version.Info
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// GetAuditEvents returns the audit events of the greeting changes, oldest first.
+// Empty prompt returns events of all greetings, limit is the max number
+// of the most recent events to return, 0 means no limit.
+func (c *Client) GetAuditEvents(prompt string, limit int) ([]audit.Event, error) {
+	body, err := convert(
+		c.Get(c.Endpoint("audit"), url.Values{
+			"prompt": []string{prompt},
+			"limit":  []string{strconv.Itoa(limit)},
+		}))
+	if err != nil {
+		return nil, err
+	}
+	var re *auditResponse
+	if err := json.Unmarshal(body, &re); err != nil {
+		return nil, err
+	}
+	return re.Events, nil
+}
+
+// Close closes the client, it has no resources to release
+// as it uses the shared HTTP client
 func (c *Client) Close() error {
 	return nil
 }
 
+// postForm is like roundtrip.Client.PostForm, but sends additional headers
+func (c *Client) postForm(endpoint string, vals url.Values, h http.Header) (*roundtrip.Response, error) {
+	return c.postFormContext(context.Background(), endpoint, vals, h)
+}
+
+// postFormContext is like postForm, the request is canceled with the context
+func (c *Client) postFormContext(ctx context.Context, endpoint string, vals url.Values, h http.Header) (*roundtrip.Response, error) {
+	return c.RoundTrip(func() (*http.Response, error) {
+		req, err := http.NewRequest("POST", endpoint, strings.NewReader(vals.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header = h
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return c.client.Do(req.WithContext(ctx))
+	})
+}
+
+// delete is like roundtrip.Client.Delete, but sends additional headers
+func (c *Client) delete(endpoint string, h http.Header) (*roundtrip.Response, error) {
+	return c.RoundTrip(func() (*http.Response, error) {
+		req, err := http.NewRequest("DELETE", endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header = h
+		return c.client.Do(req)
+	})
+}
+
+// writeHeaders converts write options to conditional request headers
+func writeHeaders(opts []backend.WriteOption) http.Header {
+	h := http.Header{}
+	o := backend.GetWriteOptions(opts)
+	if o.Create {
+		h.Set("If-None-Match", "*")
+	}
+	if o.Revision != 0 {
+		h.Set("If-Match", etag(o.Revision))
+	}
+	return h
+}
+
+// writeParams converts write options that are not conditions to parameters,
+// the author is recorded only by servers that don't authenticate clients
+func writeParams(o backend.WriteOptions) url.Values {
+	vals := url.Values{}
+	if o.NoHistory {
+		vals.Set("history", "false")
+	}
+	if o.Author != "" {
+		vals.Set("author", o.Author)
+	}
+	return vals
+}
+
 // convert converts generic HTTP response codes to hello-specific errors
 func convert(re *roundtrip.Response, err error) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	if re.Code() == http.StatusNotFound {
-		return nil, &backend.NotFoundError{ID: string(re.Bytes())}
+	return convertBody(re.Code(), re.Headers(), re.Bytes())
+}
+
+// convertBody converts response code and body to hello-specific errors
+func convertBody(code int, h http.Header, body []byte) ([]byte, error) {
+	if code >= 200 && code < 300 {
+		return body, nil
+	}
+	return nil, fromErrorResponse(code, h, body)
+}
+
+// headerTransport adds the credentials and the request id to every request
+type headerTransport struct {
+	next   http.RoundTripper
+	token  string
+	apiKey string
+	retry  retryOptions
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// round trippers should not modify the request
+	req = req.Clone(req.Context())
+	if t.token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	if t.apiKey != "" {
+		req.Header.Set(auth.APIKeyHeader, t.apiKey)
 	}
-	if re.Code() >= 200 && re.Code() < 300 {
-		return re.Bytes(), nil
+	if req.Header.Get(requestid.Header) == "" {
+		req.Header.Set(requestid.Header, requestid.New())
 	}
-	return nil, fmt.Errorf(string(re.Bytes()))
+	return t.retry.roundTrip(t.next, req)
 }
 
 // CurrentVersion is a current API version prefix
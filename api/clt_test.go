@@ -0,0 +1,111 @@
+package api
+
+import (
+	"net/http/httptest"
+
+	"github.com/gravitational/hello"
+	. "github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/check.v1"
+	"github.com/gravitational/hello/backend"
+	"github.com/gravitational/hello/backend/membk"
+	"github.com/gravitational/hello/backend/test"
+)
+
+// ClientSuite runs the backend acceptance suite against the client to make
+// sure the remote backend behaves exactly like the local one
+type ClientSuite struct {
+	bk    *membk.MemBackend
+	srv   *httptest.Server
+	suite test.BackendSuite
+}
+
+var _ = Suite(&ClientSuite{})
+
+func (s *ClientSuite) SetUpTest(c *C) {
+	var err error
+	s.bk, err = membk.New()
+	c.Assert(err, IsNil)
+	s.srv = httptest.NewServer(NewAPIServer(hello.New(s.bk), s.bk))
+	clt, err := NewClient(s.srv.URL)
+	c.Assert(err, IsNil)
+	s.suite.B = clt
+}
+
+func (s *ClientSuite) TearDownTest(c *C) {
+	c.Assert(s.suite.B.Close(), IsNil)
+	s.srv.Close()
+	c.Assert(s.bk.Close(), IsNil)
+}
+
+func (s *ClientSuite) TestGreetingCRUD(c *C) {
+	s.suite.GreetingCRUD(c)
+}
+
+func (s *ClientSuite) TestGreetingsList(c *C) {
+	s.suite.GreetingsList(c)
+}
+
+func (s *ClientSuite) TestMetadata(c *C) {
+	s.suite.Metadata(c)
+}
+
+func (s *ClientSuite) TestConditionalWrites(c *C) {
+	s.suite.ConditionalWrites(c)
+}
+
+func (s *ClientSuite) TestGreetingsTTL(c *C) {
+	s.suite.GreetingsTTL(c)
+}
+
+func (s *ClientSuite) TestConcurrency(c *C) {
+	s.suite.Concurrency(c)
+}
+
+func (s *ClientSuite) TestGreetingsWatch(c *C) {
+	s.suite.GreetingsWatch(c)
+}
+
+func (s *ClientSuite) TestPing(c *C) {
+	s.suite.Ping(c)
+}
+
+// TestChaining uses one hello server as a backend of another
+func (s *ClientSuite) TestChaining(c *C) {
+	edge := httptest.NewServer(NewAPIServer(hello.New(s.suite.B), s.suite.B))
+	defer edge.Close()
+	clt, err := NewClient(edge.URL)
+	c.Assert(err, IsNil)
+
+	c.Assert(clt.UpsertGreeting("hello.us", "Hello"), IsNil)
+	c.Assert(s.bk.Greetings()["hello.us"], Equals, "Hello")
+
+	var h hello.Helloer = clt
+	out, err := h.Hello("hello.us", "Dog")
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, "Hello, Dog!")
+
+	// errors keep their types across both hops
+	_, err = h.Hello("hello.fr", "Dog")
+	c.Assert(err, DeepEquals, &backend.NotFoundError{ID: "hello.fr"})
+	_, err = h.Hello("hello.us", "")
+	c.Assert(err, NotNil)
+}
+
+func (s *ClientSuite) TestFromString(c *C) {
+	b, err := FromString(`{"addr": "` + s.srv.URL + `"}`)
+	c.Assert(err, IsNil)
+	c.Assert(b.UpsertGreeting("hello.us", "Hello"), IsNil)
+	c.Assert(s.bk.Greetings()["hello.us"], Equals, "Hello")
+
+	_, err = FromString("")
+	c.Assert(err, NotNil)
+	_, err = FromString(`{}`)
+	c.Assert(err, NotNil)
+}
+
+func (s *ClientSuite) TestHistory(c *C) {
+	s.suite.History(c)
+}
+
+func (s *ClientSuite) TestClose(c *C) {
+	s.suite.Close(c)
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync"
+
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/gravitational/form"
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/gravitational/hello/version"
+)
+
+// NewDebugHandler returns http.Handler of the admin endpoints:
+//
+//  /debug/pprof/  - runtime profiles, e.g. go tool pprof http://localhost:6060/debug/pprof/profile
+//  /debug/vars    - runtime stats in expvar format
+//  /debug/log     - GET returns the log severity, PUT with 'severity' parameter changes it
+//  /debug/reload  - POST reloads the configuration, served if OnReload option is set
+//
+// The endpoints expose internals of the process and are not authenticated,
+// so the handler should be served on a separate listener that is not reachable
+// by the API clients, never on the API server router.
+func NewDebugHandler(opts ...DebugOption) http.Handler {
+	var o debugOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	publishVars()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/log", logSeverity)
+	if o.reload != nil {
+		mux.HandleFunc("/debug/reload", reload(o.reload))
+	}
+	return mux
+}
+
+// DebugOption is a functional option for the debug handler
+type DebugOption func(o *debugOptions)
+
+type debugOptions struct {
+	reload func() error
+}
+
+// OnReload serves /debug/reload endpoint calling fn, that reloads
+// the configuration, e.g. the same way as on SIGHUP
+func OnReload(fn func() error) DebugOption {
+	return func(o *debugOptions) {
+		o.reload = fn
+	}
+}
+
+// reload calls fn on POST and replies with the error if it fails,
+// the debug listener is reachable by operators only, so the reply
+// tells what is wrong with the configuration even for internal errors
+func reload(fn func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			reply(w, http.StatusMethodNotAllowed, message("method not allowed"))
+			return
+		}
+		if err := fn(); err != nil {
+			code, re := toErrorResponse(err)
+			re.Error.Message = err.Error()
+			reply(w, code, re)
+			return
+		}
+		reply(w, http.StatusOK, message("configuration reloaded"))
+	}
+}
+
+var publishOnce sync.Once
+
+// publishVars publishes runtime stats in addition to 'cmdline' and 'memstats'
+// published by expvar, expvar panics on repeated publishing, so it's done once
+func publishVars() {
+	publishOnce.Do(func() {
+		expvar.Publish("goroutines", expvar.Func(func() interface{} {
+			return runtime.NumGoroutine()
+		}))
+		expvar.Publish("version", expvar.Func(func() interface{} {
+			return version.Get()
+		}))
+	})
+}
+
+type severityResponse struct {
+	Severity string `json:"severity"`
+}
+
+// logSeverity returns or changes the log severity threshold at runtime
+func logSeverity(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT", "POST":
+		var val string
+		if err := form.Parse(r, form.String("severity", &val, form.Required())); err != nil {
+			replyErr(w, err)
+			return
+		}
+		sev, err := log.SeverityFromString(val)
+		if err != nil {
+			replyErr(w, &form.BadParameterError{Param: "severity", Message: "expected one of INFO, WARN, ERROR or FATAL"})
+			return
+		}
+		log.SetSeverity(sev)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		reply(w, http.StatusMethodNotAllowed, message("method not allowed"))
+		return
+	}
+	reply(w, http.StatusOK, severityResponse{Severity: log.GetSeverity().String()})
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	"github.com/gravitational/hello"
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/gravitational/hello/backend/membk"
+
+	. "github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+type DebugSuite struct {
+	srv      *httptest.Server
+	severity log.Severity
+}
+
+var _ = Suite(&DebugSuite{})
+
+func (s *DebugSuite) SetUpTest(c *C) {
+	s.severity = log.GetSeverity()
+	s.srv = httptest.NewServer(NewDebugHandler())
+}
+
+func (s *DebugSuite) TearDownTest(c *C) {
+	s.srv.Close()
+	log.SetSeverity(s.severity)
+}
+
+func (s *DebugSuite) do(c *C, method, path string, vals url.Values) (int, []byte) {
+	req, err := http.NewRequest(method, s.srv.URL+path, strings.NewReader(vals.Encode()))
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	re, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer re.Body.Close()
+	data, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	return re.StatusCode, data
+}
+
+func (s *DebugSuite) TestPprof(c *C) {
+	code, data := s.do(c, "GET", "/debug/pprof/", nil)
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(string(data), Matches, "(?s).*goroutine.*")
+
+	code, _ = s.do(c, "GET", "/debug/pprof/goroutine?debug=1", nil)
+	c.Assert(code, Equals, http.StatusOK)
+}
+
+func (s *DebugSuite) TestVars(c *C) {
+	code, data := s.do(c, "GET", "/debug/vars", nil)
+	c.Assert(code, Equals, http.StatusOK)
+	var vars map[string]json.RawMessage
+	c.Assert(json.Unmarshal(data, &vars), IsNil)
+	for _, name := range []string{"memstats", "goroutines", "version"} {
+		_, ok := vars[name]
+		c.Assert(ok, Equals, true, Commentf("missing %v", name))
+	}
+
+	// handler can be created more than once
+	NewDebugHandler()
+}
+
+func (s *DebugSuite) TestLogSeverity(c *C) {
+	log.SetSeverity(log.SeverityWarn)
+	code, data := s.do(c, "GET", "/debug/log", nil)
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(string(data), Equals, `{"severity":"WARN"}`)
+
+	code, data = s.do(c, "PUT", "/debug/log", url.Values{"severity": []string{"info"}})
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(string(data), Equals, `{"severity":"INFO"}`)
+	c.Assert(log.GetSeverity(), Equals, log.SeverityInfo)
+
+	code, _ = s.do(c, "PUT", "/debug/log", url.Values{"severity": []string{"loud"}})
+	c.Assert(code, Equals, http.StatusBadRequest)
+	code, _ = s.do(c, "PUT", "/debug/log", nil)
+	c.Assert(code, Equals, http.StatusBadRequest)
+	c.Assert(log.GetSeverity(), Equals, log.SeverityInfo)
+
+	code, _ = s.do(c, "DELETE", "/debug/log", nil)
+	c.Assert(code, Equals, http.StatusMethodNotAllowed)
+}
+
+func (s *DebugSuite) TestReload(c *C) {
+	code, _ := s.do(c, "POST", "/debug/reload", nil)
+	c.Assert(code, Equals, http.StatusNotFound)
+
+	var err error
+	calls := 0
+	s.srv.Close()
+	s.srv = httptest.NewServer(NewDebugHandler(OnReload(func() error {
+		calls++
+		return err
+	})))
+
+	code, data := s.do(c, "POST", "/debug/reload", nil)
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(string(data), Matches, ".*configuration reloaded.*")
+
+	err = errors.New("invalid config field 'addr'")
+	code, data = s.do(c, "POST", "/debug/reload", nil)
+	c.Assert(code, Equals, http.StatusInternalServerError)
+	c.Assert(string(data), Matches, ".*invalid config field 'addr'.*")
+
+	code, _ = s.do(c, "GET", "/debug/reload", nil)
+	c.Assert(code, Equals, http.StatusMethodNotAllowed)
+	c.Assert(calls, Equals, 2)
+}
+
+// TestNotOnAPI makes sure the debug endpoints are not exposed by the API server
+func (s *DebugSuite) TestNotOnAPI(c *C) {
+	bk, err := membk.New()
+	c.Assert(err, IsNil)
+	defer bk.Close()
+	srv := httptest.NewServer(NewAPIServer(hello.New(bk), bk))
+	defer srv.Close()
+	for _, path := range []string{"/debug/pprof/", "/debug/vars", "/debug/log", "/debug/reload"} {
+		re, err := http.Get(srv.URL + path)
+		c.Assert(err, IsNil)
+		re.Body.Close()
+		c.Assert(re.StatusCode, Equals, http.StatusNotFound, Commentf(path))
+	}
+}
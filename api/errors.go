@@ -0,0 +1,276 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+	"weak"
+
+	"github.com/gravitational/hello"
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/gravitational/form"
+	"github.com/gravitational/hello/audit"
+	"github.com/gravitational/hello/auth"
+	"github.com/gravitational/hello/backend"
+	"github.com/gravitational/hello/ratelimit"
+	"github.com/gravitational/hello/requestid"
+)
+
+// Error codes returned in the error envelope
+const (
+	codeNotFound         = "not_found"
+	codeConflict         = "conflict"
+	codeEmptyParameter   = "empty_parameter"
+	codeMissingParameter = "missing_parameter"
+	codeBadParameter     = "bad_parameter"
+	codeInvalidTemplate  = "invalid_template"
+	codeUnavailable      = "unavailable"
+	codeUnauthenticated  = "unauthenticated"
+	codeAccessDenied     = "access_denied"
+	codeNotSupported     = "not_supported"
+	codeRateLimited      = "rate_limited"
+	codeInternal         = "internal"
+)
+
+// errorResponse is an envelope of all error replies, e.g.
+//
+//   {"error": {"code": "not_found", "message": "greeting with id 'hello.us' not found", "details": {"id": "hello.us"}}}
+//
+// details carry the fields of the error, so the client can restore the error
+// with the same type that the library returns
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// internalMessage is the message of internal errors, their messages
+// may reveal internals, e.g. backend addresses or paths, so they are
+// written to the server log along with the request id instead
+const internalMessage = "internal server error"
+
+// toErrorResponse returns HTTP status code and envelope for the error,
+// errors of unknown types are internal errors
+func toErrorResponse(e error) (int, errorResponse) {
+	code, body := toErrorBody(e)
+	body.Message = e.Error()
+	if body.Code == codeInternal {
+		body.Message = internalMessage
+	}
+	return code, errorResponse{Error: body}
+}
+
+func toErrorBody(e error) (int, errorBody) {
+	switch err := e.(type) {
+	case *backend.NotFoundError:
+		return http.StatusNotFound, errorBody{
+			Code: codeNotFound, Details: map[string]string{"id": err.ID}}
+	case *backend.ConflictError:
+		return http.StatusConflict, errorBody{
+			Code: codeConflict, Details: map[string]string{"id": err.ID, "reason": err.Message}}
+	case *hello.EmptyParamError:
+		return http.StatusBadRequest, errorBody{Code: codeEmptyParameter}
+	case *form.MissingParameterError:
+		return http.StatusBadRequest, errorBody{
+			Code: codeMissingParameter, Details: map[string]string{"param": err.Param}}
+	case *form.BadParameterError:
+		return http.StatusBadRequest, errorBody{
+			Code: codeBadParameter, Details: map[string]string{"param": err.Param, "reason": err.Message}}
+	case *hello.TemplateError:
+		return http.StatusBadRequest, errorBody{
+			Code: codeInvalidTemplate, Details: map[string]string{"template": err.Value, "reason": err.Err.Error()}}
+	case *backend.UnavailableError:
+		return http.StatusServiceUnavailable, errorBody{
+			Code: codeUnavailable, Details: map[string]string{"reason": err.Message}}
+	case *auth.UnauthenticatedError:
+		return http.StatusUnauthorized, errorBody{
+			Code: codeUnauthenticated, Details: map[string]string{"reason": err.Message}}
+	case *ratelimit.LimitExceededError:
+		return http.StatusTooManyRequests, errorBody{
+			Code: codeRateLimited, Details: map[string]string{"retry_after": err.RetryAfter.String()}}
+	case *audit.NotSupportedError:
+		return http.StatusNotImplemented, errorBody{
+			Code: codeNotSupported, Details: map[string]string{"reason": err.Message}}
+	case *backend.NotSupportedError:
+		return http.StatusNotImplemented, errorBody{
+			Code: codeNotSupported, Details: map[string]string{"reason": err.Message, "source": "backend"}}
+	case *auth.AccessDeniedError:
+		return http.StatusForbidden, errorBody{
+			Code: codeAccessDenied, Details: map[string]string{
+				"name": err.Name, "role": string(err.Role), "required": string(err.Required)}}
+	}
+	return http.StatusInternalServerError, errorBody{Code: codeInternal}
+}
+
+// fromErrorResponse restores the error from the error reply,
+// replies without the envelope, e.g. from proxies, are converted by status code.
+// Internal errors and errors the client does not know are returned as ServerError,
+// the request id from the reply headers is kept with every error, see RequestID.
+func fromErrorResponse(status int, h http.Header, data []byte) error {
+	requestID := h.Get(requestid.Header)
+	return setRequestID(restoreError(status, requestID, h, data), requestID)
+}
+
+func restoreError(status int, requestID string, h http.Header, data []byte) error {
+	var re *errorResponse
+	if err := json.Unmarshal(data, &re); err != nil || re == nil || re.Error.Code == "" {
+		switch status {
+		case http.StatusNotFound:
+			return &backend.NotFoundError{ID: string(data)}
+		case http.StatusConflict:
+			return &backend.ConflictError{Message: string(data)}
+		case http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusGatewayTimeout:
+			return &backend.UnavailableError{Message: string(data)}
+		case http.StatusUnauthorized:
+			return &auth.UnauthenticatedError{Message: string(data)}
+		case http.StatusTooManyRequests:
+			d, _ := parseRetryAfter(h.Get("Retry-After"), time.Now())
+			return &ratelimit.LimitExceededError{RetryAfter: d}
+		}
+		return &ServerError{Status: status, Message: string(data), RequestID: requestID}
+	}
+	d := re.Error.Details
+	switch re.Error.Code {
+	case codeNotFound:
+		return &backend.NotFoundError{ID: d["id"]}
+	case codeConflict:
+		return &backend.ConflictError{ID: d["id"], Message: d["reason"]}
+	case codeEmptyParameter:
+		return &hello.EmptyParamError{}
+	case codeMissingParameter:
+		return &form.MissingParameterError{Param: d["param"]}
+	case codeBadParameter:
+		return &form.BadParameterError{Param: d["param"], Message: d["reason"]}
+	case codeInvalidTemplate:
+		return &hello.TemplateError{Value: d["template"], Err: errors.New(d["reason"])}
+	case codeUnavailable:
+		return &backend.UnavailableError{Message: d["reason"]}
+	case codeUnauthenticated:
+		return &auth.UnauthenticatedError{Message: d["reason"]}
+	case codeRateLimited:
+		wait, err := time.ParseDuration(d["retry_after"])
+		if err != nil {
+			wait, _ = parseRetryAfter(h.Get("Retry-After"), time.Now())
+		}
+		return &ratelimit.LimitExceededError{RetryAfter: wait}
+	case codeNotSupported:
+		if d["source"] == "backend" {
+			return &backend.NotSupportedError{Message: d["reason"]}
+		}
+		return &audit.NotSupportedError{Message: d["reason"]}
+	case codeAccessDenied:
+		return &auth.AccessDeniedError{Name: d["name"], Role: auth.Role(d["role"]), Required: auth.Role(d["required"])}
+	}
+	return &ServerError{Status: status, Code: re.Error.Code, Message: re.Error.Message, RequestID: requestID}
+}
+
+// ServerError is returned by the client when the server fails with an internal
+// error, or with an error the client does not recognize
+type ServerError struct {
+	// Status is the HTTP status code of the reply
+	Status int
+	// Code is the error code, e.g. 'internal', empty if the reply had no error envelope
+	Code string
+	// Message is the error message
+	Message string
+	// RequestID is the id of the failed request, see requestid package
+	RequestID string
+}
+
+func (e *ServerError) Error() string {
+	if e.RequestID == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%v, request id: %v", e.Message, e.RequestID)
+}
+
+// RequestID returns the id of the failed request the client error was
+// restored from, so the error can be found in the server logs, e.g.
+//
+//   if _, err := c.GetGreeting("hello.us"); err != nil {
+//       log.Errorf("%v, request id: %v", err, api.RequestID(err))
+//   }
+//
+// It returns an empty string for other errors and for empty parameter
+// errors, that are all equal.
+func RequestID(err error) string {
+	if e, ok := err.(*ServerError); ok {
+		return e.RequestID
+	}
+	if r, ok := refOf(err); ok {
+		if id, ok := requestIDs.Load(r.key); ok {
+			return id.(string)
+		}
+	}
+	return ""
+}
+
+// requestIDs keeps the request ids of the errors restored by the client,
+// keyed by weak pointers, so the errors keep their types and the entries
+// are removed once the errors are collected
+var requestIDs sync.Map
+
+// errorRef identifies the restored error without keeping it alive
+type errorRef struct {
+	key       interface{}
+	onCollect func(func())
+}
+
+func ref[T any](e *T) errorRef {
+	return errorRef{
+		key: weak.Make(e),
+		onCollect: func(f func()) {
+			runtime.AddCleanup(e, func(struct{}) { f() }, struct{}{})
+		},
+	}
+}
+
+// refOf returns the reference of the error types restored by fromErrorResponse,
+// except empty parameter errors, pointers to empty structs can't be told apart
+func refOf(err error) (errorRef, bool) {
+	switch e := err.(type) {
+	case *backend.NotFoundError:
+		return ref(e), true
+	case *backend.ConflictError:
+		return ref(e), true
+	case *form.MissingParameterError:
+		return ref(e), true
+	case *form.BadParameterError:
+		return ref(e), true
+	case *hello.TemplateError:
+		return ref(e), true
+	case *backend.UnavailableError:
+		return ref(e), true
+	case *auth.UnauthenticatedError:
+		return ref(e), true
+	case *ratelimit.LimitExceededError:
+		return ref(e), true
+	case *audit.NotSupportedError:
+		return ref(e), true
+	case *backend.NotSupportedError:
+		return ref(e), true
+	case *auth.AccessDeniedError:
+		return ref(e), true
+	}
+	return errorRef{}, false
+}
+
+// setRequestID records the request id of the restored error
+func setRequestID(err error, requestID string) error {
+	r, ok := refOf(err)
+	if !ok || requestID == "" {
+		return err
+	}
+	// the cleanup must not refer to the error, or it is never collected
+	key := r.key
+	requestIDs.Store(key, requestID)
+	r.onCollect(func() { requestIDs.Delete(key) })
+	return err
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/gravitational/form"
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/julienschmidt/httprouter"
+	"github.com/gravitational/hello/audit"
+	"github.com/gravitational/hello/backend"
+)
+
+type historyResponse struct {
+	History []greetingVersion `json:"history"`
+}
+
+type greetingVersion struct {
+	Revision uint64    `json:"revision"`
+	Value    string    `json:"value,omitempty"`
+	Template bool      `json:"template,omitempty"`
+	Deleted  bool      `json:"deleted,omitempty"`
+	Author   string    `json:"author,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// getHistory returns the recorded changes of the greeting, most recent first,
+// see backend.HistoryBackend
+func (s *APIServer) getHistory(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	history, err := backend.GetHistory(s.b, p[0].Value)
+	if err != nil {
+		replyErr(w, err)
+		return
+	}
+	out := make([]greetingVersion, len(history))
+	for i, v := range history {
+		out[i] = greetingVersion{
+			Revision: v.Revision, Value: v.Value, Template: v.Template, Deleted: v.Deleted, Author: v.Author, Time: v.Time}
+	}
+	reply(w, http.StatusOK, historyResponse{History: out})
+}
+
+// rollbackGreeting writes the value the greeting had at the 'revision' from
+// it's history back, the rollback is a change recorded in the history as well.
+// The write is conditional on the revision read before it, so a concurrent
+// change fails the rollback with a conflict instead of being overwritten.
+func (s *APIServer) rollbackGreeting(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	prompt := p[0].Value
+	var param string
+	if err := form.Parse(r, form.String("revision", &param, form.Required())); err != nil {
+		replyErr(w, err)
+		return
+	}
+	rev, err := strconv.ParseUint(param, 10, 64)
+	if err != nil || rev == 0 {
+		replyErr(w, &form.BadParameterError{Param: "revision", Message: "expected greeting revision"})
+		return
+	}
+	history, err := backend.GetHistory(s.b, prompt)
+	if err != nil {
+		replyErr(w, err)
+		return
+	}
+	var target *backend.Version
+	for i := range history {
+		if history[i].Revision == rev {
+			target = &history[i]
+			break
+		}
+	}
+	switch {
+	case target == nil:
+		replyErr(w, &form.BadParameterError{
+			Param: "revision", Message: fmt.Sprintf("revision %v is not in the history of '%v'", rev, prompt)})
+		return
+	case target.Deleted:
+		replyErr(w, &form.BadParameterError{
+			Param: "revision", Message: fmt.Sprintf("revision %v deleted '%v', delete the greeting instead", rev, prompt)})
+		return
+	}
+	var old string
+	opts := []backend.WriteOption{backend.Create()}
+	g, err := s.b.GetGreeting(prompt)
+	switch err.(type) {
+	case nil:
+		// the history keeps values, the metadata of the greeting is kept as is
+		old = g.Value
+		opts = []backend.WriteOption{backend.IfRevision(g.Revision),
+			backend.Locale(g.Locale), backend.Description(g.Description), backend.Tags(g.Tags...)}
+	case *backend.NotFoundError:
+	default:
+		replyErr(w, err)
+		return
+	}
+	if target.Template {
+		opts = append(opts, backend.Template())
+	}
+	var written uint64
+	opts = append(opts, backend.ReturnRevision(&written))
+	if err := s.b.UpsertGreeting(prompt, target.Value, withAuthor(r, opts)...); err != nil {
+		replyErr(w, err)
+		return
+	}
+	s.emit(r, audit.ActionRollback, prompt, old, target.Value)
+	replyWritten(w, greeting{Prompt: prompt, Value: target.Value, Template: target.Template, Revision: written})
+}
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+
+	"github.com/gravitational/hello"
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/gravitational/form"
+	"github.com/gravitational/hello/audit"
+	"github.com/gravitational/hello/auth"
+	"github.com/gravitational/hello/backend"
+	"github.com/gravitational/hello/backend/membk"
+
+	. "github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+type HistorySuite struct {
+	srv  *httptest.Server
+	bk   *membk.MemBackend
+	sink *audit.FileSink
+}
+
+var _ = Suite(&HistorySuite{})
+
+func (s *HistorySuite) SetUpTest(c *C) {
+	var err error
+	s.bk, err = membk.New()
+	c.Assert(err, IsNil)
+	s.sink, err = audit.NewFileSink(filepath.Join(c.MkDir(), "audit.log"))
+	c.Assert(err, IsNil)
+	keys, err := auth.FromString(`{
+      "tokens": [{"name": "alice", "token": "reader-token", "role": "reader"},
+                 {"name": "bob", "token": "editor-token", "role": "editor"},
+                 {"name": "ops", "token": "admin-token", "role": "admin"}]}`)
+	c.Assert(err, IsNil)
+	s.srv = httptest.NewServer(NewAPIServer(hello.New(s.bk), s.bk, Auth(keys), Audit(s.sink)))
+}
+
+func (s *HistorySuite) TearDownTest(c *C) {
+	s.srv.Close()
+	c.Assert(s.sink.Close(), IsNil)
+	c.Assert(s.bk.Close(), IsNil)
+}
+
+func (s *HistorySuite) client(c *C, token string) *Client {
+	clt, err := NewClient(s.srv.URL, BearerToken(token))
+	c.Assert(err, IsNil)
+	return clt
+}
+
+func (s *HistorySuite) TestHistory(c *C) {
+	reader := s.client(c, "reader-token")
+	editor := s.client(c, "editor-token")
+	admin := s.client(c, "admin-token")
+
+	_, err := reader.GetHistory("hello.us")
+	c.Assert(err, DeepEquals, &backend.NotFoundError{ID: "hello.us"})
+
+	c.Assert(editor.UpsertGreeting("hello.us", "Hello"), IsNil)
+	// authenticated clients are recorded by their names, not the Author option
+	c.Assert(editor.UpsertGreeting("hello.us", "Hellp", backend.Author("mallory")), IsNil)
+	c.Assert(admin.DeleteGreeting("hello.us"), IsNil)
+
+	history, err := reader.GetHistory("hello.us")
+	c.Assert(err, IsNil)
+	type change struct {
+		value   string
+		deleted bool
+		author  string
+	}
+	changes := func(history []backend.Version) []change {
+		out := make([]change, len(history))
+		for i, v := range history {
+			out[i] = change{v.Value, v.Deleted, v.Author}
+			c.Assert(v.Time.IsZero(), Equals, false)
+		}
+		return out
+	}
+	c.Assert(changes(history), DeepEquals, []change{
+		{"", true, "ops"},
+		{"Hellp", false, "bob"},
+		{"Hello", false, "bob"},
+	})
+
+	// rollback brings the deleted greeting back and returns it's new revision
+	rev, err := editor.RollbackGreeting("hello.us", history[2].Revision)
+	c.Assert(err, IsNil)
+	g, err := reader.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(g.Value, Equals, "Hello")
+	c.Assert(rev, Equals, g.Revision)
+
+	// and is recorded in the history and the audit log
+	history, err = reader.GetHistory("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(history[0].Revision, Equals, g.Revision)
+	c.Assert(changes(history)[0], DeepEquals, change{"Hello", false, "bob"})
+	events, err := admin.GetAuditEvents("hello.us", 1)
+	c.Assert(err, IsNil)
+	c.Assert(len(events), Equals, 1)
+	c.Assert(events[0].Action, Equals, audit.ActionRollback)
+	c.Assert(events[0].User, Equals, "bob")
+	c.Assert(events[0].NewValue, Equals, "Hello")
+
+	// rollback of the existing greeting
+	_, err = editor.RollbackGreeting("hello.us", history[2].Revision)
+	c.Assert(err, IsNil)
+	g, err = reader.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(g.Value, Equals, "Hellp")
+}
+
+func (s *HistorySuite) TestRollbackMetadata(c *C) {
+	reader := s.client(c, "reader-token")
+	editor := s.client(c, "editor-token")
+
+	c.Assert(s.bk.UpsertGreeting("hello.us", "Hello"), IsNil)
+	c.Assert(s.bk.UpsertGreeting("hello.us", "Hellp", backend.Description("landing page"), backend.Tags("web")), IsNil)
+	history, err := reader.GetHistory("hello.us")
+	c.Assert(err, IsNil)
+
+	// rollback changes the value and keeps the metadata of the greeting
+	_, err = editor.RollbackGreeting("hello.us", history[1].Revision)
+	c.Assert(err, IsNil)
+	g, err := reader.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(g.Value, Equals, "Hello")
+	c.Assert(g.Description, Equals, "landing page")
+	c.Assert(g.Tags, DeepEquals, []string{"web"})
+	c.Assert(g.Author, Equals, "bob")
+}
+
+func (s *HistorySuite) TestRollbackTemplate(c *C) {
+	reader := s.client(c, "reader-token")
+	editor := s.client(c, "editor-token")
+
+	c.Assert(editor.UpsertGreeting("hello.jp", "{{.Name}}さん、こんにちは", backend.Template()), IsNil)
+	c.Assert(editor.UpsertGreeting("hello.jp", "こんにちは"), IsNil)
+	history, err := reader.GetHistory("hello.jp")
+	c.Assert(err, IsNil)
+	c.Assert(history[1].Template, Equals, true)
+
+	// the value rolled back to is a template again
+	_, err = editor.RollbackGreeting("hello.jp", history[1].Revision)
+	c.Assert(err, IsNil)
+	out, err := reader.Hello("hello.jp", "Dog")
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, "Dogさん、こんにちは")
+}
+
+func (s *HistorySuite) TestRollbackErrors(c *C) {
+	reader := s.client(c, "reader-token")
+	editor := s.client(c, "editor-token")
+
+	_, err := editor.RollbackGreeting("hello.us", 1)
+	c.Assert(err, DeepEquals, &backend.NotFoundError{ID: "hello.us"})
+
+	c.Assert(editor.UpsertGreeting("hello.us", "Hello"), IsNil)
+	c.Assert(editor.DeleteGreeting("hello.us"), FitsTypeOf, &auth.AccessDeniedError{})
+	c.Assert(s.bk.DeleteGreeting("hello.us"), IsNil)
+	history, err := reader.GetHistory("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(history[0].Deleted, Equals, true)
+
+	// revisions deleting the greeting and revisions missing in the history can't be rolled back to
+	for _, rev := range []uint64{0, history[0].Revision, history[0].Revision + 1} {
+		_, err = editor.RollbackGreeting("hello.us", rev)
+		c.Assert(err, FitsTypeOf, &form.BadParameterError{}, Commentf("revision %v", rev))
+		c.Assert(err.(*form.BadParameterError).Param, Equals, "revision")
+	}
+
+	// readers can't roll back
+	_, err = reader.RollbackGreeting("hello.us", history[1].Revision)
+	c.Assert(err, FitsTypeOf, &auth.AccessDeniedError{})
+}
+
+func (s *HistorySuite) TestNotSupported(c *C) {
+	bk := struct{ backend.GreetingBackend }{s.bk}
+	srv := httptest.NewServer(NewAPIServer(hello.New(bk), bk))
+	defer srv.Close()
+	clt, err := NewClient(srv.URL)
+	c.Assert(err, IsNil)
+	_, err = clt.GetHistory("hello.us")
+	c.Assert(err, FitsTypeOf, &backend.NotSupportedError{})
+	_, err = clt.RollbackGreeting("hello.us", 1)
+	c.Assert(err, FitsTypeOf, &backend.NotSupportedError{})
+}
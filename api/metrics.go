@@ -0,0 +1,23 @@
+package api
+
+import (
+	"github.com/gravitational/hello/metrics"
+)
+
+// serverMetrics are metrics recorded by the API server
+type serverMetrics struct {
+	requests  *metrics.Counter
+	duration  *metrics.Histogram
+	greetings *metrics.Counter
+}
+
+func newServerMetrics(r *metrics.Registry) *serverMetrics {
+	return &serverMetrics{
+		requests: r.NewCounter("hello_http_requests_total",
+			"HTTP requests served by route and status code", "method", "route", "code"),
+		duration: r.NewHistogram("hello_http_request_duration_seconds",
+			"Latency of HTTP requests by route", metrics.DefaultBuckets, "method", "route"),
+		greetings: r.NewCounter("hello_greetings_total",
+			"Successful Hello calls by greeting used", "greeting"),
+	}
+}
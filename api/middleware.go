@@ -0,0 +1,135 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/julienschmidt/httprouter"
+	"github.com/gravitational/hello/auth"
+	"github.com/gravitational/hello/requestid"
+)
+
+// unmatchedRoute is a route label of requests that did not match any route
+const unmatchedRoute = "unmatched"
+
+// handle registers the handler for the route that requires the role, see authorize,
+// and is rate limited by it's class, see RateLimit. Requests are checked against
+// the limit of the address before authentication, and failed authentication
+// takes a token from it, so guessing tokens is throttled too. Requests are served by serve,
+// that assigns request ids, records metrics and writes the access log. Routes are recorded by the path pattern,
+// e.g. '/v1/greetings/:prompt', to keep the number of series bounded.
+func (s *APIServer) handle(method, path string, role auth.Role, h httprouter.Handle) {
+	class := routeClass(method, path, role)
+	s.Handle(method, path, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		s.serve(routeLabel(path, r), w, r, func(w http.ResponseWriter, r *http.Request) {
+			if err := s.peekLimit(r, class); err != nil {
+				replyErr(w, err)
+				return
+			}
+			ar, err := s.authorize(r, role)
+			if err != nil {
+				if _, ok := err.(*auth.UnauthenticatedError); ok {
+					// the reply is 401 even if the address is throttled now
+					s.limit(r, class)
+				}
+				replyErr(w, err)
+				return
+			}
+			r = ar
+			if err := s.limit(r, class); err != nil {
+				replyErr(w, err)
+				return
+			}
+			h(w, r, p)
+		})
+	})
+}
+
+// routeLabel returns the route the request is recorded by, watch streams
+// are recorded apart from listings, as they last until the client goes away
+func routeLabel(path string, r *http.Request) string {
+	if path == "/v1/greetings" && r.Method == "GET" {
+		if watch, _ := isWatch(r); watch {
+			return path + "?watch=true"
+		}
+	}
+	return path
+}
+
+func (s *APIServer) notFound(w http.ResponseWriter, r *http.Request) {
+	s.serve(unmatchedRoute, w, r, http.NotFound)
+}
+
+// serve propagates the request id passed by the client in X-Request-ID header,
+// or assigns a new one, and passes it to the handler in the request context,
+// see requestid.FromContext. The id is returned in X-Request-ID response header.
+func (s *APIServer) serve(route string, w http.ResponseWriter, r *http.Request, fn http.HandlerFunc) {
+	start := time.Now()
+	id := r.Header.Get(requestid.Header)
+	if !requestid.Valid(id) {
+		id = requestid.New()
+	}
+	w.Header().Set(requestid.Header, id)
+	sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+	fn(sw, r.WithContext(requestid.NewContext(r.Context(), id)))
+
+	duration := time.Since(start)
+	method := methodLabel(r.Method)
+	s.metrics.duration.Observe(duration.Seconds(), method, route)
+	s.metrics.requests.Inc(method, route, strconv.Itoa(sw.code))
+	if s.accessLog != nil {
+		s.accessLog.write(accessEntry{
+			Time:      start.UTC(),
+			RequestID: id,
+			Method:    r.Method,
+			Route:     route,
+			Path:      r.URL.Path,
+			Status:    sw.code,
+			Duration:  duration.Seconds(),
+			Bytes:     sw.bytes,
+			Client:    r.RemoteAddr,
+		})
+	}
+}
+
+// methodLabel returns the method label of the request, clients can send
+// any method, so methods other than the standard ones are reported as 'other'
+// to keep the number of series bounded
+func methodLabel(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS":
+		return method
+	}
+	return "other"
+}
+
+// statusWriter remembers the status code and the size of the response
+type statusWriter struct {
+	http.ResponseWriter
+	code        int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.code = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(data)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush supports streaming responses, e.g. watches
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,205 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gravitational/hello/auth"
+	"github.com/gravitational/hello/ratelimit"
+)
+
+// RouteClass is a group of routes sharing a rate limit
+type RouteClass string
+
+const (
+	// ReadRoutes are routes reading greetings and the audit log
+	ReadRoutes RouteClass = "read"
+	// HelloRoutes is POST /v1/hello
+	HelloRoutes RouteClass = "hello"
+	// MutationRoutes are routes upserting and deleting greetings
+	MutationRoutes RouteClass = "mutation"
+)
+
+// ParseRouteClass returns the route class by name
+func ParseRouteClass(v string) (RouteClass, error) {
+	switch c := RouteClass(v); c {
+	case ReadRoutes, HelloRoutes, MutationRoutes:
+		return c, nil
+	}
+	return "", fmt.Errorf("unsupported route class '%v', expected 'read', 'hello' or 'mutation'", v)
+}
+
+// RateLimit limits the rate of requests to the routes of the class per client.
+// Authenticated clients are limited by their names, i.e. by their tokens
+// and API keys, others are limited by their IP addresses. Requests failing
+// authentication take tokens of their addresses, and once the address
+// is throttled all of it's requests are, authenticated or not. Throttled requests
+// get 429 replies with Retry-After header. Health checks, version and metrics
+// are never limited.
+//
+//  l, err := ratelimit.New(ratelimit.Limit{Rate: 10, Burst: 20})
+//  if err != nil {
+//      return err
+//  }
+//  srv := api.NewAPIServer(h, b, api.RateLimit(api.HelloRoutes, l))
+//
+func RateLimit(class RouteClass, l *ratelimit.Limiter) ServerOption {
+	return func(s *APIServer) {
+		if s.limiters == nil {
+			s.limiters = make(map[RouteClass]*ratelimit.Limiter)
+		}
+		s.limiters[class] = l
+	}
+}
+
+// SetRateLimits replaces the rate limits of all route classes at runtime,
+// e.g. when the configuration is reloaded, the classes missing from limits
+// are not limited, see RateLimit
+func (s *APIServer) SetRateLimits(limits map[RouteClass]*ratelimit.Limiter) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.limiters = limits
+}
+
+// routeClass returns the class of the route, or empty string
+// for public routes that are not limited
+func routeClass(method, path string, role auth.Role) RouteClass {
+	switch {
+	case role == public:
+		return ""
+	case path == "/v1/hello":
+		return HelloRoutes
+	case method == "GET":
+		return ReadRoutes
+	}
+	return MutationRoutes
+}
+
+// limit takes a token from the bucket of the client for the route class
+func (s *APIServer) limit(r *http.Request, class RouteClass) error {
+	s.mtx.RLock()
+	l, ok := s.limiters[class]
+	s.mtx.RUnlock()
+	if !ok {
+		return nil
+	}
+	return l.Take(string(class) + "/" + clientKey(r))
+}
+
+// peekLimit returns error if the bucket of the client address is empty,
+// it's checked before authentication, see handle
+func (s *APIServer) peekLimit(r *http.Request, class RouteClass) error {
+	s.mtx.RLock()
+	l, ok := s.limiters[class]
+	s.mtx.RUnlock()
+	if !ok {
+		return nil
+	}
+	return l.Peek(string(class) + "/" + clientKey(r))
+}
+
+// clientKey identifies the client by the name of the authenticated client,
+// or by the IP address
+func clientKey(r *http.Request) string {
+	if id := auth.GetIdentity(r.Context()); id != nil {
+		return "client:" + id.Name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// retryAfter formats the duration as Retry-After header value in whole seconds
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(d.Seconds()))))
+}
+
+// parseRetryAfter parses Retry-After header value, either seconds or HTTP date
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+const (
+	// DefaultRetries is the default number of retries of throttled requests
+	DefaultRetries = 3
+	// DefaultMaxRetryWait is the default max time to wait before a retry
+	DefaultMaxRetryWait = 10 * time.Second
+	// baseBackoff is the first wait if the server did not send Retry-After
+	baseBackoff = 250 * time.Millisecond
+)
+
+// Retry sets the number of retries of requests throttled by the server,
+// and the max time to wait before a retry. The client waits for the time
+// in Retry-After header, or backs off exponentially if there is none,
+// and gives up if the server asks to wait longer than maxWait.
+// Zero retries turn retries off.
+//
+//     c, err := api.NewClient("http://localhost:8080", api.Retry(5, time.Minute))
+//
+func Retry(retries int, maxWait time.Duration) ClientOption {
+	return func(c *clientOptions) {
+		c.retry = retryOptions{retries: retries, maxWait: maxWait}
+	}
+}
+
+type retryOptions struct {
+	retries int
+	maxWait time.Duration
+}
+
+// roundTrip sends the request and retries it while it's throttled,
+// the requests with bodies are retried only if the body can be replayed
+func (o retryOptions) roundTrip(next http.RoundTripper, req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		re, err := next.RoundTrip(req)
+		if err != nil || re.StatusCode != http.StatusTooManyRequests || attempt >= o.retries {
+			return re, err
+		}
+		wait, ok := parseRetryAfter(re.Header.Get("Retry-After"), time.Now())
+		if !ok {
+			wait = baseBackoff << uint(attempt)
+		}
+		// jitter spreads the retries of the clients throttled at once
+		wait += time.Duration(rand.Int63n(int64(wait/10) + 1))
+		if wait > o.maxWait || (req.Body != nil && req.GetBody == nil) {
+			return re, nil
+		}
+		io.Copy(ioutil.Discard, re.Body)
+		re.Body.Close()
+
+		req = req.Clone(req.Context())
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"github.com/gravitational/hello"
+	"github.com/gravitational/hello/auth"
+	"github.com/gravitational/hello/backend/membk"
+	"github.com/gravitational/hello/backend/test"
+	"github.com/gravitational/hello/ratelimit"
+
+	. "github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+type RateLimitSuite struct {
+	bk    *membk.MemBackend
+	clock *test.FakeClock
+}
+
+var _ = Suite(&RateLimitSuite{})
+
+func (s *RateLimitSuite) SetUpTest(c *C) {
+	var err error
+	s.bk, err = membk.New()
+	c.Assert(err, IsNil)
+	c.Assert(s.bk.UpsertGreeting("hello.us", "Hello"), IsNil)
+	s.clock = test.NewFakeClock(time.Date(2015, 12, 1, 0, 0, 0, 0, time.UTC))
+}
+
+func (s *RateLimitSuite) TearDownTest(c *C) {
+	c.Assert(s.bk.Close(), IsNil)
+}
+
+func (s *RateLimitSuite) limiter(c *C, rate float64, burst int) *ratelimit.Limiter {
+	l, err := ratelimit.New(ratelimit.Limit{Rate: rate, Burst: burst}, ratelimit.Clock(s.clock))
+	c.Assert(err, IsNil)
+	return l
+}
+
+func (s *RateLimitSuite) TestThrottled(c *C) {
+	srv := httptest.NewServer(NewAPIServer(hello.New(s.bk), s.bk,
+		RateLimit(HelloRoutes, s.limiter(c, 0.5, 2)),
+		RateLimit(MutationRoutes, s.limiter(c, 1, 1))))
+	defer srv.Close()
+	clt, err := NewClient(srv.URL, Retry(0, 0))
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 2; i++ {
+		_, err = clt.Hello("hello.us", "Dog")
+		c.Assert(err, IsNil)
+	}
+	_, err = clt.Hello("hello.us", "Dog")
+	c.Assert(err, FitsTypeOf, &ratelimit.LimitExceededError{})
+	c.Assert(err.(*ratelimit.LimitExceededError).RetryAfter, Equals, 2*time.Second)
+
+	// route classes are limited separately, reads and probes are not limited
+	c.Assert(clt.UpsertGreeting("hello.uk", "Hi"), IsNil)
+	c.Assert(clt.UpsertGreeting("hello.uk", "Hi"), FitsTypeOf, &ratelimit.LimitExceededError{})
+	for i := 0; i < 5; i++ {
+		_, err = clt.GetGreeting("hello.us")
+		c.Assert(err, IsNil)
+		c.Assert(clt.Ping(), IsNil)
+	}
+
+	re, err := http.Post(srv.URL+"/v1/hello", "application/x-www-form-urlencoded", nil)
+	c.Assert(err, IsNil)
+	re.Body.Close()
+	c.Assert(re.StatusCode, Equals, http.StatusTooManyRequests)
+	c.Assert(re.Header.Get("Retry-After"), Equals, "2")
+
+	s.clock.Advance(2 * time.Second)
+	_, err = clt.Hello("hello.us", "Dog")
+	c.Assert(err, IsNil)
+}
+
+func (s *RateLimitSuite) TestClients(c *C) {
+	keys, err := auth.FromString(`{
+      "tokens": [{"name": "alice", "token": "alice-token", "role": "reader"},
+                 {"name": "bob", "token": "bob-token", "role": "reader"}]}`)
+	c.Assert(err, IsNil)
+	srv := httptest.NewServer(NewAPIServer(hello.New(s.bk), s.bk,
+		Auth(keys), RateLimit(ReadRoutes, s.limiter(c, 1, 1))))
+	defer srv.Close()
+
+	// authenticated clients are limited by their names, not addresses
+	for _, token := range []string{"alice-token", "bob-token"} {
+		clt, err := NewClient(srv.URL, BearerToken(token), Retry(0, 0))
+		c.Assert(err, IsNil)
+		_, err = clt.GetGreeting("hello.us")
+		c.Assert(err, IsNil)
+		_, err = clt.GetGreeting("hello.us")
+		c.Assert(err, FitsTypeOf, &ratelimit.LimitExceededError{})
+	}
+
+	c.Assert(clientKey(&http.Request{RemoteAddr: "10.0.0.1:5000"}), Equals, "ip:10.0.0.1")
+	c.Assert(routeClass("GET", "/v1/greetings/:prompt", auth.Reader), Equals, ReadRoutes)
+	c.Assert(routeClass("POST", "/v1/hello", auth.Reader), Equals, HelloRoutes)
+	c.Assert(routeClass("DELETE", "/v1/greetings/:prompt", auth.Admin), Equals, MutationRoutes)
+	c.Assert(routeClass("GET", "/readyz", public), Equals, RouteClass(""))
+
+	_, err = ParseRouteClass("write")
+	c.Assert(err, NotNil)
+}
+
+// TestBadTokens checks that requests failing authentication are throttled
+func (s *RateLimitSuite) TestBadTokens(c *C) {
+	keys, err := auth.FromString(`{"tokens": [{"name": "alice", "token": "alice-token", "role": "reader"}]}`)
+	c.Assert(err, IsNil)
+	srv := httptest.NewServer(NewAPIServer(hello.New(s.bk), s.bk,
+		Auth(keys), RateLimit(ReadRoutes, s.limiter(c, 1, 2))))
+	defer srv.Close()
+
+	bad, err := NewClient(srv.URL, BearerToken("guess"), Retry(0, 0))
+	c.Assert(err, IsNil)
+	for i := 0; i < 2; i++ {
+		_, err = bad.GetGreeting("hello.us")
+		c.Assert(err, FitsTypeOf, &auth.UnauthenticatedError{})
+	}
+	_, err = bad.GetGreeting("hello.us")
+	c.Assert(err, FitsTypeOf, &ratelimit.LimitExceededError{})
+
+	// the address is throttled, valid tokens included
+	clt, err := NewClient(srv.URL, BearerToken("alice-token"), Retry(0, 0))
+	c.Assert(err, IsNil)
+	_, err = clt.GetGreeting("hello.us")
+	c.Assert(err, FitsTypeOf, &ratelimit.LimitExceededError{})
+
+	s.clock.Advance(time.Second)
+	_, err = clt.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+}
+
+// TestRetry checks that the client retries throttled requests
+func (s *RateLimitSuite) TestRetry(c *C) {
+	var attempts, throttle int32
+	retryAfterHeader := "0"
+	h := NewAPIServer(hello.New(s.bk), s.bk)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) <= atomic.LoadInt32(&throttle) {
+			if retryAfterHeader != "" {
+				w.Header().Set("Retry-After", retryAfterHeader)
+			}
+			// proxies throttle with plain replies
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	clt, err := NewClient(srv.URL)
+	c.Assert(err, IsNil)
+
+	// the request body is replayed on retries
+	atomic.StoreInt32(&throttle, 2)
+	c.Assert(clt.UpsertGreeting("hello.uk", "Hi"), IsNil)
+	c.Assert(atomic.LoadInt32(&attempts), Equals, int32(3))
+	g, err := s.bk.GetGreeting("hello.uk")
+	c.Assert(err, IsNil)
+	c.Assert(g.Value, Equals, "Hi")
+
+	// the client gives up after the retries
+	atomic.StoreInt32(&attempts, 0)
+	atomic.StoreInt32(&throttle, 10)
+	_, err = clt.Hello("hello.us", "Dog")
+	c.Assert(err, FitsTypeOf, &ratelimit.LimitExceededError{})
+	c.Assert(atomic.LoadInt32(&attempts), Equals, int32(DefaultRetries+1))
+
+	// or if the server asks to wait too long
+	atomic.StoreInt32(&attempts, 0)
+	retryAfterHeader = "60"
+	_, err = clt.Hello("hello.us", "Dog")
+	c.Assert(err, FitsTypeOf, &ratelimit.LimitExceededError{})
+	c.Assert(err.(*ratelimit.LimitExceededError).RetryAfter, Equals, time.Minute)
+	c.Assert(atomic.LoadInt32(&attempts), Equals, int32(1))
+
+	// and backs off without Retry-After header
+	atomic.StoreInt32(&attempts, 0)
+	retryAfterHeader = ""
+	clt, err = NewClient(srv.URL, Retry(1, time.Second))
+	c.Assert(err, IsNil)
+	start := time.Now()
+	_, err = clt.Hello("hello.us", "Dog")
+	c.Assert(err, FitsTypeOf, &ratelimit.LimitExceededError{})
+	c.Assert(atomic.LoadInt32(&attempts), Equals, int32(2))
+	c.Assert(time.Since(start) >= baseBackoff, Equals, true)
+}
+
+func (s *RateLimitSuite) TestRetryAfter(c *C) {
+	c.Assert(retryAfter(time.Millisecond), Equals, "1")
+	c.Assert(retryAfter(1500*time.Millisecond), Equals, "2")
+
+	now := time.Date(2015, 12, 1, 0, 0, 0, 0, time.UTC)
+	d, ok := parseRetryAfter("3", now)
+	c.Assert(ok, Equals, true)
+	c.Assert(d, Equals, 3*time.Second)
+	d, ok = parseRetryAfter(now.Add(time.Minute).Format(http.TimeFormat), now)
+	c.Assert(ok, Equals, true)
+	c.Assert(d, Equals, time.Minute)
+	_, ok = parseRetryAfter("soon", now)
+	c.Assert(ok, Equals, false)
+}
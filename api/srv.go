@@ -5,17 +5,78 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gravitational/hello"
 	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/gravitational/form"
 	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/julienschmidt/httprouter" // APIServer is a http.Handler server requests to Helo server
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/gravitational/hello/audit"
+	"github.com/gravitational/hello/auth"
 	"github.com/gravitational/hello/backend"
+	"github.com/gravitational/hello/metrics"
+	"github.com/gravitational/hello/ratelimit"
+	"github.com/gravitational/hello/requestid"
+	"github.com/gravitational/hello/version"
 )
 
 type APIServer struct {
 	httprouter.Router
 	h hello.Helloer
 	b backend.GreetingBackend
+	// closeC is closed when the server shuts down to end long-lived watch streams
+	closeC    chan bool
+	closeOnce sync.Once
+	registry  *metrics.Registry
+	metrics   *serverMetrics
+	audit     audit.Sink
+	accessLog *accessLog
+	// mtx guards the settings that can be changed at runtime,
+	// see SetAuth and SetRateLimits
+	mtx      sync.RWMutex
+	auth     auth.Authenticator
+	limiters map[RouteClass]*ratelimit.Limiter
+}
+
+// ServerOption is a functional option for the API server
+type ServerOption func(s *APIServer)
+
+// Registry sets the registry of the metrics served on /metrics, it is handy
+// to share the registry with other components, e.g. metricsbk backend.
+// By default the server uses it's own registry.
+func Registry(r *metrics.Registry) ServerOption {
+	return func(s *APIServer) {
+		s.registry = r
+	}
+}
+
+// Auth turns on authentication of the clients with the authenticator,
+// e.g. auth.Keys. Greeting routes require roles: reader may say hello and read
+// greetings, editor may also upsert and admin may also delete them.
+// By default all clients are allowed to do everything.
+func Auth(a auth.Authenticator) ServerOption {
+	return func(s *APIServer) {
+		s.auth = a
+	}
+}
+
+// SetAuth replaces the authenticator at runtime, e.g. when the keys are
+// reloaded, requests in flight complete with the old one. nil turns
+// authentication off, see Auth.
+func (s *APIServer) SetAuth(a auth.Authenticator) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.auth = a
+}
+
+func (s *APIServer) authenticator() auth.Authenticator {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.auth
 }
 
 // NewAPIServer returns http.Handler compatible HTTP server
@@ -23,106 +84,477 @@ type APIServer struct {
 //  srv := NewAPIServer(h, b)
 //  http.ListenAndServe(srv)
 //
-func NewAPIServer(h hello.Helloer, b backend.GreetingBackend) *APIServer {
+func NewAPIServer(h hello.Helloer, b backend.GreetingBackend, opts ...ServerOption) *APIServer {
 	srv := &APIServer{
-		h: h,
-		b: b,
+		h:      h,
+		b:      b,
+		closeC: make(chan bool),
+	}
+	for _, o := range opts {
+		o(srv)
 	}
+	if srv.registry == nil {
+		srv.registry = metrics.NewRegistry()
+	}
+	srv.metrics = newServerMetrics(srv.registry)
 	srv.Router = *httprouter.New()
+	srv.NotFound = srv.notFound
 
 	// Greetings CRUD
-	srv.POST("/v1/greetings", srv.upsertGreeting)
-	srv.GET("/v1/greetings/:prompt", srv.getGreeting)
-	srv.DELETE("/v1/greetings/:prompt", srv.deleteGreeting)
+	srv.handle("POST", "/v1/greetings", auth.Editor, srv.upsertGreeting)
+	srv.handle("GET", "/v1/greetings", auth.Reader, srv.getGreetings)
+	srv.handle("GET", "/v1/greetings/:prompt", auth.Reader, srv.getGreeting)
+	srv.handle("DELETE", "/v1/greetings/:prompt", auth.Admin, srv.deleteGreeting)
+
+	// History of greeting changes, see backend.HistoryBackend
+	srv.handle("GET", "/v1/greetings/:prompt/history", auth.Reader, srv.getHistory)
+	srv.handle("POST", "/v1/greetings/:prompt/rollback", auth.Editor, srv.rollbackGreeting)
 
 	// Say hello
-	srv.POST("/v1/hello", srv.hello)
+	srv.handle("POST", "/v1/hello", auth.Reader, srv.hello)
+
+	// Audit log of greeting changes
+	srv.handle("GET", "/v1/audit", auth.Admin, srv.getAuditEvents)
+
+	// Health checks, version and metrics are not versioned, so load balancers,
+	// monitoring and clients of any version can use them, they don't
+	// require authentication, as probes and scrapers rarely have credentials
+	srv.handle("GET", "/healthz", public, srv.healthz)
+	srv.handle("GET", "/readyz", public, srv.readyz)
+	srv.handle("GET", "/version", public, srv.version)
+	srv.handle("GET", "/metrics", public, srv.serveMetrics)
 
 	return srv
 }
 
+// Close ends watch streams, so they don't hold off the graceful shutdown.
+// It does not close the Helloer and the backend, that are owned by the caller.
+//
+//  srv := &http.Server{Handler: apiSrv}
+//  srv.RegisterOnShutdown(apiSrv.Close)
+//
+func (s *APIServer) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closeC)
+	})
+}
+
 // note that these functions are not exported, so godoc is not mentioning them, as they are really
 // implementation detail that is not visible to users
+
+// upsertGreeting writes the greeting record, 'template=true' marks the value
+// as a template, optional 'locale', 'description' and repeated 'tags' parameters
+// set the greeting metadata
 func (s *APIServer) upsertGreeting(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	var prompt, value string
+	var prompt, value, tmpl, locale, description string
+	var ttl time.Duration
 	err := form.Parse(r,
 		form.String("prompt", &prompt, form.Required()),
-		form.String("value", &value, form.Required()))
+		form.String("value", &value, form.Required()),
+		form.String("template", &tmpl),
+		form.String("locale", &locale),
+		form.String("description", &description),
+		form.Duration("ttl", &ttl))
 	if err != nil {
 		replyErr(w, err)
 		return
 	}
-	if err := s.b.UpsertGreeting(prompt, value); err != nil {
+	if ttl < 0 {
+		replyErr(w, &form.BadParameterError{Param: "ttl", Message: "expected positive duration"})
+		return
+	}
+	isTemplate := false
+	if tmpl != "" {
+		if isTemplate, err = strconv.ParseBool(tmpl); err != nil {
+			replyErr(w, &form.BadParameterError{Param: "template", Message: "expected true or false"})
+			return
+		}
+	}
+	opts, err := writeOptions(r)
+	if err != nil {
 		replyErr(w, err)
 		return
 	}
-	reply(w, http.StatusOK, greetingResponse{Greeting: greeting{Prompt: prompt, Value: value}})
+	if isTemplate {
+		if err := hello.CheckTemplate(value); err != nil {
+			replyErr(w, err)
+			return
+		}
+		opts = append(opts, backend.Template())
+	}
+	if ttl != 0 {
+		opts = append(opts, backend.TTL(ttl))
+	}
+	var written uint64
+	opts = append(opts, backend.Locale(locale), backend.Description(description), backend.Tags(r.PostForm["tags"]...),
+		backend.ReturnRevision(&written))
+	old := s.currentValue(prompt)
+	if err := s.b.UpsertGreeting(prompt, value, opts...); err != nil {
+		replyErr(w, err)
+		return
+	}
+	s.emit(r, audit.ActionUpsert, prompt, old, value)
+	replyWritten(w, greeting{Prompt: prompt, Value: value, Template: isTemplate, Revision: written})
+}
+
+// replyWritten replies with the written greeting and it's revision in ETag header,
+// so clients can make the next conditional write without reading it again
+func replyWritten(w http.ResponseWriter, g greeting) {
+	if g.Revision != 0 {
+		w.Header().Set("ETag", etag(g.Revision))
+	}
+	reply(w, http.StatusOK, greetingResponse{Greeting: g})
 }
 
 func (s *APIServer) getGreeting(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	prompt := p[0].Value
-	val, err := s.b.GetGreeting(prompt)
+	g, err := s.b.GetGreeting(p[0].Value)
+	if err != nil {
+		replyErr(w, err)
+		return
+	}
+	w.Header().Set("ETag", etag(g.Revision))
+	reply(w, http.StatusOK, &greetingResponse{Greeting: toGreeting(*g)})
+}
+
+// getGreetings lists the greetings, or streams their changes with 'watch=true',
+// see watchGreetings. The stream is a parameter of the collection, so it does
+// not take a greeting id out of use.
+func (s *APIServer) getGreetings(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	q := r.URL.Query()
+	watch, err := isWatch(r)
+	if err != nil {
+		replyErr(w, err)
+		return
+	}
+	if watch {
+		s.watchGreetings(w, r, p)
+		return
+	}
+	limit := 0
+	if v := q.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			replyErr(w, &form.BadParameterError{Param: "limit", Message: "expected non-negative integer"})
+			return
+		}
+	}
+	gs, next, err := s.b.GetGreetings(q.Get("prefix"), q.Get("cursor"), limit)
 	if err != nil {
 		replyErr(w, err)
 		return
 	}
-	reply(w, http.StatusOK, &greetingResponse{Greeting: greeting{Prompt: prompt, Value: val}})
+	out := make([]greeting, len(gs))
+	for i, g := range gs {
+		out[i] = toGreeting(g)
+	}
+	reply(w, http.StatusOK, &greetingsResponse{Greetings: out, NextCursor: next})
+}
+
+// isWatch returns true if the greetings request has 'watch=true' parameter
+func isWatch(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("watch")
+	if v == "" {
+		return false, nil
+	}
+	watch, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, &form.BadParameterError{Param: "watch", Message: "expected true or false"}
+	}
+	return watch, nil
+}
+
+// watchGreetings streams greeting changes as a chunked sequence
+// of JSON encoded greetingEvent objects separated by new lines,
+// until the client goes away or the backend stops the watch
+func (s *APIServer) watchGreetings(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		replyErr(w, fmt.Errorf("streaming is not supported"))
+		return
+	}
+	stopC := make(chan bool)
+	defer close(stopC)
+	events, err := s.b.WatchGreetings(stopC)
+	if err != nil {
+		replyErr(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			err := enc.Encode(&greetingEvent{
+				Type: string(e.Type), Prompt: e.ID, Value: e.Value, Revision: e.Revision})
+			if err != nil {
+				return
+			}
+			f.Flush()
+		case <-r.Context().Done():
+			return
+		case <-s.closeC:
+			return
+		}
+	}
 }
 
 func (s *APIServer) deleteGreeting(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	prompt := p[0].Value
-	if err := s.b.DeleteGreeting(prompt); err != nil {
+	opts, err := writeOptions(r)
+	if err != nil {
 		replyErr(w, err)
 		return
 	}
+	old := s.currentValue(prompt)
+	if err := s.b.DeleteGreeting(prompt, opts...); err != nil {
+		replyErr(w, err)
+		return
+	}
+	s.emit(r, audit.ActionDelete, prompt, old, "")
 
 	reply(w, http.StatusOK, message(fmt.Sprintf("greeting '%v' deleted", prompt)))
 }
 
+// hello greets the name, the greeting is resolved for the locale passed
+// in the optional 'locale' form parameter, or for the locales listed in
+// the Accept-Language header. Form parameters 'fields.<key>' are passed
+// to greeting templates as fields.
 func (s *APIServer) hello(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	var prompt, name string
+	var prompt, name, locale string
 
 	err := form.Parse(r,
 		form.String("prompt", &prompt, form.Required()),
-		form.String("name", &name, form.Required()))
+		form.String("name", &name, form.Required()),
+		form.String("locale", &locale))
 
 	if err != nil {
 		replyErr(w, err)
 		return
 	}
-	hello, err := s.h.Hello(prompt, name)
+	locales := hello.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	if locale != "" {
+		locales = append([]string{locale}, locales...)
+	}
+	re, err := s.h.Greet(r.Context(), hello.Request{
+		Prompt: prompt, Name: name, Locales: locales, Fields: fields(r.PostForm)})
 	if err != nil {
 		replyErr(w, err)
 		return
 	}
 
-	reply(w, http.StatusOK, &helloResponse{Value: hello})
+	s.metrics.greetings.Inc(re.GreetingID)
+	reply(w, http.StatusOK, &helloResponse{Value: re.Value, Greeting: re.GreetingID, Locale: re.Locale})
+}
+
+// healthz reports that the server is alive, it does not check the backend,
+// so a backend outage does not get the server restarted
+func (s *APIServer) healthz(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	reply(w, http.StatusOK, message("ok"))
+}
+
+// readyz reports whether the server can serve requests,
+// i.e. that the backend is reachable
+func (s *APIServer) readyz(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if err := s.b.Ping(); err != nil {
+		if _, ok := err.(*backend.UnavailableError); !ok {
+			err = &backend.UnavailableError{Message: err.Error()}
+		}
+		replyErr(w, err)
+		return
+	}
+	reply(w, http.StatusOK, message("ok"))
+}
+
+func (s *APIServer) serveMetrics(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	s.registry.ServeHTTP(w, r)
+}
+
+func (s *APIServer) version(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	reply(w, http.StatusOK, version.Get())
+}
+
+// fieldPrefix is a prefix of form parameters passed to greeting templates as fields
+const fieldPrefix = "fields."
+
+// fields returns template fields from the form parameters 'fields.<key>'
+func fields(vals url.Values) map[string]string {
+	out := map[string]string{}
+	for k, v := range vals {
+		if strings.HasPrefix(k, fieldPrefix) && len(v) != 0 {
+			out[strings.TrimPrefix(k, fieldPrefix)] = v[0]
+		}
+	}
+	return out
 }
 
 type greetingResponse struct {
 	Greeting greeting `json:"greeting"`
 }
 
+type greetingsResponse struct {
+	Greetings  []greeting `json:"greetings"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
 type greeting struct {
-	Prompt string `json:"prompt"`
-	Value  string `json:"value"`
+	Prompt      string   `json:"prompt"`
+	Value       string   `json:"value"`
+	Template    bool     `json:"template,omitempty"`
+	Locale      string   `json:"locale,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	// Created and Updated are omitted for greetings stored by older versions
+	Created  *time.Time `json:"created,omitempty"`
+	Updated  *time.Time `json:"updated,omitempty"`
+	Author   string     `json:"author,omitempty"`
+	Revision uint64     `json:"revision,omitempty"`
+	// TTL is the time left before greeting expires, e.g. "1h59m30s"
+	TTL string `json:"ttl,omitempty"`
+}
+
+func toGreeting(g backend.Greeting) greeting {
+	out := greeting{
+		Prompt:      g.ID,
+		Value:       g.Value,
+		Template:    g.Template,
+		Locale:      g.Locale,
+		Description: g.Description,
+		Tags:        g.Tags,
+		Author:      g.Author,
+		Revision:    g.Revision,
+	}
+	if !g.Created.IsZero() {
+		out.Created = &g.Created
+	}
+	if !g.Updated.IsZero() {
+		out.Updated = &g.Updated
+	}
+	if g.TTL != 0 {
+		out.TTL = g.TTL.String()
+	}
+	return out
+}
+
+func fromGreeting(g greeting) (*backend.Greeting, error) {
+	out := &backend.Greeting{
+		ID:          g.Prompt,
+		Value:       g.Value,
+		Template:    g.Template,
+		Locale:      g.Locale,
+		Description: g.Description,
+		Tags:        g.Tags,
+		Author:      g.Author,
+		Revision:    g.Revision,
+	}
+	if g.Created != nil {
+		out.Created = *g.Created
+	}
+	if g.Updated != nil {
+		out.Updated = *g.Updated
+	}
+	if g.TTL != "" {
+		ttl, err := time.ParseDuration(g.TTL)
+		if err != nil {
+			return nil, err
+		}
+		out.TTL = ttl
+	}
+	return out, nil
+}
+
+type greetingEvent struct {
+	Type     string `json:"type"`
+	Prompt   string `json:"prompt"`
+	Value    string `json:"value,omitempty"`
+	Revision uint64 `json:"revision"`
 }
 
 type helloResponse struct {
 	Value string `json:"val"`
+	// Greeting is the id of the greeting used, e.g. 'hello.es'
+	Greeting string `json:"greeting,omitempty"`
+	// Locale is the locale of the greeting used, e.g. 'es'
+	Locale string `json:"locale,omitempty"`
+}
+
+// writeOptions converts conditional request headers to backend write options:
+// "If-None-Match: *" allows only to create a greeting and "If-Match: <etag>"
+// allows to change the greeting only if it's revision matches the ETag.
+// Parameter 'history=false' skips recording the change in the greeting history.
+// The authenticated caller is recorded as the author of the change, see withAuthor.
+func writeOptions(r *http.Request) ([]backend.WriteOption, error) {
+	opts := []backend.WriteOption{}
+	if r.Header.Get("If-None-Match") == "*" {
+		opts = append(opts, backend.Create())
+	}
+	if v := r.Header.Get("If-Match"); v != "" {
+		rev, err := parseETag(v)
+		if err != nil {
+			return nil, &form.BadParameterError{Param: "If-Match", Message: "expected greeting revision ETag"}
+		}
+		opts = append(opts, backend.IfRevision(rev))
+	}
+	if v := r.FormValue("history"); v != "" {
+		history, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, &form.BadParameterError{Param: "history", Message: "expected true or false"}
+		}
+		if !history {
+			opts = append(opts, backend.NoHistory())
+		}
+	}
+	return withAuthor(r, opts), nil
+}
+
+// withAuthor adds the name of the authenticated caller to the write options,
+// so it is recorded in the greeting history. Servers that don't authenticate
+// clients record the name passed in 'author' parameter instead.
+func withAuthor(r *http.Request, opts []backend.WriteOption) []backend.WriteOption {
+	if id := auth.GetIdentity(r.Context()); id != nil {
+		return append(opts, backend.Author(id.Name))
+	}
+	if name := r.FormValue("author"); name != "" {
+		opts = append(opts, backend.Author(name))
+	}
+	return opts
+}
+
+// etag returns ETag header value for the greeting revision
+func etag(rev uint64) string {
+	return fmt.Sprintf(`"%v"`, rev)
+}
+
+func parseETag(v string) (uint64, error) {
+	return strconv.ParseUint(strings.Trim(v, `"`), 10, 64)
 }
 
 func message(msg string) map[string]interface{} {
 	return map[string]interface{}{"message": msg}
 }
 
+// replyErr replies with the error envelope, see errorResponse
 func replyErr(w http.ResponseWriter, e error) {
+	code, re := toErrorResponse(e)
+	// backend calls take no context, so their failures are logged here
+	// to tie them to the request
+	switch code {
+	case http.StatusInternalServerError:
+		log.Errorf("internal error: %v request_id=%v", e, w.Header().Get(requestid.Header))
+	case http.StatusServiceUnavailable:
+		log.Warningf("%v request_id=%v", e, w.Header().Get(requestid.Header))
+	}
 	switch err := e.(type) {
-	case *backend.NotFoundError:
-		reply(w, http.StatusNotFound, message(err.Error()))
-	default:
-		reply(w, http.StatusBadRequest, message(err.Error()))
+	case *auth.UnauthenticatedError:
+		w.Header().Set("WWW-Authenticate", `Bearer realm="hello"`)
+	case *ratelimit.LimitExceededError:
+		w.Header().Set("Retry-After", retryAfter(err.RetryAfter))
 	}
+	reply(w, code, re)
 }
 
 func reply(w http.ResponseWriter, code int, message interface{}) {
@@ -1,12 +1,24 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gravitational/hello"
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/gravitational/form"
 	"github.com/gravitational/hello/backend"
 	"github.com/gravitational/hello/backend/membk"
+	"github.com/gravitational/hello/metrics"
+	"github.com/gravitational/hello/requestid"
+	"github.com/gravitational/hello/version"
 
 	. "github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/check.v1"
 )
@@ -25,9 +37,11 @@ func (s *APISuite) SetUpSuite(c *C) {
 }
 
 func (s *APISuite) SetUpTest(c *C) {
-	s.bk = membk.New()
+	var err error
+	s.bk, err = membk.New()
+	c.Assert(err, IsNil)
 
-	h := hello.New(s.bk)
+	h := hello.New(s.bk, hello.DefaultLocale("en"))
 	s.srv = httptest.NewServer(
 		NewAPIServer(h, s.bk))
 	clt, err := NewClient(s.srv.URL)
@@ -43,24 +57,24 @@ func (s *APISuite) TearDownTest(c *C) {
 func (s *APISuite) TestGreetingsCRUD(c *C) {
 	// Create
 	c.Assert(s.clt.UpsertGreeting("hello.us", "Hello"), IsNil)
-	c.Assert(s.bk.Greetings["hello.us"], Equals, "Hello")
+	c.Assert(s.bk.Greetings()["hello.us"], Equals, "Hello")
 
 	// Read
 	g, err := s.clt.GetGreeting("hello.us")
 	c.Assert(err, IsNil)
-	c.Assert(g, Equals, "Hello")
+	c.Assert(g.Value, Equals, "Hello")
 
 	// Update
 	c.Assert(s.clt.UpsertGreeting("hello.us", "Howdy"), IsNil)
-	c.Assert(s.bk.Greetings["hello.us"], Equals, "Howdy")
+	c.Assert(s.bk.Greetings()["hello.us"], Equals, "Howdy")
 
 	g, err = s.clt.GetGreeting("hello.us")
 	c.Assert(err, IsNil)
-	c.Assert(g, Equals, "Howdy")
+	c.Assert(g.Value, Equals, "Howdy")
 
 	// Delete
 	c.Assert(s.clt.DeleteGreeting("hello.us"), IsNil)
-	_, ok := s.bk.Greetings["hello.us"]
+	_, ok := s.bk.Greetings()["hello.us"]
 	c.Assert(ok, Equals, false)
 
 	// Make sure it's not found
@@ -68,6 +82,207 @@ func (s *APISuite) TestGreetingsCRUD(c *C) {
 	c.Assert(err, FitsTypeOf, &backend.NotFoundError{})
 }
 
+func (s *APISuite) TestGreetingMetadata(c *C) {
+	c.Assert(s.clt.UpsertGreeting("hello.us", "Hello",
+		backend.Locale("en-US"), backend.Description("landing page"), backend.Tags("web", "default")), IsNil)
+	stored, err := s.bk.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(stored.Locale, Equals, "en-US")
+	c.Assert(stored.Description, Equals, "landing page")
+	c.Assert(stored.Tags, DeepEquals, []string{"web", "default"})
+
+	g, err := s.clt.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(g, DeepEquals, stored)
+
+	re, err := http.Get(s.srv.URL + "/v1/greetings/hello.us")
+	c.Assert(err, IsNil)
+	defer re.Body.Close()
+	var out map[string]map[string]interface{}
+	c.Assert(json.NewDecoder(re.Body).Decode(&out), IsNil)
+	c.Assert(out["greeting"]["locale"], Equals, "en-US")
+	c.Assert(out["greeting"]["tags"], DeepEquals, []interface{}{"web", "default"})
+	c.Assert(out["greeting"]["created"], Equals, stored.Created.Format(time.RFC3339Nano))
+
+	// greetings stored by older versions have no timestamps
+	c.Assert(toGreeting(backend.Greeting{ID: "hello.us", Value: "Hello"}).Created, IsNil)
+}
+
+func (s *APISuite) TestConditionalWrites(c *C) {
+	c.Assert(s.clt.UpsertGreeting("hello.us", "Hello", backend.Create()), IsNil)
+	err := s.clt.UpsertGreeting("hello.us", "Hello", backend.Create())
+	c.Assert(err, FitsTypeOf, &backend.ConflictError{})
+
+	g, err := s.clt.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+
+	c.Assert(s.clt.UpsertGreeting("hello.us", "Howdy", backend.IfRevision(g.Revision)), IsNil)
+	err = s.clt.UpsertGreeting("hello.us", "Hi", backend.IfRevision(g.Revision))
+	c.Assert(err, FitsTypeOf, &backend.ConflictError{})
+	err = s.clt.DeleteGreeting("hello.us", backend.IfRevision(g.Revision))
+	c.Assert(err, FitsTypeOf, &backend.ConflictError{})
+
+	g, err = s.clt.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(g.Value, Equals, "Howdy")
+	c.Assert(s.clt.DeleteGreeting("hello.us", backend.IfRevision(g.Revision)), IsNil)
+
+	// the upsert reply carries the new revision in ETag header and the body
+	re, err := http.PostForm(s.srv.URL+"/v1/greetings", url.Values{"prompt": {"hello.us"}, "value": {"Hi"}})
+	c.Assert(err, IsNil)
+	defer re.Body.Close()
+	var out greetingResponse
+	c.Assert(json.NewDecoder(re.Body).Decode(&out), IsNil)
+	g, err = s.clt.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(out.Greeting.Revision, Equals, g.Revision)
+	c.Assert(re.Header.Get("ETag"), Equals, etag(g.Revision))
+}
+
+func (s *APISuite) TestGreetingTTL(c *C) {
+	c.Assert(s.clt.UpsertGreeting("hello.xmas", "Merry Christmas", backend.TTL(time.Hour)), IsNil)
+	g, err := s.clt.GetGreeting("hello.xmas")
+	c.Assert(err, IsNil)
+	c.Assert(g.TTL > 0 && g.TTL <= time.Hour, Equals, true)
+
+	gs, _, err := s.clt.GetGreetings("hello.xmas", "", 0)
+	c.Assert(err, IsNil)
+	c.Assert(gs[0].TTL > 0, Equals, true)
+
+	re, err := http.PostForm(s.srv.URL+"/v1/greetings",
+		url.Values{"prompt": []string{"hello.us"}, "value": []string{"Hello"}, "ttl": []string{"soon"}})
+	c.Assert(err, IsNil)
+	re.Body.Close()
+	c.Assert(re.StatusCode, Equals, http.StatusBadRequest)
+}
+
+func (s *APISuite) TestETag(c *C) {
+	c.Assert(s.clt.UpsertGreeting("hello.us", "Hello"), IsNil)
+	re, err := http.Get(s.srv.URL + "/v1/greetings/hello.us")
+	c.Assert(err, IsNil)
+	re.Body.Close()
+	c.Assert(re.Header.Get("ETag"), Equals, `"1"`)
+
+	// malformed If-Match is rejected
+	req, err := http.NewRequest("DELETE", s.srv.URL+"/v1/greetings/hello.us", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("If-Match", "yesterday")
+	re, err = http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	re.Body.Close()
+	c.Assert(re.StatusCode, Equals, http.StatusBadRequest)
+}
+
+func (s *APISuite) TestGreetingsList(c *C) {
+	c.Assert(s.clt.UpsertGreeting("hello.us", "Hello"), IsNil)
+	c.Assert(s.clt.UpsertGreeting("hello.sp", "Hola"), IsNil)
+	c.Assert(s.clt.UpsertGreeting("bye.us", "Bye"), IsNil)
+
+	sp, err := s.bk.GetGreeting("hello.sp")
+	c.Assert(err, IsNil)
+	us, err := s.bk.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+
+	gs, next, err := s.clt.GetGreetings("hello.", "", 1)
+	c.Assert(err, IsNil)
+	c.Assert(gs, DeepEquals, []backend.Greeting{*sp})
+	c.Assert(gs[0].Revision, Equals, uint64(2))
+	c.Assert(next, Equals, "hello.sp")
+
+	gs, next, err = s.clt.GetGreetings("hello.", next, 1)
+	c.Assert(err, IsNil)
+	c.Assert(gs, DeepEquals, []backend.Greeting{*us})
+	c.Assert(next, Equals, "")
+
+	gs, next, err = s.clt.GetGreetings("", "", 0)
+	c.Assert(err, IsNil)
+	c.Assert(len(gs), Equals, 3)
+	c.Assert(next, Equals, "")
+}
+
+func (s *APISuite) TestGreetingsWatch(c *C) {
+	stopC := make(chan bool)
+	events, err := s.clt.WatchGreetings(stopC)
+	c.Assert(err, IsNil)
+
+	// the stream is a parameter of the collection, so greeting ids don't collide with it
+	c.Assert(s.clt.UpsertGreeting("watch", "Hey"), IsNil)
+	g, err := s.clt.GetGreeting("watch")
+	c.Assert(err, IsNil)
+	c.Assert(g.Value, Equals, "Hey")
+	e := s.expectEvent(c, events)
+	c.Assert(e.ID, Equals, "watch")
+
+	c.Assert(s.clt.UpsertGreeting("hello.us", "Hello"), IsNil)
+	c.Assert(s.clt.DeleteGreeting("hello.us"), IsNil)
+
+	e = s.expectEvent(c, events)
+	c.Assert(e.Type, Equals, backend.EventUpsert)
+	c.Assert(e.ID, Equals, "hello.us")
+	c.Assert(e.Value, Equals, "Hello")
+
+	e = s.expectEvent(c, events)
+	c.Assert(e.Type, Equals, backend.EventDelete)
+	c.Assert(e.ID, Equals, "hello.us")
+
+	// closing the stop channel ends the stream and releases the server watcher
+	close(stopC)
+	for range events {
+	}
+	for i := 0; i < 100 && s.bk.Watchers() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(s.bk.Watchers(), Equals, 0)
+
+	re, err := http.Get(s.srv.URL + "/v1/greetings?watch=maybe")
+	c.Assert(err, IsNil)
+	re.Body.Close()
+	c.Assert(re.StatusCode, Equals, http.StatusBadRequest)
+
+	c.Assert(routeLabel("/v1/greetings", &http.Request{Method: "GET", URL: &url.URL{RawQuery: "watch=true"}}), Equals, "/v1/greetings?watch=true")
+	c.Assert(routeLabel("/v1/greetings", &http.Request{Method: "GET", URL: &url.URL{RawQuery: "limit=1"}}), Equals, "/v1/greetings")
+}
+
+func (s *APISuite) TestGracefulShutdown(c *C) {
+	s.srv.Close()
+	apiSrv := NewAPIServer(hello.New(s.bk), s.bk)
+	s.srv = httptest.NewUnstartedServer(apiSrv)
+	s.srv.Config.RegisterOnShutdown(apiSrv.Close)
+	s.srv.Start()
+	clt, err := NewClient(s.srv.URL)
+	c.Assert(err, IsNil)
+
+	events, err := clt.WatchGreetings(make(chan bool))
+	c.Assert(err, IsNil)
+	c.Assert(clt.UpsertGreeting("hello.us", "Hello"), IsNil)
+	s.expectEvent(c, events)
+
+	// shutdown ends watch streams instead of waiting for them until the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.Assert(s.srv.Config.Shutdown(ctx), IsNil)
+	for range events {
+	}
+	for i := 0; i < 100 && s.bk.Watchers() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(s.bk.Watchers(), Equals, 0)
+
+	_, err = clt.GetGreeting("hello.us")
+	c.Assert(err, NotNil)
+}
+
+func (s *APISuite) expectEvent(c *C, events <-chan backend.GreetingEvent) backend.GreetingEvent {
+	select {
+	case e, ok := <-events:
+		c.Assert(ok, Equals, true)
+		return e
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timeout waiting for event")
+	}
+	return backend.GreetingEvent{}
+}
+
 func (s *APISuite) TestHello(c *C) {
 	c.Assert(s.clt.UpsertGreeting("hello.us", "Hello"), IsNil)
 	c.Assert(s.clt.UpsertGreeting("hello.sp", "Hola"), IsNil)
@@ -80,3 +295,289 @@ func (s *APISuite) TestHello(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(hello, Equals, "Hola, John!")
 }
+
+func (s *APISuite) TestGreetingTemplates(c *C) {
+	c.Assert(s.clt.UpsertGreeting("hello.jp", "{{.Name}}さん、こんにちは", backend.Template()), IsNil)
+	c.Assert(s.clt.UpsertGreeting("hello.formal", "{{.Fields.title}} {{.Name}}, welcome", backend.Template()), IsNil)
+	c.Assert(s.clt.UpsertGreeting("hello.braces", "{{.Name"), IsNil)
+
+	out, err := s.clt.Hello("hello.jp", "John")
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, "Johnさん、こんにちは")
+
+	re, err := s.clt.Greet(context.Background(), hello.Request{Prompt: "hello.formal", Name: "John", Fields: map[string]string{"title": "Sir"}})
+	c.Assert(err, IsNil)
+	c.Assert(re.Value, Equals, "Sir John, welcome")
+	g, err := s.clt.GetGreeting("hello.jp")
+	c.Assert(err, IsNil)
+	c.Assert(g.Template, Equals, true)
+
+	// values that are not marked as templates are plain
+	out, err = s.clt.Hello("hello.braces", "John")
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, "{{.Name, John!")
+
+	// broken templates are rejected at upsert time
+	err = s.clt.UpsertGreeting("hello.broken", "{{.Name", backend.Template())
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Matches, ".*invalid greeting template.*")
+	err = s.clt.UpsertGreeting("hello.broken", "{{.Surname}}", backend.Template())
+	c.Assert(err, NotNil)
+	_, ok := s.bk.Greetings()["hello.broken"]
+	c.Assert(ok, Equals, false)
+}
+
+func (s *APISuite) TestGreetLocales(c *C) {
+	c.Assert(s.clt.UpsertGreeting("hello.en", "Hello"), IsNil)
+	c.Assert(s.clt.UpsertGreeting("hello.es", "Hola"), IsNil)
+
+	re, err := s.clt.Greet(context.Background(), hello.Request{Prompt: "hello", Name: "John", Locales: []string{"fr", "es-MX"}})
+	c.Assert(err, IsNil)
+	c.Assert(*re, DeepEquals, hello.Response{Value: "Hola, John!", GreetingID: "hello.es", Locale: "es"})
+
+	re, err = s.clt.Greet(context.Background(), hello.Request{Prompt: "hello", Name: "John", Locales: []string{"fr"}})
+	c.Assert(err, IsNil)
+	c.Assert(*re, DeepEquals, hello.Response{Value: "Hello, John!", GreetingID: "hello.en", Locale: "en"})
+
+	// locale form parameter takes precedence over Accept-Language header
+	req, err := http.NewRequest("POST", s.srv.URL+"/v1/hello",
+		strings.NewReader(url.Values{"prompt": {"hello"}, "name": {"John"}, "locale": {"es"}}.Encode()))
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
+	body, err := convert(s.clt.RoundTrip(func() (*http.Response, error) { return http.DefaultClient.Do(req) }))
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Matches, `.*"val":"Hola, John!".*"locale":"es".*`)
+
+	_, err = s.clt.Greet(context.Background(), hello.Request{Prompt: "bye", Name: "John", Locales: []string{"es"}})
+	c.Assert(err, FitsTypeOf, &backend.NotFoundError{})
+}
+
+func (s *APISuite) TestErrors(c *C) {
+	c.Assert(s.clt.UpsertGreeting("hello.us", "Hello"), IsNil)
+
+	// client restores errors with the same types and fields the library returns
+	_, err := s.clt.GetGreeting("hello.missing")
+	c.Assert(err, DeepEquals, &backend.NotFoundError{ID: "hello.missing"})
+
+	err = s.clt.UpsertGreeting("hello.us", "Hello", backend.Create())
+	c.Assert(err, FitsTypeOf, &backend.ConflictError{})
+	c.Assert(err.(*backend.ConflictError).ID, Equals, "hello.us")
+
+	_, err = s.clt.Hello("hello.us", "")
+	c.Assert(err, FitsTypeOf, &form.MissingParameterError{})
+
+	_, _, err = s.clt.GetGreetings("", "", -1)
+	c.Assert(err, DeepEquals, &form.BadParameterError{Param: "limit", Message: "expected non-negative integer"})
+
+	err = s.clt.UpsertGreeting("hello.broken", "{{.Name", backend.Template())
+	c.Assert(err, FitsTypeOf, &hello.TemplateError{})
+	c.Assert(err.(*hello.TemplateError).Value, Equals, "{{.Name")
+	c.Assert(err.Error(), Equals, hello.CheckTemplate("{{.Name").Error())
+
+	// backend failures are reported as 503 and 500
+	s.srv.Close()
+	bk := &faultyBackend{MemBackend: s.bk}
+	s.srv = httptest.NewServer(NewAPIServer(hello.New(bk), bk))
+	s.clt, err = NewClient(s.srv.URL)
+	c.Assert(err, IsNil)
+
+	bk.err = &backend.UnavailableError{Message: "all peers are unreachable"}
+	_, err = s.clt.GetGreeting("hello.us")
+	c.Assert(err, DeepEquals, bk.err)
+	_, err = s.clt.Hello("hello.us", "John")
+	c.Assert(err, DeepEquals, bk.err)
+
+	// internal errors are logged, clients get the request id
+	// to find them in the server logs
+	bk.err = errors.New("open /var/lib/hello/greetings.log: disk is on fire")
+	_, err = s.clt.GetGreeting("hello.us")
+	c.Assert(err, FitsTypeOf, &ServerError{})
+	serr := err.(*ServerError)
+	c.Assert(serr.Message, Equals, internalMessage)
+	c.Assert(serr.Code, Equals, codeInternal)
+	c.Assert(requestid.Valid(serr.RequestID), Equals, true)
+	c.Assert(err.Error(), Equals, internalMessage+", request id: "+serr.RequestID)
+
+	// replies carry the error envelope
+	re, err := http.Get(s.srv.URL + "/v1/greetings/hello.us")
+	c.Assert(err, IsNil)
+	defer re.Body.Close()
+	c.Assert(re.StatusCode, Equals, http.StatusInternalServerError)
+	var out *errorResponse
+	c.Assert(json.NewDecoder(re.Body).Decode(&out), IsNil)
+	c.Assert(out.Error, DeepEquals, errorBody{Code: codeInternal, Message: internalMessage})
+}
+
+func (s *APISuite) TestErrorStatuses(c *C) {
+	tcs := []struct {
+		err    error
+		status int
+	}{
+		{err: &backend.NotFoundError{ID: "a"}, status: http.StatusNotFound},
+		{err: &backend.ConflictError{ID: "a", Message: "exists"}, status: http.StatusConflict},
+		{err: &hello.EmptyParamError{}, status: http.StatusBadRequest},
+		{err: &form.MissingParameterError{Param: "name"}, status: http.StatusBadRequest},
+		{err: &form.BadParameterError{Param: "ttl", Message: "bad"}, status: http.StatusBadRequest},
+		{err: &backend.UnavailableError{Message: "down"}, status: http.StatusServiceUnavailable},
+		{err: &backend.NotSupportedError{Message: "no history"}, status: http.StatusNotImplemented},
+	}
+	for i, tc := range tcs {
+		comment := Commentf("test #%d err=%v", i+1, tc.err)
+		status, re := toErrorResponse(tc.err)
+		c.Assert(status, Equals, tc.status, comment)
+		data, err := json.Marshal(re)
+		c.Assert(err, IsNil, comment)
+		c.Assert(fromErrorResponse(status, requestIDHeader("42"), data), DeepEquals, tc.err, comment)
+	}
+
+	// unknown errors are internal
+	status, re := toErrorResponse(errors.New("oops"))
+	c.Assert(status, Equals, http.StatusInternalServerError)
+	data, err := json.Marshal(re)
+	c.Assert(err, IsNil)
+	c.Assert(fromErrorResponse(status, requestIDHeader("42"), data), DeepEquals,
+		&ServerError{Status: http.StatusInternalServerError, Code: codeInternal, Message: internalMessage, RequestID: "42"})
+
+	// replies without envelope are converted by status code
+	c.Assert(fromErrorResponse(http.StatusBadGateway, http.Header{}, []byte("bad gateway")),
+		DeepEquals, &backend.UnavailableError{Message: "bad gateway"})
+	c.Assert(fromErrorResponse(http.StatusTeapot, requestIDHeader("42"), []byte("teapot")), DeepEquals,
+		&ServerError{Status: http.StatusTeapot, Message: "teapot", RequestID: "42"})
+	// a proxy's 403 page names no client and role
+	c.Assert(fromErrorResponse(http.StatusForbidden, requestIDHeader("42"), []byte("<html>forbidden</html>")), DeepEquals,
+		&ServerError{Status: http.StatusForbidden, Message: "<html>forbidden</html>", RequestID: "42"})
+}
+
+func (s *APISuite) TestErrorRequestID(c *C) {
+	status, re := toErrorResponse(&backend.NotFoundError{ID: "hello.us"})
+	data, err := json.Marshal(re)
+	c.Assert(err, IsNil)
+	err = fromErrorResponse(status, requestIDHeader("42"), data)
+	c.Assert(err, DeepEquals, &backend.NotFoundError{ID: "hello.us"})
+	c.Assert(RequestID(err), Equals, "42")
+
+	err = fromErrorResponse(http.StatusServiceUnavailable, requestIDHeader("43"), []byte("down"))
+	c.Assert(err, DeepEquals, &backend.UnavailableError{Message: "down"})
+	c.Assert(RequestID(err), Equals, "43")
+
+	// errors of other requests and other errors have no request id
+	c.Assert(RequestID(&backend.NotFoundError{ID: "hello.us"}), Equals, "")
+	c.Assert(RequestID(fromErrorResponse(http.StatusNotFound, http.Header{}, []byte("missing"))), Equals, "")
+	c.Assert(RequestID(errors.New("oops")), Equals, "")
+
+	// the client errors carry the id the server logged
+	_, err = s.clt.GetGreeting("hello.missing")
+	c.Assert(err, FitsTypeOf, &backend.NotFoundError{})
+	c.Assert(requestid.Valid(RequestID(err)), Equals, true)
+}
+
+func (s *APISuite) TestHealth(c *C) {
+	get := func(path string) (int, []byte) {
+		re, err := http.Get(s.srv.URL + path)
+		c.Assert(err, IsNil)
+		defer re.Body.Close()
+		data, err := ioutil.ReadAll(re.Body)
+		c.Assert(err, IsNil)
+		return re.StatusCode, data
+	}
+	code, _ := get("/healthz")
+	c.Assert(code, Equals, http.StatusOK)
+	code, _ = get("/readyz")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(s.clt.Ping(), IsNil)
+
+	v, err := s.clt.Version()
+	c.Assert(err, IsNil)
+	c.Assert(*v, DeepEquals, version.Get())
+
+	// server is alive, but not ready when the backend fails
+	s.srv.Close()
+	bk := &faultyBackend{MemBackend: s.bk, err: errors.New("connection refused")}
+	s.srv = httptest.NewServer(NewAPIServer(hello.New(bk), bk))
+	s.clt, err = NewClient(s.srv.URL)
+	c.Assert(err, IsNil)
+
+	code, _ = get("/healthz")
+	c.Assert(code, Equals, http.StatusOK)
+	code, data := get("/readyz")
+	c.Assert(code, Equals, http.StatusServiceUnavailable)
+	c.Assert(string(data), Matches, ".*connection refused.*")
+	c.Assert(s.clt.Ping(), DeepEquals, &backend.UnavailableError{Message: "connection refused"})
+}
+
+func (s *APISuite) TestMetrics(c *C) {
+	s.srv.Close()
+	r := metrics.NewRegistry()
+	s.srv = httptest.NewServer(NewAPIServer(hello.New(s.bk), s.bk, Registry(r)))
+	var err error
+	s.clt, err = NewClient(s.srv.URL)
+	c.Assert(err, IsNil)
+
+	c.Assert(s.clt.UpsertGreeting("hello.us", "Hello"), IsNil)
+	_, err = s.clt.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	_, err = s.clt.GetGreeting("hello.fr")
+	c.Assert(err, NotNil)
+	_, err = s.clt.Hello("hello.us", "Dog")
+	c.Assert(err, IsNil)
+	_, err = s.clt.Hello("hello.us", "Cat")
+	c.Assert(err, IsNil)
+	_, err = s.clt.Greet(context.Background(), hello.Request{Prompt: "hello", Name: "Dog", Locales: []string{"us"}})
+	c.Assert(err, IsNil)
+	_, err = s.clt.Hello("hello.fr", "Dog")
+	c.Assert(err, NotNil)
+	re, err := http.Get(s.srv.URL + "/no/such/route")
+	c.Assert(err, IsNil)
+	re.Body.Close()
+	req, err := http.NewRequest("BREW", s.srv.URL+"/no/such/route", nil)
+	c.Assert(err, IsNil)
+	re, err = http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	re.Body.Close()
+
+	requests := r.NewCounter("hello_http_requests_total", "HTTP requests served by route and status code", "method", "route", "code")
+	c.Assert(requests.Value("POST", "/v1/greetings", "200"), Equals, 1.0)
+	c.Assert(requests.Value("GET", "/v1/greetings/:prompt", "200"), Equals, 1.0)
+	c.Assert(requests.Value("GET", "/v1/greetings/:prompt", "404"), Equals, 1.0)
+	c.Assert(requests.Value("POST", "/v1/hello", "200"), Equals, 3.0)
+	c.Assert(requests.Value("GET", unmatchedRoute, "404"), Equals, 1.0)
+	// arbitrary methods don't create new series
+	c.Assert(requests.Value("other", unmatchedRoute, "404"), Equals, 1.0)
+
+	// greetings are counted by the greeting used, not by the prompt requested
+	greetings := r.NewCounter("hello_greetings_total", "Successful Hello calls by greeting used", "greeting")
+	c.Assert(greetings.Value("hello.us"), Equals, 3.0)
+	c.Assert(greetings.Value("hello"), Equals, 0.0)
+	c.Assert(greetings.Value("hello.fr"), Equals, 0.0)
+
+	re, err = http.Get(s.srv.URL + "/metrics")
+	c.Assert(err, IsNil)
+	defer re.Body.Close()
+	data, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Matches, `(?s).*hello_http_request_duration_seconds_count\{method="POST",route="/v1/hello"\} 4.*`)
+}
+
+// faultyBackend fails reads with err when it is set
+type faultyBackend struct {
+	*membk.MemBackend
+	err error
+}
+
+func (b *faultyBackend) GetGreeting(id string) (*backend.Greeting, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	return b.MemBackend.GetGreeting(id)
+}
+
+func (b *faultyBackend) Ping() error {
+	return b.err
+}
+
+func requestIDHeader(id string) http.Header {
+	h := make(http.Header)
+	h.Set(requestid.Header, id)
+	return h
+}
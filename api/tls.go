@@ -0,0 +1,169 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/mailgun/log"
+)
+
+// ServerTLSConfig returns TLS config serving the certificate from certFile and keyFile.
+// If caFile is set, clients have to present certificates signed by one
+// of the CAs from the file (mutual TLS).
+//
+// Files are checked on every handshake and reloaded when they change on disk,
+// so rotated certificates are picked up without a restart. If the new files
+// fail to load, e.g. while they are being written, the last good ones are used.
+func ServerTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	kp := &keyPair{certFile: certFile, keyFile: keyFile}
+	if _, err := kp.get(); err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return kp.get()
+		},
+	}
+	if caFile == "" {
+		return cfg, nil
+	}
+	cas := &certPool{file: caFile}
+	if _, err := cas.get(); err != nil {
+		return nil, err
+	}
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		pool, err := cas.get()
+		if err != nil {
+			return nil, err
+		}
+		out := cfg.Clone()
+		out.GetConfigForClient = nil
+		out.ClientCAs = pool
+		return out, nil
+	}
+	return cfg, nil
+}
+
+// ClientTLSConfig returns TLS config that verifies the server with the CAs from caFile,
+// or with the system CAs if caFile is empty. Client certificate from certFile
+// and keyFile is presented to servers requiring mutual TLS, it is reloaded
+// when it changes on disk. insecure turns off server verification
+// and should only be used in development.
+func ClientTLSConfig(caFile, certFile, keyFile string, insecure bool) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: insecure,
+	}
+	if caFile != "" {
+		pool, err := (&certPool{file: caFile}).get()
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		kp := &keyPair{certFile: certFile, keyFile: keyFile}
+		if _, err := kp.get(); err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return kp.get()
+		}
+	}
+	return cfg, nil
+}
+
+// keyPair is a certificate with a private key loaded from files
+// and reloaded when they change
+type keyPair struct {
+	certFile string
+	keyFile  string
+
+	mtx     sync.Mutex
+	cert    *tls.Certificate
+	version string
+}
+
+func (k *keyPair) get() (*tls.Certificate, error) {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	version, err := fileVersion(k.certFile, k.keyFile)
+	if err == nil && k.cert != nil && version == k.version {
+		return k.cert, nil
+	}
+	if err == nil {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(k.certFile, k.keyFile); err == nil {
+			k.cert, k.version = &cert, version
+			return k.cert, nil
+		}
+	}
+	if k.cert == nil {
+		return nil, fmt.Errorf("failed to load key pair %v, %v: %v", k.certFile, k.keyFile, err)
+	}
+	log.Warningf("failed to reload key pair %v, %v: %v, using the last one", k.certFile, k.keyFile, err)
+	return k.cert, nil
+}
+
+// certPool is a pool of CA certificates loaded from PEM file
+// and reloaded when it changes
+type certPool struct {
+	file string
+
+	mtx     sync.Mutex
+	pool    *x509.CertPool
+	version string
+}
+
+func (p *certPool) get() (*x509.CertPool, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	version, err := fileVersion(p.file)
+	if err == nil && p.pool != nil && version == p.version {
+		return p.pool, nil
+	}
+	if err == nil {
+		var pool *x509.CertPool
+		if pool, err = loadCertPool(p.file); err == nil {
+			p.pool, p.version = pool, version
+			return p.pool, nil
+		}
+	}
+	if p.pool == nil {
+		return nil, fmt.Errorf("failed to load CA certificates %v: %v", p.file, err)
+	}
+	log.Warningf("failed to reload CA certificates %v: %v, using the last ones", p.file, err)
+	return p.pool, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM encoded certificates found")
+	}
+	return pool, nil
+}
+
+// fileVersion returns a string that changes whenever any of the files is modified
+func fileVersion(files ...string) (string, error) {
+	version := ""
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return "", err
+		}
+		version += fmt.Sprintf("%v:%v:%v;", f, fi.ModTime().Format(time.RFC3339Nano), fi.Size())
+	}
+	return version, nil
+}
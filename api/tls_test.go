@@ -0,0 +1,206 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/gravitational/hello"
+	. "github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/check.v1"
+	"github.com/gravitational/hello/backend/membk"
+)
+
+// TLSSuite tests HTTPS and mutual TLS with certificates generated for every test
+type TLSSuite struct {
+	dir string
+	ca  *testCA
+	bk  *membk.MemBackend
+	srv *http.Server
+	url string
+}
+
+var _ = Suite(&TLSSuite{})
+
+func (s *TLSSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	s.ca = newTestCA(c, "hello CA")
+	s.ca.writeCA(c, s.path("ca.pem"))
+	s.ca.writeCert(c, s.path("server.pem"), s.path("server-key.pem"), "server", 1)
+	s.ca.writeCert(c, s.path("client.pem"), s.path("client-key.pem"), "client", 2)
+	var err error
+	s.bk, err = membk.New()
+	c.Assert(err, IsNil)
+	c.Assert(s.bk.UpsertGreeting("hello.us", "Hello"), IsNil)
+}
+
+func (s *TLSSuite) TearDownTest(c *C) {
+	if s.srv != nil {
+		s.srv.Close()
+	}
+	c.Assert(s.bk.Close(), IsNil)
+}
+
+func (s *TLSSuite) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+func (s *TLSSuite) start(c *C, caFile string) {
+	cfg, err := ServerTLSConfig(s.path("server.pem"), s.path("server-key.pem"), caFile)
+	c.Assert(err, IsNil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	s.srv = &http.Server{
+		Handler:   NewAPIServer(hello.New(s.bk), s.bk),
+		TLSConfig: cfg,
+		// rejected handshakes are expected
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	}
+	go s.srv.ServeTLS(l, "", "")
+	s.url = "https://" + l.Addr().String()
+}
+
+func (s *TLSSuite) hello(c *C, cfg *tls.Config) error {
+	clt, err := NewClient(s.url, TLS(cfg))
+	c.Assert(err, IsNil)
+	_, err = clt.Hello("hello.us", "Dog")
+	return err
+}
+
+func (s *TLSSuite) TestTLS(c *C) {
+	s.start(c, "")
+
+	cfg, err := ClientTLSConfig(s.path("ca.pem"), "", "", false)
+	c.Assert(err, IsNil)
+	c.Assert(s.hello(c, cfg), IsNil)
+
+	// server certificate is not signed by system CAs
+	cfg, err = ClientTLSConfig("", "", "", false)
+	c.Assert(err, IsNil)
+	c.Assert(s.hello(c, cfg), NotNil)
+
+	cfg, err = ClientTLSConfig("", "", "", true)
+	c.Assert(err, IsNil)
+	c.Assert(s.hello(c, cfg), IsNil)
+}
+
+func (s *TLSSuite) TestMutualTLS(c *C) {
+	s.start(c, s.path("ca.pem"))
+
+	cfg, err := ClientTLSConfig(s.path("ca.pem"), s.path("client.pem"), s.path("client-key.pem"), false)
+	c.Assert(err, IsNil)
+	c.Assert(s.hello(c, cfg), IsNil)
+
+	// clients without certificates are rejected
+	cfg, err = ClientTLSConfig(s.path("ca.pem"), "", "", false)
+	c.Assert(err, IsNil)
+	c.Assert(s.hello(c, cfg), NotNil)
+
+	// as well as clients with certificates signed by other CAs
+	other := newTestCA(c, "other CA")
+	other.writeCert(c, s.path("other.pem"), s.path("other-key.pem"), "client", 3)
+	cfg, err = ClientTLSConfig(s.path("ca.pem"), s.path("other.pem"), s.path("other-key.pem"), false)
+	c.Assert(err, IsNil)
+	c.Assert(s.hello(c, cfg), NotNil)
+
+	// rotated client CA bundle is picked up without restart,
+	// clients keep verifying the server with the CA loaded before
+	other.writeCA(c, s.path("ca.pem"))
+	c.Assert(s.hello(c, cfg), IsNil)
+	cfg, err = ClientTLSConfig("", s.path("client.pem"), s.path("client-key.pem"), false)
+	c.Assert(err, IsNil)
+	cfg.RootCAs = x509.NewCertPool()
+	cfg.RootCAs.AddCert(s.ca.cert)
+	c.Assert(s.hello(c, cfg), NotNil)
+}
+
+func (s *TLSSuite) TestRotation(c *C) {
+	s.start(c, "")
+	c.Assert(s.serverSerial(c), Equals, int64(1))
+
+	s.ca.writeCert(c, s.path("server.pem"), s.path("server-key.pem"), "server", 10)
+	c.Assert(s.serverSerial(c), Equals, int64(10))
+
+	// broken files are ignored, server keeps using the last good certificate
+	c.Assert(ioutil.WriteFile(s.path("server.pem"), []byte("garbage"), 0600), IsNil)
+	c.Assert(s.serverSerial(c), Equals, int64(10))
+}
+
+func (s *TLSSuite) TestBadFiles(c *C) {
+	_, err := ServerTLSConfig(s.path("missing.pem"), s.path("server-key.pem"), "")
+	c.Assert(err, NotNil)
+	_, err = ServerTLSConfig(s.path("server.pem"), s.path("server-key.pem"), s.path("server-key.pem"))
+	c.Assert(err, NotNil)
+	_, err = ClientTLSConfig(s.path("missing.pem"), "", "", false)
+	c.Assert(err, NotNil)
+	_, err = ClientTLSConfig("", s.path("client.pem"), "", false)
+	c.Assert(err, NotNil)
+}
+
+// serverSerial returns the serial number of the certificate presented by the server
+func (s *TLSSuite) serverSerial(c *C) int64 {
+	conn, err := tls.Dial("tcp", s.url[len("https://"):], &tls.Config{InsecureSkipVerify: true})
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(c *C, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) writeCA(c *C, path string) {
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	c.Assert(ioutil.WriteFile(path, data, 0600), IsNil)
+}
+
+// writeCert writes certificate valid for 127.0.0.1 for both server and client auth
+func (ca *testCA) writeCert(c *C, certPath, keyPath, name string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	c.Assert(err, IsNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600), IsNil)
+	c.Assert(ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600), IsNil)
+}
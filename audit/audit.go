@@ -0,0 +1,92 @@
+// Package audit records who changed greetings and when. API server emits
+// an Event for every greeting upsert, delete and rollback to a Sink, e.g. a file
+// with rotation, syslog or the greetings backend itself.
+package audit
+
+import (
+	"fmt"
+	"time"
+)
+
+// Actions recorded in the audit log
+const (
+	ActionUpsert   = "upsert"
+	ActionDelete   = "delete"
+	ActionRollback = "rollback"
+)
+
+// Event is an audit record of the greeting change
+type Event struct {
+	// Time is when the change was made
+	Time time.Time `json:"time"`
+	// Action is ActionUpsert, ActionDelete or ActionRollback
+	Action string `json:"action"`
+	// User is the name of the authenticated caller,
+	// empty if the server does not authenticate clients
+	User string `json:"user,omitempty"`
+	// RemoteAddr is the network address of the caller
+	RemoteAddr string `json:"remote_addr"`
+	// RequestID identifies the request in the server logs
+	RequestID string `json:"request_id,omitempty"`
+	// Prompt is the id of the changed greeting
+	Prompt string `json:"prompt"`
+	// OldValue is the value before the change, empty for new greetings
+	OldValue string `json:"old_value,omitempty"`
+	// NewValue is the value after the change, empty for deletes
+	NewValue string `json:"new_value,omitempty"`
+}
+
+// Sink receives audit events
+type Sink interface {
+	// Emit records the event
+	Emit(e Event) error
+	// Close releases resources held by the sink
+	Close() error
+}
+
+// Query selects events to search
+type Query struct {
+	// Prompt selects events of the greeting, all events if empty
+	Prompt string
+	// Limit is the max number of events to return, the most recent ones
+	// are returned, 0 means no limit
+	Limit int
+}
+
+// Searcher is implemented by sinks that can search the recorded events
+type Searcher interface {
+	// Search returns events matching the query, oldest first
+	Search(q Query) ([]Event, error)
+}
+
+// Search searches events in the sink, it returns NotSupportedError
+// if the sink does not support searching, e.g. syslog
+func Search(s Sink, q Query) ([]Event, error) {
+	searcher, ok := s.(Searcher)
+	if !ok {
+		return nil, &NotSupportedError{Message: "audit log does not support search"}
+	}
+	return searcher.Search(q)
+}
+
+// match returns true if the event matches the query prompt
+func (q Query) match(e Event) bool {
+	return q.Prompt == "" || q.Prompt == e.Prompt
+}
+
+// last returns the last limit events
+func (q Query) last(events []Event) []Event {
+	if q.Limit > 0 && len(events) > q.Limit {
+		return events[len(events)-q.Limit:]
+	}
+	return events
+}
+
+// NotSupportedError is returned when the audit log does not support the operation
+type NotSupportedError struct {
+	Message string
+}
+
+func (e *NotSupportedError) Error() string {
+	return fmt.Sprintf("not supported: %v", e.Message)
+}
@@ -0,0 +1,215 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/gravitational/hello/backend"
+	"github.com/gravitational/hello/backend/membk"
+
+	. "github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+func TestAudit(t *testing.T) { TestingT(t) }
+
+type AuditSuite struct {
+	dir string
+}
+
+var _ = Suite(&AuditSuite{})
+
+func (s *AuditSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+}
+
+func event(prompt string, i int) Event {
+	return Event{
+		Time:       time.Date(2015, 10, 1, 12, 0, i, 0, time.UTC),
+		Action:     ActionUpsert,
+		User:       "alice",
+		RemoteAddr: "127.0.0.1:4242",
+		RequestID:  fmt.Sprintf("req-%v", i),
+		Prompt:     prompt,
+		OldValue:   fmt.Sprintf("Hello %v", i-1),
+		NewValue:   fmt.Sprintf("Hello %v", i),
+	}
+}
+
+// searchSuite checks that the searcher returns emitted events
+func searchSuite(c *C, sink Sink) {
+	for i := 0; i < 6; i++ {
+		prompt := "hello.us"
+		if i%2 == 1 {
+			prompt = "hello.uk"
+		}
+		c.Assert(sink.Emit(event(prompt, i)), IsNil)
+	}
+
+	events, err := Search(sink, Query{})
+	c.Assert(err, IsNil)
+	c.Assert(len(events), Equals, 6)
+	for i, e := range events {
+		c.Assert(e.RequestID, Equals, fmt.Sprintf("req-%v", i))
+	}
+
+	events, err = Search(sink, Query{Prompt: "hello.uk"})
+	c.Assert(err, IsNil)
+	c.Assert(events, DeepEquals, []Event{event("hello.uk", 1), event("hello.uk", 3), event("hello.uk", 5)})
+
+	events, err = Search(sink, Query{Prompt: "hello.us", Limit: 2})
+	c.Assert(err, IsNil)
+	c.Assert(events, DeepEquals, []Event{event("hello.us", 2), event("hello.us", 4)})
+
+	events, err = Search(sink, Query{Prompt: "hello.fr"})
+	c.Assert(err, IsNil)
+	c.Assert(len(events), Equals, 0)
+}
+
+func (s *AuditSuite) TestFileSearch(c *C) {
+	sink, err := NewFileSink(filepath.Join(s.dir, "log", "audit.log"))
+	c.Assert(err, IsNil)
+	defer sink.Close()
+	searchSuite(c, sink)
+}
+
+func (s *AuditSuite) TestFileRotation(c *C) {
+	path := filepath.Join(s.dir, "audit.log")
+	data, err := json.Marshal(event("hello.us", 0))
+	c.Assert(err, IsNil)
+	// two events per file
+	sink, err := NewFileSink(path, MaxSize(int64(2*(len(data)+1))), MaxBackups(2))
+	c.Assert(err, IsNil)
+	for i := 0; i < 7; i++ {
+		c.Assert(sink.Emit(event("hello.us", i)), IsNil)
+	}
+	for _, name := range []string{"audit.log", "audit.log.1", "audit.log.2"} {
+		_, err := os.Stat(filepath.Join(s.dir, name))
+		c.Assert(err, IsNil)
+	}
+	_, err = os.Stat(filepath.Join(s.dir, "audit.log.3"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// the oldest file has been removed
+	events, err := sink.Search(Query{})
+	c.Assert(err, IsNil)
+	c.Assert(len(events), Equals, 5)
+	c.Assert(events[0], DeepEquals, event("hello.us", 2))
+	c.Assert(events[4], DeepEquals, event("hello.us", 6))
+	c.Assert(sink.Close(), IsNil)
+
+	// reopened sink keeps appending
+	sink, err = NewFileSink(path, MaxSize(int64(2*(len(data)+1))), MaxBackups(2))
+	c.Assert(err, IsNil)
+	c.Assert(sink.Emit(event("hello.us", 7)), IsNil)
+	events, err = sink.Search(Query{Limit: 2})
+	c.Assert(err, IsNil)
+	c.Assert(events, DeepEquals, []Event{event("hello.us", 6), event("hello.us", 7)})
+	events, err = sink.Search(Query{Limit: 3})
+	c.Assert(err, IsNil)
+	c.Assert(events, DeepEquals, []Event{event("hello.us", 5), event("hello.us", 6), event("hello.us", 7)})
+
+	// older files are not read once the limit is reached
+	c.Assert(os.Remove(filepath.Join(s.dir, "audit.log.2")), IsNil)
+	c.Assert(os.Mkdir(filepath.Join(s.dir, "audit.log.2"), 0700), IsNil)
+	_, err = sink.Search(Query{Limit: 4})
+	c.Assert(err, IsNil)
+	_, err = sink.Search(Query{Limit: 5})
+	c.Assert(err, NotNil)
+	c.Assert(os.Remove(filepath.Join(s.dir, "audit.log.2")), IsNil)
+	c.Assert(sink.Close(), IsNil)
+	c.Assert(sink.Emit(event("hello.us", 8)), NotNil)
+}
+
+func (s *AuditSuite) TestFileBrokenRecords(c *C) {
+	path := filepath.Join(s.dir, "audit.log")
+	sink, err := NewFileSink(path)
+	c.Assert(err, IsNil)
+	defer sink.Close()
+	c.Assert(sink.Emit(event("hello.us", 0)), IsNil)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	c.Assert(err, IsNil)
+	_, err = f.Write([]byte(`{"time": "2015-`))
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	events, err := sink.Search(Query{})
+	c.Assert(err, IsNil)
+	c.Assert(events, DeepEquals, []Event{event("hello.us", 0)})
+}
+
+func (s *AuditSuite) TestFileFromString(c *C) {
+	path := filepath.Join(s.dir, "audit.log")
+	sink, err := FileFromString(`{"path": "` + path + `", "maxSize": 1024, "maxBackups": 0}`)
+	c.Assert(err, IsNil)
+	c.Assert(sink.maxSize, Equals, int64(1024))
+	c.Assert(sink.maxBackups, Equals, 0)
+	c.Assert(sink.Close(), IsNil)
+
+	for _, v := range []string{"", "{", `{"path": ""}`, `{"path": "` + path + `", "maxSize": -1}`} {
+		_, err := FileFromString(v)
+		c.Assert(err, NotNil, Commentf(v))
+	}
+}
+
+func (s *AuditSuite) TestBackend(c *C) {
+	b, err := membk.New()
+	c.Assert(err, IsNil)
+	defer b.Close()
+	c.Assert(b.UpsertGreeting("hello.us", "Hello"), IsNil)
+	sink, err := NewBackendSink(b)
+	c.Assert(err, IsNil)
+	searchSuite(c, sink)
+
+	// events emitted at the same time are kept
+	e := event("hello.us", 10)
+	c.Assert(sink.Emit(e), IsNil)
+	c.Assert(sink.Emit(e), IsNil)
+	events, err := sink.Search(Query{Limit: 3})
+	c.Assert(err, IsNil)
+	c.Assert(events, DeepEquals, []Event{event("hello.uk", 5), e, e})
+
+	// events are not greetings
+	c.Assert(b.Greetings(), DeepEquals, map[string]string{"hello.us": "Hello"})
+
+	// backends that don't store events are refused
+	_, err = NewBackendSink(struct{ backend.GreetingBackend }{b})
+	c.Assert(err, FitsTypeOf, &backend.NotSupportedError{})
+}
+
+func (s *AuditSuite) TestLogger(c *C) {
+	l := &bufLogger{}
+	sink := NewLoggerSink(l)
+	c.Assert(sink.Emit(event("hello.us", 0)), IsNil)
+	var e Event
+	c.Assert(json.Unmarshal(l.buf.Bytes(), &e), IsNil)
+	c.Assert(e, DeepEquals, event("hello.us", 0))
+
+	_, err := Search(sink, Query{})
+	c.Assert(err, FitsTypeOf, &NotSupportedError{})
+}
+
+// bufLogger is a logger writing info messages to the buffer
+type bufLogger struct {
+	buf bytes.Buffer
+}
+
+func (l *bufLogger) Infof(format string, args ...interface{})    {}
+func (l *bufLogger) Warningf(format string, args ...interface{}) {}
+func (l *bufLogger) Errorf(format string, args ...interface{})   {}
+func (l *bufLogger) Fatalf(format string, args ...interface{})   {}
+
+func (l *bufLogger) Writer(sev log.Severity) io.Writer {
+	if sev == log.SeverityInfo {
+		return &l.buf
+	}
+	return ioutil.Discard
+}
@@ -0,0 +1,60 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/gravitational/hello/backend"
+)
+
+// BackendSink stores events in the greetings backend, so they are replicated
+// and shared by all servers using the backend, e.g. etcd. Events are stored
+// apart from greetings, see backend.AuditBackend, so API clients can't read
+// or change them via the greetings API. BackendSink is a Searcher.
+type BackendSink struct {
+	b backend.AuditBackend
+}
+
+// NewBackendSink returns a sink storing events in the backend, it returns
+// backend.NotSupportedError if the backend does not store audit events.
+// The backend is owned by the caller and is not closed by the sink.
+func NewBackendSink(b backend.GreetingBackend) (*BackendSink, error) {
+	a, err := backend.GetAuditBackend(b)
+	if err != nil {
+		return nil, err
+	}
+	return &BackendSink{b: a}, nil
+}
+
+// Emit stores the event in the backend
+func (s *BackendSink) Emit(e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.b.AppendAuditEvent(string(data))
+}
+
+// Search lists events stored in the backend
+func (s *BackendSink) Search(q Query) ([]Event, error) {
+	records, err := s.b.GetAuditEvents()
+	if err != nil {
+		return nil, err
+	}
+	var events []Event
+	for i, data := range records {
+		var e Event
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return nil, fmt.Errorf("broken audit record #%v: %v", i, err)
+		}
+		if q.match(e) {
+			events = append(events, e)
+		}
+	}
+	return q.last(events), nil
+}
+
+// Close does nothing, the backend is owned by the caller
+func (s *BackendSink) Close() error {
+	return nil
+}
@@ -0,0 +1,238 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/mailgun/log"
+)
+
+const (
+	// DefaultMaxSize is the default size of the audit log file that triggers rotation
+	DefaultMaxSize = 100 * 1024 * 1024
+	// DefaultMaxBackups is the default number of rotated files to keep
+	DefaultMaxBackups = 5
+)
+
+// FileSink writes events to the file as JSON lines. When the file grows above
+// the max size, it is renamed to '<path>.1', the previous '<path>.1' to '<path>.2'
+// and so on, the files above the max number of backups are removed.
+// FileSink is a Searcher, it searches all files including backups.
+type FileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mtx  sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// FileOption is a functional option for the file sink
+type FileOption func(s *FileSink)
+
+// MaxSize sets the size of the file in bytes that triggers rotation
+func MaxSize(v int64) FileOption {
+	return func(s *FileSink) {
+		s.maxSize = v
+	}
+}
+
+// MaxBackups sets the number of rotated files to keep, 0 means that
+// events are dropped on rotation
+func MaxBackups(v int) FileOption {
+	return func(s *FileSink) {
+		s.maxBackups = v
+	}
+}
+
+// NewFileSink opens or creates the audit log file at path
+func NewFileSink(path string, opts ...FileOption) (*FileSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("supply a valid audit log path")
+	}
+	s := &FileSink{path: path, maxSize: DefaultMaxSize, maxBackups: DefaultMaxBackups}
+	for _, o := range opts {
+		o(s)
+	}
+	if s.maxSize <= 0 || s.maxBackups < 0 {
+		return nil, fmt.Errorf("expected positive max size and non-negative max backups")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.size = f, fi.Size()
+	return nil
+}
+
+// Emit appends the event to the file, rotating it if needed
+func (s *FileSink) Emit(e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.f == nil {
+		return fmt.Errorf("audit log %v is closed", s.path)
+	}
+	if s.size > 0 && s.size+int64(len(data)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(data)
+	s.size += int64(n)
+	return err
+}
+
+// rotate shifts the backups and starts the new file
+func (s *FileSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		log.Warningf("failed to close audit log %v: %v", s.path, err)
+	}
+	s.f = nil
+	err := s.shift()
+	// keep writing to the current file if the backups could not be shifted
+	if oerr := s.open(); oerr != nil {
+		return oerr
+	}
+	return err
+}
+
+func (s *FileSink) shift() error {
+	if err := os.Remove(s.backup(s.maxBackups)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := s.maxBackups - 1; i >= 0; i-- {
+		if err := os.Rename(s.backup(i), s.backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// backup returns the path of the i-th backup, 0 is the current file
+func (s *FileSink) backup(i int) string {
+	if i == 0 {
+		return s.path
+	}
+	return fmt.Sprintf("%v.%v", s.path, i)
+}
+
+// Search reads events from the current file and the backups, newest file
+// first, and stops once the limit is reached. The files are read without
+// holding the lock, as rotation only renames them
+func (s *FileSink) Search(q Query) ([]Event, error) {
+	s.mtx.Lock()
+	paths := make([]string, 0, s.maxBackups+1)
+	for i := 0; i <= s.maxBackups; i++ {
+		paths = append(paths, s.backup(i))
+	}
+	s.mtx.Unlock()
+
+	var events []Event
+	for _, path := range paths {
+		found, err := s.read(path, q)
+		if err != nil {
+			return nil, err
+		}
+		if q.Limit > 0 {
+			found = Query{Limit: q.Limit - len(events)}.last(found)
+		}
+		events = append(found, events...)
+		if q.Limit > 0 && len(events) >= q.Limit {
+			break
+		}
+	}
+	return events, nil
+}
+
+// read returns the events in the file matching the query, oldest first
+func (s *FileSink) read(path string, q Query) ([]Event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// the last line may be cut off by a crash
+			log.Warningf("skipping broken audit record in %v: %v", path, err)
+			continue
+		}
+		if q.match(e) {
+			events = append(events, e)
+		}
+	}
+	return events, scanner.Err()
+}
+
+// Close closes the file
+func (s *FileSink) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// fileCfg represents JSON config for the file sink
+type fileCfg struct {
+	Path       string `json:"path"`
+	MaxSize    int64  `json:"maxSize"`
+	MaxBackups *int   `json:"maxBackups"`
+}
+
+// FileFromString initializes the file sink from configuration string
+//
+//   audit.FileFromString(`{"path": "/var/log/hello/audit.log", "maxSize": 10485760, "maxBackups": 5}`)
+//
+func FileFromString(v string) (*FileSink, error) {
+	if len(v) == 0 {
+		return nil, fmt.Errorf(`please supply a valid dictionary, e.g. {"path": "/var/log/hello/audit.log"}`)
+	}
+	var c *fileCfg
+	if err := json.Unmarshal([]byte(v), &c); err != nil {
+		return nil, fmt.Errorf("invalid audit configuration format, err: %v", err)
+	}
+	options := []FileOption{}
+	if c.MaxSize != 0 {
+		options = append(options, MaxSize(c.MaxSize))
+	}
+	if c.MaxBackups != nil {
+		options = append(options, MaxBackups(*c.MaxBackups))
+	}
+	return NewFileSink(c.Path, options...)
+}
@@ -0,0 +1,42 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/mailgun/log"
+)
+
+// LoggerSink writes events as JSON to the info writer of the logger
+type LoggerSink struct {
+	w io.Writer
+}
+
+// NewLoggerSink returns a sink writing events to the logger, e.g. log.NewSysLogger
+func NewLoggerSink(l log.Logger) *LoggerSink {
+	return &LoggerSink{w: l.Writer(log.SeverityInfo)}
+}
+
+// NewSyslogSink returns a sink writing events to syslog
+func NewSyslogSink() (*LoggerSink, error) {
+	l, err := log.NewSysLogger(&log.LogConfig{Name: "syslog"})
+	if err != nil {
+		return nil, err
+	}
+	return NewLoggerSink(l), nil
+}
+
+// Emit writes the event to the logger
+func (s *LoggerSink) Emit(e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = s.w.Write(append(data, '\n'))
+	return err
+}
+
+// Close does nothing, loggers are not closed
+func (s *LoggerSink) Close() error {
+	return nil
+}
@@ -0,0 +1,215 @@
+// Package auth implements authentication of API clients with static bearer
+// tokens and API keys, and role-based authorization of their requests.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Role is a set of operations the client is allowed to do,
+// every role is allowed to do what the roles below it do
+type Role string
+
+const (
+	// Reader may read greetings and say hello
+	Reader Role = "reader"
+	// Editor may also upsert greetings
+	Editor Role = "editor"
+	// Admin may also delete greetings
+	Admin Role = "admin"
+)
+
+var ranks = map[Role]int{Reader: 1, Editor: 2, Admin: 3}
+
+// ParseRole returns the role by name, e.g. 'editor'
+func ParseRole(v string) (Role, error) {
+	r := Role(strings.ToLower(v))
+	if _, ok := ranks[r]; !ok {
+		return "", fmt.Errorf("unsupported role '%v', expected 'reader', 'editor' or 'admin'", v)
+	}
+	return r, nil
+}
+
+// Includes returns true if the role is allowed to do what role o does,
+// e.g. Admin includes Editor
+func (r Role) Includes(o Role) bool {
+	return ranks[r] != 0 && ranks[r] >= ranks[o]
+}
+
+// Identity is an authenticated client
+type Identity struct {
+	// Name identifies the client in logs, e.g. 'ci'
+	Name string
+	// Role is the role granted to the client
+	Role Role
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a copy of the context carrying the identity
+// of the authenticated client
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// GetIdentity returns the identity of the client from the context,
+// or nil if the client was not authenticated
+func GetIdentity(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
+
+// Authenticator authenticates clients by the credentials in HTTP requests
+type Authenticator interface {
+	// Authenticate returns identity of the client that sent the request
+	// or UnauthenticatedError if the credentials are missing or invalid
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// APIKeyHeader is a header carrying API keys
+const APIKeyHeader = "X-API-Key"
+
+// Keys authenticates clients with static bearer tokens passed in
+// 'Authorization: Bearer <token>' header and API keys passed in 'X-API-Key' header.
+// Keys are not safe to modify while serving requests, build them first.
+type Keys struct {
+	// tokens and apiKeys are identities by the hashes of the secrets,
+	// so secrets are not kept in memory in plain text
+	tokens  map[[sha256.Size]byte]Identity
+	apiKeys map[[sha256.Size]byte]Identity
+}
+
+// NewKeys returns an empty set of keys that rejects all clients
+func NewKeys() *Keys {
+	return &Keys{
+		tokens:  make(map[[sha256.Size]byte]Identity),
+		apiKeys: make(map[[sha256.Size]byte]Identity),
+	}
+}
+
+// AddToken adds a bearer token of the client
+func (k *Keys) AddToken(token string, id Identity) error {
+	return add(k.tokens, "token", token, id)
+}
+
+// AddAPIKey adds an API key of the client
+func (k *Keys) AddAPIKey(key string, id Identity) error {
+	return add(k.apiKeys, "API key", key, id)
+}
+
+func add(m map[[sha256.Size]byte]Identity, kind, secret string, id Identity) error {
+	if secret == "" {
+		return fmt.Errorf("empty %v of '%v'", kind, id.Name)
+	}
+	role, err := ParseRole(string(id.Role))
+	if err != nil {
+		return fmt.Errorf("%v of '%v': %v", kind, id.Name, err)
+	}
+	id.Role = role
+	h := sha256.Sum256([]byte(secret))
+	if _, ok := m[h]; ok {
+		return fmt.Errorf("duplicate %v of '%v'", kind, id.Name)
+	}
+	m[h] = id
+	return nil
+}
+
+// Authenticate returns identity of the client by the bearer token or API key
+func (k *Keys) Authenticate(r *http.Request) (*Identity, error) {
+	if v := r.Header.Get("Authorization"); v != "" {
+		parts := strings.SplitN(v, " ", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+			return nil, &UnauthenticatedError{Message: "unsupported authorization scheme, expected 'Bearer'"}
+		}
+		id, ok := k.tokens[sha256.Sum256([]byte(strings.TrimSpace(parts[1])))]
+		if !ok {
+			return nil, &UnauthenticatedError{Message: "invalid bearer token"}
+		}
+		return &id, nil
+	}
+	if v := r.Header.Get(APIKeyHeader); v != "" {
+		id, ok := k.apiKeys[sha256.Sum256([]byte(v))]
+		if !ok {
+			return nil, &UnauthenticatedError{Message: "invalid API key"}
+		}
+		return &id, nil
+	}
+	return nil, &UnauthenticatedError{Message: "missing bearer token or API key"}
+}
+
+// keysFile is JSON file with the keys, e.g.
+//
+//   {"tokens": [{"name": "ci", "token": "s3cr3t", "role": "editor"}],
+//    "apiKeys": [{"name": "frontend", "key": "k3y", "role": "reader"}]}
+//
+type keysFile struct {
+	Tokens []struct {
+		Name  string `json:"name"`
+		Token string `json:"token"`
+		Role  string `json:"role"`
+	} `json:"tokens"`
+	APIKeys []struct {
+		Name string `json:"name"`
+		Key  string `json:"key"`
+		Role string `json:"role"`
+	} `json:"apiKeys"`
+}
+
+// FromFile reads the keys from JSON file, see keysFile for the format
+func FromFile(path string) (*Keys, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return FromString(string(data))
+}
+
+// FromString reads the keys from JSON string, see keysFile for the format
+func FromString(v string) (*Keys, error) {
+	var f keysFile
+	if err := json.Unmarshal([]byte(v), &f); err != nil {
+		return nil, fmt.Errorf("invalid keys format, err: %v", err)
+	}
+	k := NewKeys()
+	for _, t := range f.Tokens {
+		if err := k.AddToken(t.Token, Identity{Name: t.Name, Role: Role(t.Role)}); err != nil {
+			return nil, err
+		}
+	}
+	for _, a := range f.APIKeys {
+		if err := k.AddAPIKey(a.Key, Identity{Name: a.Name, Role: Role(a.Role)}); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// UnauthenticatedError is returned when the client credentials
+// are missing or invalid
+type UnauthenticatedError struct {
+	Message string
+}
+
+func (e *UnauthenticatedError) Error() string {
+	return fmt.Sprintf("authentication required: %v", e.Message)
+}
+
+// AccessDeniedError is returned when the client role does not allow the operation
+type AccessDeniedError struct {
+	// Name is the name of the client
+	Name string
+	// Role is the role of the client
+	Role Role
+	// Required is the role required for the operation
+	Required Role
+}
+
+func (e *AccessDeniedError) Error() string {
+	return fmt.Sprintf("access denied to '%v' with role '%v', operation requires role '%v'", e.Name, e.Role, e.Required)
+}
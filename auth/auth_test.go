@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	. "github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+func TestAuth(t *testing.T) { TestingT(t) }
+
+type AuthSuite struct{}
+
+var _ = Suite(&AuthSuite{})
+
+func (s *AuthSuite) TestRoles(c *C) {
+	c.Assert(Admin.Includes(Editor), Equals, true)
+	c.Assert(Admin.Includes(Reader), Equals, true)
+	c.Assert(Editor.Includes(Reader), Equals, true)
+	c.Assert(Reader.Includes(Reader), Equals, true)
+	c.Assert(Reader.Includes(Editor), Equals, false)
+	c.Assert(Editor.Includes(Admin), Equals, false)
+	c.Assert(Role("root").Includes(Reader), Equals, false)
+
+	r, err := ParseRole("Editor")
+	c.Assert(err, IsNil)
+	c.Assert(r, Equals, Editor)
+	_, err = ParseRole("root")
+	c.Assert(err, NotNil)
+}
+
+func (s *AuthSuite) TestAuthenticate(c *C) {
+	k := NewKeys()
+	c.Assert(k.AddToken("t0k3n", Identity{Name: "ci", Role: Editor}), IsNil)
+	c.Assert(k.AddAPIKey("k3y", Identity{Name: "frontend", Role: "READER"}), IsNil)
+
+	auth := func(header, val string) (*Identity, error) {
+		r, err := http.NewRequest("GET", "/v1/greetings", nil)
+		c.Assert(err, IsNil)
+		if header != "" {
+			r.Header.Set(header, val)
+		}
+		return k.Authenticate(r)
+	}
+
+	id, err := auth("Authorization", "Bearer t0k3n")
+	c.Assert(err, IsNil)
+	c.Assert(*id, Equals, Identity{Name: "ci", Role: Editor})
+
+	id, err = auth(APIKeyHeader, "k3y")
+	c.Assert(err, IsNil)
+	c.Assert(*id, Equals, Identity{Name: "frontend", Role: Reader})
+
+	for _, tc := range [][]string{
+		{"", ""},
+		{"Authorization", "Bearer k3y"},
+		{"Authorization", "Basic dDBrM246"},
+		{"Authorization", "t0k3n"},
+		{APIKeyHeader, "t0k3n"},
+	} {
+		_, err = auth(tc[0], tc[1])
+		c.Assert(err, FitsTypeOf, &UnauthenticatedError{}, Commentf("%v", tc))
+	}
+}
+
+func (s *AuthSuite) TestBadKeys(c *C) {
+	k := NewKeys()
+	c.Assert(k.AddToken("", Identity{Name: "ci", Role: Reader}), NotNil)
+	c.Assert(k.AddToken("t0k3n", Identity{Name: "ci", Role: "root"}), NotNil)
+	c.Assert(k.AddToken("t0k3n", Identity{Name: "ci", Role: Reader}), IsNil)
+	c.Assert(k.AddToken("t0k3n", Identity{Name: "cd", Role: Reader}), NotNil)
+	// the same secret may be used as a token and API key
+	c.Assert(k.AddAPIKey("t0k3n", Identity{Name: "ci", Role: Reader}), IsNil)
+}
+
+func (s *AuthSuite) TestFromFile(c *C) {
+	path := filepath.Join(c.MkDir(), "keys.json")
+	data := `{"tokens": [{"name": "ci", "token": "t0k3n", "role": "editor"}],
+              "apiKeys": [{"name": "frontend", "key": "k3y", "role": "reader"}]}`
+	c.Assert(ioutil.WriteFile(path, []byte(data), 0600), IsNil)
+	k, err := FromFile(path)
+	c.Assert(err, IsNil)
+
+	r, err := http.NewRequest("GET", "/v1/greetings", nil)
+	c.Assert(err, IsNil)
+	r.Header.Set(APIKeyHeader, "k3y")
+	id, err := k.Authenticate(r)
+	c.Assert(err, IsNil)
+	c.Assert(id.Name, Equals, "frontend")
+
+	_, err = FromFile(filepath.Join(c.MkDir(), "missing.json"))
+	c.Assert(err, NotNil)
+	_, err = FromString(`{"tokens": [{"name": "ci", "token": "t0k3n", "role": "root"}]}`)
+	c.Assert(err, NotNil)
+	_, err = FromString(`[]`)
+	c.Assert(err, NotNil)
+}
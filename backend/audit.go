@@ -0,0 +1,22 @@
+package backend
+
+// AuditBackend is implemented by backends that store audit events,
+// see audit.BackendSink. Events are stored apart from greetings, so they
+// can't be read or changed via the greetings API, and are append-only,
+// there is no way to change or delete them via the backend.
+type AuditBackend interface {
+	// AppendAuditEvent stores the serialized audit event
+	AppendAuditEvent(data string) error
+	// GetAuditEvents returns the stored events in the order they were appended
+	GetAuditEvents() ([]string, error)
+}
+
+// GetAuditBackend returns the audit backend b, it returns NotSupportedError
+// if the backend does not store audit events, e.g. filebk
+func GetAuditBackend(b GreetingBackend) (AuditBackend, error) {
+	a, ok := b.(AuditBackend)
+	if !ok {
+		return nil, &NotSupportedError{Message: "backend does not store audit events"}
+	}
+	return a, nil
+}
@@ -4,25 +4,105 @@ package backend
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 )
 
 // GreetingBackend is an interface to the backend (usually a database)
 // that provides some storage functionality.
 type GreetingBackend interface {
 
-	// UpsertGreeting updates or inserts the greeting into the database
-	UpsertGreeting(id, val string) error
+	// UpsertGreeting updates or inserts the greeting into the database.
+	// Options can make the write conditional, e.g. Create() or IfRevision(rev),
+	// in this case ConflictError is returned when condition does not hold.
+	// TTL(d) option makes the greeting expire. Template, Locale, Description and Tags
+	// options set the metadata of the greeting, the upsert replaces the whole
+	// record, so the metadata not passed is cleared.
+	UpsertGreeting(id, val string, opts ...WriteOption) error
 
 	// GetGreeting returns a greeting stored in a database by it's id
-	GetGreeting(id string) (string, error)
+	GetGreeting(id string) (*Greeting, error)
 
-	// DeleteGreeting deletes greeting by ID
-	DeleteGreeting(id string) error
+	// DeleteGreeting deletes greeting by ID, IfRevision(rev) option
+	// makes the delete conditional
+	DeleteGreeting(id string, opts ...WriteOption) error
+
+	// GetGreetings returns greetings with ids starting with prefix, sorted by id.
+	// Only greetings with ids greater than cursor are returned, at most limit
+	// of them (0 means no limit). The second return value is a cursor
+	// of the next page, or empty string if there are no more greetings.
+	GetGreetings(prefix, cursor string, limit int) ([]Greeting, string, error)
+
+	// WatchGreetings streams changes of greetings made after the call,
+	// until stopC is closed. Callers should always close stopC to release
+	// the resources. The returned channel is closed when the watch stops,
+	// including the cases when backend fails or closes, so callers should
+	// be ready to watch again.
+	WatchGreetings(stopC <-chan bool) (<-chan GreetingEvent, error)
+
+	// Ping checks that the backend can serve requests, e.g. that the database
+	// is reachable, and returns error otherwise
+	Ping() error
 
 	// Close closes all resources associated with this backend
 	Close() error
 }
 
+// Greeting is a greeting record stored in the backend
+type Greeting struct {
+	// ID is a unique greeting id, e.g. 'hello.us'
+	ID string
+	// Value is a greeting itself, e.g. 'Hello'
+	Value string
+	// Template is true if the value is a template, e.g. '{{.Name}}さん、こんにちは',
+	// rather than a plain value, see Template write option
+	Template bool
+	// Locale is the locale of the greeting, e.g. 'en-US', see Locale write option
+	Locale string
+	// Description tells what the greeting is for, see Description write option
+	Description string
+	// Tags are labels of the greeting, e.g. 'holiday', see Tags write option
+	Tags []string
+	// Created is when the greeting was created, it is zero for greetings
+	// stored as bare strings by older versions
+	Created time.Time
+	// Updated is when the greeting was last changed
+	Updated time.Time
+	// Author is the name of the caller who made the last change, see Author write option
+	Author string
+	// Revision is the revision of the last change of this greeting,
+	// see IfRevision write option
+	Revision uint64
+	// TTL is the time left before the greeting expires, see TTL
+	// write option, it is 0 for greetings that never expire
+	TTL time.Duration
+}
+
+// Page sorts greetings by id and returns the page matching the prefix,
+// cursor and limit, along with the cursor of the next page. Backends
+// that can't filter and paginate natively can use it to implement GetGreetings.
+func Page(gs []Greeting, prefix, cursor string, limit int) ([]Greeting, string) {
+	sort.Sort(byID(gs))
+	out := []Greeting{}
+	for _, g := range gs {
+		if !strings.HasPrefix(g.ID, prefix) || g.ID <= cursor {
+			continue
+		}
+		if limit > 0 && len(out) == limit {
+			return out, out[len(out)-1].ID
+		}
+		out = append(out, g)
+	}
+	return out, ""
+}
+
+type byID []Greeting
+
+func (g byID) Len() int           { return len(g) }
+func (g byID) Less(i, j int) bool { return g[i].ID < g[j].ID }
+func (g byID) Swap(i, j int)      { g[i], g[j] = g[j], g[i] }
+
 // NotFoundError returns whenever the greeting requested is not found
 type NotFoundError struct {
 	ID string
@@ -31,3 +111,24 @@ type NotFoundError struct {
 func (e *NotFoundError) Error() string {
 	return fmt.Sprintf("greeting with id '%v' not found", e.ID)
 }
+
+// ConflictError is returned when the conditional write fails, because
+// greeting already exists or has been changed by someone else
+type ConflictError struct {
+	ID      string
+	Message string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("greeting with id '%v' conflict: %v", e.ID, e.Message)
+}
+
+// UnavailableError is returned when the backend storage can not be reached,
+// the operation may succeed when retried later
+type UnavailableError struct {
+	Message string
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("backend is unavailable: %v", e.Message)
+}
@@ -0,0 +1,413 @@
+// package cachebk implements a backend decorator that caches greetings
+// read by id in a bounded LRU cache, e.g. to spare etcd a GET on every
+// hello request
+package cachebk
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/gravitational/hello/backend"
+	"github.com/gravitational/hello/metrics"
+)
+
+const (
+	// DefaultSize is the default maximum number of cached greetings
+	DefaultSize = 1024
+	// DefaultTTL is the default time greetings stay cached
+	DefaultTTL = 10 * time.Second
+	// DefaultNegativeTTL is the default time missing greetings stay cached
+	DefaultNegativeTTL = time.Second
+	// WatchRetryPeriod is how often the cache retries watching the backend
+	// for changes if the watch fails
+	WatchRetryPeriod = time.Second
+)
+
+const (
+	// RequestsMetric is a counter of cache lookups by result, 'hit' or 'miss'
+	RequestsMetric = "hello_backend_cache_requests_total"
+	// EvictionsMetric is a counter of greetings evicted to keep the cache size
+	EvictionsMetric = "hello_backend_cache_evictions_total"
+)
+
+// Option is a functional option for the cache backend
+type Option func(b *Backend)
+
+// Size sets the maximum number of cached greetings, the least recently
+// used greetings are evicted to make room for new ones
+func Size(n int) Option {
+	return func(b *Backend) {
+		b.size = n
+	}
+}
+
+// TTL sets the time greetings stay cached, it bounds staleness
+// of the greetings changed by other servers if the backend has
+// no change notifications
+func TTL(d time.Duration) Option {
+	return func(b *Backend) {
+		b.ttl = d
+	}
+}
+
+// NegativeTTL sets the time missing greetings stay cached, 0 turns
+// off negative caching
+func NegativeTTL(d time.Duration) Option {
+	return func(b *Backend) {
+		b.negativeTTL = d
+	}
+}
+
+// Clock sets the clock used to expire cached greetings, tests use it to control time
+func Clock(c backend.Clock) Option {
+	return func(b *Backend) {
+		b.clock = c
+	}
+}
+
+// Metrics records cache hits, misses and evictions in the registry r
+func Metrics(r *metrics.Registry) Option {
+	return func(b *Backend) {
+		b.requests = r.NewCounter(RequestsMetric, "Greeting cache lookups", "result")
+		b.evictions = r.NewCounter(EvictionsMetric, "Greetings evicted from the cache")
+	}
+}
+
+// Stats are cache statistics since the cache was created
+type Stats struct {
+	// Hits is the number of greetings served from the cache,
+	// including missing greetings
+	Hits uint64
+	// Misses is the number of greetings read from the backend
+	Misses uint64
+	// Evictions is the number of greetings evicted to keep the cache size
+	Evictions uint64
+	// Len is the number of greetings in the cache
+	Len int
+}
+
+// Backend caches greetings returned by GetGreeting of the decorated backend.
+// Writes made through the cache invalidate cached greetings, and so do
+// the changes streamed by WatchGreetings of the decorated backend, so writes
+// made by other servers are visible once the change notification arrives.
+// The cache is purged whenever the watch restarts, as changes may be missed.
+// Concurrent misses of the same greeting are deduplicated into a single read.
+// Listings are not cached.
+type Backend struct {
+	b           backend.GreetingBackend
+	size        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+	clock       backend.Clock
+	requests    *metrics.Counter
+	evictions   *metrics.Counter
+
+	mtx     sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	calls   map[string]*call
+	stats   Stats
+	// watching is true while the cache watches the backend for changes
+	watching bool
+
+	closeC    chan bool
+	closeOnce sync.Once
+	watchWg   sync.WaitGroup
+}
+
+// entry is a cached greeting, greeting is nil if it does not exist
+type entry struct {
+	id       string
+	greeting *backend.Greeting
+	fetched  time.Time
+	expires  time.Time
+}
+
+// call is a read of the greeting from the backend in flight,
+// concurrent misses wait for it instead of reading again
+type call struct {
+	wg       sync.WaitGroup
+	greeting *backend.Greeting
+	err      error
+	// stale is set if the greeting has changed during the read,
+	// so the result is returned, but not cached
+	stale bool
+}
+
+// New returns backend caching greetings of the backend b
+//
+//  b = cachebk.New(b, cachebk.Size(4096), cachebk.TTL(time.Minute))
+//
+func New(b backend.GreetingBackend, options ...Option) *Backend {
+	c := &Backend{
+		b:           b,
+		size:        DefaultSize,
+		ttl:         DefaultTTL,
+		negativeTTL: DefaultNegativeTTL,
+		clock:       backend.SystemClock{},
+		lru:         list.New(),
+		entries:     make(map[string]*list.Element),
+		calls:       make(map[string]*call),
+		closeC:      make(chan bool),
+	}
+	for _, o := range options {
+		o(c)
+	}
+	c.watchWg.Add(1)
+	go c.watchLoop()
+	return c
+}
+
+// Stats returns the cache statistics
+func (c *Backend) Stats() Stats {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	s := c.stats
+	s.Len = c.lru.Len()
+	return s
+}
+
+// Purge drops all cached greetings, e.g. when the decorated backend is swapped
+func (c *Backend) Purge() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.purge()
+}
+
+// setWatching purges the cache when the watch starts or stops,
+// as greetings might have changed while we were not watching
+func (c *Backend) setWatching(watching bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.purge()
+	c.watching = watching
+}
+
+func (c *Backend) isWatching() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.watching
+}
+
+func (c *Backend) purge() {
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+	for id, cl := range c.calls {
+		cl.stale = true
+		delete(c.calls, id)
+	}
+}
+
+// invalidate drops the cached greeting, and makes sure
+// the read in flight does not cache the old value
+func (c *Backend) invalidate(id string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if el, ok := c.entries[id]; ok {
+		c.lru.Remove(el)
+		delete(c.entries, id)
+	}
+	if cl, ok := c.calls[id]; ok {
+		cl.stale = true
+		delete(c.calls, id)
+	}
+}
+
+func (c *Backend) GetGreeting(id string) (*backend.Greeting, error) {
+	c.mtx.Lock()
+	now := c.clock.Now()
+	if el, ok := c.entries[id]; ok {
+		e := el.Value.(*entry)
+		if now.Before(e.expires) {
+			c.lru.MoveToFront(el)
+			c.hit()
+			c.mtx.Unlock()
+			return e.get(now)
+		}
+		c.lru.Remove(el)
+		delete(c.entries, id)
+	}
+	c.miss()
+	if cl, ok := c.calls[id]; ok {
+		c.mtx.Unlock()
+		cl.wg.Wait()
+		return cl.result()
+	}
+	cl := &call{}
+	cl.wg.Add(1)
+	c.calls[id] = cl
+	c.mtx.Unlock()
+
+	g, err := c.b.GetGreeting(id)
+
+	c.mtx.Lock()
+	cl.greeting, cl.err = g, err
+	if !cl.stale {
+		delete(c.calls, id)
+		c.store(id, g, err, now)
+	}
+	c.mtx.Unlock()
+	cl.wg.Done()
+	return cl.result()
+}
+
+// store caches the result of the read started at now, errors other
+// than NotFound are not cached
+func (c *Backend) store(id string, g *backend.Greeting, err error, now time.Time) {
+	e := &entry{id: id, fetched: now}
+	switch err.(type) {
+	case nil:
+		e.greeting = clone(g)
+		e.expires = now.Add(c.ttl)
+		if g.TTL > 0 && g.TTL < c.ttl {
+			e.expires = now.Add(g.TTL)
+		}
+	case *backend.NotFoundError:
+		if c.negativeTTL <= 0 {
+			return
+		}
+		e.expires = now.Add(c.negativeTTL)
+	default:
+		return
+	}
+	if c.size <= 0 {
+		return
+	}
+	c.entries[id] = c.lru.PushFront(e)
+	for c.lru.Len() > c.size {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.entries, el.Value.(*entry).id)
+		c.stats.Evictions++
+		if c.evictions != nil {
+			c.evictions.Inc()
+		}
+	}
+}
+
+func (c *Backend) hit() {
+	c.stats.Hits++
+	if c.requests != nil {
+		c.requests.Inc("hit")
+	}
+}
+
+func (c *Backend) miss() {
+	c.stats.Misses++
+	if c.requests != nil {
+		c.requests.Inc("miss")
+	}
+}
+
+// get returns a copy of the cached greeting with the time left
+// before it expires, or NotFoundError
+func (e *entry) get(now time.Time) (*backend.Greeting, error) {
+	if e.greeting == nil {
+		return nil, &backend.NotFoundError{ID: e.id}
+	}
+	g := clone(e.greeting)
+	if g.TTL > 0 {
+		g.TTL -= now.Sub(e.fetched)
+	}
+	return g, nil
+}
+
+// result returns a copy of the greeting read, so callers can't change
+// the cached one
+func (cl *call) result() (*backend.Greeting, error) {
+	if cl.err != nil {
+		return nil, cl.err
+	}
+	return clone(cl.greeting), nil
+}
+
+// clone returns a deep copy of the greeting
+func clone(g *backend.Greeting) *backend.Greeting {
+	out := *g
+	out.Tags = append([]string(nil), g.Tags...)
+	return &out
+}
+
+// UpsertGreeting writes the greeting and invalidates it, failed
+// writes invalidate it too, e.g. conflicts mean the cached greeting is stale
+func (c *Backend) UpsertGreeting(id, val string, opts ...backend.WriteOption) error {
+	err := c.b.UpsertGreeting(id, val, opts...)
+	c.invalidate(id)
+	return err
+}
+
+func (c *Backend) DeleteGreeting(id string, opts ...backend.WriteOption) error {
+	err := c.b.DeleteGreeting(id, opts...)
+	c.invalidate(id)
+	return err
+}
+
+func (c *Backend) GetGreetings(prefix, cursor string, limit int) ([]backend.Greeting, string, error) {
+	return c.b.GetGreetings(prefix, cursor, limit)
+}
+
+func (c *Backend) WatchGreetings(stopC <-chan bool) (<-chan backend.GreetingEvent, error) {
+	return c.b.WatchGreetings(stopC)
+}
+
+// GetHistory returns the history of the greeting, it is not cached,
+// see backend.HistoryBackend
+func (c *Backend) GetHistory(id string) ([]backend.Version, error) {
+	return backend.GetHistory(c.b, id)
+}
+
+// AppendAuditEvent stores the audit event, see backend.AuditBackend
+func (c *Backend) AppendAuditEvent(data string) error {
+	a, err := backend.GetAuditBackend(c.b)
+	if err != nil {
+		return err
+	}
+	return a.AppendAuditEvent(data)
+}
+
+// GetAuditEvents returns the audit events, they are not cached
+func (c *Backend) GetAuditEvents() ([]string, error) {
+	a, err := backend.GetAuditBackend(c.b)
+	if err != nil {
+		return nil, err
+	}
+	return a.GetAuditEvents()
+}
+
+func (c *Backend) Ping() error {
+	return c.b.Ping()
+}
+
+// Close stops watching the decorated backend and closes it
+func (c *Backend) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closeC)
+	})
+	c.watchWg.Wait()
+	return c.b.Close()
+}
+
+// watchLoop invalidates greetings changed in the backend until the cache
+// is closed, it watches again whenever the watch stops
+func (c *Backend) watchLoop() {
+	defer c.watchWg.Done()
+	for {
+		events, err := c.b.WatchGreetings(c.closeC)
+		if err != nil {
+			log.Warningf("cache failed to watch backend, greetings are cached for %v: %v", c.ttl, err)
+		} else {
+			c.setWatching(true)
+			for e := range events {
+				c.invalidate(e.ID)
+			}
+			c.setWatching(false)
+		}
+		select {
+		case <-c.closeC:
+			return
+		case <-time.After(WatchRetryPeriod):
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package cachebk
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/check.v1"
+	"github.com/gravitational/hello/backend"
+	"github.com/gravitational/hello/backend/membk"
+	"github.com/gravitational/hello/backend/test"
+	"github.com/gravitational/hello/metrics"
+)
+
+// Cache backend is tested with the acceptance suite to make sure
+// it does not change the behavior of the decorated backend
+func TestCache(t *testing.T) { TestingT(t) }
+
+type CacheSuite struct {
+	clock *test.FakeClock
+	mem   *membk.MemBackend
+	b     *countingBackend
+	bk    *Backend
+	suite test.BackendSuite
+}
+
+var _ = Suite(&CacheSuite{})
+
+func (s *CacheSuite) SetUpTest(c *C) {
+	s.clock = test.NewFakeClock(time.Date(2015, 12, 25, 0, 0, 0, 0, time.UTC))
+	var err error
+	s.mem, err = membk.New(membk.Clock(s.clock))
+	c.Assert(err, IsNil)
+	s.b = &countingBackend{GreetingBackend: s.mem}
+	s.bk = nil
+	s.newCache(c)
+}
+
+// newCache replaces the cache with a new one watching the memory backend for changes,
+// tests write the greetings to the memory backend before creating the cache,
+// so the change events of the writes don't invalidate the cache during the test
+func (s *CacheSuite) newCache(c *C, options ...Option) {
+	if s.bk != nil {
+		c.Assert(s.bk.Close(), IsNil)
+	}
+	options = append([]Option{Size(2), TTL(time.Minute), NegativeTTL(time.Second), Clock(s.clock)}, options...)
+	s.bk = New(s.b, options...)
+	s.suite.B = s.bk
+	waitWatching(c, s.bk)
+}
+
+func (s *CacheSuite) TearDownTest(c *C) {
+	c.Assert(s.bk.Close(), IsNil)
+	c.Assert(s.mem.Close(), IsNil)
+}
+
+func (s *CacheSuite) TestGreetingCRUD(c *C) {
+	s.suite.GreetingCRUD(c)
+}
+
+func (s *CacheSuite) TestGreetingsList(c *C) {
+	s.suite.GreetingsList(c)
+}
+
+func (s *CacheSuite) TestMetadata(c *C) {
+	s.suite.Metadata(c)
+}
+
+func (s *CacheSuite) TestConditionalWrites(c *C) {
+	s.suite.ConditionalWrites(c)
+}
+
+func (s *CacheSuite) TestGreetingsTTL(c *C) {
+	s.suite.GreetingsTTL(c)
+}
+
+func (s *CacheSuite) TestConcurrency(c *C) {
+	s.suite.Concurrency(c)
+}
+
+func (s *CacheSuite) TestGreetingsWatch(c *C) {
+	s.suite.GreetingsWatch(c)
+}
+
+func (s *CacheSuite) TestPing(c *C) {
+	s.suite.Ping(c)
+}
+
+func (s *CacheSuite) TestHistory(c *C) {
+	s.suite.History(c)
+}
+
+func (s *CacheSuite) TestAuditEvents(c *C) {
+	s.suite.AuditEvents(c)
+}
+
+func (s *CacheSuite) TestHits(c *C) {
+	c.Assert(s.mem.UpsertGreeting("hello.us", "Hello"), IsNil)
+	s.newCache(c)
+	for i := 0; i < 3; i++ {
+		g, err := s.bk.GetGreeting("hello.us")
+		c.Assert(err, IsNil)
+		c.Assert(g.Value, Equals, "Hello")
+		// callers can't change the cached greeting
+		g.Value = "Howdy"
+	}
+	c.Assert(s.b.gets(), Equals, 1)
+	c.Assert(s.bk.Stats(), DeepEquals, Stats{Hits: 2, Misses: 1, Len: 1})
+
+	// expired greetings are read again
+	s.clock.Advance(time.Minute)
+	_, err := s.bk.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(s.b.gets(), Equals, 2)
+
+	// writes invalidate cached greetings
+	c.Assert(s.bk.UpsertGreeting("hello.us", "Howdy"), IsNil)
+	g, err := s.bk.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(g.Value, Equals, "Howdy")
+	c.Assert(s.bk.DeleteGreeting("hello.us"), IsNil)
+	_, err = s.bk.GetGreeting("hello.us")
+	c.Assert(err, FitsTypeOf, &backend.NotFoundError{})
+	c.Assert(s.b.gets(), Equals, 4)
+}
+
+func (s *CacheSuite) TestNegative(c *C) {
+	for i := 0; i < 3; i++ {
+		_, err := s.bk.GetGreeting("hello.us")
+		c.Assert(err, FitsTypeOf, &backend.NotFoundError{})
+	}
+	c.Assert(s.b.gets(), Equals, 1)
+
+	s.clock.Advance(time.Second)
+	_, err := s.bk.GetGreeting("hello.us")
+	c.Assert(err, FitsTypeOf, &backend.NotFoundError{})
+	c.Assert(s.b.gets(), Equals, 2)
+
+	// creating the greeting invalidates it's absence
+	c.Assert(s.bk.UpsertGreeting("hello.us", "Hello", backend.Create()), IsNil)
+	g, err := s.bk.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(g.Value, Equals, "Hello")
+
+	// negative caching can be turned off
+	s.newCache(c, NegativeTTL(0))
+	gets := s.b.gets()
+	for i := 0; i < 2; i++ {
+		_, err := s.bk.GetGreeting("hello.fr")
+		c.Assert(err, FitsTypeOf, &backend.NotFoundError{})
+	}
+	c.Assert(s.b.gets(), Equals, gets+2)
+}
+
+func (s *CacheSuite) TestGreetingTTL(c *C) {
+	c.Assert(s.mem.UpsertGreeting("hello.xmas", "Merry Christmas", backend.TTL(30*time.Second)), IsNil)
+	s.newCache(c)
+	g, err := s.bk.GetGreeting("hello.xmas")
+	c.Assert(err, IsNil)
+	c.Assert(g.TTL, Equals, 30*time.Second)
+
+	// cached greetings report the time left
+	s.clock.Advance(10 * time.Second)
+	g, err = s.bk.GetGreeting("hello.xmas")
+	c.Assert(err, IsNil)
+	c.Assert(g.TTL, Equals, 20*time.Second)
+	c.Assert(s.b.gets(), Equals, 1)
+
+	// and are not served after they expire, even if the cache TTL is longer
+	s.clock.Advance(20 * time.Second)
+	_, err = s.bk.GetGreeting("hello.xmas")
+	c.Assert(err, FitsTypeOf, &backend.NotFoundError{})
+	c.Assert(s.b.gets(), Equals, 2)
+}
+
+func (s *CacheSuite) TestEviction(c *C) {
+	for _, id := range []string{"hello.us", "hello.fr", "hello.sp"} {
+		c.Assert(s.mem.UpsertGreeting(id, "Hello"), IsNil)
+	}
+	s.newCache(c)
+	for _, id := range []string{"hello.us", "hello.fr", "hello.us", "hello.sp"} {
+		_, err := s.bk.GetGreeting(id)
+		c.Assert(err, IsNil)
+	}
+	// hello.fr is the least recently used
+	c.Assert(s.bk.Stats(), DeepEquals, Stats{Hits: 1, Misses: 3, Evictions: 1, Len: 2})
+	for _, id := range []string{"hello.us", "hello.sp"} {
+		_, err := s.bk.GetGreeting(id)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(s.b.gets(), Equals, 3)
+	_, err := s.bk.GetGreeting("hello.fr")
+	c.Assert(err, IsNil)
+	c.Assert(s.b.gets(), Equals, 4)
+}
+
+func (s *CacheSuite) TestSingleFlight(c *C) {
+	c.Assert(s.mem.UpsertGreeting("hello.us", "Hello"), IsNil)
+	s.newCache(c)
+	startedC, doneC := s.b.block()
+
+	const readers = 10
+	wg := sync.WaitGroup{}
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g, err := s.bk.GetGreeting("hello.us")
+			c.Assert(err, IsNil)
+			c.Assert(g.Value, Equals, "Hello")
+		}()
+	}
+	<-startedC
+	for s.bk.Stats().Misses != readers {
+		time.Sleep(time.Millisecond)
+	}
+	close(doneC)
+	wg.Wait()
+	c.Assert(s.b.gets(), Equals, 1)
+}
+
+func (s *CacheSuite) TestWriteDuringRead(c *C) {
+	c.Assert(s.mem.UpsertGreeting("hello.us", "Hello"), IsNil)
+	s.newCache(c)
+	startedC, doneC := s.b.block()
+
+	resultC := make(chan string, 1)
+	go func() {
+		g, err := s.bk.GetGreeting("hello.us")
+		c.Assert(err, IsNil)
+		resultC <- g.Value
+	}()
+	<-startedC
+	c.Assert(s.bk.UpsertGreeting("hello.us", "Howdy"), IsNil)
+	close(doneC)
+	c.Assert(<-resultC, Equals, "Hello")
+
+	// the value read before the write is not cached
+	g, err := s.bk.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(g.Value, Equals, "Howdy")
+}
+
+func (s *CacheSuite) TestWatchInvalidation(c *C) {
+	c.Assert(s.bk.UpsertGreeting("hello.us", "Hello"), IsNil)
+	_, err := s.bk.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+
+	// another server changes the greeting behind the cache's back
+	c.Assert(s.mem.UpsertGreeting("hello.us", "Howdy"), IsNil)
+	timeout := time.After(test.WaitTimeout)
+	for {
+		g, err := s.bk.GetGreeting("hello.us")
+		c.Assert(err, IsNil)
+		if g.Value == "Howdy" {
+			break
+		}
+		select {
+		case <-timeout:
+			c.Fatalf("timeout waiting for the cached greeting to be invalidated")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (s *CacheSuite) TestMetrics(c *C) {
+	r := metrics.NewRegistry()
+	c.Assert(s.mem.UpsertGreeting("hello.us", "Hello"), IsNil)
+	s.newCache(c, Size(1), Metrics(r))
+	for _, id := range []string{"hello.us", "hello.us", "hello.fr"} {
+		s.bk.GetGreeting(id)
+	}
+	buf := &bytes.Buffer{}
+	_, err := r.WriteTo(buf)
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Matches, `(?s).*hello_backend_cache_requests_total\{result="hit"\} 1\n.*`)
+	c.Assert(buf.String(), Matches, `(?s).*hello_backend_cache_requests_total\{result="miss"\} 2\n.*`)
+	c.Assert(buf.String(), Matches, `(?s).*hello_backend_cache_evictions_total 1\n.*`)
+}
+
+// waitWatching waits until the cache watches the backend, so the purge
+// at the start of the watch does not interfere with the test
+func waitWatching(c *C, bk *Backend) {
+	timeout := time.After(test.WaitTimeout)
+	for !bk.isWatching() {
+		select {
+		case <-timeout:
+			c.Fatalf("timeout waiting for the cache to watch the backend")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// countingBackend counts greeting reads, and blocks the first read
+// after block is called until doneC is closed, the read returns the greeting
+// as it was before blocking. Closing it does not close
+// the memory backend, so tests can replace the cache.
+type countingBackend struct {
+	backend.GreetingBackend
+	mtx      sync.Mutex
+	count    int
+	startedC chan bool
+	doneC    chan bool
+}
+
+func (b *countingBackend) Close() error {
+	return nil
+}
+
+func (b *countingBackend) GetHistory(id string) ([]backend.Version, error) {
+	return backend.GetHistory(b.GreetingBackend, id)
+}
+
+func (b *countingBackend) AppendAuditEvent(data string) error {
+	return b.GreetingBackend.(backend.AuditBackend).AppendAuditEvent(data)
+}
+
+func (b *countingBackend) GetAuditEvents() ([]string, error) {
+	return b.GreetingBackend.(backend.AuditBackend).GetAuditEvents()
+}
+
+// block returns the channel closed when the read starts blocking,
+// and the channel to close to unblock it
+func (b *countingBackend) block() (chan bool, chan bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.startedC = make(chan bool)
+	b.doneC = make(chan bool)
+	return b.startedC, b.doneC
+}
+
+func (b *countingBackend) gets() int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.count
+}
+
+func (b *countingBackend) GetGreeting(id string) (*backend.Greeting, error) {
+	b.mtx.Lock()
+	b.count++
+	startedC, doneC := b.startedC, b.doneC
+	b.startedC = nil
+	b.mtx.Unlock()
+	g, err := b.GreetingBackend.GetGreeting(id)
+	if startedC != nil {
+		close(startedC)
+		<-doneC
+	}
+	return g, err
+}
+
+func (s *CacheSuite) TestClose(c *C) {
+	s.suite.Close(c)
+}
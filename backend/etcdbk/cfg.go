@@ -7,10 +7,24 @@ import (
 	"github.com/gravitational/hello/backend"
 )
 
+func init() {
+	backend.Register(backend.Registration{
+		Name:        "etcd",
+		Description: "etcd cluster, greetings are shared by the servers using the same key",
+		Params: []backend.Param{
+			{Name: "nodes", Type: backend.StringsParam, Required: true, Description: "etcd node URLs, e.g. http://localhost:4001"},
+			{Name: "key", Type: backend.StringParam, Required: true, Description: "etcd key greetings are stored under, e.g. /hello"},
+			{Name: "historySize", Type: backend.IntParam, Description: "how many changes of each greeting are kept in it's history, 10 by default"},
+		},
+		New: FromString,
+	})
+}
+
 // cfg represents JSON config for etcd backlend
 type cfg struct {
-	Nodes []string `json:"nodes"`
-	Key   string   `json:"key"`
+	Nodes       []string `json:"nodes"`
+	Key         string   `json:"key"`
+	HistorySize *int     `json:"historySize"`
 }
 
 // FromString initializes the backend from backend-specific configuration string
@@ -25,5 +39,9 @@ func FromString(v string) (backend.GreetingBackend, error) {
 	if err := json.Unmarshal([]byte(v), &c); err != nil {
 		return nil, fmt.Errorf("invalid backend configuration format, err: %v", err)
 	}
-	return New(c.Nodes, c.Key)
+	var options []BackendOption
+	if c.HistorySize != nil {
+		options = append(options, HistorySize(*c.HistorySize))
+	}
+	return New(c.Nodes, c.Key, options...)
 }
@@ -2,10 +2,14 @@
 package etcdbk
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/coreos/go-etcd/etcd"
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/mailgun/log"
 	"github.com/gravitational/hello/backend"
 )
 
@@ -18,14 +22,28 @@ func Consistency(v string) BackendOption {
 	}
 }
 
+// HistorySize sets how many of the most recent changes of each greeting
+// are kept in it's history under <key>/history/<id>, see backend.HistoryBackend
+func HistorySize(n int) BackendOption {
+	return func(b *bk) error {
+		if n < 0 {
+			return fmt.Errorf("history size should be non-negative, got %v", n)
+		}
+		b.historySize = n
+		return nil
+	}
+}
+
 type bk struct {
 	nodes []string
 
 	etcdConsistency string
 	etcdKey         string
+	historySize     int
 	client          *etcd.Client
-	cancelC         chan bool
-	stopC           chan bool
+	// stopC is closed when backend closes to stop all watches
+	stopC     chan bool
+	closeOnce sync.Once
 }
 
 func New(nodes []string, etcdKey string, options ...BackendOption) (backend.GreetingBackend, error) {
@@ -38,10 +56,10 @@ func New(nodes []string, etcdKey string, options ...BackendOption) (backend.Gree
 	}
 
 	b := &bk{
-		nodes:   nodes,
-		etcdKey: etcdKey,
-		cancelC: make(chan bool, 1),
-		stopC:   make(chan bool, 1),
+		nodes:       nodes,
+		etcdKey:     etcdKey,
+		historySize: backend.DefaultHistorySize,
+		stopC:       make(chan bool),
 	}
 	b.etcdConsistency = etcd.WEAK_CONSISTENCY
 	for _, o := range options {
@@ -55,7 +73,11 @@ func New(nodes []string, etcdKey string, options ...BackendOption) (backend.Gree
 	return b, nil
 }
 
+// Close stops the watches, closing the closed backend does nothing
 func (b *bk) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.stopC)
+	})
 	return nil
 }
 
@@ -68,25 +90,368 @@ func (b *bk) reconnect() error {
 	return nil
 }
 
-func (b *bk) UpsertGreeting(id, greeting string) error {
-	_, err := b.client.Set(b.key("greetings", id), greeting, 0)
-	return convertErr(err)
+// maxUpsertAttempts is the number of times the unconditional upsert is tried
+// before it gives up on the greeting that keeps changing
+const maxUpsertAttempts = 10
+
+// UpsertGreeting maps conditional writes on etcd's Create and CompareAndSwap,
+// greeting revision is etcd's modified index and TTL is etcd's native TTL.
+// Greetings are stored as records encoded with backend.EncodeRecord.
+// Unconditional upserts that lose the race with other changes of the greeting
+// are retried up to maxUpsertAttempts times, then ConflictError is returned.
+func (b *bk) UpsertGreeting(id, greeting string, opts ...backend.WriteOption) error {
+	o := backend.GetWriteOptions(opts)
+	for attempt := 1; ; attempt++ {
+		re, err := b.upsert(id, greeting, o)
+		if err != nil {
+			if !retry(err) || o.Create || o.Revision != 0 {
+				return err
+			}
+			if attempt < maxUpsertAttempts {
+				continue
+			}
+			if _, ok := err.(*backend.ConflictError); ok {
+				return err
+			}
+			return &backend.ConflictError{ID: id, Message: "greeting was deleted while it was upserted"}
+		}
+		b.record(id, o, backend.Version{Revision: re.Node.ModifiedIndex, Value: greeting, Template: o.Template})
+		o.SetWritten(re.Node.ModifiedIndex)
+		return nil
+	}
+}
+
+// upsert writes the greeting record keeping the creation time of the greeting
+// it replaces. Unconditional upserts are made conditional on the greeting read,
+// so they fail with ConflictError or NotFoundError and should be retried
+// if the greeting changes in between.
+func (b *bk) upsert(id, val string, o backend.WriteOptions) (*etcd.Response, error) {
+	var current *backend.Greeting
+	if !o.Create {
+		g, err := b.GetGreeting(id)
+		switch err.(type) {
+		case nil:
+			current = g
+		case *backend.NotFoundError:
+		default:
+			return nil, err
+		}
+	}
+	data, err := backend.EncodeRecord(backend.NewGreeting(id, val, current, o, time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	key, ttl := b.key("greetings", id), ttlSeconds(o.TTL)
+	var re *etcd.Response
+	switch {
+	case o.Create || (o.Revision == 0 && current == nil):
+		re, err = b.client.Create(key, data, ttl)
+	case o.Revision != 0:
+		re, err = b.client.CompareAndSwap(key, data, ttl, "", o.Revision)
+	default:
+		re, err = b.client.CompareAndSwap(key, data, ttl, "", current.Revision)
+	}
+	return re, convertErr(err)
+}
+
+// retry returns true if the unconditional upsert lost the race
+// with another change of the greeting
+func retry(err error) bool {
+	switch err.(type) {
+	case *backend.ConflictError, *backend.NotFoundError:
+		return true
+	}
+	return false
+}
+
+// ttlSeconds converts TTL to etcd TTL in seconds, rounding up
+// so short TTLs don't turn into "never expires"
+func ttlSeconds(d time.Duration) uint64 {
+	if d <= 0 {
+		return 0
+	}
+	return uint64((d + time.Second - 1) / time.Second)
 }
 
-func (b *bk) GetGreeting(id string) (string, error) {
+func (b *bk) GetGreeting(id string) (*backend.Greeting, error) {
 	re, err := b.client.Get(b.key("greetings", id), false, false)
 	if err != nil {
-		return "", convertErr(err)
+		return nil, convertErr(err)
+	}
+	return toGreeting(id, re.Node)
+}
+
+// toGreeting decodes the greeting record stored in the node,
+// bare strings stored by older versions are read as values
+func toGreeting(id string, n *etcd.Node) (*backend.Greeting, error) {
+	g := &backend.Greeting{
+		ID:       id,
+		Revision: n.ModifiedIndex,
+		TTL:      time.Duration(n.TTL) * time.Second,
+	}
+	if err := backend.DecodeRecord(n.Value, g); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// DeleteGreeting deletes the greeting, conditional delete maps on etcd's CompareAndDelete
+func (b *bk) DeleteGreeting(id string, opts ...backend.WriteOption) error {
+	o := backend.GetWriteOptions(opts)
+	var re *etcd.Response
+	var err error
+	if o.Revision != 0 {
+		re, err = b.client.CompareAndDelete(b.key("greetings", id), "", o.Revision)
+	} else {
+		re, err = b.client.Delete(b.key("greetings", id), true)
+	}
+	if err != nil {
+		return convertErr(err)
+	}
+	b.record(id, o, backend.Version{Revision: re.Node.ModifiedIndex, Deleted: true})
+	return nil
+}
+
+// version is a change of the greeting stored in <key>/history/<id>/<revision>,
+// revisions are zero padded, so the changes are sorted by revision
+type version struct {
+	Revision uint64    `json:"revision"`
+	Value    string    `json:"value,omitempty"`
+	Template bool      `json:"template,omitempty"`
+	Deleted  bool      `json:"deleted,omitempty"`
+	Author   string    `json:"author,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// record adds the change to the greeting history and drops the oldest changes.
+// The change has been made already, so failures are logged and not returned,
+// the history may miss changes if etcd fails in between.
+func (b *bk) record(id string, o backend.WriteOptions, v backend.Version) {
+	if o.NoHistory || b.historySize <= 0 {
+		return
+	}
+	data, err := json.Marshal(version{
+		Revision: v.Revision, Value: v.Value, Template: v.Template, Deleted: v.Deleted,
+		Author: o.Author, Time: time.Now().UTC()})
+	if err != nil {
+		log.Errorf("failed to record history of %v: %v", id, err)
+		return
+	}
+	dir := b.key("history", id)
+	if _, err := b.client.Set(fmt.Sprintf("%v/%020d", dir, v.Revision), string(data), 0); err != nil {
+		log.Errorf("failed to record history of %v: %v", id, err)
+		return
+	}
+	re, err := b.client.Get(dir, true, false)
+	if err != nil {
+		log.Errorf("failed to trim history of %v: %v", id, err)
+		return
+	}
+	nodes := versionNodes(re.Node)
+	for i := 0; i < len(nodes)-b.historySize; i++ {
+		if _, err := b.client.Delete(nodes[i].Key, false); err != nil && !notFound(err) {
+			log.Errorf("failed to trim history of %v: %v", id, err)
+			return
+		}
+	}
+}
+
+// GetHistory returns the changes of the greeting recorded under <key>/history/<id>,
+// most recent first, see backend.HistoryBackend
+func (b *bk) GetHistory(id string) ([]backend.Version, error) {
+	re, err := b.client.Get(b.key("history", id), true, false)
+	if err != nil {
+		if notFound(err) {
+			return nil, &backend.NotFoundError{ID: id}
+		}
+		return nil, convertErr(err)
+	}
+	nodes := versionNodes(re.Node)
+	if len(nodes) == 0 {
+		return nil, &backend.NotFoundError{ID: id}
+	}
+	out := make([]backend.Version, 0, len(nodes))
+	for i := len(nodes) - 1; i >= 0; i-- {
+		var v version
+		if err := json.Unmarshal([]byte(nodes[i].Value), &v); err != nil {
+			return nil, fmt.Errorf("broken history record %v: %v", nodes[i].Key, err)
+		}
+		out = append(out, backend.Version{
+			Revision: v.Revision, Value: v.Value, Template: v.Template, Deleted: v.Deleted,
+			Author: v.Author, Time: v.Time})
 	}
-	return re.Node.Value, nil
+	return out, nil
 }
 
-// DeleteUser deletes a user with all the keys from the backend
-func (b *bk) DeleteGreeting(id string) error {
-	_, err := b.client.Delete(b.key("greetings", id), true)
+// versionNodes returns the history records of the greeting sorted by revision,
+// skipping the directories of the greetings with ids prefixed by this one's id,
+// e.g. <key>/history/hello/us/... of the greeting 'hello/us' in the history of 'hello'
+func versionNodes(dir *etcd.Node) etcd.Nodes {
+	var nodes etcd.Nodes
+	for _, n := range dir.Nodes {
+		if !n.Dir {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// AppendAuditEvent stores the audit event under <key>/audit, in-order
+// keys keep the events sorted, see backend.AuditBackend
+func (b *bk) AppendAuditEvent(data string) error {
+	_, err := b.client.CreateInOrder(b.key("audit"), data, 0)
 	return convertErr(err)
 }
 
+// GetAuditEvents returns the audit events stored under <key>/audit
+// in the order they were appended
+func (b *bk) GetAuditEvents() ([]string, error) {
+	re, err := b.client.Get(b.key("audit"), true, false)
+	if err != nil {
+		if notFound(err) {
+			return []string{}, nil
+		}
+		return nil, convertErr(err)
+	}
+	out := make([]string, 0, len(re.Node.Nodes))
+	for _, n := range re.Node.Nodes {
+		out = append(out, n.Value)
+	}
+	return out, nil
+}
+
+// GetGreetings reads all greetings stored under <key>/greetings with
+// a single recursive Get and returns the requested page
+func (b *bk) GetGreetings(prefix, cursor string, limit int) ([]backend.Greeting, string, error) {
+	dir := b.key("greetings")
+	re, err := b.client.Get(dir, true, true)
+	if err != nil {
+		if notFound(err) {
+			return []backend.Greeting{}, "", nil
+		}
+		return nil, "", convertErr(err)
+	}
+	gs := []backend.Greeting{}
+	// etcd always returns absolute keys, regardless of the key we've configured
+	if err := collect("/"+strings.Trim(dir, "/")+"/", re.Node, &gs); err != nil {
+		return nil, "", err
+	}
+	out, next := backend.Page(gs, prefix, cursor, limit)
+	return out, next, nil
+}
+
+// collect walks the etcd directory and collects all greetings stored in it
+func collect(dir string, n *etcd.Node, gs *[]backend.Greeting) error {
+	for _, c := range n.Nodes {
+		if c.Dir {
+			if err := collect(dir, c, gs); err != nil {
+				return err
+			}
+			continue
+		}
+		g, err := toGreeting(strings.TrimPrefix(c.Key, dir), c)
+		if err != nil {
+			return err
+		}
+		*gs = append(*gs, *g)
+	}
+	return nil
+}
+
+// WatchGreetings streams changes under <key>/greetings using etcd watch
+func (b *bk) WatchGreetings(stopC <-chan bool) (<-chan backend.GreetingEvent, error) {
+	dir := b.key("greetings")
+	// start watching right after the current index, so no changes made
+	// after the call are missed while the watch request is in flight
+	index, err := b.index(dir)
+	if err != nil {
+		return nil, err
+	}
+	receiver := make(chan *etcd.Response)
+	stopWatchC := make(chan bool)
+	go func() {
+		_, err := b.client.Watch(dir, index+1, true, receiver, stopWatchC)
+		if err != nil && err != etcd.ErrWatchStoppedByUser {
+			log.Errorf("watch %v stopped: %v", dir, err)
+		}
+	}()
+
+	prefix := "/" + strings.Trim(dir, "/") + "/"
+	out := make(chan backend.GreetingEvent)
+	go func() {
+		defer func() {
+			close(stopWatchC)
+			// watch may be blocked on sending the response, unblock it
+			// so it notices the stop channel, it closes receiver on exit
+			for range receiver {
+			}
+			close(out)
+		}()
+		for {
+			select {
+			case re, ok := <-receiver:
+				if !ok {
+					return
+				}
+				if re.Node.Dir {
+					continue
+				}
+				select {
+				case out <- toEvent(prefix, re):
+				case <-stopC:
+					return
+				case <-b.stopC:
+					return
+				}
+			case <-stopC:
+				return
+			case <-b.stopC:
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// Ping makes a round-trip to etcd to make sure it's reachable
+func (b *bk) Ping() error {
+	_, err := b.index(b.key("greetings"))
+	return err
+}
+
+// index returns the current etcd index
+func (b *bk) index(key string) (uint64, error) {
+	re, err := b.client.Get(key, false, false)
+	if err != nil {
+		if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode == 100 {
+			return e.Index, nil
+		}
+		return 0, convertErr(err)
+	}
+	return re.EtcdIndex, nil
+}
+
+func toEvent(prefix string, re *etcd.Response) backend.GreetingEvent {
+	e := backend.GreetingEvent{
+		ID:       strings.TrimPrefix(re.Node.Key, prefix),
+		Revision: re.Node.ModifiedIndex,
+	}
+	switch re.Action {
+	case "delete", "expire", "compareAndDelete":
+		e.Type = backend.EventDelete
+	default:
+		e.Type = backend.EventUpsert
+		g, err := toGreeting(e.ID, re.Node)
+		if err != nil {
+			log.Warningf("failed to decode %v: %v", re.Node.Key, err)
+			e.Value = re.Node.Value
+			break
+		}
+		e.Value = g.Value
+	}
+	return e
+}
+
 func notFound(e error) bool {
 	err, ok := e.(*etcd.EtcdError)
 	return ok && err.ErrorCode == 100
@@ -98,8 +463,18 @@ func convertErr(e error) error {
 	}
 	switch err := e.(type) {
 	case *etcd.EtcdError:
-		if err.ErrorCode == 100 {
+		switch err.ErrorCode {
+		case 100: // key not found
 			return &backend.NotFoundError{ID: err.Cause}
+		case 101: // compare failed
+			return &backend.ConflictError{ID: err.Cause, Message: err.Message}
+		case 105: // key already exists
+			return &backend.ConflictError{ID: err.Cause, Message: err.Message}
+		case etcd.ErrCodeEtcdNotReachable:
+			return &backend.UnavailableError{Message: err.Message}
+		}
+		if err.ErrorCode >= 300 && err.ErrorCode < 400 { // raft and leader election errors
+			return &backend.UnavailableError{Message: err.Message}
 		}
 	}
 	return e
@@ -3,9 +3,11 @@ package etcdbk
 import (
 	"os"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/coreos/go-etcd/etcd"
+	"github.com/gravitational/hello/backend"
 	"github.com/gravitational/hello/backend/test"
 
 	. "github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/check.v1"
@@ -61,3 +63,92 @@ func (s *EtcdSuite) SetUpTest(c *C) {
 func (s *EtcdSuite) TestGreetingCRUD(c *C) {
 	s.suite.GreetingCRUD(c)
 }
+
+func (s *EtcdSuite) TestGreetingsList(c *C) {
+	s.suite.GreetingsList(c)
+}
+
+func (s *EtcdSuite) TestMetadata(c *C) {
+	s.suite.Metadata(c)
+}
+
+func (s *EtcdSuite) TestConditionalWrites(c *C) {
+	s.suite.ConditionalWrites(c)
+}
+
+func (s *EtcdSuite) TestGreetingsTTL(c *C) {
+	s.suite.GreetingsTTL(c)
+}
+
+func (s *EtcdSuite) TestConcurrency(c *C) {
+	s.suite.Concurrency(c)
+}
+
+func (s *EtcdSuite) TestGreetingsWatch(c *C) {
+	s.suite.GreetingsWatch(c)
+}
+
+func (s *EtcdSuite) TestPing(c *C) {
+	s.suite.Ping(c)
+}
+
+func (s *EtcdSuite) TestHistory(c *C) {
+	s.suite.History(c)
+}
+
+func (s *EtcdSuite) TestAuditEvents(c *C) {
+	s.suite.AuditEvents(c)
+}
+
+func (s *EtcdSuite) TestUpsertRace(c *C) {
+	// unconditional upserts of the same greeting are retried when they lose the race
+	const iterations = 20
+	errC := make(chan error, 2*iterations)
+	wg := sync.WaitGroup{}
+	for _, val := range []string{"Hello", "Howdy"} {
+		wg.Add(1)
+		go func(val string) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				errC <- s.suite.B.UpsertGreeting("hello.us", val)
+			}
+		}(val)
+	}
+	wg.Wait()
+	close(errC)
+	for err := range errC {
+		c.Assert(err, IsNil)
+	}
+	g, err := s.suite.B.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(g.Value, Matches, "Hello|Howdy")
+	c.Assert(g.Revision, Not(Equals), uint64(0))
+}
+
+func (s *EtcdSuite) TestLegacyValues(c *C) {
+	// older versions stored bare greeting values
+	_, err := s.client.Set(s.etcdPrefix+"/greetings/hello.us", "Hello", 0)
+	c.Assert(err, IsNil)
+
+	g, err := s.suite.B.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(g.Value, Equals, "Hello")
+	c.Assert(g.Created.IsZero(), Equals, true)
+	gs, _, err := s.suite.B.GetGreetings("", "", 0)
+	c.Assert(err, IsNil)
+	c.Assert(gs[0].Value, Equals, "Hello")
+
+	// upserts replace them with versioned records
+	c.Assert(s.suite.B.UpsertGreeting("hello.us", "Howdy", backend.Locale("en-US")), IsNil)
+	re, err := s.client.Get(s.etcdPrefix+"/greetings/hello.us", false, false)
+	c.Assert(err, IsNil)
+	c.Assert(re.Node.Value, Matches, `\{"version":1,"value":"Howdy","locale":"en-US".*`)
+	g, err = s.suite.B.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(g.Value, Equals, "Howdy")
+	c.Assert(g.Locale, Equals, "en-US")
+}
+
+func (s *EtcdSuite) TestClose(c *C) {
+	s.suite.Close(c)
+}
@@ -0,0 +1,50 @@
+package filebk
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gravitational/hello/backend"
+)
+
+func init() {
+	backend.Register(backend.Registration{
+		Name:        "file",
+		Description: "log of greetings in the local directory, for single node installs",
+		Params: []backend.Param{
+			{Name: "path", Type: backend.StringParam, Required: true, Description: "directory of the log, e.g. /var/lib/hello"},
+			{Name: "compactionPeriod", Type: backend.DurationParam, Description: "how often the log is compacted"},
+		},
+		New: FromString,
+	})
+}
+
+// cfg represents JSON config for file backend
+type cfg struct {
+	Path             string `json:"path"`
+	CompactionPeriod string `json:"compactionPeriod"`
+}
+
+// FromString initializes the backend from backend-specific configuration string
+//
+//   backend.FromString(`{"path": "/var/lib/hello", "compactionPeriod": "10m"}`)
+//
+func FromString(v string) (backend.GreetingBackend, error) {
+	if len(v) == 0 {
+		return nil, fmt.Errorf(`please supply a valid dictionary, e.g. {"path": "/var/lib/hello"}`)
+	}
+	var c *cfg
+	if err := json.Unmarshal([]byte(v), &c); err != nil {
+		return nil, fmt.Errorf("invalid backend configuration format, err: %v", err)
+	}
+	options := []BackendOption{}
+	if c.CompactionPeriod != "" {
+		d, err := time.ParseDuration(c.CompactionPeriod)
+		if err != nil {
+			return nil, fmt.Errorf("invalid compactionPeriod: %v", err)
+		}
+		options = append(options, CompactionPeriod(d))
+	}
+	return New(c.Path, options...)
+}
@@ -0,0 +1,525 @@
+// package filebk implements embedded greetings backend that persists greetings
+// on the local disk, it is handy for single node installs and development.
+//
+// All greetings are kept in memory and every change is appended to the log file
+// and fsynced before it is acknowledged. The log is periodically compacted:
+// the live greetings are written to a temporary file that is fsynced and renamed
+// over the log, so the log is always either the old or the new one on crash.
+package filebk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/gravitational/hello/backend"
+)
+
+type BackendOption func(b *bk) error
+
+// CompactionPeriod sets how often the backend checks whether the log needs compaction
+func CompactionPeriod(d time.Duration) BackendOption {
+	return func(b *bk) error {
+		if d <= 0 {
+			return fmt.Errorf("compaction period should be positive, got %v", d)
+		}
+		b.compactionPeriod = d
+		return nil
+	}
+}
+
+// Clock sets the clock used to expire greetings, tests use it to control time
+func Clock(c backend.Clock) BackendOption {
+	return func(b *bk) error {
+		b.clock = c
+		return nil
+	}
+}
+
+// ReapPeriod sets how often the backend deletes expired greetings
+func ReapPeriod(d time.Duration) BackendOption {
+	return func(b *bk) error {
+		if d <= 0 {
+			return fmt.Errorf("reap period should be positive, got %v", d)
+		}
+		b.reapPeriod = d
+		return nil
+	}
+}
+
+// DefaultReapPeriod is a default period of deleting expired greetings
+const DefaultReapPeriod = time.Second
+
+// DefaultCompactionPeriod is a default period of the log compaction checks
+const DefaultCompactionPeriod = 10 * time.Minute
+
+// logName is the name of the log file in the backend directory
+const logName = "greetings.log"
+
+const (
+	opUpsert = "upsert"
+	opDelete = "delete"
+	// opRev only carries the revision of the last change, compaction
+	// writes it as the last record as the last change may have been a delete
+	opRev = "rev"
+)
+
+// record is a single log entry, log is a sequence of JSON encoded records
+// separated by new lines
+type record struct {
+	Op string `json:"op"`
+	ID string `json:"id"`
+	// Value is the greeting record encoded with backend.EncodeRecord,
+	// logs written by older versions have bare values
+	Value string `json:"val,omitempty"`
+	// Rev is a revision of the change, compaction preserves
+	// the revisions so they never go back after restart
+	Rev uint64 `json:"rev"`
+	// Expires is set for greetings upserted with TTL
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// entry is a stored greeting with it's expiry time, that is zero
+// for greetings that never expire
+type entry struct {
+	greeting backend.Greeting
+	expires  time.Time
+}
+
+// get returns a copy of the greeting with the TTL left,
+// or nil if the greeting has expired
+func (e entry) get(now time.Time) *backend.Greeting {
+	g := e.greeting
+	g.Tags = append([]string(nil), g.Tags...)
+	if !e.expires.IsZero() {
+		if !now.Before(e.expires) {
+			return nil
+		}
+		g.TTL = e.expires.Sub(now)
+	}
+	return &g
+}
+
+// logFile is the open log, tests replace it to simulate failing disks
+type logFile interface {
+	io.Writer
+	Seek(offset int64, whence int) (int64, error)
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+type bk struct {
+	mtx       sync.RWMutex
+	dir       string
+	file      logFile
+	greetings map[string]entry
+	// rev is a revision of the last change
+	rev    uint64
+	fanout backend.Fanout
+	// records is a count of records in the log, used to decide
+	// whether compaction is worth it
+	records int
+	// failed is set when the log is left in unknown state by a failed write
+	// or compaction, writes are refused from then on, as they would not
+	// survive restart, until the backend is reopened
+	failed error
+
+	compactionPeriod time.Duration
+	reapPeriod       time.Duration
+	clock            backend.Clock
+	closeC           chan bool
+	closeOnce        sync.Once
+	wg               sync.WaitGroup
+}
+
+// New opens or creates the backend storing greetings in the directory dir
+func New(dir string, options ...BackendOption) (backend.GreetingBackend, error) {
+	if len(dir) == 0 {
+		return nil, fmt.Errorf("supply a valid directory path")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	b := &bk{
+		dir:              dir,
+		greetings:        make(map[string]entry),
+		compactionPeriod: DefaultCompactionPeriod,
+		reapPeriod:       DefaultReapPeriod,
+		clock:            backend.SystemClock{},
+		closeC:           make(chan bool),
+	}
+	for _, o := range options {
+		if err := o(b); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+	b.wg.Add(1)
+	go b.loop()
+	return b, nil
+}
+
+func (b *bk) path() string {
+	return filepath.Join(b.dir, logName)
+}
+
+// load replays the log into memory and opens it for appending.
+// A partially written trailing record left by a crash is truncated.
+func (b *bk) load() error {
+	f, err := os.OpenFile(b.path(), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	valid, err := b.replay(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(valid, 0); err != nil {
+		f.Close()
+		return err
+	}
+	b.file = f
+	return nil
+}
+
+// replay applies records from the log and returns the offset of the end
+// of the last complete record
+func (b *bk) replay(f *os.File) (int64, error) {
+	var valid int64
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) != 0 {
+				log.Warningf("%v: discarding incomplete trailing record", b.path())
+			}
+			return valid, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		var rec record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return 0, fmt.Errorf("%v: corrupted record at offset %v: %v", b.path(), valid, err)
+		}
+		if err := b.apply(rec); err != nil {
+			return 0, fmt.Errorf("%v: record at offset %v: %v", b.path(), valid, err)
+		}
+		b.records++
+		valid += int64(len(line))
+	}
+}
+
+func (b *bk) apply(rec record) error {
+	if rec.Rev > b.rev {
+		b.rev = rec.Rev
+	}
+	switch rec.Op {
+	case opUpsert:
+		e := entry{greeting: backend.Greeting{ID: rec.ID, Revision: rec.Rev}}
+		if err := backend.DecodeRecord(rec.Value, &e.greeting); err != nil {
+			return err
+		}
+		if rec.Expires != nil {
+			e.expires = *rec.Expires
+		}
+		b.greetings[rec.ID] = e
+	case opDelete:
+		delete(b.greetings, rec.ID)
+	}
+	return nil
+}
+
+// append durably writes the record to the log and applies it,
+// should be called under the write lock
+func (b *bk) append(rec record) error {
+	if b.failed != nil {
+		return b.failed
+	}
+	rec.Rev = b.rev + 1
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	offset, err := b.file.Seek(0, 2)
+	if err != nil {
+		return err
+	}
+	if err := b.write(append(data, '\n')); err != nil {
+		// cut the partially written record off, otherwise the next record
+		// is appended to it and the log can not be replayed
+		if terr := b.rewind(offset); terr != nil {
+			b.fail(fmt.Errorf("failed to remove partial record after %v: %v", err, terr))
+		}
+		return err
+	}
+	if err := b.apply(rec); err != nil {
+		return err
+	}
+	b.records++
+	e := backend.GreetingEvent{Type: backend.EventDelete, ID: rec.ID, Revision: rec.Rev}
+	if rec.Op == opUpsert {
+		e.Type = backend.EventUpsert
+		e.Value = b.greetings[rec.ID].greeting.Value
+	}
+	b.fanout.Broadcast(e)
+	return nil
+}
+
+func (b *bk) write(data []byte) error {
+	if _, err := b.file.Write(data); err != nil {
+		return err
+	}
+	return b.file.Sync()
+}
+
+// rewind truncates the log to the offset
+func (b *bk) rewind(offset int64) error {
+	if err := b.file.Truncate(offset); err != nil {
+		return err
+	}
+	_, err := b.file.Seek(offset, 0)
+	return err
+}
+
+// fail marks the backend as failed, should be called under the write lock
+func (b *bk) fail(err error) {
+	log.Errorf("%v: refusing writes until restart: %v", b.path(), err)
+	b.failed = &backend.UnavailableError{Message: fmt.Sprintf("%v: %v", b.path(), err)}
+}
+
+func (b *bk) UpsertGreeting(id, val string, opts ...backend.WriteOption) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	o := backend.GetWriteOptions(opts)
+	current := b.current(id)
+	if err := backend.CheckWrite(id, current, o); err != nil {
+		return err
+	}
+	now := b.clock.Now()
+	data, err := backend.EncodeRecord(backend.NewGreeting(id, val, current, o, now))
+	if err != nil {
+		return err
+	}
+	rec := record{Op: opUpsert, ID: id, Value: data}
+	if o.TTL != 0 {
+		expires := now.Add(o.TTL)
+		rec.Expires = &expires
+	}
+	if err := b.append(rec); err != nil {
+		return err
+	}
+	o.SetWritten(b.rev)
+	return nil
+}
+
+func (b *bk) GetGreeting(id string) (*backend.Greeting, error) {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	g := b.current(id)
+	if g == nil {
+		return nil, &backend.NotFoundError{ID: id}
+	}
+	return g, nil
+}
+
+func (b *bk) DeleteGreeting(id string, opts ...backend.WriteOption) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	g := b.current(id)
+	if g == nil {
+		return &backend.NotFoundError{ID: id}
+	}
+	if err := backend.CheckWrite(id, g, backend.GetWriteOptions(opts)); err != nil {
+		return err
+	}
+	return b.append(record{Op: opDelete, ID: id})
+}
+
+// current returns a copy of the greeting or nil if it's not found or expired
+// and waits to be reaped, should be called under lock
+func (b *bk) current(id string) *backend.Greeting {
+	e, ok := b.greetings[id]
+	if !ok {
+		return nil
+	}
+	return e.get(b.clock.Now())
+}
+
+func (b *bk) GetGreetings(prefix, cursor string, limit int) ([]backend.Greeting, string, error) {
+	b.mtx.RLock()
+	now := b.clock.Now()
+	gs := make([]backend.Greeting, 0, len(b.greetings))
+	for _, e := range b.greetings {
+		if g := e.get(now); g != nil {
+			gs = append(gs, *g)
+		}
+	}
+	b.mtx.RUnlock()
+	out, next := backend.Page(gs, prefix, cursor, limit)
+	return out, next, nil
+}
+
+func (b *bk) WatchGreetings(stopC <-chan bool) (<-chan backend.GreetingEvent, error) {
+	return b.fanout.Watch(stopC), nil
+}
+
+// Ping checks that the log file is still in place, e.g. the disk
+// has not been unmounted or the directory removed, and writable
+func (b *bk) Ping() error {
+	b.mtx.RLock()
+	failed := b.failed
+	b.mtx.RUnlock()
+	if failed != nil {
+		return failed
+	}
+	if _, err := os.Stat(b.path()); err != nil {
+		return &backend.UnavailableError{Message: err.Error()}
+	}
+	return nil
+}
+
+func (b *bk) loop() {
+	defer b.wg.Done()
+	compactT := time.NewTicker(b.compactionPeriod)
+	defer compactT.Stop()
+	reapT := time.NewTicker(b.reapPeriod)
+	defer reapT.Stop()
+	for {
+		select {
+		case <-compactT.C:
+			if err := b.compact(false); err != nil {
+				log.Errorf("%v: failed to compact: %v", b.path(), err)
+			}
+		case <-reapT.C:
+			if err := b.reap(); err != nil {
+				log.Errorf("%v: failed to delete expired greetings: %v", b.path(), err)
+			}
+		case <-b.closeC:
+			return
+		}
+	}
+}
+
+// reap deletes expired greetings, watchers get delete events for them
+func (b *bk) reap() error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	now := b.clock.Now()
+	for id, e := range b.greetings {
+		if e.get(now) == nil {
+			if err := b.append(record{Op: opDelete, ID: id}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compact rewrites the log keeping only live greetings. Unless forced,
+// it does nothing when obsolete records take less than a half of the log.
+func (b *bk) compact(force bool) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.failed != nil {
+		return b.failed
+	}
+	if !force && b.records <= 2*len(b.greetings)+1 {
+		return nil
+	}
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, e := range b.greetings {
+		data, err := backend.EncodeRecord(e.greeting)
+		if err != nil {
+			return err
+		}
+		rec := record{Op: opUpsert, ID: e.greeting.ID, Value: data, Rev: e.greeting.Revision}
+		if !e.expires.IsZero() {
+			expires := e.expires
+			rec.Expires = &expires
+		}
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	if err := enc.Encode(record{Op: opRev, Rev: b.rev}); err != nil {
+		return err
+	}
+	tmp := b.path() + ".tmp"
+	if err := writeFileSync(tmp, buf.Bytes()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, b.path()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// the old log is unlinked now, so writes appended to it are lost
+	// on restart, the backend switches to the new one before anything else
+	f, err := os.OpenFile(b.path(), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		b.fail(fmt.Errorf("failed to open compacted log: %v", err))
+		return err
+	}
+	b.file.Close()
+	b.file = f
+	b.records = len(b.greetings) + 1
+	// fsync the directory to make sure the rename itself is durable
+	return syncDir(b.dir)
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Close stops the background loops and closes the log,
+// closing the closed backend does nothing
+func (b *bk) Close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		close(b.closeC)
+		b.wg.Wait()
+		b.fanout.Close()
+		b.mtx.Lock()
+		defer b.mtx.Unlock()
+		err = b.file.Close()
+	})
+	return err
+}
@@ -0,0 +1,311 @@
+package filebk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gravitational/hello/backend"
+	"github.com/gravitational/hello/backend/test"
+
+	. "github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+func TestFile(t *testing.T) { TestingT(t) }
+
+type FileSuite struct {
+	dir   string
+	bk    *bk
+	suite test.BackendSuite
+}
+
+var _ = Suite(&FileSuite{})
+
+func (s *FileSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	s.bk = s.open(c)
+	s.suite.B = s.bk
+}
+
+func (s *FileSuite) TearDownTest(c *C) {
+	c.Assert(s.bk.Close(), IsNil)
+}
+
+func (s *FileSuite) open(c *C) *bk {
+	b, err := New(s.dir)
+	c.Assert(err, IsNil)
+	return b.(*bk)
+}
+
+// reopen closes the backend and opens it again from the same directory
+func (s *FileSuite) reopen(c *C) {
+	c.Assert(s.bk.Close(), IsNil)
+	s.bk = s.open(c)
+}
+
+func (s *FileSuite) TestGreetingCRUD(c *C) {
+	s.suite.GreetingCRUD(c)
+}
+
+func (s *FileSuite) TestGreetingsList(c *C) {
+	s.suite.GreetingsList(c)
+}
+
+func (s *FileSuite) TestMetadata(c *C) {
+	s.suite.Metadata(c)
+}
+
+func (s *FileSuite) TestConditionalWrites(c *C) {
+	s.suite.ConditionalWrites(c)
+}
+
+func (s *FileSuite) TestGreetingsTTL(c *C) {
+	s.suite.GreetingsTTL(c)
+}
+
+func (s *FileSuite) TestConcurrency(c *C) {
+	s.suite.Concurrency(c)
+}
+
+func (s *FileSuite) TestGreetingsWatch(c *C) {
+	s.suite.GreetingsWatch(c)
+}
+
+func (s *FileSuite) TestPing(c *C) {
+	s.suite.Ping(c)
+
+	c.Assert(os.Remove(s.bk.path()), IsNil)
+	c.Assert(s.bk.Ping(), FitsTypeOf, &backend.UnavailableError{})
+}
+
+func (s *FileSuite) TestPersistence(c *C) {
+	c.Assert(s.bk.UpsertGreeting("hello.us", "Hello"), IsNil)
+	c.Assert(s.bk.UpsertGreeting("hello.sp", "Hola"), IsNil)
+	c.Assert(s.bk.UpsertGreeting("hello.us", "Howdy"), IsNil)
+	c.Assert(s.bk.DeleteGreeting("hello.sp"), IsNil)
+
+	s.reopen(c)
+
+	g, err := s.bk.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(g.Value, Equals, "Howdy")
+
+	_, err = s.bk.GetGreeting("hello.sp")
+	c.Assert(err, FitsTypeOf, &backend.NotFoundError{})
+}
+
+func (s *FileSuite) TestCompaction(c *C) {
+	for _, v := range []string{"Hi", "Hello", "Howdy"} {
+		c.Assert(s.bk.UpsertGreeting("hello.us", v, backend.Description("landing page")), IsNil)
+	}
+	c.Assert(s.bk.UpsertGreeting("hello.sp", "Hola"), IsNil)
+	c.Assert(s.bk.DeleteGreeting("hello.sp"), IsNil)
+	us, err := s.bk.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	before := s.logSize(c)
+	rev := s.bk.rev
+
+	c.Assert(s.bk.compact(false), IsNil)
+	c.Assert(s.bk.records, Equals, 2)
+	c.Assert(s.logSize(c) < before, Equals, true)
+
+	// backend keeps appending to the compacted log
+	c.Assert(s.bk.UpsertGreeting("hello.fr", "Bonjour"), IsNil)
+	fr, err := s.bk.GetGreeting("hello.fr")
+	c.Assert(err, IsNil)
+
+	s.reopen(c)
+
+	gs, _, err := s.bk.GetGreetings("", "", 0)
+	c.Assert(err, IsNil)
+	// compaction preserves greeting records and revisions
+	c.Assert(gs, DeepEquals, []backend.Greeting{*fr, *us})
+	c.Assert(gs[0].Revision, Equals, uint64(6))
+	c.Assert(gs[1].Revision, Equals, uint64(3))
+	c.Assert(gs[1].Description, Equals, "landing page")
+	c.Assert(s.bk.records, Equals, 3)
+	// revisions never go back, even if the last change before compaction was a delete
+	c.Assert(s.bk.rev, Equals, rev+1)
+
+	// compaction is skipped when there is nothing to gain
+	c.Assert(s.bk.UpsertGreeting("hello.fr", "Salut"), IsNil)
+	before = s.logSize(c)
+	c.Assert(s.bk.compact(false), IsNil)
+	c.Assert(s.logSize(c), Equals, before)
+	c.Assert(s.bk.records, Equals, 4)
+}
+
+func (s *FileSuite) TestTornWrite(c *C) {
+	c.Assert(s.bk.UpsertGreeting("hello.us", "Hello"), IsNil)
+	c.Assert(s.bk.Close(), IsNil)
+
+	// simulate crash in the middle of the write
+	f, err := os.OpenFile(filepath.Join(s.dir, logName), os.O_WRONLY|os.O_APPEND, 0600)
+	c.Assert(err, IsNil)
+	_, err = f.Write([]byte(`{"op":"upsert","id":"hello.sp","va`))
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	s.bk = s.open(c)
+	_, err = s.bk.GetGreeting("hello.sp")
+	c.Assert(err, FitsTypeOf, &backend.NotFoundError{})
+
+	// the torn record is gone and the log is usable again
+	c.Assert(s.bk.UpsertGreeting("hello.sp", "Hola"), IsNil)
+	s.reopen(c)
+	g, err := s.bk.GetGreeting("hello.sp")
+	c.Assert(err, IsNil)
+	c.Assert(g.Value, Equals, "Hola")
+}
+
+// faultyFile writes a part of the data and fails, as a full disk does
+type faultyFile struct {
+	*os.File
+	failTruncate bool
+}
+
+func (f *faultyFile) Write(data []byte) (int, error) {
+	n, err := f.File.Write(data[:len(data)/2])
+	if err != nil {
+		return n, err
+	}
+	return n, fmt.Errorf("no space left on device")
+}
+
+func (f *faultyFile) Truncate(size int64) error {
+	if f.failTruncate {
+		return fmt.Errorf("input/output error")
+	}
+	return f.File.Truncate(size)
+}
+
+func (s *FileSuite) TestFailedWrite(c *C) {
+	c.Assert(s.bk.UpsertGreeting("hello.us", "Hello"), IsNil)
+	f := s.bk.file.(*os.File)
+	s.bk.file = &faultyFile{File: f}
+	c.Assert(s.bk.UpsertGreeting("hello.sp", "Hola"), NotNil)
+
+	// the partial record is removed, so writes acknowledged later survive restart
+	s.bk.file = f
+	c.Assert(s.bk.UpsertGreeting("hello.fr", "Bonjour"), IsNil)
+	s.reopen(c)
+	gs, _, err := s.bk.GetGreetings("", "", 0)
+	c.Assert(err, IsNil)
+	c.Assert(len(gs), Equals, 2)
+	_, err = s.bk.GetGreeting("hello.sp")
+	c.Assert(err, FitsTypeOf, &backend.NotFoundError{})
+
+	// the backend refuses writes if the partial record can't be removed
+	f = s.bk.file.(*os.File)
+	s.bk.file = &faultyFile{File: f, failTruncate: true}
+	c.Assert(s.bk.UpsertGreeting("hello.sp", "Hola"), NotNil)
+	s.bk.file = f
+	c.Assert(s.bk.UpsertGreeting("hello.sp", "Hola"), FitsTypeOf, &backend.UnavailableError{})
+	c.Assert(s.bk.DeleteGreeting("hello.us"), FitsTypeOf, &backend.UnavailableError{})
+	c.Assert(s.bk.compact(true), FitsTypeOf, &backend.UnavailableError{})
+	c.Assert(s.bk.Ping(), FitsTypeOf, &backend.UnavailableError{})
+	_, err = s.bk.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+}
+
+func (s *FileSuite) TestLegacyRecords(c *C) {
+	c.Assert(s.bk.Close(), IsNil)
+	// log written by older versions stores bare greeting values
+	err := ioutil.WriteFile(filepath.Join(s.dir, logName), []byte(
+		`{"op":"upsert","id":"hello.us","val":"Hello","rev":1}`+"\n"+
+			`{"op":"upsert","id":"hello.json","val":"{\"a\": 1}","rev":2}`+"\n"), 0600)
+	c.Assert(err, IsNil)
+	s.bk = s.open(c)
+
+	g, err := s.bk.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(g.Value, Equals, "Hello")
+	c.Assert(g.Revision, Equals, uint64(1))
+	c.Assert(g.Created.IsZero(), Equals, true)
+	g, err = s.bk.GetGreeting("hello.json")
+	c.Assert(err, IsNil)
+	c.Assert(g.Value, Equals, `{"a": 1}`)
+
+	// compaction rewrites them as versioned records
+	c.Assert(s.bk.UpsertGreeting("hello.us", "Howdy", backend.Locale("en-US")), IsNil)
+	c.Assert(s.bk.compact(true), IsNil)
+	s.reopen(c)
+	g, err = s.bk.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(g.Value, Equals, "Howdy")
+	c.Assert(g.Locale, Equals, "en-US")
+	g, err = s.bk.GetGreeting("hello.json")
+	c.Assert(err, IsNil)
+	c.Assert(g.Value, Equals, `{"a": 1}`)
+}
+
+func (s *FileSuite) TestExpiry(c *C) {
+	clock := test.NewFakeClock(time.Date(2015, 12, 24, 0, 0, 0, 0, time.UTC))
+	open := func() *bk {
+		b, err := New(s.dir, Clock(clock), ReapPeriod(time.Millisecond))
+		c.Assert(err, IsNil)
+		return b.(*bk)
+	}
+	c.Assert(s.bk.Close(), IsNil)
+	s.bk = open()
+
+	c.Assert(s.bk.UpsertGreeting("hello.xmas", "Merry Christmas", backend.TTL(time.Minute)), IsNil)
+
+	// expiry time survives restarts
+	c.Assert(s.bk.Close(), IsNil)
+	clock.Advance(30 * time.Second)
+	s.bk = open()
+
+	g, err := s.bk.GetGreeting("hello.xmas")
+	c.Assert(err, IsNil)
+	c.Assert(g.TTL, Equals, 30*time.Second)
+
+	stopC := make(chan bool)
+	defer close(stopC)
+	events, err := s.bk.WatchGreetings(stopC)
+	c.Assert(err, IsNil)
+
+	clock.Advance(30 * time.Second)
+	_, err = s.bk.GetGreeting("hello.xmas")
+	c.Assert(err, FitsTypeOf, &backend.NotFoundError{})
+
+	// reaper deletes the expired greeting and notifies watchers
+	select {
+	case e := <-events:
+		c.Assert(e.Type, Equals, backend.EventDelete)
+		c.Assert(e.ID, Equals, "hello.xmas")
+	case <-time.After(test.WaitTimeout):
+		c.Fatalf("timeout waiting for expiry")
+	}
+	s.reopen(c)
+	c.Assert(len(s.bk.greetings), Equals, 0)
+}
+
+func (s *FileSuite) TestFromString(c *C) {
+	dir := c.MkDir()
+	b, err := FromString(`{"path": "` + dir + `", "compactionPeriod": "1m"}`)
+	c.Assert(err, IsNil)
+	c.Assert(b.Close(), IsNil)
+
+	_, err = FromString("")
+	c.Assert(err, NotNil)
+
+	_, err = FromString(`{"path": ""}`)
+	c.Assert(err, NotNil)
+
+	_, err = FromString(`{"path": "` + dir + `", "compactionPeriod": "often"}`)
+	c.Assert(err, NotNil)
+}
+
+func (s *FileSuite) logSize(c *C) int {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, logName))
+	c.Assert(err, IsNil)
+	return len(data)
+}
+
+func (s *FileSuite) TestClose(c *C) {
+	s.suite.Close(c)
+}
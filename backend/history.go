@@ -0,0 +1,68 @@
+package backend
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultHistorySize is the default number of the most recent changes
+// backends keep in the history of each greeting
+const DefaultHistorySize = 10
+
+// Version is a change of the greeting recorded in it's history
+type Version struct {
+	// Revision is the revision of the greeting after the change
+	Revision uint64
+	// Value is the value written, empty for deletes
+	Value string
+	// Template is true if the value written is a template, see Template write option
+	Template bool
+	// Deleted is true if the change deleted the greeting
+	Deleted bool
+	// Author is the name of the caller who made the change, see Author
+	// write option, empty if unknown
+	Author string
+	// Time is when the change was made
+	Time time.Time
+}
+
+// HistoryBackend is implemented by backends that keep the history
+// of greeting changes, so a broken greeting can be rolled back.
+// The history is bounded, the oldest changes are dropped, and is kept
+// after the greeting is deleted. Writes with NoHistory option and
+// expiry of greetings are not recorded.
+type HistoryBackend interface {
+	// GetHistory returns the recorded changes of the greeting, most recent first,
+	// or NotFoundError if there are none
+	GetHistory(id string) ([]Version, error)
+}
+
+// GetHistory returns the history of the greeting, it returns NotSupportedError
+// if the backend does not keep the history, e.g. filebk
+func GetHistory(b GreetingBackend, id string) ([]Version, error) {
+	h, ok := b.(HistoryBackend)
+	if !ok {
+		return nil, &NotSupportedError{Message: "backend does not keep greeting history"}
+	}
+	return h.GetHistory(id)
+}
+
+// AddVersion appends the change to the history, that is sorted from the
+// oldest to the most recent change, and drops the oldest changes to keep
+// at most size of them
+func AddVersion(history []Version, v Version, size int) []Version {
+	history = append(history, v)
+	if len(history) > size {
+		history = append([]Version{}, history[len(history)-size:]...)
+	}
+	return history
+}
+
+// NotSupportedError is returned when the backend does not support the operation
+type NotSupportedError struct {
+	Message string
+}
+
+func (e *NotSupportedError) Error() string {
+	return fmt.Sprintf("not supported: %v", e.Message)
+}
@@ -0,0 +1,54 @@
+package membk
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gravitational/hello/backend"
+)
+
+func init() {
+	backend.Register(backend.Registration{
+		Name:        "memory",
+		Description: "in-memory greetings, lost on restart, for development and tests",
+		Params: []backend.Param{
+			{Name: "reapPeriod", Type: backend.DurationParam, Description: "how often expired greetings are deleted, 1s by default"},
+			{Name: "historySize", Type: backend.IntParam, Description: "how many changes of each greeting are kept in it's history, 10 by default"},
+		},
+		New: FromString,
+	})
+}
+
+// cfg represents JSON config for memory backend
+type cfg struct {
+	ReapPeriod  string `json:"reapPeriod"`
+	HistorySize *int   `json:"historySize"`
+}
+
+// FromString initializes the backend from backend-specific configuration string,
+// the configuration is optional
+//
+//   membk.FromString(`{"reapPeriod": "10s", "historySize": 20}`)
+//
+func FromString(v string) (backend.GreetingBackend, error) {
+	var c cfg
+	if strings.TrimSpace(v) != "" {
+		if err := json.Unmarshal([]byte(v), &c); err != nil {
+			return nil, fmt.Errorf("invalid backend configuration format, err: %v", err)
+		}
+	}
+	var options []Option
+	if c.ReapPeriod != "" {
+		d, err := time.ParseDuration(c.ReapPeriod)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reapPeriod: %v", err)
+		}
+		options = append(options, ReapPeriod(d))
+	}
+	if c.HistorySize != nil {
+		options = append(options, HistorySize(*c.HistorySize))
+	}
+	return New(options...)
+}
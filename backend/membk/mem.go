@@ -2,45 +2,294 @@
 package membk
 
 import (
+	"fmt"
+	"sync"
+	"time"
+
 	"github.com/gravitational/hello/backend"
 )
 
+// Option is a functional option for the memory backend
+type Option func(b *MemBackend) error
+
+// Clock sets the clock used to expire greetings, tests use it to control time
+func Clock(c backend.Clock) Option {
+	return func(b *MemBackend) error {
+		b.clock = c
+		return nil
+	}
+}
+
+// ReapPeriod sets how often the backend deletes expired greetings
+func ReapPeriod(d time.Duration) Option {
+	return func(b *MemBackend) error {
+		if d <= 0 {
+			return fmt.Errorf("reap period should be positive, got %v", d)
+		}
+		b.reapPeriod = d
+		return nil
+	}
+}
+
+// HistorySize sets how many of the most recent changes of each greeting
+// are kept in it's history, see backend.HistoryBackend
+func HistorySize(n int) Option {
+	return func(b *MemBackend) error {
+		if n < 0 {
+			return fmt.Errorf("history size should be non-negative, got %v", n)
+		}
+		b.historySize = n
+		return nil
+	}
+}
+
+// DefaultReapPeriod is a default period of deleting expired greetings
+const DefaultReapPeriod = time.Second
+
+// MemBackend is an in-memory backend, it is safe for concurrent use
 type MemBackend struct {
-	Greetings map[string]string
+	mtx       sync.RWMutex
+	greetings map[string]entry
+	// history is the history of greeting changes, oldest first
+	history map[string][]backend.Version
+	// events are audit events, see backend.AuditBackend
+	events []string
+	// rev is a revision of the last change
+	rev    uint64
+	fanout backend.Fanout
+
+	clock       backend.Clock
+	reapPeriod  time.Duration
+	historySize int
+	closeC      chan bool
+	closeOnce   sync.Once
+}
+
+// entry is a stored greeting with it's expiry time, that is zero
+// for greetings that never expire
+type entry struct {
+	greeting backend.Greeting
+	expires  time.Time
 }
 
-func New() *MemBackend {
-	return &MemBackend{
-		Greetings: make(map[string]string),
+// New returns a memory backend, it returns error if the options are not valid
+func New(options ...Option) (*MemBackend, error) {
+	b := &MemBackend{
+		greetings:   make(map[string]entry),
+		history:     make(map[string][]backend.Version),
+		clock:       backend.SystemClock{},
+		reapPeriod:  DefaultReapPeriod,
+		historySize: backend.DefaultHistorySize,
+		closeC:      make(chan bool),
 	}
+	for _, o := range options {
+		if err := o(b); err != nil {
+			return nil, err
+		}
+	}
+	go b.reapLoop()
+	return b, nil
+}
+
+// Greetings returns a copy of all greeting values stored in the backend,
+// it is handy for inspecting the backend state in tests
+func (b *MemBackend) Greetings() map[string]string {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	now := b.clock.Now()
+	out := make(map[string]string, len(b.greetings))
+	for id, e := range b.greetings {
+		if g := e.get(now); g != nil {
+			out[id] = g.Value
+		}
+	}
+	return out
 }
 
 // UpsertGreeting updates or inserts the greeting into the database
-func (b *MemBackend) UpsertGreeting(id, val string) error {
-	b.Greetings[id] = val
+func (b *MemBackend) UpsertGreeting(id, val string, opts ...backend.WriteOption) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	o := backend.GetWriteOptions(opts)
+	current := b.current(id)
+	if err := backend.CheckWrite(id, current, o); err != nil {
+		return err
+	}
+	b.rev++
+	now := b.clock.Now()
+	e := entry{greeting: backend.NewGreeting(id, val, current, o, now)}
+	e.greeting.Revision = b.rev
+	if o.TTL != 0 {
+		e.expires = now.Add(o.TTL)
+	}
+	b.greetings[id] = e
+	b.record(id, o, backend.Version{Revision: b.rev, Value: val, Template: o.Template})
+	b.fanout.Broadcast(backend.GreetingEvent{Type: backend.EventUpsert, ID: id, Value: val, Revision: b.rev})
+	o.SetWritten(b.rev)
 	return nil
 }
 
 // GetGreeting returns a greeting stored in a database by it's id
-func (b *MemBackend) GetGreeting(id string) (string, error) {
-	g, ok := b.Greetings[id]
-	if !ok {
-		return "", &backend.NotFoundError{ID: id}
+func (b *MemBackend) GetGreeting(id string) (*backend.Greeting, error) {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	g := b.current(id)
+	if g == nil {
+		return nil, &backend.NotFoundError{ID: id}
 	}
 	return g, nil
 }
 
 // DeleteGreeting deletes greeting by ID
-func (b *MemBackend) DeleteGreeting(id string) error {
-	_, ok := b.Greetings[id]
+func (b *MemBackend) DeleteGreeting(id string, opts ...backend.WriteOption) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	g := b.current(id)
+	if g == nil {
+		return &backend.NotFoundError{ID: id}
+	}
+	o := backend.GetWriteOptions(opts)
+	if err := backend.CheckWrite(id, g, o); err != nil {
+		return err
+	}
+	b.delete(id)
+	b.record(id, o, backend.Version{Revision: b.rev, Deleted: true})
+	return nil
+}
+
+// record adds the change of the greeting to it's history, unless
+// the write has NoHistory option, should be called under lock
+func (b *MemBackend) record(id string, o backend.WriteOptions, v backend.Version) {
+	if o.NoHistory || b.historySize <= 0 {
+		return
+	}
+	v.Author = o.Author
+	v.Time = b.clock.Now().UTC()
+	b.history[id] = backend.AddVersion(b.history[id], v, b.historySize)
+}
+
+// GetHistory returns the recorded changes of the greeting, most recent first,
+// see backend.HistoryBackend
+func (b *MemBackend) GetHistory(id string) ([]backend.Version, error) {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	history := b.history[id]
+	if len(history) == 0 {
+		return nil, &backend.NotFoundError{ID: id}
+	}
+	out := make([]backend.Version, len(history))
+	for i, v := range history {
+		out[len(history)-1-i] = v
+	}
+	return out, nil
+}
+
+// AppendAuditEvent stores the audit event, see backend.AuditBackend
+func (b *MemBackend) AppendAuditEvent(data string) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.events = append(b.events, data)
+	return nil
+}
+
+// GetAuditEvents returns the audit events in the order they were appended
+func (b *MemBackend) GetAuditEvents() ([]string, error) {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	return append([]string{}, b.events...), nil
+}
+
+// delete deletes the greeting and notifies watchers, should be called under lock
+func (b *MemBackend) delete(id string) {
+	delete(b.greetings, id)
+	b.rev++
+	b.fanout.Broadcast(backend.GreetingEvent{Type: backend.EventDelete, ID: id, Revision: b.rev})
+}
+
+// current returns a copy of the greeting or nil if it's not found or expired
+// and waits to be reaped, should be called under lock
+func (b *MemBackend) current(id string) *backend.Greeting {
+	e, ok := b.greetings[id]
 	if !ok {
-		return &backend.NotFoundError{}
+		return nil
 	}
-	delete(b.Greetings, id)
+	return e.get(b.clock.Now())
+}
+
+// get returns a copy of the greeting with the TTL left,
+// or nil if the greeting has expired
+func (e entry) get(now time.Time) *backend.Greeting {
+	g := e.greeting
+	g.Tags = append([]string(nil), g.Tags...)
+	if !e.expires.IsZero() {
+		if !now.Before(e.expires) {
+			return nil
+		}
+		g.TTL = e.expires.Sub(now)
+	}
+	return &g
+}
+
+// GetGreetings returns greetings matching the prefix, see backend.GreetingBackend
+func (b *MemBackend) GetGreetings(prefix, cursor string, limit int) ([]backend.Greeting, string, error) {
+	b.mtx.RLock()
+	now := b.clock.Now()
+	gs := make([]backend.Greeting, 0, len(b.greetings))
+	for _, e := range b.greetings {
+		if g := e.get(now); g != nil {
+			gs = append(gs, *g)
+		}
+	}
+	b.mtx.RUnlock()
+	out, next := backend.Page(gs, prefix, cursor, limit)
+	return out, next, nil
+}
+
+// WatchGreetings streams greeting changes, see backend.GreetingBackend
+func (b *MemBackend) WatchGreetings(stopC <-chan bool) (<-chan backend.GreetingEvent, error) {
+	return b.fanout.Watch(stopC), nil
+}
+
+// Ping always succeeds for the memory backend
+func (b *MemBackend) Ping() error {
 	return nil
 }
 
+// Watchers returns the number of active watchers
+func (b *MemBackend) Watchers() int {
+	return b.fanout.Len()
+}
+
+func (b *MemBackend) reapLoop() {
+	t := time.NewTicker(b.reapPeriod)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			b.reap()
+		case <-b.closeC:
+			return
+		}
+	}
+}
+
+// reap deletes expired greetings, watchers get delete events for them
+func (b *MemBackend) reap() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	now := b.clock.Now()
+	for id, e := range b.greetings {
+		if e.get(now) == nil {
+			b.delete(id)
+		}
+	}
+}
+
 // Close closes all resources associated with this backend
 func (b *MemBackend) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.closeC)
+		b.fanout.Close()
+	})
 	return nil
 }
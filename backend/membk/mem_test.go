@@ -2,8 +2,10 @@ package membk
 
 import (
 	"testing"
+	"time"
 
 	. "github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/check.v1"
+	"github.com/gravitational/hello/backend"
 	"github.com/gravitational/hello/backend/test"
 )
 
@@ -19,7 +21,9 @@ type MemSuite struct {
 var _ = Suite(&MemSuite{})
 
 func (s *MemSuite) SetUpTest(c *C) {
-	s.bk = New()
+	var err error
+	s.bk, err = New()
+	c.Assert(err, IsNil)
 	s.suite.B = s.bk
 }
 
@@ -30,3 +34,99 @@ func (s *MemSuite) TearDownTest(c *C) {
 func (s *MemSuite) TestGretingsCRUD(c *C) {
 	s.suite.GreetingCRUD(c)
 }
+
+func (s *MemSuite) TestGreetingsList(c *C) {
+	s.suite.GreetingsList(c)
+}
+
+func (s *MemSuite) TestMetadata(c *C) {
+	s.suite.Metadata(c)
+}
+
+func (s *MemSuite) TestConditionalWrites(c *C) {
+	s.suite.ConditionalWrites(c)
+}
+
+func (s *MemSuite) TestGreetingsTTL(c *C) {
+	s.suite.GreetingsTTL(c)
+}
+
+func (s *MemSuite) TestConcurrency(c *C) {
+	s.suite.Concurrency(c)
+}
+
+func (s *MemSuite) TestGreetingsWatch(c *C) {
+	s.suite.GreetingsWatch(c)
+}
+
+func (s *MemSuite) TestPing(c *C) {
+	s.suite.Ping(c)
+}
+
+func (s *MemSuite) TestExpiry(c *C) {
+	clock := test.NewFakeClock(time.Date(2015, 12, 24, 0, 0, 0, 0, time.UTC))
+	b, err := New(Clock(clock), ReapPeriod(time.Millisecond))
+	c.Assert(err, IsNil)
+	defer b.Close()
+
+	stopC := make(chan bool)
+	defer close(stopC)
+	events, err := b.WatchGreetings(stopC)
+	c.Assert(err, IsNil)
+
+	c.Assert(b.UpsertGreeting("hello.xmas", "Merry Christmas", backend.TTL(time.Minute)), IsNil)
+	c.Assert((<-events).Type, Equals, backend.EventUpsert)
+
+	clock.Advance(30 * time.Second)
+	g, err := b.GetGreeting("hello.xmas")
+	c.Assert(err, IsNil)
+	c.Assert(g.TTL, Equals, 30*time.Second)
+
+	clock.Advance(30 * time.Second)
+	_, err = b.GetGreeting("hello.xmas")
+	c.Assert(err, FitsTypeOf, &backend.NotFoundError{})
+	gs, _, err := b.GetGreetings("", "", 0)
+	c.Assert(err, IsNil)
+	c.Assert(len(gs), Equals, 0)
+
+	// reaper deletes the expired greeting and notifies watchers
+	select {
+	case e := <-events:
+		c.Assert(e.Type, Equals, backend.EventDelete)
+		c.Assert(e.ID, Equals, "hello.xmas")
+	case <-time.After(test.WaitTimeout):
+		c.Fatalf("timeout waiting for expiry")
+	}
+}
+
+func (s *MemSuite) TestHistory(c *C) {
+	s.suite.History(c)
+}
+
+func (s *MemSuite) TestAuditEvents(c *C) {
+	s.suite.AuditEvents(c)
+}
+
+func (s *MemSuite) TestFromString(c *C) {
+	b, err := FromString(`{"reapPeriod": "10s", "historySize": 20}`)
+	c.Assert(err, IsNil)
+	c.Assert(b.Close(), IsNil)
+
+	b, err = FromString("")
+	c.Assert(err, IsNil)
+	c.Assert(b.Close(), IsNil)
+
+	for _, v := range []string{
+		`{"reapPeriod": "0s"}`,
+		`{"reapPeriod": "-1s"}`,
+		`{"reapPeriod": "often"}`,
+		`{"historySize": -1}`,
+	} {
+		_, err = FromString(v)
+		c.Assert(err, NotNil, Commentf(v))
+	}
+}
+
+func (s *MemSuite) TestClose(c *C) {
+	s.suite.Close(c)
+}
@@ -0,0 +1,135 @@
+// package metricsbk implements a backend decorator that records
+// latency and errors of backend operations
+package metricsbk
+
+import (
+	"time"
+
+	"github.com/gravitational/hello/backend"
+	"github.com/gravitational/hello/metrics"
+)
+
+const (
+	// DurationMetric is a histogram of backend operation latencies by operation
+	DurationMetric = "hello_backend_operation_duration_seconds"
+	// ErrorsMetric is a counter of failed backend operations by operation and error type
+	ErrorsMetric = "hello_backend_errors_total"
+)
+
+// New returns backend that records latency and errors of operations of the backend b
+// in the registry r. Errors are counted by type: 'not_found', 'conflict', 'unavailable',
+// 'not_supported' or 'other'.
+func New(b backend.GreetingBackend, r *metrics.Registry) backend.GreetingBackend {
+	return &bk{
+		b:        b,
+		duration: r.NewHistogram(DurationMetric, "Latency of backend operations", metrics.DefaultBuckets, "op"),
+		errors:   r.NewCounter(ErrorsMetric, "Failed backend operations", "op", "type"),
+	}
+}
+
+type bk struct {
+	b        backend.GreetingBackend
+	duration *metrics.Histogram
+	errors   *metrics.Counter
+}
+
+// observe records the operation started at start
+func (b *bk) observe(op string, start time.Time, err error) {
+	b.duration.Observe(time.Since(start).Seconds(), op)
+	if err != nil {
+		b.errors.Inc(op, errorType(err))
+	}
+}
+
+func errorType(err error) string {
+	switch err.(type) {
+	case *backend.NotFoundError:
+		return "not_found"
+	case *backend.ConflictError:
+		return "conflict"
+	case *backend.UnavailableError:
+		return "unavailable"
+	case *backend.NotSupportedError:
+		return "not_supported"
+	}
+	return "other"
+}
+
+func (b *bk) UpsertGreeting(id, val string, opts ...backend.WriteOption) error {
+	start := time.Now()
+	err := b.b.UpsertGreeting(id, val, opts...)
+	b.observe("upsert", start, err)
+	return err
+}
+
+func (b *bk) GetGreeting(id string) (*backend.Greeting, error) {
+	start := time.Now()
+	g, err := b.b.GetGreeting(id)
+	b.observe("get", start, err)
+	return g, err
+}
+
+func (b *bk) DeleteGreeting(id string, opts ...backend.WriteOption) error {
+	start := time.Now()
+	err := b.b.DeleteGreeting(id, opts...)
+	b.observe("delete", start, err)
+	return err
+}
+
+func (b *bk) GetGreetings(prefix, cursor string, limit int) ([]backend.Greeting, string, error) {
+	start := time.Now()
+	gs, next, err := b.b.GetGreetings(prefix, cursor, limit)
+	b.observe("list", start, err)
+	return gs, next, err
+}
+
+// WatchGreetings records the latency of starting the watch
+func (b *bk) WatchGreetings(stopC <-chan bool) (<-chan backend.GreetingEvent, error) {
+	start := time.Now()
+	events, err := b.b.WatchGreetings(stopC)
+	b.observe("watch", start, err)
+	return events, err
+}
+
+// GetHistory records the latency of reading the history, see backend.HistoryBackend
+func (b *bk) GetHistory(id string) ([]backend.Version, error) {
+	start := time.Now()
+	history, err := backend.GetHistory(b.b, id)
+	b.observe("history", start, err)
+	return history, err
+}
+
+// AppendAuditEvent records the latency of storing the audit event,
+// see backend.AuditBackend
+func (b *bk) AppendAuditEvent(data string) error {
+	start := time.Now()
+	a, err := backend.GetAuditBackend(b.b)
+	if err == nil {
+		err = a.AppendAuditEvent(data)
+	}
+	b.observe("audit_append", start, err)
+	return err
+}
+
+// GetAuditEvents records the latency of reading the audit events
+func (b *bk) GetAuditEvents() ([]string, error) {
+	start := time.Now()
+	a, err := backend.GetAuditBackend(b.b)
+	var events []string
+	if err == nil {
+		events, err = a.GetAuditEvents()
+	}
+	b.observe("audit_get", start, err)
+	return events, err
+}
+
+func (b *bk) Ping() error {
+	start := time.Now()
+	err := b.b.Ping()
+	b.observe("ping", start, err)
+	return err
+}
+
+func (b *bk) Close() error {
+	return b.b.Close()
+}
@@ -0,0 +1,105 @@
+package metricsbk
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/check.v1"
+	"github.com/gravitational/hello/backend"
+	"github.com/gravitational/hello/backend/membk"
+	"github.com/gravitational/hello/backend/test"
+	"github.com/gravitational/hello/metrics"
+)
+
+// Metrics backend is tested with the acceptance suite to make sure
+// it does not change the behavior of the decorated backend
+func TestMetrics(t *testing.T) { TestingT(t) }
+
+type MetricsSuite struct {
+	r     *metrics.Registry
+	bk    backend.GreetingBackend
+	suite test.BackendSuite
+}
+
+var _ = Suite(&MetricsSuite{})
+
+func (s *MetricsSuite) SetUpTest(c *C) {
+	s.r = metrics.NewRegistry()
+	mem, err := membk.New()
+	c.Assert(err, IsNil)
+	s.bk = New(mem, s.r)
+	s.suite.B = s.bk
+}
+
+func (s *MetricsSuite) TearDownTest(c *C) {
+	c.Assert(s.bk.Close(), IsNil)
+}
+
+func (s *MetricsSuite) TestGreetingCRUD(c *C) {
+	s.suite.GreetingCRUD(c)
+}
+
+func (s *MetricsSuite) TestGreetingsList(c *C) {
+	s.suite.GreetingsList(c)
+}
+
+func (s *MetricsSuite) TestMetadata(c *C) {
+	s.suite.Metadata(c)
+}
+
+func (s *MetricsSuite) TestConditionalWrites(c *C) {
+	s.suite.ConditionalWrites(c)
+}
+
+func (s *MetricsSuite) TestGreetingsTTL(c *C) {
+	s.suite.GreetingsTTL(c)
+}
+
+func (s *MetricsSuite) TestConcurrency(c *C) {
+	s.suite.Concurrency(c)
+}
+
+func (s *MetricsSuite) TestGreetingsWatch(c *C) {
+	s.suite.GreetingsWatch(c)
+}
+
+func (s *MetricsSuite) TestPing(c *C) {
+	s.suite.Ping(c)
+}
+
+func (s *MetricsSuite) TestHistory(c *C) {
+	s.suite.History(c)
+}
+
+func (s *MetricsSuite) TestAuditEvents(c *C) {
+	s.suite.AuditEvents(c)
+}
+
+func (s *MetricsSuite) TestMetrics(c *C) {
+	c.Assert(s.bk.UpsertGreeting("hello.us", "Hello"), IsNil)
+	c.Assert(s.bk.UpsertGreeting("hello.us", "Hello", backend.Create()), FitsTypeOf, &backend.ConflictError{})
+	_, err := s.bk.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	_, err = s.bk.GetGreeting("hello.fr")
+	c.Assert(err, FitsTypeOf, &backend.NotFoundError{})
+
+	duration := s.r.NewHistogram(DurationMetric, "Latency of backend operations", metrics.DefaultBuckets, "op")
+	c.Assert(duration.Count("upsert"), Equals, uint64(2))
+	c.Assert(duration.Count("get"), Equals, uint64(2))
+	c.Assert(duration.Count("delete"), Equals, uint64(0))
+
+	errors := s.r.NewCounter(ErrorsMetric, "Failed backend operations", "op", "type")
+	c.Assert(errors.Value("upsert", "conflict"), Equals, 1.0)
+	c.Assert(errors.Value("get", "not_found"), Equals, 1.0)
+	c.Assert(errors.Value("get", "other"), Equals, 0.0)
+
+	buf := &bytes.Buffer{}
+	_, err = s.r.WriteTo(buf)
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Matches, `(?s).*hello_backend_errors_total\{op="get",type="not_found"\} 1.*`)
+	c.Assert(buf.String(), Matches, `(?s).*hello_backend_operation_duration_seconds_count\{op="get"\} 2.*`)
+}
+
+func (s *MetricsSuite) TestClose(c *C) {
+	s.suite.Close(c)
+}
@@ -0,0 +1,169 @@
+package backend
+
+import (
+	"fmt"
+	"time"
+)
+
+// WriteOption is a functional argument that sets conditions
+// of the write operations
+type WriteOption func(o *WriteOptions)
+
+// WriteOptions are parameters of the write operation collected from WriteOption's
+type WriteOptions struct {
+	// Create allows upsert only if greeting does not exist yet
+	Create bool
+	// Revision allows write only if the current greeting revision
+	// matches it, 0 means no revision check
+	Revision uint64
+	// TTL is the time after which greeting expires and is deleted,
+	// 0 means greeting never expires
+	TTL time.Duration
+	// Author is the name of the caller making the change, recorded
+	// in the greeting history, see HistoryBackend
+	Author string
+	// NoHistory turns off recording of the change in the greeting history
+	NoHistory bool
+	// Template marks the upserted value as a template
+	Template bool
+	// Locale is the locale of the upserted greeting
+	Locale string
+	// Description tells what the upserted greeting is for
+	Description string
+	// Tags are labels of the upserted greeting
+	Tags []string
+	// Written receives the revision of the upserted greeting, see ReturnRevision
+	Written *uint64
+}
+
+// Create makes upsert insert-only, it fails with ConflictError
+// if the greeting already exists
+func Create() WriteOption {
+	return func(o *WriteOptions) {
+		o.Create = true
+	}
+}
+
+// IfRevision makes upsert or delete fail with ConflictError unless the greeting
+// revision matches rev, i.e. nobody has changed the greeting since we've read it
+func IfRevision(rev uint64) WriteOption {
+	return func(o *WriteOptions) {
+		o.Revision = rev
+	}
+}
+
+// TTL makes the upserted greeting expire after the given time,
+// e.g. for seasonal or campaign greetings
+func TTL(d time.Duration) WriteOption {
+	return func(o *WriteOptions) {
+		o.TTL = d
+	}
+}
+
+// Author records the name of the caller making the change
+// in the greeting record and history, see HistoryBackend
+func Author(name string) WriteOption {
+	return func(o *WriteOptions) {
+		o.Author = name
+	}
+}
+
+// NoHistory makes backends skip recording the change in the greeting history,
+// e.g. for bulk imports
+func NoHistory() WriteOption {
+	return func(o *WriteOptions) {
+		o.NoHistory = true
+	}
+}
+
+// Template marks the upserted value as a template executed when greeting,
+// values are plain otherwise, even if they contain '{{'
+func Template() WriteOption {
+	return func(o *WriteOptions) {
+		o.Template = true
+	}
+}
+
+// Locale sets the locale of the upserted greeting, e.g. 'en-US'
+func Locale(locale string) WriteOption {
+	return func(o *WriteOptions) {
+		o.Locale = locale
+	}
+}
+
+// Description sets the description of the upserted greeting,
+// e.g. 'shown on the landing page'
+func Description(d string) WriteOption {
+	return func(o *WriteOptions) {
+		o.Description = d
+	}
+}
+
+// Tags sets the labels of the upserted greeting, e.g. 'holiday'
+func Tags(tags ...string) WriteOption {
+	return func(o *WriteOptions) {
+		o.Tags = tags
+	}
+}
+
+// ReturnRevision makes upsert store the revision of the written greeting in rev,
+// so the caller can make the next conditional write without reading it again
+//
+//  var rev uint64
+//  err := b.UpsertGreeting("hello.us", "Hello", backend.ReturnRevision(&rev))
+//  err = b.UpsertGreeting("hello.us", "Howdy", backend.IfRevision(rev))
+//
+func ReturnRevision(rev *uint64) WriteOption {
+	return func(o *WriteOptions) {
+		o.Written = rev
+	}
+}
+
+// SetWritten stores the revision of the written greeting
+// if the caller asked for it, see ReturnRevision
+func (o WriteOptions) SetWritten(rev uint64) {
+	if o.Written != nil {
+		*o.Written = rev
+	}
+}
+
+// GetWriteOptions collects options into WriteOptions
+func GetWriteOptions(opts []WriteOption) WriteOptions {
+	var o WriteOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// CheckWrite checks write conditions against the current greeting, that is
+// nil if greeting does not exist. Backends that can't check conditions
+// natively use it to emulate conditional writes.
+func CheckWrite(id string, current *Greeting, o WriteOptions) error {
+	switch {
+	case o.Create && current != nil:
+		return &ConflictError{ID: id, Message: "greeting already exists"}
+	case o.Revision != 0 && current == nil:
+		return &NotFoundError{ID: id}
+	case o.Revision != 0 && o.Revision != current.Revision:
+		return &ConflictError{
+			ID:      id,
+			Message: fmt.Sprintf("expected revision %v, got %v", o.Revision, current.Revision),
+		}
+	}
+	return nil
+}
+
+// Clock is a source of time, backends that expire greetings on their own
+// accept it to make expiry testable
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is a Clock that returns the system time
+type SystemClock struct{}
+
+// Now returns the current system time
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,97 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RecordVersion is the version of the greeting record format written by EncodeRecord
+const RecordVersion = 1
+
+// record is the serialized greeting record. New optional fields can be added
+// without changing the version, as readers ignore unknown fields, the version
+// is bumped for incompatible changes, that older readers refuse to decode
+// rather than misread.
+type record struct {
+	Version     int       `json:"version"`
+	Value       string    `json:"value"`
+	Template    bool      `json:"template,omitempty"`
+	Locale      string    `json:"locale,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	Created     time.Time `json:"created"`
+	Updated     time.Time `json:"updated"`
+	Author      string    `json:"author,omitempty"`
+}
+
+// NewGreeting returns the greeting record written by the upsert with options o
+// at time now. current is the greeting replaced by the upsert, nil if there is none,
+// the replaced greeting keeps it's creation time.
+func NewGreeting(id, val string, current *Greeting, o WriteOptions, now time.Time) Greeting {
+	g := Greeting{
+		ID:          id,
+		Value:       val,
+		Template:    o.Template,
+		Locale:      o.Locale,
+		Description: o.Description,
+		Created:     now.UTC(),
+		Updated:     now.UTC(),
+		Author:      o.Author,
+	}
+	if len(o.Tags) != 0 {
+		g.Tags = append([]string{}, o.Tags...)
+	}
+	if current != nil {
+		g.Created = current.Created
+	}
+	return g
+}
+
+// EncodeRecord serializes the value and the metadata of the greeting
+// for backends that store greetings as strings, e.g. etcdbk
+//
+//  {"version":1,"value":"Hello","locale":"en-US","created":"2015-10-01T12:00:00Z","updated":"2015-10-01T12:00:00Z"}
+//
+func EncodeRecord(g Greeting) (string, error) {
+	data, err := json.Marshal(record{
+		Version:     RecordVersion,
+		Value:       g.Value,
+		Template:    g.Template,
+		Locale:      g.Locale,
+		Description: g.Description,
+		Tags:        g.Tags,
+		Created:     g.Created,
+		Updated:     g.Updated,
+		Author:      g.Author,
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// DecodeRecord restores the value and the metadata of the greeting g from the data
+// written by EncodeRecord. Data that is not a versioned record is the bare value
+// written by older versions, it is read as the plain value with no metadata.
+func DecodeRecord(data string, g *Greeting) error {
+	var r record
+	if !strings.HasPrefix(data, "{") || json.Unmarshal([]byte(data), &r) != nil || r.Version == 0 {
+		g.Value = data
+		return nil
+	}
+	if r.Version > RecordVersion {
+		return fmt.Errorf("greeting '%v' is stored in record version %v, this server reads up to %v",
+			g.ID, r.Version, RecordVersion)
+	}
+	g.Value = r.Value
+	g.Template = r.Template
+	g.Locale = r.Locale
+	g.Description = r.Description
+	g.Tags = r.Tags
+	g.Created = r.Created
+	g.Updated = r.Updated
+	g.Author = r.Author
+	return nil
+}
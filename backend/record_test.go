@@ -0,0 +1,49 @@
+package backend
+
+import (
+	"time"
+
+	. "github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+type RecordSuite struct{}
+
+var _ = Suite(&RecordSuite{})
+
+func (s *RecordSuite) TestRoundTrip(c *C) {
+	now := time.Date(2015, 10, 1, 12, 0, 0, 0, time.UTC)
+	current := &Greeting{ID: "hello.us", Value: "Hi", Created: now.Add(-time.Hour)}
+	g := NewGreeting("hello.us", "Hello {{.Name}}", current,
+		GetWriteOptions([]WriteOption{Template(), Locale("en-US"), Tags("web"), Author("alice")}), now)
+	c.Assert(g.Created, DeepEquals, now.Add(-time.Hour))
+	c.Assert(g.Updated, DeepEquals, now)
+
+	data, err := EncodeRecord(g)
+	c.Assert(err, IsNil)
+	c.Assert(data, Equals, `{"version":1,"value":"Hello {{.Name}}","template":true,"locale":"en-US","tags":["web"],`+
+		`"created":"2015-10-01T11:00:00Z","updated":"2015-10-01T12:00:00Z","author":"alice"}`)
+
+	out := Greeting{ID: "hello.us"}
+	c.Assert(DecodeRecord(data, &out), IsNil)
+	c.Assert(out, DeepEquals, g)
+}
+
+func (s *RecordSuite) TestLegacyValues(c *C) {
+	// values stored by older versions are read as they are
+	for _, v := range []string{"Hello", "", "{{.Name}}", `{"value": "Hello"}`, "{broken"} {
+		g := Greeting{ID: "hello.us"}
+		c.Assert(DecodeRecord(v, &g), IsNil)
+		c.Assert(g, DeepEquals, Greeting{ID: "hello.us", Value: v})
+	}
+}
+
+func (s *RecordSuite) TestFutureVersions(c *C) {
+	// fields added later are ignored
+	g := Greeting{ID: "hello.us"}
+	c.Assert(DecodeRecord(`{"version":1,"value":"Hello","audience":"kids"}`, &g), IsNil)
+	c.Assert(g.Value, Equals, "Hello")
+
+	// incompatible versions are refused
+	err := DecodeRecord(`{"version":2,"value":"Hello"}`, &g)
+	c.Assert(err, ErrorMatches, ".*record version 2.*")
+}
@@ -0,0 +1,211 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Factory creates the backend from backend-specific configuration string,
+// usually a JSON dictionary, e.g. etcdbk.FromString
+type Factory func(cfg string) (GreetingBackend, error)
+
+// Param types of backend configuration parameters
+const (
+	StringParam   = "string"
+	StringsParam  = "[]string"
+	DurationParam = "duration"
+	IntParam      = "int"
+	BoolParam     = "bool"
+)
+
+// Param describes a parameter of the backend configuration dictionary
+type Param struct {
+	// Name is the key in the dictionary, e.g. 'nodes'
+	Name string `json:"name"`
+	// Type is one of StringParam, StringsParam, DurationParam, IntParam or BoolParam
+	Type string `json:"type"`
+	// Required is true if the parameter has to be set
+	Required bool `json:"required"`
+	// Description tells what the parameter is for, e.g. 'etcd node URLs'
+	Description string `json:"description"`
+}
+
+// Registration is a backend implementation selectable by name, e.g. with
+// -backend flag of the hello server
+type Registration struct {
+	// Name is a unique backend name, e.g. 'etcd'
+	Name string `json:"name"`
+	// Description tells what the backend is for
+	Description string `json:"description"`
+	// Params is the schema of the configuration dictionary
+	Params []Param `json:"params"`
+	// New creates the backend from the configuration
+	New Factory `json:"-"`
+}
+
+var registry = struct {
+	sync.RWMutex
+	backends map[string]Registration
+}{backends: make(map[string]Registration)}
+
+// Register makes the backend selectable by name, implementations
+// register themselves in init functions, so importing the package is enough:
+//
+//  func init() {
+//      backend.Register(backend.Registration{
+//          Name:   "etcd",
+//          Params: []backend.Param{{Name: "nodes", Type: backend.StringsParam, Required: true}},
+//          New:    FromString,
+//      })
+//  }
+//
+// It panics if the name is empty or taken, or the factory is nil.
+func Register(r Registration) {
+	registry.Lock()
+	defer registry.Unlock()
+	if r.Name == "" || r.New == nil {
+		panic("backend: registration needs a name and a factory")
+	}
+	if _, ok := registry.backends[r.Name]; ok {
+		panic(fmt.Sprintf("backend: %v is registered twice", r.Name))
+	}
+	registry.backends[r.Name] = r
+}
+
+// Lookup returns the registered backend by name
+func Lookup(name string) (*Registration, error) {
+	registry.RLock()
+	defer registry.RUnlock()
+	r, ok := registry.backends[name]
+	if !ok {
+		return nil, &UnsupportedError{Name: name, Registered: names()}
+	}
+	return &r, nil
+}
+
+// Registered returns the registered backends sorted by name
+func Registered() []Registration {
+	registry.RLock()
+	defer registry.RUnlock()
+	out := make([]Registration, 0, len(registry.backends))
+	for _, name := range names() {
+		out = append(out, registry.backends[name])
+	}
+	return out
+}
+
+func names() []string {
+	out := make([]string, 0, len(registry.backends))
+	for name := range registry.backends {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// New creates the registered backend by name from the configuration
+//
+//  b, err := backend.New("etcd", `{"nodes": ["http://localhost:4001"], "key": "/hello"}`)
+//
+func New(name, cfg string) (GreetingBackend, error) {
+	r, err := Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return r.New(cfg)
+}
+
+// CheckConfig checks the configuration dictionary against the schema
+// without creating the backend, it returns BadConfigError naming the parameter
+// that is missing, unknown or has a wrong type
+func (r *Registration) CheckConfig(cfg string) error {
+	vals := map[string]interface{}{}
+	if strings.TrimSpace(cfg) != "" {
+		if err := json.Unmarshal([]byte(cfg), &vals); err != nil || vals == nil {
+			return &BadConfigError{Backend: r.Name, Message: "expected a dictionary"}
+		}
+	}
+	params := make(map[string]bool, len(r.Params))
+	for _, p := range r.Params {
+		params[p.Name] = true
+		v, ok := vals[p.Name]
+		if !ok || v == nil {
+			if p.Required {
+				return &BadConfigError{Backend: r.Name, Param: p.Name, Message: "missing required parameter"}
+			}
+			continue
+		}
+		if !p.valid(v) {
+			return &BadConfigError{Backend: r.Name, Param: p.Name, Message: fmt.Sprintf("expected %v, got %v", p.Type, v)}
+		}
+	}
+	for name := range vals {
+		if !params[name] {
+			return &BadConfigError{Backend: r.Name, Param: name, Message: "unknown parameter"}
+		}
+	}
+	return nil
+}
+
+func (p Param) valid(v interface{}) bool {
+	switch p.Type {
+	case StringParam:
+		_, ok := v.(string)
+		return ok
+	case StringsParam:
+		items, ok := v.([]interface{})
+		for _, item := range items {
+			if _, isString := item.(string); !isString {
+				return false
+			}
+		}
+		return ok
+	case DurationParam:
+		s, ok := v.(string)
+		if !ok {
+			return false
+		}
+		_, err := time.ParseDuration(s)
+		return err == nil
+	case IntParam:
+		f, ok := v.(float64)
+		return ok && f == float64(int64(f))
+	case BoolParam:
+		_, ok := v.(bool)
+		return ok
+	}
+	return true
+}
+
+// UnsupportedError is returned when the backend is not registered
+type UnsupportedError struct {
+	// Name is the backend name
+	Name string
+	// Registered are the names of the registered backends
+	Registered []string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("unsupported backend type '%v', expected one of: %v", e.Name, strings.Join(e.Registered, ", "))
+}
+
+// BadConfigError is returned when the backend configuration does not match the schema
+type BadConfigError struct {
+	// Backend is the backend name
+	Backend string
+	// Param is the parameter name, empty if the whole configuration is wrong
+	Param string
+	// Message describes the problem
+	Message string
+}
+
+func (e *BadConfigError) Error() string {
+	if e.Param == "" {
+		return fmt.Sprintf("invalid %v backend configuration: %v", e.Backend, e.Message)
+	}
+	return fmt.Sprintf("invalid %v backend parameter '%v': %v", e.Backend, e.Param, e.Message)
+}
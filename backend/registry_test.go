@@ -0,0 +1,75 @@
+package backend
+
+import (
+	"testing"
+
+	. "github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+func TestBackend(t *testing.T) { TestingT(t) }
+
+type RegistrySuite struct{}
+
+var _ = Suite(&RegistrySuite{})
+
+func (s *RegistrySuite) TestRegister(c *C) {
+	created := ""
+	Register(Registration{
+		Name: "test.register",
+		Params: []Param{
+			{Name: "path", Type: StringParam, Required: true},
+		},
+		New: func(cfg string) (GreetingBackend, error) {
+			created = cfg
+			return nil, nil
+		},
+	})
+	r, err := Lookup("test.register")
+	c.Assert(err, IsNil)
+	c.Assert(r.Name, Equals, "test.register")
+	_, err = New("test.register", `{"path": "/tmp"}`)
+	c.Assert(err, IsNil)
+	c.Assert(created, Equals, `{"path": "/tmp"}`)
+
+	found := false
+	for _, r := range Registered() {
+		found = found || r.Name == "test.register"
+	}
+	c.Assert(found, Equals, true)
+
+	_, err = New("test.missing", "")
+	c.Assert(err, FitsTypeOf, &UnsupportedError{})
+
+	c.Assert(func() { Register(Registration{Name: "test.register", New: r.New}) }, PanicMatches, ".*registered twice")
+	c.Assert(func() { Register(Registration{Name: "test.nil"}) }, PanicMatches, ".*needs a name and a factory")
+}
+
+func (s *RegistrySuite) TestCheckConfig(c *C) {
+	r := &Registration{
+		Name: "test",
+		Params: []Param{
+			{Name: "nodes", Type: StringsParam, Required: true},
+			{Name: "period", Type: DurationParam},
+			{Name: "size", Type: IntParam},
+			{Name: "sync", Type: BoolParam},
+		},
+	}
+	c.Assert(r.CheckConfig(`{"nodes": ["a"], "period": "1m", "size": 10, "sync": true}`), IsNil)
+	c.Assert(r.CheckConfig(`{"nodes": []}`), IsNil)
+
+	for cfg, param := range map[string]string{
+		``:                                 "nodes",
+		`{}`:                               "nodes",
+		`[]`:                               "",
+		`{"nodes": "a"}`:                   "nodes",
+		`{"nodes": [1]}`:                   "nodes",
+		`{"nodes": [], "period": "often"}`: "period",
+		`{"nodes": [], "size": 1.5}`:       "size",
+		`{"nodes": [], "sync": "yes"}`:     "sync",
+		`{"nodes": [], "node": "a"}`:       "node",
+	} {
+		err := r.CheckConfig(cfg)
+		c.Assert(err, FitsTypeOf, &BadConfigError{}, Commentf(cfg))
+		c.Assert(err.(*BadConfigError).Param, Equals, param, Commentf(cfg))
+	}
+}
@@ -0,0 +1,137 @@
+// package swapbk implements a backend decorator that delegates to a backend
+// that can be replaced at runtime, e.g. when the server configuration is reloaded
+package swapbk
+
+import (
+	"sync"
+
+	"github.com/gravitational/hello/backend"
+)
+
+// New returns backend delegating to the backend b until it's swapped, see Swap
+func New(b backend.GreetingBackend) *Backend {
+	return &Backend{cur: &generation{b: b}}
+}
+
+// Backend delegates operations to the current backend. Swap replaces it
+// without interrupting operations in flight: they complete on the old backend,
+// that is closed afterwards, and new operations go to the new one.
+type Backend struct {
+	mtx sync.RWMutex
+	cur *generation
+}
+
+// generation is a backend with the operations in flight on it
+type generation struct {
+	b        backend.GreetingBackend
+	inflight sync.WaitGroup
+}
+
+// acquire returns the current backend, the caller has to call release
+// when the operation completes
+func (s *Backend) acquire() *generation {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	s.cur.inflight.Add(1)
+	return s.cur
+}
+
+func (g *generation) release() {
+	g.inflight.Done()
+}
+
+// Swap replaces the current backend with b and returns the channel
+// receiving the result of closing the old backend, once it's operations
+// in flight complete. Closing the old backend ends it's watches, watchers
+// have to watch again to get the changes of the new one, e.g. cachebk does,
+// and API watch streams end, so their clients have to reconnect.
+func (s *Backend) Swap(b backend.GreetingBackend) <-chan error {
+	s.mtx.Lock()
+	old := s.cur
+	s.cur = &generation{b: b}
+	s.mtx.Unlock()
+
+	errC := make(chan error, 1)
+	go func() {
+		old.inflight.Wait()
+		errC <- old.b.Close()
+	}()
+	return errC
+}
+
+func (s *Backend) UpsertGreeting(id, val string, opts ...backend.WriteOption) error {
+	g := s.acquire()
+	defer g.release()
+	return g.b.UpsertGreeting(id, val, opts...)
+}
+
+func (s *Backend) GetGreeting(id string) (*backend.Greeting, error) {
+	g := s.acquire()
+	defer g.release()
+	return g.b.GetGreeting(id)
+}
+
+func (s *Backend) DeleteGreeting(id string, opts ...backend.WriteOption) error {
+	g := s.acquire()
+	defer g.release()
+	return g.b.DeleteGreeting(id, opts...)
+}
+
+func (s *Backend) GetGreetings(prefix, cursor string, limit int) ([]backend.Greeting, string, error) {
+	g := s.acquire()
+	defer g.release()
+	return g.b.GetGreetings(prefix, cursor, limit)
+}
+
+// WatchGreetings watches the current backend, the watch is not an operation
+// in flight, as it lasts until the backend is closed
+func (s *Backend) WatchGreetings(stopC <-chan bool) (<-chan backend.GreetingEvent, error) {
+	g := s.acquire()
+	defer g.release()
+	return g.b.WatchGreetings(stopC)
+}
+
+// GetHistory returns the history of the greeting kept by the current backend,
+// see backend.HistoryBackend
+func (s *Backend) GetHistory(id string) ([]backend.Version, error) {
+	g := s.acquire()
+	defer g.release()
+	return backend.GetHistory(g.b, id)
+}
+
+// AppendAuditEvent stores the audit event in the current backend,
+// see backend.AuditBackend
+func (s *Backend) AppendAuditEvent(data string) error {
+	g := s.acquire()
+	defer g.release()
+	a, err := backend.GetAuditBackend(g.b)
+	if err != nil {
+		return err
+	}
+	return a.AppendAuditEvent(data)
+}
+
+// GetAuditEvents returns the audit events stored in the current backend
+func (s *Backend) GetAuditEvents() ([]string, error) {
+	g := s.acquire()
+	defer g.release()
+	a, err := backend.GetAuditBackend(g.b)
+	if err != nil {
+		return nil, err
+	}
+	return a.GetAuditEvents()
+}
+
+func (s *Backend) Ping() error {
+	g := s.acquire()
+	defer g.release()
+	return g.b.Ping()
+}
+
+// Close closes the current backend, the callers should stop
+// the operations first, e.g. by shutting down the server
+func (s *Backend) Close() error {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.cur.b.Close()
+}
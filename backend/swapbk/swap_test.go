@@ -0,0 +1,140 @@
+package swapbk
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/check.v1"
+	"github.com/gravitational/hello/backend"
+	"github.com/gravitational/hello/backend/membk"
+	"github.com/gravitational/hello/backend/test"
+)
+
+// Swap backend is tested with the acceptance suite to make sure
+// it does not change the behavior of the decorated backend
+func TestSwap(t *testing.T) { TestingT(t) }
+
+type SwapSuite struct {
+	bk    *Backend
+	suite test.BackendSuite
+}
+
+var _ = Suite(&SwapSuite{})
+
+func (s *SwapSuite) SetUpTest(c *C) {
+	mem, err := membk.New()
+	c.Assert(err, IsNil)
+	s.bk = New(mem)
+	s.suite.B = s.bk
+}
+
+func (s *SwapSuite) TearDownTest(c *C) {
+	c.Assert(s.bk.Close(), IsNil)
+}
+
+func (s *SwapSuite) TestGreetingCRUD(c *C) {
+	s.suite.GreetingCRUD(c)
+}
+
+func (s *SwapSuite) TestGreetingsList(c *C) {
+	s.suite.GreetingsList(c)
+}
+
+func (s *SwapSuite) TestMetadata(c *C) {
+	s.suite.Metadata(c)
+}
+
+func (s *SwapSuite) TestConditionalWrites(c *C) {
+	s.suite.ConditionalWrites(c)
+}
+
+func (s *SwapSuite) TestGreetingsTTL(c *C) {
+	s.suite.GreetingsTTL(c)
+}
+
+func (s *SwapSuite) TestConcurrency(c *C) {
+	s.suite.Concurrency(c)
+}
+
+func (s *SwapSuite) TestGreetingsWatch(c *C) {
+	s.suite.GreetingsWatch(c)
+}
+
+func (s *SwapSuite) TestPing(c *C) {
+	s.suite.Ping(c)
+}
+
+func (s *SwapSuite) TestHistory(c *C) {
+	s.suite.History(c)
+}
+
+func (s *SwapSuite) TestAuditEvents(c *C) {
+	s.suite.AuditEvents(c)
+}
+
+func (s *SwapSuite) TestSwap(c *C) {
+	c.Assert(s.bk.UpsertGreeting("hello.us", "Hello"), IsNil)
+	mem, err := membk.New()
+	c.Assert(err, IsNil)
+	old := &slowBackend{GreetingBackend: mem, startedC: make(chan bool), doneC: make(chan bool)}
+	c.Assert(old.UpsertGreeting("hello.us", "Howdy"), IsNil)
+	<-s.bk.Swap(old)
+
+	// the request in flight completes on the old backend
+	resultC := make(chan string, 1)
+	go func() {
+		g, err := s.bk.GetGreeting("hello.us")
+		c.Assert(err, IsNil)
+		resultC <- g.Value
+	}()
+	<-old.startedC
+
+	next, err := membk.New()
+	c.Assert(err, IsNil)
+	c.Assert(next.UpsertGreeting("hello.us", "Hi"), IsNil)
+	closedC := s.bk.Swap(next)
+	g, err := s.bk.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(g.Value, Equals, "Hi")
+
+	select {
+	case <-closedC:
+		c.Fatalf("old backend closed with the request in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(old.doneC)
+	c.Assert(<-resultC, Equals, "Howdy")
+	select {
+	case err := <-closedC:
+		c.Assert(err, IsNil)
+	case <-time.After(time.Second):
+		c.Fatalf("timeout waiting for old backend to close")
+	}
+	c.Assert(old.closed, Equals, true)
+}
+
+// slowBackend blocks GetGreeting until doneC is closed
+type slowBackend struct {
+	backend.GreetingBackend
+	startedC chan bool
+	doneC    chan bool
+	closed   bool
+}
+
+func (b *slowBackend) Close() error {
+	b.closed = true
+	return b.GreetingBackend.Close()
+}
+
+func (b *slowBackend) GetGreeting(id string) (*backend.Greeting, error) {
+	select {
+	case b.startedC <- true:
+		<-b.doneC
+	default:
+	}
+	return b.GreetingBackend.GetGreeting(id)
+}
+
+func (s *SwapSuite) TestClose(c *C) {
+	s.suite.Close(c)
+}
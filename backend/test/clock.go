@@ -0,0 +1,32 @@
+package test
+
+import (
+	"sync"
+	"time"
+)
+
+// FakeClock is a backend.Clock that moves only when told to,
+// use it to test greeting expiry without waiting
+type FakeClock struct {
+	mtx sync.Mutex
+	now time.Time
+}
+
+// NewFakeClock returns a clock frozen at the given time
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the current fake time
+func (c *FakeClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.now = c.now.Add(d)
+}
@@ -4,7 +4,10 @@
 package test
 
 import (
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	. "github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/check.v1"
 	"github.com/gravitational/hello/backend"
@@ -24,18 +27,395 @@ func (s *BackendSuite) GreetingCRUD(c *C) {
 	// Read
 	g, err := s.B.GetGreeting("hello.us")
 	c.Assert(err, IsNil)
-	c.Assert(g, Equals, "Hello")
+	c.Assert(g.Value, Equals, "Hello")
 
 	// Update
 	c.Assert(s.B.UpsertGreeting("hello.us", "Howdy"), IsNil)
 
 	g, err = s.B.GetGreeting("hello.us")
 	c.Assert(err, IsNil)
-	c.Assert(g, Equals, "Howdy")
+	c.Assert(g.Value, Equals, "Howdy")
 
 	// Delete
 	c.Assert(s.B.DeleteGreeting("hello.us"), IsNil)
 
+	_, err = s.B.GetGreeting("hello.us")
+	c.Assert(err, FitsTypeOf, &backend.NotFoundError{})
+}
+
+// Ping tests that a healthy backend reports it can serve requests
+func (s *BackendSuite) Ping(c *C) {
+	c.Assert(s.B.Ping(), IsNil)
+}
+
+// GreetingsList tests listing greetings by prefix with pagination
+func (s *BackendSuite) GreetingsList(c *C) {
+	gs, next, err := s.B.GetGreetings("", "", 0)
+	c.Assert(err, IsNil)
+	c.Assert(len(gs), Equals, 0)
+	c.Assert(next, Equals, "")
+
+	c.Assert(s.B.UpsertGreeting("hello.us", "Hello"), IsNil)
+	c.Assert(s.B.UpsertGreeting("hello.sp", "Hola"), IsNil)
+	c.Assert(s.B.UpsertGreeting("hello.fr", "Bonjour"), IsNil)
+	c.Assert(s.B.UpsertGreeting("bye.us", "Bye"), IsNil)
+
+	// All greetings are returned sorted by id
+	gs, next, err = s.B.GetGreetings("", "", 0)
+	c.Assert(err, IsNil)
+	c.Assert(next, Equals, "")
+	c.Assert(unstamped(gs), DeepEquals, []backend.Greeting{
+		{ID: "bye.us", Value: "Bye"},
+		{ID: "hello.fr", Value: "Bonjour"},
+		{ID: "hello.sp", Value: "Hola"},
+		{ID: "hello.us", Value: "Hello"},
+	})
+
+	// Filter by prefix
+	gs, next, err = s.B.GetGreetings("hello.", "", 0)
+	c.Assert(err, IsNil)
+	c.Assert(next, Equals, "")
+	c.Assert(len(gs), Equals, 3)
+
+	// Paginate through the prefix
+	gs, next, err = s.B.GetGreetings("hello.", "", 2)
+	c.Assert(err, IsNil)
+	c.Assert(unstamped(gs), DeepEquals, []backend.Greeting{
+		{ID: "hello.fr", Value: "Bonjour"},
+		{ID: "hello.sp", Value: "Hola"},
+	})
+	c.Assert(next, Equals, "hello.sp")
+
+	gs, next, err = s.B.GetGreetings("hello.", next, 2)
+	c.Assert(err, IsNil)
+	c.Assert(unstamped(gs), DeepEquals, []backend.Greeting{
+		{ID: "hello.us", Value: "Hello"},
+	})
+	c.Assert(next, Equals, "")
+
+	// Nothing matches the prefix
+	gs, next, err = s.B.GetGreetings("howdy.", "", 0)
+	c.Assert(err, IsNil)
+	c.Assert(len(gs), Equals, 0)
+	c.Assert(next, Equals, "")
+}
+
+// Metadata tests that greetings keep their metadata, creation and update times
+func (s *BackendSuite) Metadata(c *C) {
+	c.Assert(s.B.UpsertGreeting("hello.us", "Hello",
+		backend.Locale("en-US"), backend.Description("landing page"),
+		backend.Tags("web", "default"), backend.Author("alice")), IsNil)
+	g, err := s.B.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(g.Value, Equals, "Hello")
+	c.Assert(g.Locale, Equals, "en-US")
+	c.Assert(g.Description, Equals, "landing page")
+	c.Assert(g.Tags, DeepEquals, []string{"web", "default"})
+	c.Assert(g.Author, Equals, "alice")
+	c.Assert(g.Created.IsZero(), Equals, false)
+	c.Assert(g.Updated.Equal(g.Created), Equals, true)
+
+	// callers can't change the stored greeting
+	g.Tags[0] = "mobile"
+	g2, err := s.B.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(g2.Tags, DeepEquals, []string{"web", "default"})
+
+	// upsert keeps the creation time and replaces the rest of the record
+	c.Assert(s.B.UpsertGreeting("hello.us", "Howdy", backend.Author("bob")), IsNil)
+	g2, err = s.B.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(g2.Value, Equals, "Howdy")
+	c.Assert(g2.Created.Equal(g.Created), Equals, true, Commentf("%v != %v", g2.Created, g.Created))
+	c.Assert(g2.Updated.Before(g.Updated), Equals, false)
+	c.Assert(g2.Locale, Equals, "")
+	c.Assert(g2.Description, Equals, "")
+	c.Assert(len(g2.Tags), Equals, 0)
+	c.Assert(g2.Author, Equals, "bob")
+
+	// conditional writes keep it too
+	c.Assert(s.B.UpsertGreeting("hello.us", "Hi", backend.IfRevision(g2.Revision), backend.Tags("short")), IsNil)
+	g2, err = s.B.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(g2.Created.Equal(g.Created), Equals, true)
+	c.Assert(g2.Tags, DeepEquals, []string{"short"})
+
+	// listings return the metadata as well
+	gs, _, err := s.B.GetGreetings("hello.us", "", 0)
+	c.Assert(err, IsNil)
+	c.Assert(len(gs), Equals, 1)
+	c.Assert(gs[0].Tags, DeepEquals, []string{"short"})
+	c.Assert(gs[0].Created.Equal(g.Created), Equals, true)
+}
+
+// ConditionalWrites tests create-only writes and compare-and-swap by revision
+func (s *BackendSuite) ConditionalWrites(c *C) {
+	// Create-only
+	c.Assert(s.B.UpsertGreeting("hello.us", "Hello", backend.Create()), IsNil)
+	err := s.B.UpsertGreeting("hello.us", "Howdy", backend.Create())
+	c.Assert(err, FitsTypeOf, &backend.ConflictError{})
+
+	g, err := s.B.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(g.Value, Equals, "Hello")
+	c.Assert(g.Revision, Not(Equals), uint64(0))
+
+	// Update if revision matches
+	c.Assert(s.B.UpsertGreeting("hello.us", "Howdy", backend.IfRevision(g.Revision)), IsNil)
+	g2, err := s.B.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(g2.Value, Equals, "Howdy")
+	c.Assert(g2.Revision > g.Revision, Equals, true)
+
+	// Stale revision loses
+	err = s.B.UpsertGreeting("hello.us", "Hi", backend.IfRevision(g.Revision))
+	c.Assert(err, FitsTypeOf, &backend.ConflictError{})
+	err = s.B.DeleteGreeting("hello.us", backend.IfRevision(g.Revision))
+	c.Assert(err, FitsTypeOf, &backend.ConflictError{})
+
+	g, err = s.B.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(g.Value, Equals, "Howdy")
+
+	// Delete if revision matches
+	c.Assert(s.B.DeleteGreeting("hello.us", backend.IfRevision(g2.Revision)), IsNil)
+	_, err = s.B.GetGreeting("hello.us")
+	c.Assert(err, FitsTypeOf, &backend.NotFoundError{})
+
+	// Conditional writes of missing greetings
+	err = s.B.UpsertGreeting("hello.us", "Hi", backend.IfRevision(g2.Revision))
+	c.Assert(err, FitsTypeOf, &backend.NotFoundError{})
+	err = s.B.DeleteGreeting("hello.us", backend.IfRevision(g2.Revision))
+	c.Assert(err, FitsTypeOf, &backend.NotFoundError{})
+
+	// Writes return the revision, so the next write needs no read
+	var rev uint64
+	c.Assert(s.B.UpsertGreeting("hello.us", "Hello", backend.ReturnRevision(&rev)), IsNil)
+	g, err = s.B.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(rev, Equals, g.Revision)
+	c.Assert(s.B.UpsertGreeting("hello.us", "Howdy", backend.IfRevision(rev), backend.ReturnRevision(&rev)), IsNil)
+	c.Assert(rev > g.Revision, Equals, true)
+	c.Assert(s.B.DeleteGreeting("hello.us", backend.IfRevision(rev)), IsNil)
+}
+
+// GreetingsTTL tests that greetings upserted with TTL report the time left
+func (s *BackendSuite) GreetingsTTL(c *C) {
+	c.Assert(s.B.UpsertGreeting("hello.xmas", "Merry Christmas", backend.TTL(time.Hour)), IsNil)
+	c.Assert(s.B.UpsertGreeting("hello.us", "Hello"), IsNil)
+
+	g, err := s.B.GetGreeting("hello.xmas")
+	c.Assert(err, IsNil)
+	c.Assert(g.Value, Equals, "Merry Christmas")
+	c.Assert(g.TTL > 0 && g.TTL <= time.Hour, Equals, true, Commentf("unexpected ttl: %v", g.TTL))
+
 	g, err = s.B.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(g.TTL, Equals, time.Duration(0))
+
+	gs, _, err := s.B.GetGreetings("hello.xmas", "", 0)
+	c.Assert(err, IsNil)
+	c.Assert(len(gs), Equals, 1)
+	c.Assert(gs[0].TTL > 0, Equals, true)
+
+	// upsert without TTL makes greeting permanent
+	c.Assert(s.B.UpsertGreeting("hello.xmas", "Happy Holidays"), IsNil)
+	g, err = s.B.GetGreeting("hello.xmas")
+	c.Assert(err, IsNil)
+	c.Assert(g.TTL, Equals, time.Duration(0))
+}
+
+// Concurrency hammers the backend with concurrent readers and writers,
+// run it with -race to make sure the backend is safe for concurrent use
+func (s *BackendSuite) Concurrency(c *C) {
+	const workers, iterations = 10, 20
+	errC := make(chan error, workers*iterations*4)
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				id := fmt.Sprintf("hello.%v", i%5)
+				errC <- s.B.UpsertGreeting(id, fmt.Sprintf("Hello %v-%v", w, i))
+				if _, err := s.B.GetGreeting(id); !isNotFound(err) {
+					errC <- err
+				}
+				if _, _, err := s.B.GetGreetings("hello.", "", 0); err != nil {
+					errC <- err
+				}
+				if err := s.B.DeleteGreeting(id); !isNotFound(err) {
+					errC <- err
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errC)
+	for err := range errC {
+		c.Assert(err, IsNil)
+	}
+
+	// backend is still consistent after the storm
+	c.Assert(s.B.UpsertGreeting("hello.us", "Hello"), IsNil)
+	g, err := s.B.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(g.Value, Equals, "Hello")
+}
+
+// GreetingsWatch tests streaming of the greeting changes
+func (s *BackendSuite) GreetingsWatch(c *C) {
+	stopC := make(chan bool)
+	events, err := s.B.WatchGreetings(stopC)
+	c.Assert(err, IsNil)
+
+	c.Assert(s.B.UpsertGreeting("hello.us", "Hello"), IsNil)
+	c.Assert(s.B.UpsertGreeting("hello.us", "Howdy"), IsNil)
+	c.Assert(s.B.DeleteGreeting("hello.us"), IsNil)
+
+	e1 := expectEvent(c, events)
+	c.Assert(e1.Type, Equals, backend.EventUpsert)
+	c.Assert(e1.ID, Equals, "hello.us")
+	c.Assert(e1.Value, Equals, "Hello")
+
+	e2 := expectEvent(c, events)
+	c.Assert(e2.Type, Equals, backend.EventUpsert)
+	c.Assert(e2.ID, Equals, "hello.us")
+	c.Assert(e2.Value, Equals, "Howdy")
+	c.Assert(e2.Revision > e1.Revision, Equals, true)
+
+	e3 := expectEvent(c, events)
+	c.Assert(e3.Type, Equals, backend.EventDelete)
+	c.Assert(e3.ID, Equals, "hello.us")
+	c.Assert(e3.Revision > e2.Revision, Equals, true)
+
+	// stopping the watch closes the channel
+	close(stopC)
+	timeout := time.After(WaitTimeout)
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			c.Fatalf("timeout waiting for watch to stop")
+		}
+	}
+}
+
+// History tests that the backend records the changes of the greetings with
+// their authors, it should be run only for backends implementing backend.HistoryBackend
+func (s *BackendSuite) History(c *C) {
+	_, err := backend.GetHistory(s.B, "hello.us")
 	c.Assert(err, FitsTypeOf, &backend.NotFoundError{})
+
+	c.Assert(s.B.UpsertGreeting("hello.us", "Hello", backend.Author("alice")), IsNil)
+	c.Assert(s.B.UpsertGreeting("hello.us", "Howdy", backend.Author("bob")), IsNil)
+	g, err := s.B.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(s.B.DeleteGreeting("hello.us", backend.Author("alice")), IsNil)
+	// writes with NoHistory option are not recorded
+	c.Assert(s.B.UpsertGreeting("hello.us", "Hi", backend.NoHistory()), IsNil)
+
+	history, err := backend.GetHistory(s.B, "hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(len(history), Equals, 3)
+	// most recent first
+	c.Assert(history[0].Deleted, Equals, true)
+	c.Assert(history[0].Author, Equals, "alice")
+	c.Assert(history[1].Value, Equals, "Howdy")
+	c.Assert(history[1].Author, Equals, "bob")
+	c.Assert(history[1].Revision, Equals, g.Revision)
+	c.Assert(history[2].Value, Equals, "Hello")
+	c.Assert(history[2].Deleted, Equals, false)
+	for i, v := range history {
+		c.Assert(v.Time.IsZero(), Equals, false)
+		if i > 0 {
+			c.Assert(v.Revision < history[i-1].Revision, Equals, true)
+		}
+	}
+
+	// the history is bounded
+	for i := 0; i < backend.DefaultHistorySize+5; i++ {
+		c.Assert(s.B.UpsertGreeting("hello.fr", fmt.Sprintf("Bonjour %v", i)), IsNil)
+	}
+	history, err = backend.GetHistory(s.B, "hello.fr")
+	c.Assert(err, IsNil)
+	c.Assert(len(history), Equals, backend.DefaultHistorySize)
+	c.Assert(history[0].Value, Equals, fmt.Sprintf("Bonjour %v", backend.DefaultHistorySize+4))
+
+	// histories of greetings with ids prefixed by other ids are separate
+	c.Assert(s.B.UpsertGreeting("hello.fr/paris", "Salut"), IsNil)
+	history, err = backend.GetHistory(s.B, "hello.fr")
+	c.Assert(err, IsNil)
+	c.Assert(len(history), Equals, backend.DefaultHistorySize)
+}
+
+// AuditEvents tests that the backend stores audit events in order apart
+// from greetings, it should be run only for backends implementing backend.AuditBackend
+func (s *BackendSuite) AuditEvents(c *C) {
+	a, err := backend.GetAuditBackend(s.B)
+	c.Assert(err, IsNil)
+	events, err := a.GetAuditEvents()
+	c.Assert(err, IsNil)
+	c.Assert(len(events), Equals, 0)
+
+	c.Assert(s.B.UpsertGreeting("hello.us", "Hello"), IsNil)
+	for i := 0; i < 12; i++ {
+		c.Assert(a.AppendAuditEvent(fmt.Sprintf(`{"seq": %v}`, i)), IsNil)
+	}
+	events, err = a.GetAuditEvents()
+	c.Assert(err, IsNil)
+	c.Assert(len(events), Equals, 12)
+	for i, e := range events {
+		c.Assert(e, Equals, fmt.Sprintf(`{"seq": %v}`, i))
+	}
+
+	// events are not greetings
+	gs, _, err := s.B.GetGreetings("", "", 0)
+	c.Assert(err, IsNil)
+	c.Assert(len(gs), Equals, 1)
+}
+
+// WaitTimeout is a timeout for waiting on asynchronous events in tests
+const WaitTimeout = 5 * time.Second
+
+func expectEvent(c *C, events <-chan backend.GreetingEvent) backend.GreetingEvent {
+	select {
+	case e, ok := <-events:
+		c.Assert(ok, Equals, true, Commentf("watch closed unexpectedly"))
+		return e
+	case <-time.After(WaitTimeout):
+		c.Fatalf("timeout waiting for event")
+	}
+	return backend.GreetingEvent{}
+}
+
+// unstamped resets revisions and timestamps of the greetings,
+// so they can be compared with the expected values
+func unstamped(gs []backend.Greeting) []backend.Greeting {
+	out := make([]backend.Greeting, len(gs))
+	for i, g := range gs {
+		g.Revision = 0
+		g.Created, g.Updated = time.Time{}, time.Time{}
+		out[i] = g
+	}
+	return out
+}
+
+// isNotFound returns true for nil errors and NotFound errors, that are
+// expected when another goroutine deleted the greeting first
+func isNotFound(err error) bool {
+	if err == nil {
+		return true
+	}
+	_, ok := err.(*backend.NotFoundError)
+	return ok
+}
+
+// Close checks that closing the backend again does nothing
+func (s *BackendSuite) Close(c *C) {
+	c.Assert(s.B.Close(), IsNil)
+	c.Assert(s.B.Close(), IsNil)
 }
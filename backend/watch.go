@@ -0,0 +1,106 @@
+package backend
+
+import (
+	"sync"
+
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/mailgun/log"
+)
+
+// EventType is a type of the greeting change
+type EventType string
+
+const (
+	// EventUpsert is sent when greeting is inserted or updated
+	EventUpsert EventType = "upsert"
+	// EventDelete is sent when greeting is deleted
+	EventDelete EventType = "delete"
+)
+
+// GreetingEvent describes a single change of the greeting
+type GreetingEvent struct {
+	Type EventType
+	// ID is the id of the changed greeting
+	ID string
+	// Value is a new value of the greeting, empty for deletes
+	Value string
+	// Revision is a backend-wide revision of the change, it grows with every change
+	Revision uint64
+}
+
+// WatchBufferSize is the amount of events buffered for each watcher of the Fanout.
+// Watchers that fall behind by more than that are dropped to keep writers going,
+// and their channels are closed.
+const WatchBufferSize = 1024
+
+// Fanout delivers greeting events to watchers, backends that have no
+// native change notifications use it to implement WatchGreetings.
+// Zero value is ready to use.
+type Fanout struct {
+	mtx      sync.Mutex
+	closed   bool
+	watchers map[chan GreetingEvent]bool
+}
+
+// Watch registers a new watcher, the returned channel is closed when stopC is closed,
+// when the fanout is closed or when the watcher falls behind.
+func (f *Fanout) Watch(stopC <-chan bool) <-chan GreetingEvent {
+	ch := make(chan GreetingEvent, WatchBufferSize)
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.closed {
+		close(ch)
+		return ch
+	}
+	if f.watchers == nil {
+		f.watchers = make(map[chan GreetingEvent]bool)
+	}
+	f.watchers[ch] = true
+	go func() {
+		<-stopC
+		f.remove(ch)
+	}()
+	return ch
+}
+
+// Broadcast sends event to all watchers without blocking. Callers should
+// broadcast events in the order of their revisions.
+func (f *Fanout) Broadcast(e GreetingEvent) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for ch := range f.watchers {
+		select {
+		case ch <- e:
+		default:
+			log.Warningf("dropping watcher that fell behind by %v events", WatchBufferSize)
+			delete(f.watchers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Len returns the number of active watchers
+func (f *Fanout) Len() int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return len(f.watchers)
+}
+
+// Close closes all watchers, new watchers will be closed right away
+func (f *Fanout) Close() {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.closed = true
+	for ch := range f.watchers {
+		delete(f.watchers, ch)
+		close(ch)
+	}
+}
+
+func (f *Fanout) remove(ch chan GreetingEvent) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.watchers[ch] {
+		delete(f.watchers, ch)
+		close(ch)
+	}
+}
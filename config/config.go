@@ -0,0 +1,369 @@
+// Package config reads hello server configuration from a JSON or YAML file
+// and HELLO_* environment variables, so the settings and backend credentials
+// don't have to be passed on the command line:
+//
+//  addr: 0.0.0.0:8080
+//  log:
+//    severity: INFO
+//  backend:
+//    type: etcd
+//    config:
+//      nodes: ["http://etcd-0:4001", "http://etcd-1:4001"]
+//      key: /hello
+//
+// Environment variables override the file, e.g. HELLO_ADDR overrides addr,
+// and the server flags set on the command line override both.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/gravitational/hello/api"
+	"github.com/gravitational/hello/auth"
+	"github.com/gravitational/hello/backend"
+	"github.com/gravitational/hello/backend/cachebk"
+	"github.com/gravitational/hello/ratelimit"
+)
+
+const (
+	// DefaultAddr is the default listening host:port
+	DefaultAddr = "localhost:8080"
+	// DefaultShutdownTimeout is the default time to drain in-flight requests
+	DefaultShutdownTimeout = 30 * time.Second
+	// DefaultLogOutput is the default log output
+	DefaultLogOutput = "console"
+	// DefaultLogSeverity is the default log severity
+	DefaultLogSeverity = "WARN"
+	// DefaultAccessLogFormat is the default access log format
+	DefaultAccessLogFormat = "logfmt"
+	// DefaultBackend is the default backend type
+	DefaultBackend = "etcd"
+	// DefaultCacheTTL is the default time greetings stay cached
+	DefaultCacheTTL = cachebk.DefaultTTL
+	// DefaultCacheNegativeTTL is the default time missing greetings stay cached
+	DefaultCacheNegativeTTL = cachebk.DefaultNegativeTTL
+)
+
+// Config is the hello server configuration
+type Config struct {
+	// Addr is the listening host:port
+	Addr string `json:"addr"`
+	// ShutdownTimeout is the time to drain in-flight requests on SIGTERM or SIGINT
+	ShutdownTimeout string `json:"shutdownTimeout"`
+	// DebugAddr is the admin listening host:port, off when empty
+	DebugAddr string `json:"debugAddr"`
+	// Log configures server and access logs
+	Log Log `json:"log"`
+	// Backend configures the greetings backend
+	Backend Backend `json:"backend"`
+	// Cache configures caching of greetings read from the backend
+	Cache Cache `json:"cache"`
+	// TLS turns on HTTPS when the certificate and the key are set
+	TLS TLS `json:"tls"`
+	// Auth turns on authentication of clients
+	Auth Auth `json:"auth"`
+	// RateLimits are per client rate limits of 'read', 'hello' and 'mutation'
+	// routes, the routes missing from the dictionary are not limited
+	RateLimits map[string]ratelimit.Limit `json:"rateLimits"`
+}
+
+// Log configures server and access logs
+type Log struct {
+	// Output is 'console' or 'syslog'
+	Output string `json:"output"`
+	// Severity is the log severity threshold, e.g. 'INFO'
+	Severity string `json:"severity"`
+	// AccessLog is 'stdout' or a file path, off when empty
+	AccessLog string `json:"accessLog"`
+	// AccessLogFormat is 'logfmt' or 'json'
+	AccessLogFormat string `json:"accessLogFormat"`
+}
+
+// Backend configures the greetings backend
+type Backend struct {
+	// Type is the name of the registered backend, see backend.Register
+	Type string `json:"type"`
+	// Config is the backend-specific configuration dictionary, see backend.Param
+	Config json.RawMessage `json:"config"`
+}
+
+// Cache configures caching of greetings read from the backend, see cachebk
+type Cache struct {
+	// Size is the maximum number of cached greetings, 0 turns off the cache
+	Size int `json:"size"`
+	// TTL is the time greetings stay cached, e.g. '10s'
+	TTL string `json:"ttl"`
+	// NegativeTTL is the time missing greetings stay cached, '0s' turns off
+	// caching of missing greetings
+	NegativeTTL string `json:"negativeTTL"`
+}
+
+// TLS configures HTTPS
+type TLS struct {
+	// Cert is the path to TLS certificate
+	Cert string `json:"cert"`
+	// Key is the path to TLS private key
+	Key string `json:"key"`
+	// CA is the path to CA certificates clients have to present certificates signed by
+	CA string `json:"ca"`
+}
+
+// Auth configures authentication of clients
+type Auth struct {
+	// Keys is the path to JSON file with client tokens, API keys and roles
+	Keys string `json:"keys"`
+}
+
+// Default returns the default configuration
+func Default() *Config {
+	return &Config{
+		Addr:            DefaultAddr,
+		ShutdownTimeout: DefaultShutdownTimeout.String(),
+		Log: Log{
+			Output:          DefaultLogOutput,
+			Severity:        DefaultLogSeverity,
+			AccessLogFormat: DefaultAccessLogFormat,
+		},
+		Backend: Backend{Type: DefaultBackend},
+		Cache: Cache{
+			TTL:         DefaultCacheTTL.String(),
+			NegativeTTL: DefaultCacheNegativeTTL.String(),
+		},
+	}
+}
+
+// FromFile reads the configuration from JSON or YAML file, the settings
+// missing from the file are set to defaults
+//
+//  cfg, err := config.FromFile("/etc/hello.yaml")
+//
+func FromFile(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse parses the configuration in JSON or YAML
+func Parse(data []byte) (*Config, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) != 0 && data[0] != '{' {
+		v, err := parseYAML(data)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+	c := Default()
+	if len(data) == 0 {
+		return c, nil
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	if err := d.Decode(c); err != nil {
+		return nil, decodeError(err)
+	}
+	return c, nil
+}
+
+// decodeError names the field that failed to decode
+func decodeError(err error) error {
+	switch e := err.(type) {
+	case *json.UnmarshalTypeError:
+		return &FieldError{Field: e.Field, Message: fmt.Sprintf("expected %v, got %v", e.Type, e.Value)}
+	case *json.SyntaxError:
+		return fmt.Errorf("invalid config format at offset %v: %v", e.Offset, e)
+	}
+	if field := strings.TrimPrefix(err.Error(), "json: unknown field "); field != err.Error() {
+		return &FieldError{Field: strings.Trim(field, `"`), Message: "unknown field"}
+	}
+	return fmt.Errorf("invalid config format: %v", err)
+}
+
+// envVar is an environment variable overriding the field
+type envVar struct {
+	name string
+	set  func(c *Config, v string)
+}
+
+// envVars lists environment variables overriding the configuration
+var envVars = []envVar{
+	{"HELLO_ADDR", func(c *Config, v string) { c.Addr = v }},
+	{"HELLO_SHUTDOWN_TIMEOUT", func(c *Config, v string) { c.ShutdownTimeout = v }},
+	{"HELLO_DEBUG_ADDR", func(c *Config, v string) { c.DebugAddr = v }},
+	{"HELLO_LOG", func(c *Config, v string) { c.Log.Output = v }},
+	{"HELLO_LOG_SEVERITY", func(c *Config, v string) { c.Log.Severity = v }},
+	{"HELLO_ACCESS_LOG", func(c *Config, v string) { c.Log.AccessLog = v }},
+	{"HELLO_ACCESS_LOG_FORMAT", func(c *Config, v string) { c.Log.AccessLogFormat = v }},
+	{"HELLO_BACKEND", func(c *Config, v string) { c.Backend.Type = v }},
+	{"HELLO_BACKEND_CONFIG", func(c *Config, v string) { c.Backend.Config = json.RawMessage(v) }},
+	{"HELLO_TLS_CERT", func(c *Config, v string) { c.TLS.Cert = v }},
+	{"HELLO_TLS_KEY", func(c *Config, v string) { c.TLS.Key = v }},
+	{"HELLO_TLS_CA", func(c *Config, v string) { c.TLS.CA = v }},
+	{"HELLO_AUTH_KEYS", func(c *Config, v string) { c.Auth.Keys = v }},
+}
+
+// Env overrides the configuration with HELLO_* environment variables
+// returned by lookup, e.g. os.LookupEnv, and returns the names of
+// the variables that were set
+//
+//  HELLO_BACKEND_CONFIG='{"nodes": ["http://etcd-0:4001"]}' hello -config=/etc/hello.yaml
+//
+func (c *Config) Env(lookup func(string) (string, bool)) []string {
+	var names []string
+	for _, e := range envVars {
+		if v, ok := lookup(e.name); ok {
+			e.set(c, v)
+			names = append(names, e.name)
+		}
+	}
+	return names
+}
+
+// Check returns FieldError naming the first invalid field
+func (c *Config) Check() error {
+	if err := checkAddr("addr", c.Addr, true); err != nil {
+		return err
+	}
+	if err := checkAddr("debugAddr", c.DebugAddr, false); err != nil {
+		return err
+	}
+	if d, err := time.ParseDuration(c.ShutdownTimeout); err != nil || d < 0 {
+		return &FieldError{Field: "shutdownTimeout", Message: fmt.Sprintf("expected non-negative duration, e.g. '30s', got '%v'", c.ShutdownTimeout)}
+	}
+	if c.Log.Output != "console" && c.Log.Output != "syslog" {
+		return &FieldError{Field: "log.output", Message: fmt.Sprintf("expected 'console' or 'syslog', got '%v'", c.Log.Output)}
+	}
+	if _, err := log.SeverityFromString(c.Log.Severity); err != nil {
+		return &FieldError{Field: "log.severity", Message: err.Error()}
+	}
+	if _, err := api.ParseAccessLogFormat(c.Log.AccessLogFormat); err != nil {
+		return &FieldError{Field: "log.accessLogFormat", Message: err.Error()}
+	}
+	if err := c.Backend.check(); err != nil {
+		return err
+	}
+	if err := c.Cache.check(); err != nil {
+		return err
+	}
+	if err := c.TLS.check(); err != nil {
+		return err
+	}
+	if c.Auth.Keys != "" {
+		if _, err := auth.FromFile(c.Auth.Keys); err != nil {
+			return &FieldError{Field: "auth.keys", Message: err.Error()}
+		}
+	}
+	classes := make([]string, 0, len(c.RateLimits))
+	for class := range c.RateLimits {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		if _, err := api.ParseRouteClass(class); err != nil {
+			return &FieldError{Field: "rateLimits." + class, Message: err.Error()}
+		}
+		if err := c.RateLimits[class].Check(); err != nil {
+			return &FieldError{Field: "rateLimits." + class, Message: err.Error()}
+		}
+	}
+	return nil
+}
+
+// Timeout returns the shutdown timeout, the config has to be checked
+func (c *Config) Timeout() time.Duration {
+	d, _ := time.ParseDuration(c.ShutdownTimeout)
+	return d
+}
+
+func checkAddr(field, addr string, required bool) error {
+	if addr == "" && !required {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return &FieldError{Field: field, Message: fmt.Sprintf("expected host:port, got '%v'", addr)}
+	}
+	return nil
+}
+
+// check checks the backend configuration against the schema of the registered
+// backend, the packages of the backends have to be imported to register them
+func (b Backend) check() error {
+	r, err := backend.Lookup(b.Type)
+	if err != nil {
+		return &FieldError{Field: "backend.type", Message: err.Error()}
+	}
+	if err := r.CheckConfig(string(b.Config)); err != nil {
+		field := "backend.config"
+		if e, ok := err.(*backend.BadConfigError); ok && e.Param != "" {
+			field += "." + e.Param
+		}
+		return &FieldError{Field: field, Message: err.Error()}
+	}
+	return nil
+}
+
+func (c Cache) check() error {
+	if c.Size < 0 {
+		return &FieldError{Field: "cache.size", Message: fmt.Sprintf("expected non-negative number, got %v", c.Size)}
+	}
+	if d, err := time.ParseDuration(c.TTL); err != nil || d <= 0 {
+		return &FieldError{Field: "cache.ttl", Message: fmt.Sprintf("expected positive duration, e.g. '10s', got '%v'", c.TTL)}
+	}
+	if d, err := time.ParseDuration(c.NegativeTTL); err != nil || d < 0 {
+		return &FieldError{Field: "cache.negativeTTL", Message: fmt.Sprintf("expected non-negative duration, e.g. '1s', got '%v'", c.NegativeTTL)}
+	}
+	return nil
+}
+
+// Options returns the cache options, the config has to be checked
+func (c Cache) Options() []cachebk.Option {
+	ttl, _ := time.ParseDuration(c.TTL)
+	negativeTTL, _ := time.ParseDuration(c.NegativeTTL)
+	return []cachebk.Option{cachebk.Size(c.Size), cachebk.TTL(ttl), cachebk.NegativeTTL(negativeTTL)}
+}
+
+func (t TLS) check() error {
+	if t.Cert == "" && t.Key == "" {
+		if t.CA != "" {
+			return &FieldError{Field: "tls.ca", Message: "requires tls.cert and tls.key"}
+		}
+		return nil
+	}
+	for _, f := range []struct{ field, path string }{{"tls.cert", t.Cert}, {"tls.key", t.Key}, {"tls.ca", t.CA}} {
+		if f.path == "" {
+			if f.field == "tls.ca" {
+				continue
+			}
+			return &FieldError{Field: f.field, Message: "both tls.cert and tls.key are required"}
+		}
+		if _, err := os.Stat(f.path); err != nil {
+			return &FieldError{Field: f.field, Message: err.Error()}
+		}
+	}
+	return nil
+}
+
+// FieldError is returned when the configuration field is invalid
+type FieldError struct {
+	// Field is the path to the field, e.g. 'log.severity'
+	Field string
+	// Message describes the problem
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("invalid config field '%v': %v", e.Field, e.Message)
+}
@@ -0,0 +1,204 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gravitational/hello/ratelimit"
+
+	// backends are registered by their packages
+	_ "github.com/gravitational/hello/backend/etcdbk"
+	_ "github.com/gravitational/hello/backend/filebk"
+	_ "github.com/gravitational/hello/backend/membk"
+
+	. "github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+func TestConfig(t *testing.T) { TestingT(t) }
+
+type ConfigSuite struct {
+	dir string
+}
+
+var _ = Suite(&ConfigSuite{})
+
+func (s *ConfigSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+}
+
+func (s *ConfigSuite) write(c *C, name, data string) string {
+	path := filepath.Join(s.dir, name)
+	c.Assert(ioutil.WriteFile(path, []byte(data), 0600), IsNil)
+	return path
+}
+
+const yamlConfig = `
+# hello server
+addr: 0.0.0.0:9090
+shutdownTimeout: 10s
+log:
+  severity: INFO   # more verbose
+  accessLog: "/var/log/hello/access.log"
+backend:
+  type: etcd
+  config:
+    nodes:
+      - http://etcd-0:4001
+      - 'http://etcd-1:4001'
+    key: /hello
+rateLimits:
+  hello: {"rate": 10, "burst": 20}
+cache:
+  size: 4096
+  ttl: 1m
+`
+
+const jsonConfig = `{
+  "addr": "0.0.0.0:9090",
+  "shutdownTimeout": "10s",
+  "log": {"severity": "INFO", "accessLog": "/var/log/hello/access.log"},
+  "backend": {"type": "etcd", "config": {"nodes": ["http://etcd-0:4001", "http://etcd-1:4001"], "key": "/hello"}},
+  "rateLimits": {"hello": {"rate": 10, "burst": 20}},
+  "cache": {"size": 4096, "ttl": "1m"}
+}`
+
+func (s *ConfigSuite) TestFromFile(c *C) {
+	for _, data := range []string{yamlConfig, jsonConfig} {
+		cfg, err := FromFile(s.write(c, "hello.conf", data))
+		c.Assert(err, IsNil)
+		c.Assert(cfg.Check(), IsNil)
+		c.Assert(cfg.Addr, Equals, "0.0.0.0:9090")
+		c.Assert(cfg.Timeout(), Equals, 10*time.Second)
+		c.Assert(cfg.Log.Severity, Equals, "INFO")
+		c.Assert(cfg.Log.AccessLog, Equals, "/var/log/hello/access.log")
+		c.Assert(cfg.Backend.Type, Equals, "etcd")
+		var backend map[string]interface{}
+		c.Assert(json.Unmarshal(cfg.Backend.Config, &backend), IsNil)
+		c.Assert(backend, DeepEquals, map[string]interface{}{
+			"nodes": []interface{}{"http://etcd-0:4001", "http://etcd-1:4001"}, "key": "/hello"})
+
+		c.Assert(cfg.RateLimits, DeepEquals, map[string]ratelimit.Limit{"hello": {Rate: 10, Burst: 20}})
+
+		c.Assert(cfg.Cache.Size, Equals, 4096)
+		c.Assert(cfg.Cache.TTL, Equals, "1m")
+
+		// missing settings are set to defaults
+		c.Assert(cfg.Cache.NegativeTTL, Equals, DefaultCacheNegativeTTL.String())
+		c.Assert(cfg.Log.Output, Equals, DefaultLogOutput)
+		c.Assert(cfg.Log.AccessLogFormat, Equals, DefaultAccessLogFormat)
+	}
+
+	_, err := FromFile(filepath.Join(s.dir, "missing.yaml"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *ConfigSuite) TestEnv(c *C) {
+	cfg, err := Parse([]byte(yamlConfig))
+	c.Assert(err, IsNil)
+	env := map[string]string{
+		"HELLO_ADDR":           "localhost:7070",
+		"HELLO_BACKEND":        "file",
+		"HELLO_BACKEND_CONFIG": `{"path": "/var/lib/hello"}`,
+		"HELLO_AUTH_KEYS":      "",
+	}
+	names := cfg.Env(func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	})
+	c.Assert(len(names), Equals, 4)
+	c.Assert(cfg.Addr, Equals, "localhost:7070")
+	c.Assert(cfg.Backend.Type, Equals, "file")
+	c.Assert(string(cfg.Backend.Config), Equals, `{"path": "/var/lib/hello"}`)
+	c.Assert(cfg.Log.Severity, Equals, "INFO")
+	c.Assert(cfg.Check(), IsNil)
+}
+
+func (s *ConfigSuite) TestCheck(c *C) {
+	keys := s.write(c, "keys.json", `{"tokens": [{"name": "alice", "token": "t", "role": "root"}]}`)
+	cert := s.write(c, "cert.pem", "cert")
+	tcs := []struct {
+		config string
+		field  string
+	}{
+		{config: `addr: 8080`, field: "addr"},
+		{config: `addr: localhost`, field: "addr"},
+		{config: `debugAddr: 6060`, field: "debugAddr"},
+		{config: `shutdownTimeout: soon`, field: "shutdownTimeout"},
+		{config: `log: {"output": "file"}`, field: "log.output"},
+		{config: "log:\n  severity: LOUD", field: "log.severity"},
+		{config: "log:\n  accessLogFormat: xml", field: "log.accessLogFormat"},
+		{config: "backend:\n  type: redis", field: "backend.type"},
+		{config: "backend:\n  type: file", field: "backend.config.path"},
+		{config: "backend:\n  type: file\n  config: [1, 2]", field: "backend.config"},
+		{config: "backend:\n  type: file\n  config: {\"path\": 1}", field: "backend.config.path"},
+		{config: "backend:\n  type: file\n  config: {\"path\": \"/tmp\", \"compaction\": \"1m\"}", field: "backend.config.compaction"},
+		{config: "cache:\n  size: -1", field: "cache.size"},
+		{config: "cache:\n  size: 100\n  ttl: 0s", field: "cache.ttl"},
+		{config: `cache: {"negativeTTL": "never"}`, field: "cache.negativeTTL"},
+		{config: "tls:\n  cert: " + cert, field: "tls.key"},
+		{config: "tls:\n  ca: " + cert, field: "tls.ca"},
+		{config: "tls:\n  cert: " + cert + "\n  key: /missing.pem", field: "tls.key"},
+		{config: "auth:\n  keys: " + keys, field: "auth.keys"},
+		{config: `{"addr": ["localhost:8080"]}`, field: "addr"},
+		{config: `{"log": {"severity": 1}}`, field: "log.severity"},
+		{config: `adr: localhost:8080`, field: "adr"},
+		{config: `rateLimits: {"write": {"rate": 1, "burst": 1}}`, field: "rateLimits.write"},
+		{config: "rateLimits:\n  hello:\n    rate: 1\n    burst: 0", field: "rateLimits.hello"},
+	}
+	for _, tc := range tcs {
+		comment := Commentf(tc.config)
+		cfg, err := Parse([]byte(tc.config + "\n"))
+		if err == nil {
+			if !strings.HasPrefix(tc.field, "backend.") {
+				cfg.Backend.Config = []byte(`{"nodes": ["http://localhost:4001"], "key": "/hello"}`)
+			}
+			err = cfg.Check()
+		}
+		c.Assert(err, FitsTypeOf, &FieldError{}, comment)
+		c.Assert(err.(*FieldError).Field, Equals, tc.field, comment)
+	}
+}
+
+func (s *ConfigSuite) TestYAML(c *C) {
+	v, err := parseYAML([]byte(`---
+a: 1
+b: 1.5
+c: true
+d: ~
+"e f": 'it''s # not a comment'
+g:
+- x
+- m: 1
+  z: [1, "2"]
+h: {"k": "v"}
+i: http://localhost:8080
+`))
+	c.Assert(err, IsNil)
+	c.Assert(v, DeepEquals, map[string]interface{}{
+		"a":   1,
+		"b":   1.5,
+		"c":   true,
+		"d":   nil,
+		"e f": "it's # not a comment",
+		"g": []interface{}{
+			"x",
+			map[string]interface{}{"m": 1, "z": []interface{}{1, "2"}},
+		},
+		"h": map[string]interface{}{"k": "v"},
+		"i": "http://localhost:8080",
+	})
+
+	v, err = parseYAML([]byte("# comments only"))
+	c.Assert(err, IsNil)
+	c.Assert(v, DeepEquals, map[string]interface{}{})
+
+	for _, data := range []string{"a: 1\n  b: 2", "a: 1\na: 2", "just text", "- x", "1: x", "a:\n\t- x"} {
+		_, err := parseYAML([]byte(data))
+		c.Assert(err, NotNil, Commentf(data))
+	}
+}
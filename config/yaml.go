@@ -0,0 +1,64 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/yaml.v2"
+)
+
+// parseYAML parses the YAML document into maps, slices and scalars
+// that can be marshaled to JSON, the document must be a mapping
+// without duplicate keys, e.g.
+//
+//  backend:
+//    type: etcd           # comment
+//    config:
+//      nodes:
+//        - http://etcd-0:4001
+//        - http://etcd-1:4001
+//      key: "/hello"
+//  tls: {"cert": "/etc/hello/cert.pem", "key": "/etc/hello/key.pem"}
+//
+func parseYAML(data []byte) (interface{}, error) {
+	var v interface{}
+	if err := yaml.UnmarshalStrict(data, &v); err != nil {
+		return nil, fmt.Errorf("invalid config format: %v", err)
+	}
+	if v == nil {
+		return map[string]interface{}{}, nil
+	}
+	if _, ok := v.(map[interface{}]interface{}); !ok {
+		return nil, fmt.Errorf("invalid config format: expected mapping, got %T", v)
+	}
+	return jsonValue(v)
+}
+
+// jsonValue converts YAML mappings, that may have keys of any type,
+// to JSON objects with string keys
+func jsonValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			k, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid config format: expected string key, got %v", key)
+			}
+			var err error
+			if m[k], err = jsonValue(val); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, val := range v {
+			var err error
+			if s[i], err = jsonValue(val); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	}
+	return v, nil
+}
@@ -0,0 +1,42 @@
+package command
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/buger/goterm"
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/codegangsta/cli"
+)
+
+func newAuditCommand(c *Command) cli.Command {
+	return cli.Command{
+		Name:  "audit",
+		Usage: "Operations with the audit log of greeting changes",
+		Subcommands: []cli.Command{
+			{
+				Name:   "ls",
+				Usage:  "List audit events, oldest first",
+				Action: c.getAuditEvents,
+				Flags: []cli.Flag{
+					cli.StringFlag{Name: "prompt", Usage: "List only events of the greeting with this id"},
+					cli.IntFlag{Name: "limit", Usage: "Maximum amount of the most recent events to list, 0 lists all"},
+				},
+			},
+		},
+	}
+}
+
+func (cmd *Command) getAuditEvents(c *cli.Context) {
+	events, err := cmd.client.GetAuditEvents(c.String("prompt"), c.Int("limit"))
+	if err != nil {
+		cmd.printError(err)
+		return
+	}
+	t := goterm.NewTable(0, 10, 5, ' ', 0)
+	fmt.Fprint(t, "Time\tAction\tId\tOld Value\tNew Value\tUser\tRemote Address\tRequest Id\n")
+	for _, e := range events {
+		fmt.Fprintf(t, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			e.Time.Format(time.RFC3339), e.Action, e.Prompt, e.OldValue, e.NewValue, e.User, e.RemoteAddr, e.RequestID)
+	}
+	fmt.Fprint(cmd.out, t.String())
+}
@@ -1,13 +1,17 @@
 package command
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 
 	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/buger/goterm"
 	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/codegangsta/cli"
 	"github.com/gravitational/hello/api"
+	"github.com/gravitational/hello/version"
 	"strings"
 )
 
@@ -31,7 +35,16 @@ func (cmd *Command) Run(args []string) error {
 		return err
 	}
 	cmd.url = url
-	client, err := api.NewClient(cmd.url)
+	opts, args, err := findTLS(args)
+	if err != nil {
+		return err
+	}
+	authOpts, args, err := findAuth(args)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, authOpts...)
+	client, err := api.NewClient(cmd.url, opts...)
 	if err != nil {
 		return err
 	}
@@ -40,11 +53,14 @@ func (cmd *Command) Run(args []string) error {
 	app := cli.NewApp()
 	app.Name = "hctl"
 	app.Usage = "CLI for managing hello service"
+	app.Version = version.Get().String()
 	app.Flags = flags()
 
 	app.Commands = []cli.Command{
 		newGreetingCommand(cmd),
 		newHelloCommand(cmd),
+		newAuditCommand(cmd),
+		newVersionCommand(cmd),
 	}
 	return app.Run(args)
 }
@@ -54,7 +70,7 @@ func (cmd *Command) printError(err error) {
 }
 
 func (cmd *Command) printOK(message string, params ...interface{}) {
-	fmt.Fprintf(cmd.out,
+	fmt.Fprint(cmd.out,
 		goterm.Color(
 			fmt.Sprintf("OK: %s\n", fmt.Sprintf(message, params...)), goterm.GREEN)+"\n")
 }
@@ -62,9 +78,32 @@ func (cmd *Command) printOK(message string, params ...interface{}) {
 func flags() []cli.Flag {
 	return []cli.Flag{
 		cli.StringFlag{Name: "hello", Value: DefaultHelloURL, Usage: "Hello URL"},
+		cli.StringFlag{Name: "tls-ca", Usage: "path to CA certificates to verify the HTTPS server"},
+		cli.StringFlag{Name: "tls-cert", Usage: "path to client TLS certificate for servers requiring mutual TLS"},
+		cli.StringFlag{Name: "tls-key", Usage: "path to client TLS private key"},
+		cli.BoolFlag{Name: "insecure", Usage: "do not verify the HTTPS server certificate, use only in development"},
+		cli.StringFlag{Name: "token", Usage: "bearer token for servers that authenticate clients", EnvVar: TokenEnv},
+		cli.StringFlag{Name: "api-key", Usage: "API key for servers that authenticate clients", EnvVar: APIKeyEnv},
+		cli.StringFlag{Name: "credentials", Usage: "path to JSON file with the token or API key, ~/.hello/credentials.json by default", EnvVar: CredentialsEnv},
 	}
 }
 
+// Environment variables with the credentials, flags take precedence over them
+const (
+	TokenEnv       = "HELLO_TOKEN"
+	APIKeyEnv      = "HELLO_API_KEY"
+	CredentialsEnv = "HELLO_CREDENTIALS"
+)
+
+// credentials is a JSON file with the credentials, e.g.
+//
+//   {"token": "s3cr3t"}
+//
+type credentials struct {
+	Token  string `json:"token"`
+	APIKey string `json:"apiKey"`
+}
+
 const DefaultHelloURL = "localhost:8080"
 
 // This function extracts url from the command line regardless of it's position
@@ -85,6 +124,103 @@ func findURL(args []string) (string, []string, error) {
 	return "http://localhost:8080", args, nil
 }
 
+// findTLS extracts TLS flags from the command line regardless of their position
+// and returns client options for them, see findURL
+func findTLS(args []string) ([]api.ClientOption, []string, error) {
+	vals := map[string]string{}
+	for _, name := range []string{"tls-ca", "tls-cert", "tls-key"} {
+		var err error
+		if vals[name], args, err = findFlag(name, args); err != nil {
+			return nil, nil, err
+		}
+	}
+	insecure, args := findSwitch("insecure", args)
+	if vals["tls-ca"] == "" && vals["tls-cert"] == "" && vals["tls-key"] == "" && !insecure {
+		return nil, args, nil
+	}
+	cfg, err := api.ClientTLSConfig(vals["tls-ca"], vals["tls-cert"], vals["tls-key"], insecure)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []api.ClientOption{api.TLS(cfg)}, args, nil
+}
+
+// findAuth extracts the credentials from the command line, see findURL.
+// The token and API key set by flags take precedence over the environment
+// variables, that take precedence over the credentials file.
+func findAuth(args []string) ([]api.ClientOption, []string, error) {
+	vals := map[string]string{}
+	for _, name := range []string{"token", "api-key", "credentials"} {
+		var err error
+		if vals[name], args, err = findFlag(name, args); err != nil {
+			return nil, nil, err
+		}
+	}
+	creds := credentials{Token: vals["token"], APIKey: vals["api-key"]}
+	if creds.Token == "" && creds.APIKey == "" {
+		creds = credentials{Token: os.Getenv(TokenEnv), APIKey: os.Getenv(APIKeyEnv)}
+	}
+	if creds.Token == "" && creds.APIKey == "" {
+		var err error
+		if creds, err = readCredentials(vals["credentials"]); err != nil {
+			return nil, nil, err
+		}
+	}
+	return []api.ClientOption{api.BearerToken(creds.Token), api.APIKey(creds.APIKey)}, args, nil
+}
+
+// readCredentials reads the credentials file from path, the environment
+// variable or the default location, missing default file is not an error
+func readCredentials(path string) (credentials, error) {
+	var creds credentials
+	if path == "" {
+		path = os.Getenv(CredentialsEnv)
+	}
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return creds, nil
+		}
+		path = filepath.Join(home, ".hello", "credentials.json")
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return creds, nil
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return creds, err
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return creds, fmt.Errorf("invalid credentials file %v format, err: %v", path, err)
+	}
+	return creds, nil
+}
+
+// findFlag extracts the value of the flag passed as -name=value or -name value
+func findFlag(name string, args []string) (string, []string, error) {
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "--"+name+"=") || strings.HasPrefix(arg, "-"+name+"=") {
+			return strings.SplitN(arg, "=", 2)[1], cut(i, i+1, args), nil
+		} else if arg == "-"+name || arg == "--"+name {
+			if i > len(args)-2 {
+				return "", nil, fmt.Errorf("provide a value for %v", name)
+			}
+			return args[i+1], cut(i, i+2, args), nil
+		}
+	}
+	return "", args, nil
+}
+
+// findSwitch extracts the boolean flag passed as -name
+func findSwitch(name string, args []string) (bool, []string) {
+	for i, arg := range args {
+		if arg == "-"+name || arg == "--"+name {
+			return true, cut(i, i+1, args)
+		}
+	}
+	return false, args
+}
+
 func cut(i, j int, args []string) []string {
 	s := []string{}
 	s = append(s, args[:i]...)
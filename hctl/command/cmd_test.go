@@ -2,13 +2,21 @@ package command
 
 import (
 	"bytes"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gravitational/hello"
 	"github.com/gravitational/hello/api"
+	"github.com/gravitational/hello/audit"
+	"github.com/gravitational/hello/auth"
 	"github.com/gravitational/hello/backend/membk"
 
 	. "github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/check.v1"
@@ -32,7 +40,9 @@ func (s *CmdSuite) SetUpSuite(c *C) {
 }
 
 func (s *CmdSuite) SetUpTest(c *C) {
-	s.bk = membk.New()
+	var err error
+	s.bk, err = membk.New()
+	c.Assert(err, IsNil)
 	h := hello.New(s.bk)
 
 	s.srv = httptest.NewServer(api.NewAPIServer(h, s.bk))
@@ -66,7 +76,7 @@ func (s *CmdSuite) TestGreetingCRUD(c *C) {
 	c.Assert(
 		s.run("greeting", "upsert", "-id", "hello.us", "-val", "Hello"),
 		Matches, fmt.Sprintf(".*%v.*", "upserted"))
-	c.Assert(s.bk.Greetings["hello.us"], Equals, "Hello")
+	c.Assert(s.bk.Greetings()["hello.us"], Equals, "Hello")
 
 	c.Assert(
 		s.run("greeting", "get", "-id", "hello.us"),
@@ -75,19 +85,262 @@ func (s *CmdSuite) TestGreetingCRUD(c *C) {
 	c.Assert(
 		s.run("greeting", "upsert", "-id", "hello.us", "-val", "Howdy"),
 		Matches, fmt.Sprintf(".*%v.*", "upserted"))
-	c.Assert(s.bk.Greetings["hello.us"], Equals, "Howdy")
+	c.Assert(s.bk.Greetings()["hello.us"], Equals, "Howdy")
 
 	c.Assert(
 		s.run("greeting", "delete", "-id", "hello.us"),
 		Matches, fmt.Sprintf(".*%v.*", "deleted"))
-	_, ok := s.bk.Greetings["hello.us"]
+	_, ok := s.bk.Greetings()["hello.us"]
 	c.Assert(ok, Equals, false)
 }
 
+func (s *CmdSuite) TestGreetingConditionalWrites(c *C) {
+	c.Assert(
+		s.run("greeting", "upsert", "-id", "hello.us", "-val", "Hello", "-create"),
+		Matches, ".*upserted.*")
+	c.Assert(
+		s.run("greeting", "upsert", "-id", "hello.us", "-val", "Howdy", "-create"),
+		Matches, ".*ERROR.*conflict.*")
+
+	c.Assert(
+		s.run("greeting", "get", "-id", "hello.us"),
+		Matches, ".*Hello \\(revision 1\\).*")
+
+	c.Assert(
+		s.run("greeting", "upsert", "-id", "hello.us", "-val", "Howdy", "-rev", "1"),
+		Matches, ".*upserted \\(revision 2\\).*")
+	c.Assert(
+		s.run("greeting", "delete", "-id", "hello.us", "-rev", "1"),
+		Matches, ".*ERROR.*conflict.*")
+	c.Assert(s.bk.Greetings()["hello.us"], Equals, "Howdy")
+
+	// revisions are never negative
+	c.Assert(
+		s.run("greeting", "upsert", "-id", "hello.us", "-val", "Hi", "-rev", "-1"),
+		Matches, ".*ERROR.*--rev should not be negative.*")
+	c.Assert(
+		s.run("greeting", "delete", "-id", "hello.us", "-rev", "-1"),
+		Matches, ".*ERROR.*--rev should not be negative.*")
+	c.Assert(s.bk.Greetings()["hello.us"], Equals, "Howdy")
+
+	c.Assert(
+		s.run("greeting", "delete", "-id", "hello.us", "-rev", "2"),
+		Matches, ".*deleted.*")
+	c.Assert(len(s.bk.Greetings()), Equals, 0)
+}
+
+func (s *CmdSuite) TestGreetingMetadata(c *C) {
+	c.Assert(
+		s.run("greeting", "upsert", "-id", "hello.us", "-val", "Hello", "-locale", "en-US",
+			"-description", "landing page", "-tag", "web", "-tag", "default"),
+		Matches, ".*upserted.*")
+	g, err := s.bk.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(g.Locale, Equals, "en-US")
+	c.Assert(g.Description, Equals, "landing page")
+	c.Assert(g.Tags, DeepEquals, []string{"web", "default"})
+
+	c.Assert(
+		s.run("greeting", "get", "-id", "hello.us"),
+		Matches, ".*Hello \\(revision 1\\).*Locale: en-US.*Description: landing page.*Tags: web, default.*Created: .*Updated: .*")
+	c.Assert(
+		s.run("greeting", "ls"),
+		Matches, ".*Locale.*Tags.*hello.us.*Hello.*en-US.*web,default.*")
+}
+
+func (s *CmdSuite) TestGreetingHistory(c *C) {
+	c.Assert(s.run("greeting", "history", "-id", "hello.us"), Matches, ".*ERROR.*not found.*")
+
+	c.Assert(s.bk.UpsertGreeting("hello.us", "Hello"), IsNil)
+	c.Assert(s.bk.UpsertGreeting("hello.us", "Hellp"), IsNil)
+	c.Assert(s.bk.DeleteGreeting("hello.us"), IsNil)
+	c.Assert(
+		s.run("greeting", "history", "-id", "hello.us"),
+		Matches, ".*Revision.*3.*\\(deleted\\).*2.*Hellp.*1.*Hello.*")
+
+	c.Assert(
+		s.run("greeting", "rollback", "-id", "hello.us", "-rev", "3"),
+		Matches, ".*ERROR.*revision.*")
+	c.Assert(
+		s.run("greeting", "rollback", "-id", "hello.us", "-rev", "-1"),
+		Matches, ".*ERROR.*--rev should not be negative.*")
+	c.Assert(
+		s.run("greeting", "rollback", "-id", "hello.us", "-rev", "1"),
+		Matches, ".*rolled back to revision 1, new revision 4.*")
+	c.Assert(s.bk.Greetings()["hello.us"], Equals, "Hello")
+}
+
+func (s *CmdSuite) TestGreetingTTL(c *C) {
+	c.Assert(
+		s.run("greeting", "upsert", "-id", "hello.xmas", "-val", "Merry", "-ttl", "24h"),
+		Matches, ".*upserted.*")
+	c.Assert(
+		s.run("greeting", "get", "-id", "hello.xmas"),
+		Matches, ".*Merry.*expires in 2[34]h.*")
+}
+
+func (s *CmdSuite) TestGreetingList(c *C) {
+	c.Assert(s.bk.UpsertGreeting("hello.us", "Hello"), IsNil)
+	c.Assert(s.bk.UpsertGreeting("hello.sp", "Hola"), IsNil)
+	c.Assert(s.bk.UpsertGreeting("bye.us", "Bye"), IsNil)
+
+	out := s.run("greeting", "ls", "-prefix", "hello.")
+	c.Assert(out, Matches, ".*hello.sp.*Hola.*hello.us.*Hello.*")
+	c.Assert(out, Not(Matches), ".*bye.us.*")
+
+	out = s.run("greeting", "ls", "-limit", "1")
+	c.Assert(out, Matches, ".*bye.us.*Bye.*cursor=bye.us.*")
+}
+
+func (s *CmdSuite) TestGreetingWatch(c *C) {
+	// watch ends when the server goes away, so run it in the background
+	// and stop the server once we've seen the changes
+	args := []string{"hctl", "greeting", "watch", fmt.Sprintf("--hello=%s", s.srv.URL)}
+	out := &bytes.Buffer{}
+	cmd := &Command{out: out, url: s.srv.URL}
+	doneC := make(chan bool)
+	go func() {
+		cmd.Run(args)
+		close(doneC)
+	}()
+
+	// wait until the watch is established, so the changes are not missed
+	for i := 0; i < 100 && s.bk.Watchers() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(s.bk.UpsertGreeting("hello.us", "Hello"), IsNil)
+	c.Assert(s.bk.DeleteGreeting("hello.us"), IsNil)
+	c.Assert(s.bk.Close(), IsNil)
+
+	select {
+	case <-doneC:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timeout waiting for watch to stop")
+	}
+	c.Assert(strings.Replace(out.String(), "\n", " ", -1),
+		Matches, ".*hello.us upserted: Hello.*hello.us deleted.*")
+}
+
 func (s *CmdSuite) TestHello(c *C) {
 	c.Assert(s.bk.UpsertGreeting("hello.us", "Hello"), IsNil)
 
 	c.Assert(
 		s.run("hello", "-id", "hello.us", "-name", "Dog"),
 		Matches, fmt.Sprintf(".*%v.*", "Hello, Dog!"))
+
+	c.Assert(s.bk.UpsertGreeting("hello.es", "Hola"), IsNil)
+	c.Assert(
+		s.run("hello", "-id", "hello", "-name", "Dog", "-locale", "fr", "-locale", "es-MX"),
+		Matches, ".*Hola, Dog! \\(hello.es\\).*")
+
+	c.Assert(
+		s.run("greeting", "upsert", "-id", "hello.formal", "-val", "{{.Fields.title}} {{.Name}}, welcome", "-template"),
+		Matches, ".*upserted.*")
+	c.Assert(s.run("greeting", "get", "-id", "hello.formal"), Matches, ".*Template: yes.*")
+	c.Assert(
+		s.run("hello", "-id", "hello.formal", "-name", "Dog", "-field", "title=Sir"),
+		Matches, ".*Sir Dog, welcome.*")
+	c.Assert(
+		s.run("hello", "-id", "hello.formal", "-name", "Dog", "-field", "title"),
+		Matches, ".*expected field in form key=value.*")
+}
+
+func (s *CmdSuite) TestVersion(c *C) {
+	c.Assert(s.run("version"), Matches, ".*Client version: dev.*Server version: dev.*versions match.*")
+}
+
+func (s *CmdSuite) TestAuth(c *C) {
+	keys, err := auth.FromString(`{"tokens": [{"name": "ci", "token": "t0k3n", "role": "admin"}],
+                                   "apiKeys": [{"name": "frontend", "key": "k3y", "role": "reader"}]}`)
+	c.Assert(err, IsNil)
+	srv := httptest.NewServer(api.NewAPIServer(hello.New(s.bk), s.bk, api.Auth(keys)))
+	defer srv.Close()
+	c.Assert(s.bk.UpsertGreeting("hello.us", "Hello"), IsNil)
+
+	creds := filepath.Join(c.MkDir(), "credentials.json")
+	c.Assert(ioutil.WriteFile(creds, []byte(`{"token": "t0k3n"}`), 0600), IsNil)
+
+	run := func(params ...string) string {
+		out := &bytes.Buffer{}
+		cmd := &Command{out: out}
+		err := cmd.Run(append([]string{"hctl", "--hello=" + srv.URL}, params...))
+		if err != nil {
+			return err.Error()
+		}
+		return strings.Replace(out.String(), "\n", " ", -1)
+	}
+	hello := []string{"hello", "-id", "hello.us", "-name", "Dog"}
+
+	c.Assert(run(hello...), Matches, ".*ERROR.*authentication required.*")
+	c.Assert(run(append(hello, "--token", "t0k3n")...), Matches, ".*Hello, Dog!.*")
+	c.Assert(run(append(hello, "--api-key=k3y")...), Matches, ".*Hello, Dog!.*")
+	c.Assert(run(append(hello, "--credentials", creds)...), Matches, ".*Hello, Dog!.*")
+	c.Assert(run("--api-key=k3y", "greeting", "delete", "-id", "hello.us"),
+		Matches, ".*ERROR.*access denied to 'frontend'.*")
+
+	os.Setenv(TokenEnv, "t0k3n")
+	defer os.Unsetenv(TokenEnv)
+	c.Assert(run(hello...), Matches, ".*Hello, Dog!.*")
+	// flags take precedence over the environment
+	c.Assert(run(append(hello, "--token", "wrong")...), Matches, ".*ERROR.*invalid bearer token.*")
+}
+
+func (s *CmdSuite) TestAudit(c *C) {
+	sink, err := audit.NewFileSink(filepath.Join(c.MkDir(), "audit.log"))
+	c.Assert(err, IsNil)
+	defer sink.Close()
+	srv := httptest.NewServer(api.NewAPIServer(hello.New(s.bk), s.bk, api.Audit(sink)))
+	defer srv.Close()
+
+	run := func(params ...string) string {
+		out := &bytes.Buffer{}
+		cmd := &Command{out: out}
+		err := cmd.Run(append([]string{"hctl", "--hello=" + srv.URL}, params...))
+		if err != nil {
+			return err.Error()
+		}
+		return strings.Replace(out.String(), "\n", " ", -1)
+	}
+
+	c.Assert(run("greeting", "upsert", "-id", "hello.us", "-val", "Hello"), Matches, OK)
+	c.Assert(run("greeting", "upsert", "-id", "hello.us", "-val", "Howdy"), Matches, OK)
+	c.Assert(run("greeting", "upsert", "-id", "hello.uk", "-val", "Hiya"), Matches, OK)
+
+	out := run("audit", "ls", "--prompt=hello.us")
+	c.Assert(out, Matches, ".*upsert.*hello.us.*Hello.*upsert.*hello.us.*Hello.*Howdy.*")
+	c.Assert(out, Not(Matches), ".*hello.uk.*")
+	c.Assert(run("audit", "ls", "--limit=1"), Matches, ".*hello.uk.*Hiya.*")
+}
+
+func (s *CmdSuite) TestTLS(c *C) {
+	srv := httptest.NewUnstartedServer(api.NewAPIServer(hello.New(s.bk), s.bk))
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+	c.Assert(s.bk.UpsertGreeting("hello.us", "Hello"), IsNil)
+
+	ca := filepath.Join(c.MkDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	c.Assert(ioutil.WriteFile(ca, data, 0600), IsNil)
+
+	run := func(params ...string) string {
+		out := &bytes.Buffer{}
+		cmd := &Command{out: out}
+		err := cmd.Run(append([]string{"hctl", "--hello=" + srv.URL}, params...))
+		if err != nil {
+			return err.Error()
+		}
+		return strings.Replace(out.String(), "\n", " ", -1)
+	}
+
+	c.Assert(run("hello", "-id", "hello.us", "-name", "Dog", "--tls-ca", ca),
+		Matches, ".*Hello, Dog!.*")
+	c.Assert(run("--tls-ca="+ca, "hello", "-id", "hello.us", "-name", "Dog"),
+		Matches, ".*Hello, Dog!.*")
+	c.Assert(run("hello", "-id", "hello.us", "-name", "Dog", "--insecure"),
+		Matches, ".*Hello, Dog!.*")
+	c.Assert(run("hello", "-id", "hello.us", "-name", "Dog"),
+		Matches, ".*ERROR.*certificate.*")
+	c.Assert(run("hello", "-id", "hello.us", "-name", "Dog", "--tls-ca", filepath.Join(c.MkDir(), "missing.pem")),
+		Matches, ".*failed to load CA certificates.*")
 }
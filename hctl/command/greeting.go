@@ -1,7 +1,13 @@
 package command
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/buger/goterm"
 	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/gravitational/hello/backend"
 )
 
 func newGreetingCommand(c *Command) cli.Command {
@@ -16,6 +22,13 @@ func newGreetingCommand(c *Command) cli.Command {
 				Flags: []cli.Flag{
 					cli.StringFlag{Name: "id", Usage: "Greeting id"},
 					cli.StringFlag{Name: "val, v", Usage: "Greeting value"},
+					cli.BoolFlag{Name: "template", Usage: "Greeting value is a template, e.g. '{{.Name}}さん、こんにちは'"},
+					cli.IntFlag{Name: "rev", Usage: "Update only if the greeting revision matches, see 'greeting get'"},
+					cli.BoolFlag{Name: "create", Usage: "Create only, fail if greeting already exists"},
+					cli.DurationFlag{Name: "ttl", Usage: "Expire greeting after this time, e.g. '24h', never expires by default"},
+					cli.StringFlag{Name: "locale", Usage: "Greeting locale, e.g. en-US"},
+					cli.StringFlag{Name: "description", Usage: "What the greeting is for, e.g. 'landing page'"},
+					cli.StringSliceFlag{Name: "tag", Value: &cli.StringSlice{}, Usage: "Greeting tag, e.g. holiday, can be repeated"},
 				},
 			},
 			{
@@ -26,12 +39,45 @@ func newGreetingCommand(c *Command) cli.Command {
 					cli.StringFlag{Name: "id", Usage: "Greeting id to get"},
 				},
 			},
+			{
+				Name:   "ls",
+				Usage:  "List greetings",
+				Action: c.getGreetings,
+				Flags: []cli.Flag{
+					cli.StringFlag{Name: "prefix", Usage: "List only greetings with ids starting with prefix, e.g. 'hello.'"},
+					cli.IntFlag{Name: "limit", Usage: "Maximum amount of greetings to list, 0 lists all"},
+					cli.StringFlag{Name: "cursor", Usage: "Cursor returned by the previous listing to get the next page"},
+				},
+			},
+			{
+				Name:   "watch",
+				Usage:  "Watch greeting changes live",
+				Action: c.watchGreetings,
+			},
 			{
 				Name:   "delete",
 				Usage:  "Delete greeting by ID",
 				Action: c.deleteGreeting,
 				Flags: []cli.Flag{
 					cli.StringFlag{Name: "id", Usage: "Greeting id to delete"},
+					cli.IntFlag{Name: "rev", Usage: "Delete only if the greeting revision matches, see 'greeting get'"},
+				},
+			},
+			{
+				Name:   "history",
+				Usage:  "List recent changes of the greeting, most recent first",
+				Action: c.getHistory,
+				Flags: []cli.Flag{
+					cli.StringFlag{Name: "id", Usage: "Greeting id"},
+				},
+			},
+			{
+				Name:   "rollback",
+				Usage:  "Roll greeting back to the value it had at the revision",
+				Action: c.rollbackGreeting,
+				Flags: []cli.Flag{
+					cli.StringFlag{Name: "id", Usage: "Greeting id to roll back"},
+					cli.IntFlag{Name: "rev", Usage: "Revision to roll back to, see 'greeting history'"},
 				},
 			},
 		},
@@ -39,27 +85,175 @@ func newGreetingCommand(c *Command) cli.Command {
 }
 
 func (cmd *Command) upsertGreeting(c *cli.Context) {
-	err := cmd.client.UpsertGreeting(c.String("id"), c.String("val"))
+	opts, err := writeOptions(c)
 	if err != nil {
 		cmd.printError(err)
 		return
 	}
-	cmd.printOK("greeting %v upserted", c.String("id"))
+	if c.Bool("create") {
+		opts = append(opts, backend.Create())
+	}
+	if c.Bool("template") {
+		opts = append(opts, backend.Template())
+	}
+	if c.Duration("ttl") != 0 {
+		opts = append(opts, backend.TTL(c.Duration("ttl")))
+	}
+	opts = append(opts,
+		backend.Locale(c.String("locale")),
+		backend.Description(c.String("description")),
+		backend.Tags(c.StringSlice("tag")...))
+	var rev uint64
+	err = cmd.client.UpsertGreeting(c.String("id"), c.String("val"), append(opts, backend.ReturnRevision(&rev))...)
+	if err != nil {
+		cmd.printError(err)
+		return
+	}
+	cmd.printOK("greeting %v upserted (revision %v)", c.String("id"), rev)
 }
 
 func (cmd *Command) deleteGreeting(c *cli.Context) {
-	if err := cmd.client.DeleteGreeting(c.String("id")); err != nil {
+	opts, err := writeOptions(c)
+	if err != nil {
+		cmd.printError(err)
+		return
+	}
+	if err := cmd.client.DeleteGreeting(c.String("id"), opts...); err != nil {
 		cmd.printError(err)
 		return
 	}
-	cmd.printOK("greeting %v deleted", c.String("user"))
+	cmd.printOK("greeting %v deleted", c.String("id"))
+}
+
+// writeOptions returns conditional write options set by --rev flag
+func writeOptions(c *cli.Context) ([]backend.WriteOption, error) {
+	rev, err := revision(c)
+	if err != nil {
+		return nil, err
+	}
+	if rev != 0 {
+		return []backend.WriteOption{backend.IfRevision(rev)}, nil
+	}
+	return nil, nil
+}
+
+// revision returns the value of --rev flag, revisions are never negative
+func revision(c *cli.Context) (uint64, error) {
+	rev := c.Int("rev")
+	if rev < 0 {
+		return 0, fmt.Errorf("--rev should not be negative, got %v", rev)
+	}
+	return uint64(rev), nil
 }
 
 func (cmd *Command) getGreeting(c *cli.Context) {
-	val, err := cmd.client.GetGreeting(c.String("id"))
+	g, err := cmd.client.GetGreeting(c.String("id"))
 	if err != nil {
 		cmd.printError(err)
 		return
 	}
-	cmd.printOK("Greeting: %v %v", c.String("id"), val)
+	if g.TTL != 0 {
+		cmd.printOK("Greeting: %v %v (revision %v, expires in %v)", g.ID, g.Value, g.Revision, g.TTL)
+	} else {
+		cmd.printOK("Greeting: %v %v (revision %v)", g.ID, g.Value, g.Revision)
+	}
+	if g.Template {
+		fmt.Fprintf(cmd.out, "Template: yes\n")
+	}
+	if g.Locale != "" {
+		fmt.Fprintf(cmd.out, "Locale: %v\n", g.Locale)
+	}
+	if g.Description != "" {
+		fmt.Fprintf(cmd.out, "Description: %v\n", g.Description)
+	}
+	if len(g.Tags) != 0 {
+		fmt.Fprintf(cmd.out, "Tags: %v\n", strings.Join(g.Tags, ", "))
+	}
+	if !g.Created.IsZero() {
+		fmt.Fprintf(cmd.out, "Created: %v\n", g.Created.Format(time.RFC3339))
+	}
+	if !g.Updated.IsZero() {
+		if g.Author != "" {
+			fmt.Fprintf(cmd.out, "Updated: %v by %v\n", g.Updated.Format(time.RFC3339), g.Author)
+		} else {
+			fmt.Fprintf(cmd.out, "Updated: %v\n", g.Updated.Format(time.RFC3339))
+		}
+	}
+}
+
+func (cmd *Command) getGreetings(c *cli.Context) {
+	gs, next, err := cmd.client.GetGreetings(c.String("prefix"), c.String("cursor"), c.Int("limit"))
+	if err != nil {
+		cmd.printError(err)
+		return
+	}
+	t := goterm.NewTable(0, 10, 5, ' ', 0)
+	fmt.Fprint(t, "Id\tValue\tLocale\tTags\tRevision\tUpdated\tAuthor\n")
+	for _, g := range gs {
+		fmt.Fprintf(t, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			g.ID, g.Value, g.Locale, strings.Join(g.Tags, ","), g.Revision, formatTime(g.Updated), g.Author)
+	}
+	fmt.Fprint(cmd.out, t.String())
+	if next != "" {
+		fmt.Fprintf(cmd.out, "next page: --cursor=%v\n", next)
+	}
+}
+
+func (cmd *Command) watchGreetings(c *cli.Context) {
+	stopC := make(chan bool)
+	defer close(stopC)
+	events, err := cmd.client.WatchGreetings(stopC)
+	if err != nil {
+		cmd.printError(err)
+		return
+	}
+	for e := range events {
+		switch e.Type {
+		case backend.EventDelete:
+			fmt.Fprintf(cmd.out, "%v %v deleted\n", e.Revision, e.ID)
+		default:
+			fmt.Fprintf(cmd.out, "%v %v upserted: %v\n", e.Revision, e.ID, e.Value)
+		}
+	}
+}
+
+func (cmd *Command) getHistory(c *cli.Context) {
+	history, err := cmd.client.GetHistory(c.String("id"))
+	if err != nil {
+		cmd.printError(err)
+		return
+	}
+	t := goterm.NewTable(0, 10, 5, ' ', 0)
+	fmt.Fprint(t, "Revision\tTime\tAuthor\tValue\n")
+	for _, v := range history {
+		value := v.Value
+		if v.Deleted {
+			value = "(deleted)"
+		}
+		fmt.Fprintf(t, "%v\t%v\t%v\t%v\n", v.Revision, v.Time.Format(time.RFC3339), v.Author, value)
+	}
+	fmt.Fprint(cmd.out, t.String())
+}
+
+func (cmd *Command) rollbackGreeting(c *cli.Context) {
+	rev, err := revision(c)
+	if err != nil {
+		cmd.printError(err)
+		return
+	}
+	written, err := cmd.client.RollbackGreeting(c.String("id"), rev)
+	if err != nil {
+		cmd.printError(err)
+		return
+	}
+	cmd.printOK("greeting %v rolled back to revision %v, new revision %v", c.String("id"), rev, written)
+}
+
+// formatTime formats the time for tables, zero time is empty,
+// e.g. creation time of greetings stored by older versions
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
 }
@@ -1,6 +1,11 @@
 package command
 
 import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/gravitational/hello"
 	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/codegangsta/cli"
 )
 
@@ -12,15 +17,35 @@ func newHelloCommand(c *Command) cli.Command {
 		Flags: []cli.Flag{
 			cli.StringFlag{Name: "id", Usage: "Greeting id"},
 			cli.StringFlag{Name: "name", Usage: "Name to greet"},
+			cli.StringSliceFlag{Name: "locale", Value: &cli.StringSlice{}, Usage: "Preferred locale, e.g. es-MX, can be repeated"},
+			cli.StringSliceFlag{Name: "field", Value: &cli.StringSlice{}, Usage: "Greeting template field, e.g. title=Sir, can be repeated"},
 		},
 	}
 }
 
 func (cmd *Command) sayHello(c *cli.Context) {
-	hello, err := cmd.client.Hello(c.String("id"), c.String("name"))
+	fields := map[string]string{}
+	for _, f := range c.StringSlice("field") {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			cmd.printError(fmt.Errorf("expected field in form key=value, got '%v'", f))
+			return
+		}
+		fields[kv[0]] = kv[1]
+	}
+	re, err := cmd.client.Greet(context.Background(), hello.Request{
+		Prompt:  c.String("id"),
+		Name:    c.String("name"),
+		Locales: c.StringSlice("locale"),
+		Fields:  fields,
+	})
 	if err != nil {
 		cmd.printError(err)
 		return
 	}
-	cmd.printOK(hello)
+	if re.Locale != "" {
+		cmd.printOK("%v (%v)", re.Value, re.GreetingID)
+		return
+	}
+	cmd.printOK("%v", re.Value)
 }
@@ -0,0 +1,32 @@
+package command
+
+import (
+	"fmt"
+
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/gravitational/hello/version"
+)
+
+func newVersionCommand(c *Command) cli.Command {
+	return cli.Command{
+		Name:   "version",
+		Usage:  "Print client and server versions",
+		Action: c.printVersion,
+	}
+}
+
+func (cmd *Command) printVersion(c *cli.Context) {
+	local := version.Get()
+	fmt.Fprintf(cmd.out, "Client version: %v\n", local)
+	remote, err := cmd.client.Version()
+	if err != nil {
+		cmd.printError(err)
+		return
+	}
+	fmt.Fprintf(cmd.out, "Server version: %v\n", remote)
+	if local.Version != remote.Version || local.GitCommit != remote.GitCommit {
+		cmd.printError(fmt.Errorf("client and server versions differ"))
+		return
+	}
+	cmd.printOK("client and server versions match")
+}
@@ -22,10 +22,11 @@
 package hello
 
 import (
-	"fmt"
+	"context"
 
 	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/mailgun/log"
 	"github.com/gravitational/hello/backend"
+	"github.com/gravitational/hello/requestid"
 )
 
 // Helloer interface represents "Hello, world!" functionality providers.
@@ -33,37 +34,140 @@ type Helloer interface {
 	// Hello generates and returns "Hello, <username>!" message when called
 	// with a string parameter.
 	Hello(prompt, username string) (string, error)
+	// Greet is like Hello, but resolves the greeting for the requested
+	// locales and reports which greeting was used. The context carries
+	// request scoped values, e.g. the API request id added to log lines,
+	// see requestid package.
+	Greet(ctx context.Context, r Request) (*Response, error)
 	// Close deallocates any resources that were allocated by instance of helloer
 	Close() error
 }
 
+// Request is a request to greet someone
+type Request struct {
+	// Prompt is the greeting prompt, e.g. 'hello'
+	Prompt string
+	// Name is the name to greet
+	Name string
+	// Locales are BCP-47 language tags in the order of preference,
+	// e.g. 'es-MX', 'en', see Resolver for details
+	Locales []string
+	// Fields are extra fields available to greeting templates, see TemplateData
+	Fields map[string]string
+}
+
+// Response is a result of the greeting
+type Response struct {
+	// Value is the greeting, e.g. 'Hola, Dog!'
+	Value string
+	// GreetingID is the id of the greeting used, e.g. 'hello.es'
+	GreetingID string
+	// Locale is the locale of the greeting used, e.g. 'es',
+	// it is empty if the prompt matched the greeting directly
+	Locale string
+}
+
+// Option is a functional option for Helloer
+type Option func(h *helloer)
+
+// DefaultLocale sets the locale tried when none of the requested locales match
+func DefaultLocale(tag string) Option {
+	return func(h *helloer) {
+		h.r.Default = tag
+	}
+}
+
+// LocaleFallbacks sets additional locales to try for locales,
+// e.g. {"es-MX": ["es-419"]}, see Resolver for details
+func LocaleFallbacks(fallbacks map[string][]string) Option {
+	return func(h *helloer) {
+		h.r.Fallbacks = fallbacks
+	}
+}
+
+// Clock sets the clock used to tell the time of day to greeting templates
+func Clock(c backend.Clock) Option {
+	return func(h *helloer) {
+		h.clock = c
+	}
+}
+
 // New returns a new instance of Helloer
-func New(b backend.GreetingBackend) Helloer {
-	return &helloer{
-		b: b,
+func New(b backend.GreetingBackend, opts ...Option) Helloer {
+	h := &helloer{
+		b:     b,
+		clock: backend.SystemClock{},
+	}
+	for _, o := range opts {
+		o(h)
 	}
+	return h
 }
 
 // helloer is an internal implementation of Helloer that uses fmt
 type helloer struct {
-	b backend.GreetingBackend
+	b         backend.GreetingBackend
+	r         Resolver
+	clock     backend.Clock
+	templates templateCache
 }
 
 // Hello is Sprinf-based implementation and should not be used in high-perf
 // environments as it generates a new string when called each time.
 func (h *helloer) Hello(prompt, username string) (string, error) {
-	log.Infof("Hello(%v, %v)", prompt, username)
-	greeting, err := h.b.GetGreeting(prompt)
+	re, err := h.Greet(context.Background(), Request{Prompt: prompt, Name: username})
 	if err != nil {
 		return "", err
 	}
-	if username == "" {
+	return re.Value, nil
+}
+
+// Greet logs the request id from the context, backend calls take no context,
+// so the API server logs their failures with the request id instead
+func (h *helloer) Greet(ctx context.Context, r Request) (*Response, error) {
+	if id := requestid.FromContext(ctx); id != "" {
+		log.Infof("Greet(%v, %v, %v) request_id=%v", r.Prompt, r.Name, r.Locales, id)
+	} else {
+		log.Infof("Greet(%v, %v, %v)", r.Prompt, r.Name, r.Locales)
+	}
+	greeting, c, err := h.resolve(r.Prompt, r.Locales)
+	if err != nil {
+		return nil, err
+	}
+	if r.Name == "" {
 		// try do be specific when returning errors, it makes
 		// it easier for applications to provide better error
 		// handling by testing the type of error returned.
-		return "", &EmptyParamError{}
+		return nil, &EmptyParamError{}
+	}
+	val, err := h.templates.render(greeting, TemplateData{
+		Name:      r.Name,
+		TimeOfDay: TimeOfDay(h.clock.Now()),
+		Fields:    r.Fields,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Response{
+		Value:      val,
+		GreetingID: c.ID,
+		Locale:     c.Locale,
+	}, nil
+}
+
+// resolve returns the first greeting found for the prompt and locales
+func (h *helloer) resolve(prompt string, locales []string) (*backend.Greeting, *Candidate, error) {
+	for _, c := range h.r.Candidates(prompt, locales) {
+		g, err := h.b.GetGreeting(c.ID)
+		if err == nil {
+			c := c
+			return g, &c, nil
+		}
+		if _, ok := err.(*backend.NotFoundError); !ok {
+			return nil, nil, err
+		}
 	}
-	return fmt.Sprintf("%v, %v!", greeting, username), nil
+	return nil, nil, &backend.NotFoundError{ID: prompt}
 }
 
 func (h *helloer) Close() error {
@@ -1,72 +1,475 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
-
+	"io"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gravitational/hello"
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/buger/goterm"
 	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/codegangsta/cli"
 	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/mailgun/log"
 	"github.com/gravitational/hello/api"
+	"github.com/gravitational/hello/audit"
+	"github.com/gravitational/hello/auth"
 	"github.com/gravitational/hello/backend"
-	"github.com/gravitational/hello/backend/etcdbk"
+	"github.com/gravitational/hello/backend/cachebk"
+	// backends are registered by their packages
+	_ "github.com/gravitational/hello/backend/etcdbk"
+	_ "github.com/gravitational/hello/backend/filebk"
+	_ "github.com/gravitational/hello/backend/membk"
+	"github.com/gravitational/hello/backend/metricsbk"
+	"github.com/gravitational/hello/backend/swapbk"
+	"github.com/gravitational/hello/config"
+	"github.com/gravitational/hello/metrics"
+	"github.com/gravitational/hello/ratelimit"
+	"github.com/gravitational/hello/version"
 )
 
 func main() {
 	app := cli.NewApp()
-	app.Name = "hctl"
+	app.Name = "hello"
 	app.Usage = "Clustering Hello World application"
+	app.Version = version.Get().String()
 	app.Flags = []cli.Flag{
-		cli.StringFlag{Name: "addr", Value: "localhost:8080", Usage: "hello listening host:port"},
+		cli.StringFlag{Name: "config", Value: "", Usage: "path to YAML or JSON configuration file, HELLO_* environment variables override it and flags override both", EnvVar: "HELLO_CONFIG"},
+		cli.StringFlag{Name: "addr", Value: config.DefaultAddr, Usage: "hello listening host:port"},
+		cli.StringFlag{Name: "tls-cert", Value: "", Usage: "path to TLS certificate, the server serves HTTPS when set"},
+		cli.StringFlag{Name: "tls-key", Value: "", Usage: "path to TLS private key"},
+		cli.StringFlag{Name: "tls-ca", Value: "", Usage: "path to CA certificates, clients have to present certificates signed by them when set"},
+		cli.StringFlag{Name: "auth-keys", Value: "", Usage: "path to JSON file with client tokens, API keys and roles, clients are not authenticated when empty"},
+		cli.StringFlag{Name: "rateLimits", Value: "", Usage: `JSON dictionary of per client rate limits of 'read', 'hello' and 'mutation' routes, e.g. {"hello": {"rate": 10, "burst": 20}}`},
+		cli.DurationFlag{Name: "shutdownTimeout", Value: config.DefaultShutdownTimeout, Usage: "time to drain in-flight requests on SIGTERM or SIGINT"},
+		cli.StringFlag{Name: "debug-addr", Value: "", Usage: "admin listening host:port serving pprof, runtime stats and log severity, off when empty"},
 		cli.StringFlag{Name: "shell", Value: "/bin/sh", Usage: "path to shell to launch for interactive sessions"},
 
-		cli.StringFlag{Name: "backend", Value: "etcd", Usage: "backend type, currently only 'etcd'"},
+		cli.StringFlag{Name: "backend", Value: config.DefaultBackend, Usage: "backend type, 'hello backends' lists the supported ones"},
 		cli.StringFlag{Name: "backendConfig", Value: "", Usage: "backend-specific configuration string"},
+		cli.IntFlag{Name: "cacheSize", Value: 0, Usage: "maximum number of greetings cached in memory, off when 0"},
+		cli.DurationFlag{Name: "cacheTTL", Value: config.DefaultCacheTTL, Usage: "time greetings stay cached"},
+
+		cli.StringFlag{Name: "audit", Value: "", Usage: "audit log of greeting changes, 'file', 'syslog' or 'backend', off when empty"},
+		cli.StringFlag{Name: "auditConfig", Value: "", Usage: "audit log specific configuration string"},
 
-		cli.StringFlag{Name: "log", Value: "console", Usage: "Log output, currently 'console' or 'syslog'"},
-		cli.StringFlag{Name: "logSeverity", Value: "WARN", Usage: "Log severity, logs warning by default"},
+		cli.StringFlag{Name: "defaultLocale", Value: "", Usage: "locale of the greetings used when none of the requested locales match, e.g. 'en'"},
+		cli.StringFlag{Name: "localeFallbacks", Value: "", Usage: `JSON dictionary of locale fallbacks, e.g. {"es-MX": ["es-419"]}`},
+
+		cli.StringFlag{Name: "log", Value: config.DefaultLogOutput, Usage: "Log output, currently 'console' or 'syslog'"},
+		cli.StringFlag{Name: "logSeverity", Value: config.DefaultLogSeverity, Usage: "Log severity, logs warning by default"},
+		cli.StringFlag{Name: "accessLog", Value: "", Usage: "access log output, 'stdout' or a file path, off when empty"},
+		cli.StringFlag{Name: "accessLogFormat", Value: config.DefaultAccessLogFormat, Usage: "access log format, 'logfmt' or 'json'"},
 	}
 	app.Action = run
+	app.Commands = []cli.Command{
+		{
+			Name:  "version",
+			Usage: "Print version",
+			Action: func(c *cli.Context) {
+				fmt.Println(version.Get())
+			},
+		},
+		{
+			Name:   "backends",
+			Usage:  "List supported backends and their configuration parameters",
+			Action: listBackends,
+		},
+		{
+			Name:  "config",
+			Usage: "Operations with configuration",
+			Subcommands: []cli.Command{
+				{
+					Name:   "check",
+					Usage:  "Validate configuration file without starting the server, e.g. 'hello config check /etc/hello.yaml'",
+					Action: checkConfig,
+				},
+			},
+		},
+	}
 	app.Run(os.Args)
 }
 
 func run(c *cli.Context) {
-	if err := start(c); err != nil {
+	// logging is set up by the configuration, so config errors go to stderr
+	cfg, err := loadConfig(c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := start(c, cfg); err != nil {
 		log.Errorf("service err %v", err)
 		return
 	}
 	log.Infof("service exited gracefully")
 }
 
-func setupLogging(c *cli.Context) error {
-	s, err := log.SeverityFromString(c.String("logSeverity"))
+func setupLogging(cfg *config.Config) error {
+	s, err := log.SeverityFromString(cfg.Log.Severity)
 	if err != nil {
 		return err
 	}
-	log.Init([]*log.LogConfig{&log.LogConfig{Name: c.String("log")}})
+	log.Init([]*log.LogConfig{&log.LogConfig{Name: cfg.Log.Output}})
 	log.SetSeverity(s)
 	return nil
 }
 
-func start(c *cli.Context) error {
-	if err := setupLogging(c); err != nil {
+// loadConfig reads the configuration file if it's set, applies HELLO_* environment
+// variables and then the flags set on the command line, and checks the result
+func loadConfig(c *cli.Context) (*config.Config, error) {
+	cfg := config.Default()
+	if path := c.String("config"); path != "" {
+		var err error
+		if cfg, err = config.FromFile(path); err != nil {
+			return nil, fmt.Errorf("failed to read config %v: %v", path, err)
+		}
+	}
+	cfg.Env(os.LookupEnv)
+	for _, f := range []struct {
+		flag string
+		v    *string
+	}{
+		{"addr", &cfg.Addr},
+		{"debug-addr", &cfg.DebugAddr},
+		{"log", &cfg.Log.Output},
+		{"logSeverity", &cfg.Log.Severity},
+		{"accessLog", &cfg.Log.AccessLog},
+		{"accessLogFormat", &cfg.Log.AccessLogFormat},
+		{"backend", &cfg.Backend.Type},
+		{"tls-cert", &cfg.TLS.Cert},
+		{"tls-key", &cfg.TLS.Key},
+		{"tls-ca", &cfg.TLS.CA},
+		{"auth-keys", &cfg.Auth.Keys},
+	} {
+		if c.IsSet(f.flag) {
+			*f.v = c.String(f.flag)
+		}
+	}
+	if c.IsSet("shutdownTimeout") {
+		cfg.ShutdownTimeout = c.Duration("shutdownTimeout").String()
+	}
+	if c.IsSet("cacheSize") {
+		cfg.Cache.Size = c.Int("cacheSize")
+	}
+	if c.IsSet("cacheTTL") {
+		cfg.Cache.TTL = c.Duration("cacheTTL").String()
+	}
+	if c.IsSet("backendConfig") {
+		cfg.Backend.Config = json.RawMessage(c.String("backendConfig"))
+	}
+	if c.IsSet("rateLimits") {
+		cfg.RateLimits = nil
+		if err := json.Unmarshal([]byte(c.String("rateLimits")), &cfg.RateLimits); err != nil {
+			return nil, &config.FieldError{Field: "rateLimits", Message: fmt.Sprintf("invalid format, err: %v", err)}
+		}
+	}
+	if err := cfg.Check(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// checkConfig validates the configuration file with HELLO_* environment
+// variables applied, the file is the argument or HELLO_CONFIG
+func checkConfig(c *cli.Context) {
+	path := c.Args().First()
+	if path == "" {
+		path = os.Getenv("HELLO_CONFIG")
+	}
+	if path == "" {
+		fmt.Fprintln(os.Stderr, "usage: hello config check <path>")
+		os.Exit(2)
+	}
+	cfg, err := config.FromFile(path)
+	if err == nil {
+		cfg.Env(os.LookupEnv)
+		err = cfg.Check()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", path, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%v: OK\n", path)
+}
+
+func start(c *cli.Context, cfg *config.Config) error {
+	if err := setupLogging(cfg); err != nil {
 		return err
 	}
 
-	b, err := initBackend(c.String("backend"), c.String("backendConfig"))
+	options := []hello.Option{hello.DefaultLocale(c.String("defaultLocale"))}
+	if v := c.String("localeFallbacks"); v != "" {
+		var fallbacks map[string][]string
+		if err := json.Unmarshal([]byte(v), &fallbacks); err != nil {
+			return fmt.Errorf("invalid localeFallbacks format, err: %v", err)
+		}
+		options = append(options, hello.LocaleFallbacks(fallbacks))
+	}
+
+	tlsConfig, err := initTLS(cfg.TLS)
 	if err != nil {
 		return err
 	}
 
-	return http.ListenAndServe(c.String("addr"), api.NewAPIServer(hello.New(b), b))
+	registry := metrics.NewRegistry()
+	serverOptions := []api.ServerOption{api.Registry(registry)}
+	accessLog, err := initAccessLog(cfg.Log.AccessLog)
+	if err != nil {
+		return err
+	}
+	if accessLog != nil {
+		defer accessLog.Close()
+		format, err := api.ParseAccessLogFormat(cfg.Log.AccessLogFormat)
+		if err != nil {
+			return err
+		}
+		serverOptions = append(serverOptions, api.AccessLog(accessLog, format))
+	}
+	a, err := initAuth(cfg.Auth.Keys)
+	if err != nil {
+		return err
+	}
+	serverOptions = append(serverOptions, api.Auth(a))
+	limiters, err := initRateLimits(cfg.RateLimits)
+	if err != nil {
+		return err
+	}
+
+	b, err := initBackend(cfg.Backend.Type, string(cfg.Backend.Config))
+	if err != nil {
+		return err
+	}
+	// decorators below store audit events in any backend, so it is checked
+	// before they wrap it
+	if err := checkAudit(c.String("audit"), b); err != nil {
+		if cerr := b.Close(); cerr != nil {
+			log.Errorf("failed to close backend: %v", cerr)
+		}
+		return err
+	}
+
+	// the backend is swapped when it's configuration is reloaded
+	swap := swapbk.New(b)
+	b = metricsbk.New(swap, registry)
+	// the cache is outside of metrics, so they show the load of the backend
+	var cache *cachebk.Backend
+	if cfg.Cache.Size > 0 {
+		cache = cachebk.New(b, append(cfg.Cache.Options(), cachebk.Metrics(registry))...)
+		b = cache
+	}
+	sink, err := initAudit(c.String("audit"), c.String("auditConfig"), b)
+	if err != nil {
+		if cerr := b.Close(); cerr != nil {
+			log.Errorf("failed to close backend: %v", cerr)
+		}
+		return err
+	}
+	if sink != nil {
+		serverOptions = append(serverOptions, api.Audit(sink))
+	}
+	h := hello.New(b, options...)
+	apiSrv := api.NewAPIServer(h, b, serverOptions...)
+	apiSrv.SetRateLimits(limiters)
+	srv := &http.Server{Addr: cfg.Addr, Handler: apiSrv, TLSConfig: tlsConfig}
+	srv.RegisterOnShutdown(apiSrv.Close)
+
+	r := &reloader{c: c, cfg: cfg, srv: apiSrv, b: swap, cache: cache}
+	debugSrv, err := startDebug(cfg.DebugAddr, api.OnReload(r.reload))
+	if err == nil {
+		err = serve(srv, cfg.Timeout(), r.reload)
+	}
+	if debugSrv != nil {
+		debugSrv.Close()
+	}
+	if cerr := h.Close(); cerr != nil {
+		log.Errorf("failed to close helloer: %v", cerr)
+	}
+	if sink != nil {
+		if cerr := sink.Close(); cerr != nil {
+			log.Errorf("failed to close audit log: %v", cerr)
+		}
+	}
+	if cerr := b.Close(); cerr != nil {
+		log.Errorf("failed to close backend: %v", cerr)
+	}
+	return err
+}
+
+// serve serves requests until SIGTERM or SIGINT is received, then stops accepting
+// new connections and waits up to timeout for in-flight requests to complete.
+// SIGHUP reloads the configuration, the server keeps the current one if it fails.
+func serve(srv *http.Server, timeout time.Duration, reload func() error) error {
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(sigC)
+
+	errC := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			errC <- srv.ListenAndServeTLS("", "")
+			return
+		}
+		errC <- srv.ListenAndServe()
+	}()
+
+	for stop := false; !stop; {
+		select {
+		case err := <-errC:
+			return err
+		case sig := <-sigC:
+			if sig != syscall.SIGHUP {
+				log.Infof("got %v, shutting down, draining requests for up to %v", sig, timeout)
+				stop = true
+			} else if err := reload(); err != nil {
+				log.Errorf("failed to reload configuration, keeping the current one: %v", err)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Warningf("failed to drain requests in %v: %v, closing connections", timeout, err)
+		srv.Close()
+	}
+	return nil
+}
+
+// startDebug starts the admin server on addr if it's set, it listens before
+// returning, so the server fails to start if the address is taken
+func startDebug(addr string, opts ...api.DebugOption) (*http.Server, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on debug-addr: %v", err)
+	}
+	srv := &http.Server{Handler: api.NewDebugHandler(opts...)}
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Errorf("debug server err %v", err)
+		}
+	}()
+	log.Infof("serving debug endpoints on %v", l.Addr())
+	return srv, nil
+}
+
+// initAccessLog returns the access log output, or nil if the access log is off
+func initAccessLog(path string) (io.WriteCloser, error) {
+	switch path {
+	case "":
+		return nil, nil
+	case "stdout":
+		return nopCloser{os.Stdout}, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open access log: %v", err)
+	}
+	return f, nil
+}
+
+// nopCloser does not close the writer, e.g. stdout
+type nopCloser struct {
+	io.Writer
 }
 
+func (nopCloser) Close() error {
+	return nil
+}
+
+// initRateLimits returns the limiters of the route classes
+func initRateLimits(limits map[string]ratelimit.Limit) (map[api.RouteClass]*ratelimit.Limiter, error) {
+	limiters := make(map[api.RouteClass]*ratelimit.Limiter, len(limits))
+	for name, limit := range limits {
+		l, err := ratelimit.New(limit)
+		if err != nil {
+			return nil, &config.FieldError{Field: "rateLimits." + name, Message: err.Error()}
+		}
+		limiters[api.RouteClass(name)] = l
+	}
+	return limiters, nil
+}
+
+// initAuth returns the authenticator with the keys from the file,
+// or nil if clients are not authenticated
+func initAuth(path string) (auth.Authenticator, error) {
+	if path == "" {
+		return nil, nil
+	}
+	keys, err := auth.FromFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load auth keys: %v", err)
+	}
+	return keys, nil
+}
+
+// initTLS returns TLS config if the server should serve HTTPS, nil otherwise
+func initTLS(t config.TLS) (*tls.Config, error) {
+	if t.Cert == "" && t.Key == "" {
+		return nil, nil
+	}
+	return api.ServerTLSConfig(t.Cert, t.Key, t.CA)
+}
+
+// initAudit returns the audit log sink, or nil if the audit is off,
+// 'backend' sink stores events in the greetings backend b, see backend.AuditBackend
+func initAudit(atype, acfg string, b backend.GreetingBackend) (audit.Sink, error) {
+	switch atype {
+	case "":
+		return nil, nil
+	case "file":
+		return audit.FileFromString(acfg)
+	case "syslog":
+		return audit.NewSyslogSink()
+	case "backend":
+		return audit.NewBackendSink(b)
+	}
+	return nil, fmt.Errorf("unsupported audit type: %v", atype)
+}
+
+// checkAudit checks that the backend b stores audit events if they are
+// stored in the backend
+func checkAudit(atype string, b backend.GreetingBackend) error {
+	if atype != "backend" {
+		return nil
+	}
+	if _, err := backend.GetAuditBackend(b); err != nil {
+		return fmt.Errorf("-audit=backend: %v", err)
+	}
+	return nil
+}
+
+// initBackend creates the registered backend, see backend.Register
 func initBackend(btype, bcfg string) (backend.GreetingBackend, error) {
-	switch btype {
-	case "etcd":
-		return etcdbk.FromString(bcfg)
+	return backend.New(btype, bcfg)
+}
+
+// listBackends prints the registered backends and their configuration parameters
+func listBackends(c *cli.Context) {
+	for i, r := range backend.Registered() {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("%v - %v\n", r.Name, r.Description)
+		if len(r.Params) == 0 {
+			continue
+		}
+		t := goterm.NewTable(0, 10, 2, ' ', 0)
+		for _, p := range r.Params {
+			required := ""
+			if p.Required {
+				required = "required"
+			}
+			fmt.Fprintf(t, "  %v\t%v\t%v\t%v\n", p.Name, p.Type, required, p.Description)
+		}
+		fmt.Print(t.String())
 	}
-	return nil, fmt.Errorf("unsupported backend type: %v", btype)
 }
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/gravitational/hello/api"
+	"github.com/gravitational/hello/backend"
+	"github.com/gravitational/hello/backend/cachebk"
+	"github.com/gravitational/hello/backend/swapbk"
+	"github.com/gravitational/hello/config"
+)
+
+// reloader re-reads the configuration on SIGHUP or POST /debug/reload,
+// and applies the settings that can change without restart: log severity,
+// rate limits, auth keys and the backend. The new configuration is validated
+// and the new backend is built and pinged before anything is changed,
+// so a bad configuration does not disrupt the service.
+type reloader struct {
+	c   *cli.Context
+	srv *api.APIServer
+	b   *swapbk.Backend
+	// cache is nil if greetings are not cached
+	cache *cachebk.Backend
+
+	// mtx serializes reloads and guards the current configuration
+	mtx sync.Mutex
+	cfg *config.Config
+}
+
+func (r *reloader) reload() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	log.Infof("reloading configuration")
+
+	cfg, err := loadConfig(r.c)
+	if err != nil {
+		return err
+	}
+	severity, err := log.SeverityFromString(cfg.Log.Severity)
+	if err != nil {
+		return err
+	}
+	a, err := initAuth(cfg.Auth.Keys)
+	if err != nil {
+		return err
+	}
+	limiters, err := initRateLimits(cfg.RateLimits)
+	if err != nil {
+		return err
+	}
+	var next backend.GreetingBackend
+	if !sameBackend(r.cfg.Backend, cfg.Backend) {
+		if next, err = initBackend(cfg.Backend.Type, string(cfg.Backend.Config)); err != nil {
+			return fmt.Errorf("failed to init new backend: %v", err)
+		}
+		if err := checkAudit(r.c.String("audit"), next); err != nil {
+			if cerr := next.Close(); cerr != nil {
+				log.Errorf("failed to close new backend: %v", cerr)
+			}
+			return err
+		}
+		if err := next.Ping(); err != nil {
+			if cerr := next.Close(); cerr != nil {
+				log.Errorf("failed to close new backend: %v", cerr)
+			}
+			return fmt.Errorf("new backend failed health check: %v", err)
+		}
+	}
+	for _, field := range restartFields(r.cfg, cfg) {
+		log.Warningf("%v changed, restart the server to apply it", field)
+	}
+
+	log.SetSeverity(severity)
+	r.srv.SetAuth(a)
+	if !reflect.DeepEqual(r.cfg.RateLimits, cfg.RateLimits) {
+		r.srv.SetRateLimits(limiters)
+	}
+	if next != nil {
+		closedC := r.b.Swap(next)
+		if r.cache != nil {
+			r.cache.Purge()
+		}
+		go func() {
+			if err := <-closedC; err != nil {
+				log.Errorf("failed to close old backend: %v", err)
+				return
+			}
+			log.Infof("closed old backend")
+		}()
+		log.Infof("swapped %v backend", cfg.Backend.Type)
+	}
+	r.cfg = cfg
+	log.Infof("reloaded configuration")
+	return nil
+}
+
+// sameBackend returns true if the backend configurations are the same,
+// the configuration dictionaries are compared ignoring the formatting
+func sameBackend(a, b config.Backend) bool {
+	if a.Type != b.Type {
+		return false
+	}
+	ca, err := compactJSON(a.Config)
+	if err != nil {
+		return false
+	}
+	cb, err := compactJSON(b.Config)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ca, cb)
+}
+
+// compactJSON removes insignificant spaces from the JSON value,
+// the missing value is empty
+func compactJSON(data []byte) ([]byte, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// restartFields returns the fields that changed, but can't be applied without restart
+func restartFields(a, b *config.Config) []string {
+	var fields []string
+	for _, f := range []struct {
+		field string
+		a, b  interface{}
+	}{
+		{"addr", a.Addr, b.Addr},
+		{"shutdownTimeout", a.ShutdownTimeout, b.ShutdownTimeout},
+		{"debugAddr", a.DebugAddr, b.DebugAddr},
+		{"log.output", a.Log.Output, b.Log.Output},
+		{"log.accessLog", a.Log.AccessLog, b.Log.AccessLog},
+		{"log.accessLogFormat", a.Log.AccessLogFormat, b.Log.AccessLogFormat},
+		{"tls", a.TLS, b.TLS},
+		{"cache", a.Cache, b.Cache},
+	} {
+		if f.a != f.b {
+			fields = append(fields, f.field)
+		}
+	}
+	return fields
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gravitational/hello"
+	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/gravitational/hello/api"
+	"github.com/gravitational/hello/backend"
+	"github.com/gravitational/hello/backend/cachebk"
+	"github.com/gravitational/hello/backend/swapbk"
+	"github.com/gravitational/hello/config"
+	"github.com/gravitational/hello/ratelimit"
+
+	. "github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+func TestHello(t *testing.T) { TestingT(t) }
+
+type ReloadSuite struct {
+	dir   string
+	path  string
+	swap  *swapbk.Backend
+	cache *cachebk.Backend
+	r     *reloader
+}
+
+var _ = Suite(&ReloadSuite{})
+
+func (s *ReloadSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	s.path = filepath.Join(s.dir, "hello.json")
+	s.writeConfig(c, `{"backend": {"type": "memory"}}`)
+
+	s.r = s.reloader(c, "")
+	c.Assert(s.cache.UpsertGreeting("hello.us", "Hello"), IsNil)
+}
+
+func (s *ReloadSuite) TearDownTest(c *C) {
+	c.Assert(s.cache.Close(), IsNil)
+}
+
+// reloader returns the reloader of the server started with the config
+// file and the audit flag
+func (s *ReloadSuite) reloader(c *C, atype string) *reloader {
+	set := flag.NewFlagSet("hello", flag.ContinueOnError)
+	set.String("config", s.path, "")
+	set.String("audit", atype, "")
+	ctx := cli.NewContext(cli.NewApp(), set, set)
+
+	cfg, err := loadConfig(ctx)
+	c.Assert(err, IsNil)
+	b, err := initBackend(cfg.Backend.Type, string(cfg.Backend.Config))
+	c.Assert(err, IsNil)
+	s.swap = swapbk.New(b)
+	s.cache = cachebk.New(s.swap, cachebk.TTL(time.Hour))
+	srv := api.NewAPIServer(hello.New(s.cache), s.cache)
+	return &reloader{c: ctx, cfg: cfg, srv: srv, b: s.swap, cache: s.cache}
+}
+
+func (s *ReloadSuite) writeConfig(c *C, data string) {
+	c.Assert(ioutil.WriteFile(s.path, []byte(data), 0600), IsNil)
+}
+
+func (s *ReloadSuite) TestSwapBackend(c *C) {
+	// greeting is cached before the swap
+	_, err := s.cache.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+
+	s.writeConfig(c, `{"backend": {"type": "file", "config": {"path": "`+s.dir+`"}}}`)
+	c.Assert(s.r.reload(), IsNil)
+
+	// the cache is purged and reads go to the new backend
+	_, err = s.cache.GetGreeting("hello.us")
+	c.Assert(err, FitsTypeOf, &backend.NotFoundError{})
+	c.Assert(s.cache.UpsertGreeting("hello.uk", "Hi"), IsNil)
+	_, err = os.Stat(filepath.Join(s.dir, "greetings.log"))
+	c.Assert(err, IsNil)
+}
+
+func (s *ReloadSuite) TestSameBackendKept(c *C) {
+	s.writeConfig(c, `{"backend": {"type": "memory"}, "log": {"severity": "INFO"}}`)
+	c.Assert(s.r.reload(), IsNil)
+	c.Assert(s.r.cfg.Log.Severity, Equals, "INFO")
+
+	g, err := s.cache.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+	c.Assert(g.Value, Equals, "Hello")
+}
+
+func (s *ReloadSuite) TestRejected(c *C) {
+	for _, data := range []string{
+		`{"backend": {"type": "unknown"}}`,
+		`{"backend": {"type": "file", "config": {}}}`,
+		`{"log": {"severity": "LOUD"}}`,
+		`{"auth": {"keys": "` + filepath.Join(s.dir, "missing.json") + `"}}`,
+		`not a config`,
+	} {
+		s.writeConfig(c, data)
+		c.Assert(s.r.reload(), NotNil, Commentf(data))
+
+		// nothing is changed
+		c.Assert(s.r.cfg.Backend.Type, Equals, "memory", Commentf(data))
+		_, err := s.swap.GetGreeting("hello.us")
+		c.Assert(err, IsNil, Commentf(data))
+	}
+}
+
+func (s *ReloadSuite) TestAuditBackend(c *C) {
+	c.Assert(s.cache.Close(), IsNil)
+	s.r = s.reloader(c, "backend")
+	c.Assert(s.cache.UpsertGreeting("hello.us", "Hello"), IsNil)
+
+	// the file backend does not store audit events
+	s.writeConfig(c, `{"backend": {"type": "file", "config": {"path": "`+s.dir+`"}}}`)
+	c.Assert(s.r.reload(), ErrorMatches, "-audit=backend: .*")
+	_, err := s.swap.GetGreeting("hello.us")
+	c.Assert(err, IsNil)
+}
+
+func (s *ReloadSuite) TestSameBackend(c *C) {
+	mem := config.Backend{Type: "memory", Config: json.RawMessage(`{"reapPeriod": "1s"}`)}
+	c.Assert(sameBackend(mem, config.Backend{Type: "memory", Config: json.RawMessage(`{"reapPeriod":"1s"}`)}), Equals, true)
+	c.Assert(sameBackend(mem, config.Backend{Type: "memory", Config: json.RawMessage(`{"reapPeriod": "2s"}`)}), Equals, false)
+	c.Assert(sameBackend(mem, config.Backend{Type: "file", Config: mem.Config}), Equals, false)
+	c.Assert(sameBackend(config.Backend{Type: "memory"}, config.Backend{Type: "memory"}), Equals, true)
+}
+
+func (s *ReloadSuite) TestInitRateLimits(c *C) {
+	limiters, err := initRateLimits(map[string]ratelimit.Limit{"hello": {Rate: 1, Burst: 2}})
+	c.Assert(err, IsNil)
+	c.Assert(limiters[api.HelloRoutes], NotNil)
+
+	_, err = initRateLimits(map[string]ratelimit.Limit{"hello": {Rate: 1}})
+	c.Assert(err, ErrorMatches, ".*rateLimits.hello.*")
+}
+
+func (s *ReloadSuite) TestRestartFields(c *C) {
+	a, b := config.Default(), config.Default()
+	c.Assert(restartFields(a, b), IsNil)
+
+	b.Addr = "localhost:9090"
+	b.Log.Severity = "INFO"
+	b.TLS.Cert = "/etc/hello/cert.pem"
+	b.Cache.Size = 10
+	c.Assert(restartFields(a, b), DeepEquals, []string{"addr", "tls", "cache"})
+}
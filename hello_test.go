@@ -1,13 +1,16 @@
 package hello
 
 import (
+	"context"
 	"math/rand"
 	"testing"
 	"time"
 
 	"github.com/gravitational/hello/Godeps/_workspace/src/github.com/mailgun/log"
 	. "github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/check.v1"
+	"github.com/gravitational/hello/backend"
 	"github.com/gravitational/hello/backend/membk"
+	"github.com/gravitational/hello/backend/test"
 )
 
 // We use gocheck: a rich test framework on top of vanilla Go standard test module
@@ -34,7 +37,8 @@ func (s *HelloSuite) SetUpSuite(c *C) {
 // Make sure each test is independent from the others, use
 // SetUpTest to recreate environment and resources needed for test case.
 func (s *HelloSuite) SetUpTest(c *C) {
-	b := membk.New()
+	b, err := membk.New()
+	c.Assert(err, IsNil)
 	c.Assert(b.UpsertGreeting("hello.us", "Hello"), IsNil)
 	c.Assert(b.UpsertGreeting("hello.sp", "Hola"), IsNil)
 	s.h = New(b)
@@ -89,6 +93,132 @@ func (s *HelloSuite) TestErrors(c *C) {
 	}
 }
 
+func (s *HelloSuite) TestLocales(c *C) {
+	b, err := membk.New()
+	c.Assert(err, IsNil)
+	for id, val := range map[string]string{
+		"hello":       "Hi",
+		"hello.en":    "Hello",
+		"hello.es":    "Hola",
+		"hello.es-mx": "Quiubo",
+		"hello.pt-pt": "Olá",
+	} {
+		c.Assert(b.UpsertGreeting(id, val), IsNil)
+	}
+	h := New(b, DefaultLocale("en"), LocaleFallbacks(map[string][]string{"pt-BR": {"pt-PT"}}))
+
+	tcs := []struct {
+		name     string
+		locales  []string
+		expected string
+		id       string
+		locale   string
+	}{
+		{name: "exact match", locales: []string{"es-MX"}, expected: "Quiubo, Dog!", id: "hello.es-mx", locale: "es-mx"},
+		{name: "parent", locales: []string{"es-AR"}, expected: "Hola, Dog!", id: "hello.es", locale: "es"},
+		{name: "preference order", locales: []string{"fr", "es"}, expected: "Hola, Dog!", id: "hello.es", locale: "es"},
+		{name: "configured fallback", locales: []string{"pt-BR"}, expected: "Olá, Dog!", id: "hello.pt-pt", locale: "pt-pt"},
+		{name: "default locale", locales: []string{"fr-CA"}, expected: "Hello, Dog!", id: "hello.en", locale: "en"},
+		{name: "no locales", expected: "Hello, Dog!", id: "hello.en", locale: "en"},
+		{name: "invalid locale", locales: []string{"../es"}, expected: "Hello, Dog!", id: "hello.en", locale: "en"},
+	}
+	for i, tc := range tcs {
+		comment := Commentf("test #%d (%v) locales=%v", i+1, tc.name, tc.locales)
+		re, err := h.Greet(context.Background(), Request{Prompt: "hello", Name: "Dog", Locales: tc.locales})
+		c.Assert(err, IsNil, comment)
+		c.Assert(re.Value, Equals, tc.expected, comment)
+		c.Assert(re.GreetingID, Equals, tc.id, comment)
+		c.Assert(re.Locale, Equals, tc.locale, comment)
+	}
+
+	// without default locale, the prompt itself is the last resort
+	re, err := New(b).Greet(context.Background(), Request{Prompt: "hello", Name: "Dog", Locales: []string{"fr"}})
+	c.Assert(err, IsNil)
+	c.Assert(re.Value, Equals, "Hi, Dog!")
+	c.Assert(re.GreetingID, Equals, "hello")
+	c.Assert(re.Locale, Equals, "")
+
+	_, err = h.Greet(context.Background(), Request{Prompt: "bye", Name: "Dog", Locales: []string{"es"}})
+	c.Assert(err, FitsTypeOf, &backend.NotFoundError{})
+}
+
+func (s *HelloSuite) TestTemplates(c *C) {
+	b, err := membk.New()
+	c.Assert(err, IsNil)
+	c.Assert(b.UpsertGreeting("hello.us", "Hello"), IsNil)
+	// values that are not marked as templates are plain
+	c.Assert(b.UpsertGreeting("hello.braces", "{{Hi}}"), IsNil)
+	for id, val := range map[string]string{
+		"hello.jp":     "{{.Name}}さん、こんにちは",
+		"hello.time":   "Good {{.TimeOfDay}}, {{.Name}}.",
+		"hello.formal": "{{with .Fields.title}}{{.}} {{end}}{{.Name}}, welcome",
+	} {
+		c.Assert(b.UpsertGreeting(id, val, backend.Template()), IsNil)
+	}
+	clock := test.NewFakeClock(time.Date(2015, 11, 20, 19, 30, 0, 0, time.UTC))
+	h := New(b, Clock(clock))
+
+	tcs := []struct {
+		prompt   string
+		fields   map[string]string
+		expected string
+	}{
+		{prompt: "hello.us", expected: "Hello, Dog!"},
+		{prompt: "hello.braces", expected: "{{Hi}}, Dog!"},
+		{prompt: "hello.jp", expected: "Dogさん、こんにちは"},
+		{prompt: "hello.time", expected: "Good evening, Dog."},
+		{prompt: "hello.formal", expected: "Dog, welcome"},
+		{prompt: "hello.formal", fields: map[string]string{"title": "Sir"}, expected: "Sir Dog, welcome"},
+	}
+	for i, tc := range tcs {
+		comment := Commentf("test #%d prompt=%v", i+1, tc.prompt)
+		re, err := h.Greet(context.Background(), Request{Prompt: tc.prompt, Name: "Dog", Fields: tc.fields})
+		c.Assert(err, IsNil, comment)
+		c.Assert(re.Value, Equals, tc.expected, comment)
+	}
+
+	// broken templates that made it to the backend fail with TemplateError
+	c.Assert(b.UpsertGreeting("hello.broken", "{{.Surname}}", backend.Template()), IsNil)
+	_, err = h.Greet(context.Background(), Request{Prompt: "hello.broken", Name: "Dog"})
+	c.Assert(err, FitsTypeOf, &TemplateError{})
+}
+
+func (s *HelloSuite) TestCheckTemplate(c *C) {
+	for _, val := range []string{"Hello", "{{.Name}}!", "{{.Fields.missing}}{{.TimeOfDay}}", "100%{"} {
+		c.Assert(CheckTemplate(val), IsNil, Commentf("value: %v", val))
+	}
+	for _, val := range []string{"{{.Name", "{{.Surname}}", "{{end}}", "{{template \"x\"}}"} {
+		c.Assert(CheckTemplate(val), FitsTypeOf, &TemplateError{}, Commentf("value: %v", val))
+	}
+}
+
+func (s *HelloSuite) TestTimeOfDay(c *C) {
+	for hour, expected := range map[int]string{
+		0: "night", 4: "night", 5: "morning", 11: "morning", 12: "afternoon",
+		16: "afternoon", 17: "evening", 21: "evening", 22: "night",
+	} {
+		t := time.Date(2015, 11, 20, hour, 0, 0, 0, time.UTC)
+		c.Assert(TimeOfDay(t), Equals, expected, Commentf("hour: %v", hour))
+	}
+}
+
+func (s *HelloSuite) TestParseAcceptLanguage(c *C) {
+	tcs := []struct {
+		header   string
+		expected []string
+	}{
+		{header: "", expected: []string{}},
+		{header: "es-MX", expected: []string{"es-MX"}},
+		{header: "es-MX,es;q=0.9,en;q=0.8", expected: []string{"es-MX", "es", "en"}},
+		{header: "en;q=0.5, fr, *;q=0.1", expected: []string{"fr", "en"}},
+		{header: "de;q=0, it", expected: []string{"it"}},
+	}
+	for i, tc := range tcs {
+		comment := Commentf("test #%d header=%v", i+1, tc.header)
+		c.Assert(ParseAcceptLanguage(tc.header), DeepEquals, tc.expected, comment)
+	}
+}
+
 // Benchmarks are useful to test performance of some well isolated components
 func (s *HelloSuite) BenchmarkHello(c *C) {
 	// make sure to turn off the tests before running benchmark
@@ -0,0 +1,148 @@
+package hello
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Resolver resolves greetings for the requested locales. Greetings
+// for locales are stored with ids '<prompt>.<locale>', e.g. 'hello.es-mx',
+// locales are BCP-47 language tags, compared case-insensitively.
+//
+// For every requested locale resolver tries the locale itself, then
+// it's configured fallbacks, then the parent locales ('es-MX' -> 'es'),
+// then the default locale and finally the prompt itself, e.g. 'hello'.
+type Resolver struct {
+	// Fallbacks are additional locales tried after the locale
+	// before it's parent, e.g. "es-MX": ["es-419"]
+	Fallbacks map[string][]string
+	// Default is the locale tried when none of the requested locales
+	// matched, e.g. "en"
+	Default string
+}
+
+// Candidate is a greeting that resolver tries for the locale
+type Candidate struct {
+	// ID is the greeting id, e.g. 'hello.es-mx'
+	ID string
+	// Locale is the normalized locale of the greeting, e.g. 'es-mx',
+	// it is empty for the prompt itself
+	Locale string
+}
+
+// Candidates returns greetings to try in order for the prompt and
+// locales listed in the order of preference. Invalid locales are skipped.
+func (r *Resolver) Candidates(prompt string, locales []string) []Candidate {
+	out := []Candidate{}
+	seen := map[string]bool{}
+	add := func(locale string) {
+		if seen[locale] {
+			return
+		}
+		seen[locale] = true
+		out = append(out, Candidate{ID: prompt + "." + locale, Locale: locale})
+	}
+	fallbacks := map[string][]string{}
+	for tag, fs := range r.Fallbacks {
+		fallbacks[NormalizeLocale(tag)] = fs
+	}
+	for _, l := range locales {
+		tag := NormalizeLocale(l)
+		if !ValidLocale(tag) {
+			continue
+		}
+		for _, parent := range parents(tag) {
+			add(parent)
+			for _, f := range fallbacks[parent] {
+				if f := NormalizeLocale(f); ValidLocale(f) {
+					add(f)
+				}
+			}
+		}
+	}
+	if d := NormalizeLocale(r.Default); ValidLocale(d) {
+		for _, parent := range parents(d) {
+			add(parent)
+		}
+	}
+	return append(out, Candidate{ID: prompt})
+}
+
+// parents returns the tag followed by all it's parents,
+// e.g. 'zh-hant-tw', 'zh-hant', 'zh'
+func parents(tag string) []string {
+	out := []string{tag}
+	for {
+		i := strings.LastIndex(tag, "-")
+		if i < 0 {
+			return out
+		}
+		tag = tag[:i]
+		out = append(out, tag)
+	}
+}
+
+// NormalizeLocale converts the locale tag to the form used in greeting ids,
+// e.g. 'es_MX' to 'es-mx'
+func NormalizeLocale(tag string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(tag), "_", "-", -1))
+}
+
+// ValidLocale returns true if the normalized tag looks like BCP-47 language tag,
+// i.e. consists of alphanumeric subtags of 1 to 8 characters separated by dashes
+func ValidLocale(tag string) bool {
+	if tag == "" {
+		return false
+	}
+	for _, sub := range strings.Split(tag, "-") {
+		if len(sub) < 1 || len(sub) > 8 {
+			return false
+		}
+		for _, c := range sub {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ParseAcceptLanguage returns locales from the HTTP Accept-Language header
+// in the order of preference, e.g. 'es-MX,es;q=0.9,en;q=0.5' gives 'es-MX', 'es', 'en'.
+// Wildcards and locales with zero quality are dropped.
+func ParseAcceptLanguage(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	ws := []weighted{}
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		tag := strings.TrimSpace(params[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				v, err := strconv.ParseFloat(p[2:], 64)
+				if err != nil {
+					v = 0
+				}
+				q = v
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		ws = append(ws, weighted{tag: tag, q: q})
+	}
+	sort.SliceStable(ws, func(i, j int) bool { return ws[i].q > ws[j].q })
+	out := make([]string, len(ws))
+	for i, w := range ws {
+		out[i] = w.tag
+	}
+	return out
+}
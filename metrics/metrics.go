@@ -0,0 +1,282 @@
+// package metrics implements counters and histograms exposed
+// in Prometheus text format, so hello servers can be scraped by Prometheus
+// without pulling in the client library:
+//
+//  r := metrics.NewRegistry()
+//  requests := r.NewCounter("hello_requests_total", "Requests served", "route")
+//  requests.Inc("/v1/hello")
+//  http.Handle("/metrics", r)
+//
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram buckets in seconds suitable for request latencies
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds metrics and writes them in Prometheus text format.
+// It is safe for concurrent use.
+type Registry struct {
+	mtx     sync.Mutex
+	metrics map[string]metric
+}
+
+// NewRegistry returns a new empty registry
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+type metric interface {
+	write(w io.Writer)
+	describe() string
+}
+
+// NewCounter registers and returns a counter with the label names. If the counter
+// with the same name and labels is already registered, it is returned, so components
+// can be recreated with the same registry. It panics if the name is taken
+// by a metric of a different kind or with different labels.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{family: newFamily(name, help, labels), values: make(map[string]float64)}
+	return r.register(name, c).(*Counter)
+}
+
+// NewHistogram registers and returns a histogram with the buckets upper bounds
+// and label names, see NewCounter for the details on repeated registration
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	bs := append([]float64{}, buckets...)
+	sort.Float64s(bs)
+	h := &Histogram{family: newFamily(name, help, labels), buckets: bs, series: make(map[string]*histogramSeries)}
+	return r.register(name, h).(*Histogram)
+}
+
+func (r *Registry) register(name string, m metric) metric {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	existing, ok := r.metrics[name]
+	if !ok {
+		r.metrics[name] = m
+		return m
+	}
+	if existing.describe() != m.describe() {
+		panic(fmt.Sprintf("metric %v is already registered as %v", name, existing.describe()))
+	}
+	return existing
+}
+
+// WriteTo writes all metrics sorted by name in Prometheus text format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mtx.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	ms := make([]metric, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		ms[i] = r.metrics[name]
+	}
+	r.mtx.Unlock()
+
+	buf := &bytes.Buffer{}
+	for _, m := range ms {
+		m.write(buf)
+	}
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP serves metrics to Prometheus
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteTo(w)
+}
+
+// family is a name, help and label names shared by metric series
+type family struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func newFamily(name, help string, labels []string) family {
+	return family{name: name, help: help, labels: append([]string{}, labels...)}
+}
+
+// key returns a map key for the label values, it panics if the number
+// of values does not match the number of labels, as it's a programming error
+func (f family) key(values []string) string {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %v expects %v label values, got %v", f.name, len(f.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs formats label pairs for the series key, e.g. 'route="/v1/hello",code="200"'
+func (f family) labelPairs(key string) []string {
+	if len(f.labels) == 0 {
+		return nil
+	}
+	values := strings.Split(key, "\xff")
+	out := make([]string, len(f.labels))
+	for i, l := range f.labels {
+		out[i] = fmt.Sprintf(`%v="%v"`, l, escape(values[i]))
+	}
+	return out
+}
+
+func (f family) header(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", f.name, strings.Replace(f.help, "\n", " ", -1), f.name, kind)
+}
+
+func series(name string, pairs []string, v string) string {
+	if len(pairs) == 0 {
+		return fmt.Sprintf("%v %v\n", name, v)
+	}
+	return fmt.Sprintf("%v{%v} %v\n", name, strings.Join(pairs, ","), v)
+}
+
+// Counter is a metric that only goes up, e.g. a number of requests
+type Counter struct {
+	family
+	mtx    sync.Mutex
+	values map[string]float64
+}
+
+// Inc increments the counter for the label values by one
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v to the counter for the label values, v should not be negative
+func (c *Counter) Add(v float64, values ...string) {
+	key := c.key(values)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.values[key] += v
+}
+
+// Value returns the current value of the counter for the label values
+func (c *Counter) Value(values ...string) float64 {
+	key := c.key(values)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.values[key]
+}
+
+func (c *Counter) describe() string {
+	return fmt.Sprintf("counter%v", c.labels)
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.header(w, "counter")
+	for _, key := range sortedKeys(c.values) {
+		io.WriteString(w, series(c.name, c.labelPairs(key), formatFloat(c.values[key])))
+	}
+}
+
+// Histogram samples observations, e.g. request latencies, into buckets
+type Histogram struct {
+	family
+	buckets []float64
+	mtx     sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	// counts are non-cumulative counts of observations per bucket,
+	// the last one is for observations above all buckets
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Observe adds observation v for the label values
+func (h *Histogram) Observe(v float64, values ...string) {
+	key := h.key(values)
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+	s.counts[sort.SearchFloat64s(h.buckets, v)]++
+	s.sum += v
+	s.count++
+}
+
+// Count returns the number of observations for the label values
+func (h *Histogram) Count(values ...string) uint64 {
+	key := h.key(values)
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if s, ok := h.series[key]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (h *Histogram) describe() string {
+	return fmt.Sprintf("histogram%v%v", h.labels, h.buckets)
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.header(w, "histogram")
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	les := make([]float64, len(h.buckets)+1)
+	copy(les, h.buckets)
+	les[len(h.buckets)] = math.Inf(1)
+	for _, key := range keys {
+		s := h.series[key]
+		pairs := h.labelPairs(key)
+		var cumulative uint64
+		for i, le := range les {
+			cumulative += s.counts[i]
+			bucket := append(append([]string{}, pairs...), fmt.Sprintf(`le="%v"`, formatFloat(le)))
+			io.WriteString(w, series(h.name+"_bucket", bucket, strconv.FormatUint(cumulative, 10)))
+		}
+		io.WriteString(w, series(h.name+"_sum", pairs, formatFloat(s.sum)))
+		io.WriteString(w, series(h.name+"_count", pairs, strconv.FormatUint(s.count, 10)))
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// escape escapes label value according to the text format
+func escape(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+func TestMetrics(t *testing.T) { TestingT(t) }
+
+type MetricsSuite struct {
+}
+
+var _ = Suite(&MetricsSuite{})
+
+func (s *MetricsSuite) TestCounter(c *C) {
+	r := NewRegistry()
+	cnt := r.NewCounter("requests_total", "Requests served", "route", "code")
+	cnt.Inc("/v1/hello", "200")
+	cnt.Inc("/v1/hello", "200")
+	cnt.Add(3, "/v1/greetings", "404")
+	c.Assert(cnt.Value("/v1/hello", "200"), Equals, 2.0)
+	c.Assert(cnt.Value("/v1/hello", "500"), Equals, 0.0)
+
+	buf := &bytes.Buffer{}
+	_, err := r.WriteTo(buf)
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Equals, `# HELP requests_total Requests served
+# TYPE requests_total counter
+requests_total{route="/v1/greetings",code="404"} 3
+requests_total{route="/v1/hello",code="200"} 2
+`)
+
+	// registering the same counter returns the existing one
+	c.Assert(r.NewCounter("requests_total", "Requests served", "route", "code"), Equals, cnt)
+	c.Assert(func() { r.NewCounter("requests_total", "Requests", "route") }, PanicMatches, ".*already registered.*")
+	c.Assert(func() { cnt.Inc("/v1/hello") }, PanicMatches, ".*expects 2 label values.*")
+}
+
+func (s *MetricsSuite) TestHistogram(c *C) {
+	r := NewRegistry()
+	h := r.NewHistogram("latency_seconds", "Latency", []float64{0.1, 1}, "op")
+	h.Observe(0.05, "get")
+	h.Observe(0.1, "get")
+	h.Observe(0.5, "get")
+	h.Observe(2, "get")
+	c.Assert(h.Count("get"), Equals, uint64(4))
+	c.Assert(h.Count("put"), Equals, uint64(0))
+
+	buf := &bytes.Buffer{}
+	_, err := r.WriteTo(buf)
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Equals, `# HELP latency_seconds Latency
+# TYPE latency_seconds histogram
+latency_seconds_bucket{op="get",le="0.1"} 2
+latency_seconds_bucket{op="get",le="1"} 3
+latency_seconds_bucket{op="get",le="+Inf"} 4
+latency_seconds_sum{op="get"} 2.65
+latency_seconds_count{op="get"} 4
+`)
+}
+
+func (s *MetricsSuite) TestServeHTTP(c *C) {
+	r := NewRegistry()
+	r.NewCounter("b_total", "B").Inc()
+	r.NewCounter("a_total", "A", "value").Inc("quote\" backslash\\ newline\n")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	c.Assert(w.Header().Get("Content-Type"), Equals, "text/plain; version=0.0.4")
+	c.Assert(w.Body.String(), Equals, `# HELP a_total A
+# TYPE a_total counter
+a_total{value="quote\" backslash\\ newline\n"} 1
+# HELP b_total B
+# TYPE b_total counter
+b_total 1
+`)
+}
@@ -0,0 +1,153 @@
+// Package ratelimit implements token bucket rate limiting per client:
+//
+//  l, err := ratelimit.New(ratelimit.Limit{Rate: 10, Burst: 20})
+//  if err != nil {
+//      return err
+//  }
+//  if err := l.Take("10.0.0.1"); err != nil {
+//      // err is *ratelimit.LimitExceededError telling when to retry
+//  }
+//
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/gravitational/hello/backend"
+)
+
+// Limit is a rate of requests per second a client can sustain,
+// with bursts of up to Burst requests
+type Limit struct {
+	// Rate is the number of requests per second
+	Rate float64 `json:"rate"`
+	// Burst is the max number of requests served at once
+	Burst int `json:"burst"`
+}
+
+// Check returns error if the limit is not valid
+func (l Limit) Check() error {
+	if l.Rate <= 0 || math.IsInf(l.Rate, 0) || math.IsNaN(l.Rate) {
+		return fmt.Errorf("expected positive rate, got %v", l.Rate)
+	}
+	if l.Burst < 1 {
+		return fmt.Errorf("expected positive burst, got %v", l.Burst)
+	}
+	return nil
+}
+
+// sweepPeriod is how often the buckets of idle clients are removed
+const sweepPeriod = time.Minute
+
+// Limiter limits the rate of requests of every client with a bucket of tokens.
+// Buckets are refilled at the limit rate up to the burst size, and every
+// request takes a token. Buckets of the clients that have been idle long
+// enough to refill are removed. Limiter is safe for concurrent use.
+type Limiter struct {
+	limit Limit
+	clock backend.Clock
+
+	mtx       sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Option is a functional option for the limiter
+type Option func(l *Limiter)
+
+// Clock sets the clock used to refill buckets, it's handy in tests
+func Clock(c backend.Clock) Option {
+	return func(l *Limiter) {
+		l.clock = c
+	}
+}
+
+// New returns a limiter enforcing the limit, it returns an error
+// if the limit is not valid, see Limit.Check
+func New(limit Limit, opts ...Option) (*Limiter, error) {
+	if err := limit.Check(); err != nil {
+		return nil, err
+	}
+	l := &Limiter{
+		limit:   limit,
+		clock:   backend.SystemClock{},
+		buckets: make(map[string]*bucket),
+	}
+	for _, o := range opts {
+		o(l)
+	}
+	l.lastSweep = l.clock.Now()
+	return l, nil
+}
+
+// Take takes a token from the bucket of the client identified by key,
+// it returns LimitExceededError if the bucket is empty
+func (l *Limiter) Take(key string) error {
+	return l.take(key, 1)
+}
+
+// Peek returns LimitExceededError if the bucket of the client identified
+// by key is empty, like Take, but does not take a token
+func (l *Limiter) Peek(key string) error {
+	return l.take(key, 0)
+}
+
+func (l *Limiter) take(key string, tokens float64) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := l.clock.Now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.refill(now, l.limit)
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second))
+		return &LimitExceededError{Key: key, RetryAfter: wait}
+	}
+	b.tokens -= tokens
+	return nil
+}
+
+func (b *bucket) refill(now time.Time, limit Limit) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+elapsed*limit.Rate)
+		b.last = now
+	}
+}
+
+// sweep removes the buckets that have refilled, they are the same as new ones
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepPeriod {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		b.refill(now, l.limit)
+		if b.tokens >= float64(l.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// LimitExceededError is returned when the client exceeds the rate limit
+type LimitExceededError struct {
+	// Key identifies the client
+	Key string
+	// RetryAfter is the time after which the request is allowed
+	RetryAfter time.Duration
+}
+
+func (e *LimitExceededError) Error() string {
+	return fmt.Sprintf("rate limit exceeded, retry after %v", e.RetryAfter)
+}
@@ -0,0 +1,91 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gravitational/hello/backend/test"
+
+	. "github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+func TestRateLimit(t *testing.T) { TestingT(t) }
+
+type LimiterSuite struct {
+	clock *test.FakeClock
+}
+
+var _ = Suite(&LimiterSuite{})
+
+func (s *LimiterSuite) SetUpTest(c *C) {
+	s.clock = test.NewFakeClock(time.Date(2015, 12, 1, 0, 0, 0, 0, time.UTC))
+}
+
+func (s *LimiterSuite) TestBurst(c *C) {
+	l, err := New(Limit{Rate: 2, Burst: 3}, Clock(s.clock))
+	c.Assert(err, IsNil)
+	for i := 0; i < 3; i++ {
+		// peeking does not take tokens
+		c.Assert(l.Peek("a"), IsNil)
+		c.Assert(l.Take("a"), IsNil)
+	}
+	c.Assert(l.Peek("a"), FitsTypeOf, &LimitExceededError{})
+	err = l.Take("a")
+	c.Assert(err, FitsTypeOf, &LimitExceededError{})
+	c.Assert(err.(*LimitExceededError).RetryAfter, Equals, 500*time.Millisecond)
+	c.Assert(err.(*LimitExceededError).Key, Equals, "a")
+
+	// other clients have their own buckets
+	c.Assert(l.Take("b"), IsNil)
+}
+
+func (s *LimiterSuite) TestRefill(c *C) {
+	l, err := New(Limit{Rate: 2, Burst: 2}, Clock(s.clock))
+	c.Assert(err, IsNil)
+	c.Assert(l.Take("a"), IsNil)
+	c.Assert(l.Take("a"), IsNil)
+	c.Assert(l.Take("a"), NotNil)
+
+	s.clock.Advance(250 * time.Millisecond)
+	err = l.Take("a")
+	c.Assert(err, NotNil)
+	c.Assert(err.(*LimitExceededError).RetryAfter, Equals, 250*time.Millisecond)
+
+	s.clock.Advance(250 * time.Millisecond)
+	c.Assert(l.Take("a"), IsNil)
+	c.Assert(l.Take("a"), NotNil)
+
+	// buckets are not refilled over the burst
+	s.clock.Advance(time.Hour)
+	c.Assert(l.Take("a"), IsNil)
+	c.Assert(l.Take("a"), IsNil)
+	c.Assert(l.Take("a"), NotNil)
+}
+
+func (s *LimiterSuite) TestSweep(c *C) {
+	l, err := New(Limit{Rate: 1, Burst: 10}, Clock(s.clock))
+	c.Assert(err, IsNil)
+	c.Assert(l.Take("idle"), IsNil)
+	s.clock.Advance(sweepPeriod - time.Second)
+	for i := 0; i < 10; i++ {
+		c.Assert(l.Take("busy"), IsNil)
+	}
+	c.Assert(len(l.buckets), Equals, 2)
+
+	// the idle bucket has refilled and is removed, the busy one is not
+	s.clock.Advance(time.Second)
+	c.Assert(l.Take("other"), IsNil)
+	_, ok := l.buckets["idle"]
+	c.Assert(ok, Equals, false)
+	_, ok = l.buckets["busy"]
+	c.Assert(ok, Equals, true)
+}
+
+func (s *LimiterSuite) TestCheck(c *C) {
+	c.Assert(Limit{Rate: 0.5, Burst: 1}.Check(), IsNil)
+	c.Assert(Limit{Rate: 0, Burst: 1}.Check(), NotNil)
+	c.Assert(Limit{Rate: -1, Burst: 1}.Check(), NotNil)
+	c.Assert(Limit{Rate: 1, Burst: 0}.Check(), NotNil)
+	_, err := New(Limit{})
+	c.Assert(err, ErrorMatches, "expected positive rate.*")
+}
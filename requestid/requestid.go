@@ -0,0 +1,65 @@
+// Package requestid carries ids of API requests in contexts,
+// so log lines of the request can be tied together:
+//
+//  ctx = requestid.NewContext(ctx, requestid.New())
+//  ...
+//  log.Infof("Greet(%v) request_id=%v", name, requestid.FromContext(ctx))
+//
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// Header is a header carrying the request id
+const Header = "X-Request-ID"
+
+// MaxLength is the max length of the request id accepted from clients
+const MaxLength = 128
+
+// New returns a new random request id
+func New() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand never fails on supported platforms
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Valid returns true if the request id passed by the client is safe
+// to propagate and log: not empty, at most MaxLength of letters,
+// digits, '-', '_', '.' or ':'
+func Valid(id string) bool {
+	if id == "" || len(id) > MaxLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+type key struct{}
+
+// NewContext returns a copy of the context carrying the request id
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, key{}, id)
+}
+
+// FromContext returns the request id from the context,
+// or empty string if there is none or the context is nil
+func FromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(key{}).(string)
+	return id
+}
@@ -0,0 +1,36 @@
+package requestid
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	. "github.com/gravitational/hello/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+func TestRequestID(t *testing.T) { TestingT(t) }
+
+type RequestIDSuite struct{}
+
+var _ = Suite(&RequestIDSuite{})
+
+func (s *RequestIDSuite) TestNew(c *C) {
+	a, b := New(), New()
+	c.Assert(Valid(a), Equals, true)
+	c.Assert(a, Not(Equals), b)
+}
+
+func (s *RequestIDSuite) TestValid(c *C) {
+	for _, id := range []string{"a", "5c0d-42_x.y:z", strings.Repeat("a", MaxLength)} {
+		c.Assert(Valid(id), Equals, true, Commentf(id))
+	}
+	for _, id := range []string{"", "a b", "a\nb", `a"b`, "a=b", "привет", strings.Repeat("a", MaxLength+1)} {
+		c.Assert(Valid(id), Equals, false, Commentf(id))
+	}
+}
+
+func (s *RequestIDSuite) TestContext(c *C) {
+	c.Assert(FromContext(nil), Equals, "")
+	c.Assert(FromContext(context.Background()), Equals, "")
+	c.Assert(FromContext(NewContext(context.Background(), "42")), Equals, "42")
+}
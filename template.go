@@ -0,0 +1,126 @@
+package hello
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gravitational/hello/backend"
+)
+
+// Greetings are either plain values, like 'Hello', that are formatted
+// as 'Hello, Dog!', or templates, like '{{.Name}}さん、こんにちは', that
+// are executed with TemplateData. Templates are upserted with backend.Template
+// write option, so values stored before templates existed stay plain.
+
+// TemplateData is passed to greeting templates
+type TemplateData struct {
+	// Name is the name to greet, e.g. 'Dog'
+	Name string
+	// TimeOfDay is one of 'morning', 'afternoon', 'evening' or 'night'
+	TimeOfDay string
+	// Fields are extra fields supplied by the caller, e.g. {{.Fields.title}},
+	// missing fields are rendered as empty strings
+	Fields map[string]string
+}
+
+// CheckTemplate checks that the greeting value is a valid template,
+// it returns TemplateError otherwise. The template is executed with sample
+// data to catch references to unknown data, like {{.Surname}}.
+func CheckTemplate(val string) error {
+	t, err := parseTemplate(val)
+	if err != nil {
+		return err
+	}
+	data := TemplateData{Name: "Dog", TimeOfDay: "morning", Fields: map[string]string{}}
+	if err := t.Execute(ioutil.Discard, data); err != nil {
+		return &TemplateError{Value: val, Err: err}
+	}
+	return nil
+}
+
+// TimeOfDay returns the time of day for the time t in it's location
+func TimeOfDay(t time.Time) string {
+	switch h := t.Hour(); {
+	case h >= 5 && h < 12:
+		return "morning"
+	case h >= 12 && h < 17:
+		return "afternoon"
+	case h >= 17 && h < 22:
+		return "evening"
+	}
+	return "night"
+}
+
+// render formats the greeting for the data
+func (c *templateCache) render(g *backend.Greeting, data TemplateData) (string, error) {
+	if !g.Template {
+		return fmt.Sprintf("%v, %v!", g.Value, data.Name), nil
+	}
+	t, err := c.get(g.Value)
+	if err != nil {
+		return "", err
+	}
+	if data.Fields == nil {
+		data.Fields = map[string]string{}
+	}
+	buf := &bytes.Buffer{}
+	if err := t.Execute(buf, data); err != nil {
+		return "", &TemplateError{Value: g.Value, Err: err}
+	}
+	return buf.String(), nil
+}
+
+// maxTemplates is the number of parsed templates kept by templateCache
+const maxTemplates = 1024
+
+// templateCache keeps parsed templates, so they are not parsed on every greeting.
+// It is dropped when full, as there are few templates and they rarely change.
+type templateCache struct {
+	mtx       sync.Mutex
+	templates map[string]*template.Template
+}
+
+func (c *templateCache) get(val string) (*template.Template, error) {
+	c.mtx.Lock()
+	t, ok := c.templates[val]
+	c.mtx.Unlock()
+	if ok {
+		return t, nil
+	}
+	t, err := parseTemplate(val)
+	if err != nil {
+		return nil, err
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.templates == nil || len(c.templates) >= maxTemplates {
+		c.templates = make(map[string]*template.Template)
+	}
+	c.templates[val] = t
+	return t, nil
+}
+
+func parseTemplate(val string) (*template.Template, error) {
+	t, err := template.New("greeting").Option("missingkey=zero").Parse(val)
+	if err != nil {
+		return nil, &TemplateError{Value: val, Err: err}
+	}
+	return t, nil
+}
+
+// TemplateError is returned when the greeting template is broken
+type TemplateError struct {
+	// Value is the greeting template
+	Value string
+	// Err is the parse or execution error
+	Err error
+}
+
+// Error provides human readable explanation of error
+func (e *TemplateError) Error() string {
+	return fmt.Sprintf("invalid greeting template '%v': %v", e.Value, e.Err)
+}
@@ -0,0 +1,40 @@
+// package version reports the build version of hello binaries.
+// Version and commit are injected at build time:
+//
+//  go build -ldflags "-X github.com/gravitational/hello/version.Version=0.0.2 \
+//     -X github.com/gravitational/hello/version.GitCommit=$(git rev-parse HEAD)"
+//
+package version
+
+import "runtime"
+
+var (
+	// Version is a semantic version of the build
+	Version = "dev"
+	// GitCommit is a git commit the binary is built from
+	GitCommit = ""
+)
+
+// Info describes the build
+type Info struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"git_commit,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the information about the current build
+func Get() Info {
+	return Info{Version: Version, GitCommit: GitCommit, GoVersion: runtime.Version()}
+}
+
+// String returns a human readable build version, e.g. '0.0.2 (git 1a2b3c4, go1.5)'
+func (i Info) String() string {
+	if i.GitCommit == "" {
+		return i.Version + " (" + i.GoVersion + ")"
+	}
+	commit := i.GitCommit
+	if len(commit) > 7 {
+		commit = commit[:7]
+	}
+	return i.Version + " (git " + commit + ", " + i.GoVersion + ")"
+}